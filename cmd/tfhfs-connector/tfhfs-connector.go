@@ -28,6 +28,11 @@ func main() {
 		flag.PrintDefaults()
 	}
 	interval := flag.Duration("interval", time.Second*10, "Interval at which synchronization is run (0 = once)")
+	leftSubtree := flag.String("left-subtree", "", "Synchronize only the directory at the path on the left")
+	leftSubtreeIno := flag.Uint64("left-subtree-ino", 0, "Synchronize only the directory with the inode on the left")
+	rightSubtree := flag.String("right-subtree", "", "Synchronize only the directory at the path on the right")
+	rightSubtreeIno := flag.Uint64("right-subtree-ino", 0, "Synchronize only the directory with the inode on the right")
+	filterFile := flag.String("filter", "", "Gitignore-style file of paths not to synchronize")
 	flag.Parse()
 	if flag.NArg() < 6 {
 		flag.Usage()
@@ -36,11 +41,22 @@ func main() {
 
 	c1 := connector.Connection{Address: flag.Arg(0),
 		RootName:      flag.Arg(1),
-		OtherRootName: flag.Arg(2)}
+		OtherRootName: flag.Arg(2),
+		Subtree:       *leftSubtree,
+		SubtreeIno:    *leftSubtreeIno}
 	c2 := connector.Connection{Address: flag.Arg(3),
 		RootName:      flag.Arg(4),
-		OtherRootName: flag.Arg(5)}
+		OtherRootName: flag.Arg(5),
+		Subtree:       *rightSubtree,
+		SubtreeIno:    *rightSubtreeIno}
 	c := connector.Connector{Left: c1, Right: c2}
+	if *filterFile != "" {
+		filters, err := connector.ReadFilterFile(*filterFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		c.Filters = filters
+	}
 	for {
 		ops, err := c.Run()
 		if err != nil {
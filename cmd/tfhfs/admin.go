@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/fingon/go-tfhfs/fs"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// Administrative actions are performed on the filesystem instead of
+// mounting it.
+
+var (
+	fsck            = flag.Bool("fsck", false, "Check the filesystem consistency (read-only unless -repair) instead of mounting it")
+	repair          = flag.Bool("repair", false, "Repair the problems found by -fsck")
+	audit           = flag.Bool("audit", false, "Audit the storage block reference counts (read-only unless -rebuild or -gc) instead of mounting")
+	rebuild         = flag.Bool("rebuild", false, "Rebuild the wrong block metadata found by -audit")
+	gc              = flag.Bool("gc", false, "Remove the unreachable blocks found by -audit")
+	diff            = flag.String("diff", "", "List the changes since the given snapshot name or (hex) root block id instead of mounting")
+	diffTo          = flag.String("diffto", "", "Snapshot name or (hex) root block id to compare with in -diff (default: current state)")
+	createSubvolume = flag.String("createsubvolume", "", "Create writable subvolume of the given name instead of mounting")
+	from            = flag.String("from", "", "Snapshot to create the subvolume from with -createsubvolume (default: current state)")
+	deleteSubvolume = flag.String("deletesubvolume", "", "Delete the named subvolume instead of mounting")
+	listSubvolumes  = flag.Bool("listsubvolumes", false, "List the subvolumes instead of mounting")
+	listTrash       = flag.Bool("listtrash", false, "List the trash entries instead of mounting")
+	restore         = flag.String("restore", "", "Restore the named trash entry to its original path instead of mounting")
+	listConflicts   = flag.Bool("listconflicts", false, "List the unresolved conflict copies instead of mounting")
+)
+
+type adminAction struct {
+	// Arguments shown in the usage
+	usage string
+
+	// Is the action requested by the flags
+	requested func() bool
+
+	// Does the action write to the storage
+	writes func() bool
+
+	// run performs the action; failed indicates problems that
+	// were reported but not fixed
+	run func(st *storage.Storage, myfs *fs.Fs) (failed bool, err error)
+}
+
+func always() bool { return true }
+
+func never() bool { return false }
+
+// adminActions are in the order of precedence
+var adminActions = []adminAction{
+	{usage: "-fsck [-repair]",
+		requested: func() bool { return *fsck },
+		writes:    func() bool { return *repair },
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			problems := myfs.Fsck(*repair)
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			return len(problems) > 0 && !*repair, nil
+		}},
+	{usage: "-createsubvolume NAME [-from SNAPSHOT]",
+		requested: func() bool { return *createSubvolume != "" },
+		writes:    always,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			return false, myfs.CreateSubvolume(*createSubvolume, *from)
+		}},
+	{usage: "-deletesubvolume NAME",
+		requested: func() bool { return *deleteSubvolume != "" },
+		writes:    always,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			return false, myfs.DeleteSubvolume(*deleteSubvolume)
+		}},
+	{usage: "-listsubvolumes",
+		requested: func() bool { return *listSubvolumes },
+		writes:    never,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			for _, name := range myfs.ListSubvolumes() {
+				fmt.Println(name)
+			}
+			return false, nil
+		}},
+	{usage: "-restore NAME",
+		requested: func() bool { return *restore != "" },
+		writes:    always,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			return false, myfs.RestoreTrash(*restore)
+		}},
+	{usage: "-listtrash",
+		requested: func() bool { return *listTrash },
+		writes:    never,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			for _, e := range myfs.ListTrash() {
+				fmt.Println(&e)
+			}
+			return false, nil
+		}},
+	{usage: "-listconflicts",
+		requested: func() bool { return *listConflicts },
+		writes:    never,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			for _, c := range myfs.ListConflicts() {
+				fmt.Println(&c)
+			}
+			return false, nil
+		}},
+	{usage: "-diff FROM [-diffto TO]",
+		requested: func() bool { return *diff != "" },
+		writes:    never,
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			entries, err := myfs.Diff(*diff, *diffTo)
+			if err != nil {
+				return false, fmt.Errorf("Unable to diff: %v", err)
+			}
+			for _, e := range entries {
+				fmt.Println(e)
+			}
+			return false, nil
+		}},
+	{usage: "-audit [-rebuild] [-gc]",
+		requested: func() bool { return *audit },
+		writes:    func() bool { return *rebuild || *gc },
+		run: func(st *storage.Storage, myfs *fs.Fs) (bool, error) {
+			a := st.AuditReferences(*rebuild, *gc)
+			for _, problem := range a.Problems() {
+				fmt.Println(problem)
+			}
+			fmt.Printf("%d names, %d blocks, %d repaired\n",
+				a.Names, a.Blocks, a.Repaired)
+			return len(a.Problems()) > a.Repaired, nil
+		}},
+}
+
+// requestedAdminAction returns the action requested by the flags, if
+// any.
+func requestedAdminAction() *adminAction {
+	for i := range adminActions {
+		if adminActions[i].requested() {
+			return &adminActions[i]
+		}
+	}
+	return nil
+}
+
+func printAdminUsage() {
+	for _, action := range adminActions {
+		fmt.Fprintf(os.Stderr, "%s %s STORAGEDIR\n", os.Args[0], action.usage)
+	}
+}
+
+// runAdminAction performs the action and closes the filesystem.
+func runAdminAction(action *adminAction, st *storage.Storage, myfs *fs.Fs) {
+	failed, err := action.run(st, myfs)
+	myfs.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/fingon/go-tfhfs/fs"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// Flags choosing which filesystem (state) in the storage is used, and
+// how.
+
+var (
+	readOnly  = flag.Bool("ro", false, "Open the storage read-only (nothing is written to it)")
+	at        = flag.String("at", "", "Mount read-only the given snapshot name or (hex) root block id instead of the current state")
+	subvolume = flag.String("subvolume", "", "Use the named subvolume instead of the main filesystem")
+	volumes   = flag.String("volumes", "", "Mount the given (comma separated) root names as directories of a single mount instead of -rootname")
+	cdc       = flag.Bool("cdc", false, "Whether to store data of new files in content-defined chunks (better deduplication of modified files)")
+)
+
+// checkFlags exits if the flags conflict with each other.
+func checkFlags(action *adminAction, address string) {
+	if *diff != "" && *at != "" {
+		log.Fatal("Use -diffto instead of -at with -diff")
+	}
+	if *volumes != "" && (action != nil || *at != "" || *subvolume != "" || address != "") {
+		log.Fatal("-volumes can be used only for mounting")
+	}
+	if *readOnly && action != nil && action.writes() {
+		log.Fatal("Changes are not possible with -ro")
+	}
+}
+
+// storageReadOnly checks if the storage should be opened read-only;
+// inspection is, only the explicit changes write.
+func storageReadOnly(action *adminAction) bool {
+	return *readOnly || (action != nil && !action.writes())
+}
+
+// openFs opens the filesystem chosen by the flags.
+func openFs(st *storage.Storage, rootName string, cacheSize int) *fs.Fs {
+	if *subvolume != "" {
+		// Everything else (e.g. -at, -fsck) applies to the
+		// subvolume
+		name := fs.SubvolumeRootName(rootName, *subvolume)
+		if st.GetBlockIdByName(name) == "" {
+			st.Close()
+			log.Fatalf("Subvolume %s not found", *subvolume)
+		}
+		rootName = name
+	}
+	var myfs *fs.Fs
+	if *volumes != "" {
+		myfs = fs.NewVolumeHostFs(st, strings.Split(*volumes, ","), cacheSize)
+		if myfs == nil {
+			st.Close()
+			log.Fatalf("Invalid volumes %s", *volumes)
+		}
+	} else if *at != "" {
+		bid := fs.ResolveRootBlockId(st, rootName, *at)
+		if bid != "" {
+			myfs = fs.NewReadOnlyFs(st, bid, cacheSize)
+		}
+		if myfs == nil {
+			st.Close()
+			log.Fatalf("Root block %s not found", *at)
+		}
+	} else {
+		myfs = fs.NewFs(st, rootName, cacheSize)
+	}
+	myfs.SetChunking(*cdc)
+	return myfs
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/fingon/go-tfhfs/fs"
+)
+
+// Settings are stored in the filesystem; only explicitly given flags
+// override the stored ones.
+
+var (
+	snapInterval   = flag.Duration("snapinterval", 0, "Interval between automatic snapshots (0 = none; stored in the filesystem)")
+	keepHourly     = flag.Uint("keephourly", 0, "Number of hourly automatic snapshots to keep (stored in the filesystem)")
+	keepDaily      = flag.Uint("keepdaily", 0, "Number of daily automatic snapshots to keep (stored in the filesystem)")
+	keepWeekly     = flag.Uint("keepweekly", 0, "Number of weekly automatic snapshots to keep (stored in the filesystem)")
+	keepMonthly    = flag.Uint("keepmonthly", 0, "Number of monthly automatic snapshots to keep (stored in the filesystem)")
+	trash          = flag.Bool("trash", false, "Move removed files and directories to trash instead (stored in the filesystem)")
+	trashMaxAge    = flag.Duration("trashmaxage", 0, "Purge trash entries older than this (0 = never; stored in the filesystem)")
+	trashMinFree   = flag.Uint64("trashminfree", 0, "Purge oldest trash entries while fewer bytes are available (0 = never; stored in the filesystem)")
+	conflictCopies = flag.Bool("conflictcopies", false, "Keep the losing versions of files changed on both sides of merges as conflict copies (stored in the filesystem)")
+)
+
+// visitSettings calls cb with the names of the given flags, and
+// returns true if it returned true for any of them.
+func visitSettings(cb func(name string) bool) (changed bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if cb(f.Name) {
+			changed = true
+		}
+	})
+	return
+}
+
+func applySnapshotSchedule(myfs *fs.Fs) error {
+	sched := myfs.SnapshotSchedule()
+	changed := visitSettings(func(name string) bool {
+		switch name {
+		case "snapinterval":
+			sched.Interval = *snapInterval
+		case "keephourly":
+			sched.Hourly = uint32(*keepHourly)
+		case "keepdaily":
+			sched.Daily = uint32(*keepDaily)
+		case "keepweekly":
+			sched.Weekly = uint32(*keepWeekly)
+		case "keepmonthly":
+			sched.Monthly = uint32(*keepMonthly)
+		default:
+			return false
+		}
+		return true
+	})
+	if !changed {
+		return nil
+	}
+	return myfs.SetSnapshotSchedule(sched)
+}
+
+func applyTrashPolicy(myfs *fs.Fs) error {
+	policy := myfs.TrashPolicy()
+	changed := visitSettings(func(name string) bool {
+		switch name {
+		case "trash":
+			policy.Enabled = *trash
+		case "trashmaxage":
+			policy.MaxAge = *trashMaxAge
+		case "trashminfree":
+			policy.MinFreeBytes = *trashMinFree
+		default:
+			return false
+		}
+		return true
+	})
+	if !changed {
+		return nil
+	}
+	return myfs.SetTrashPolicy(policy)
+}
+
+func applyConflictCopies(myfs *fs.Fs) error {
+	if !visitSettings(func(name string) bool { return name == "conflictcopies" }) {
+		return nil
+	}
+	return myfs.SetConflictCopies(*conflictCopies)
+}
+
+// applySettings stores the given settings in the filesystem.
+func applySettings(myfs *fs.Fs) {
+	for _, setting := range []struct {
+		name  string
+		apply func(myfs *fs.Fs) error
+	}{
+		{"snapshot schedule", applySnapshotSchedule},
+		{"trash policy", applyTrashPolicy},
+		{"conflict copies", applyConflictCopies},
+	} {
+		err := setting.apply(myfs)
+		if err != nil {
+			myfs.Close()
+			log.Fatalf("Unable to set %s: %v", setting.name, err)
+		}
+	}
+}
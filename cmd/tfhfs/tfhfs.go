@@ -19,17 +19,17 @@ import (
 	"runtime"
 	"runtime/pprof"
 
-	"github.com/fingon/go-tfhfs/fs"
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/server"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/storage/factory"
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage:\n\n%s MOUNTDIR STORAGEDIR\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage:\n\n%s MOUNTDIR STORAGEDIR\n%s -volumes NAME,... MOUNTDIR STORAGEDIR\n", os.Args[0], os.Args[0])
+		printAdminUsage()
 		flag.PrintDefaults()
 	}
 	password := flag.String("password", "siikret", "Password")
@@ -61,21 +61,33 @@ func main() {
 	}
 	mountpoint := flag.Arg(0)
 	storedir := flag.Arg(1)
-	if flag.NArg() < 2 {
+	action := requestedAdminAction()
+	if action != nil && flag.NArg() == 1 {
+		storedir = mountpoint
+	} else if flag.NArg() < 2 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	checkFlags(action, *address)
 
 	// actual filesystem
-	beconf := storage.BackendConfiguration{Directory: storedir, CacheSize: *cachesize, Unsafe: *unsafe}
+	beconf := storage.BackendConfiguration{Directory: storedir, CacheSize: *cachesize, Unsafe: *unsafe, ReadOnly: storageReadOnly(action)}
 	conf := factory.CryptoStorageConfiguration{BackendConfiguration: beconf,
 		BackendName: *backendp, Password: *password, Salt: *salt}
 	st := factory.NewCryptoStorage(conf)
-	myfs := fs.NewFs(st, *rootName, *cachesize)
-	opts := &fuse.MountOptions{AllowOther: true}
+	myfs := openFs(st, *rootName, *cachesize)
+	applySettings(myfs)
+	if action != nil {
+		runAdminAction(action, st, myfs)
+		return
+	}
+	opts := &fuse.MountOptions{AllowOther: true, EnableLocks: true}
 	if mlog.IsEnabled() {
 		opts.Debug = true
 	}
+	if *at != "" || *readOnly {
+		opts.Options = append(opts.Options, "ro")
+	}
 
 	// twirp server
 	var serv *server.Server
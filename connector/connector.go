@@ -15,7 +15,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/pb"
@@ -25,6 +27,15 @@ import (
 
 type Connection struct {
 	Family, Address, RootName, OtherRootName string
+
+	// If either Subtree (path) or SubtreeIno (inode) is set, only
+	// the subtree rooted at the directory is synchronized.
+	Subtree    string
+	SubtreeIno uint64
+}
+
+func (self *Connection) hasSubtree() bool {
+	return self.Subtree != "" || self.SubtreeIno != 0
 }
 
 // Connector glues together two tfhfs servers ('left' and 'right').
@@ -34,6 +45,19 @@ type Connection struct {
 // repeated every SyncInterval if there is need.
 type Connector struct {
 	Left, Right Connection
+
+	// Filters are gitignore-style patterns of paths (relative to
+	// the synchronized directory) that are not synchronized.
+	Filters []string
+}
+
+// ReadFilterFile reads gitignore-style filter file.
+func ReadFilterFile(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
 }
 
 func (self *Connector) Run() (int, error) {
@@ -66,6 +90,10 @@ func (self *Connector) getClient(c *Connection) (pb.Fs, error) {
 
 func (self *Connector) Sync(from *Connection, to *Connection) (ops int, err error) {
 	mlog.Printf2("connector/connector", "Sync %v => %v", from, to)
+	if from.hasSubtree() != to.hasSubtree() {
+		err = errors.New("subtree set on only one side")
+		return
+	}
 	fclient, err := self.getClient(from)
 	if err != nil {
 		return
@@ -77,7 +105,9 @@ func (self *Connector) Sync(from *Connection, to *Connection) (ops int, err erro
 
 	bg := context.Background()
 
-	fid, err := fclient.GetBlockIdByName(bg, &pb.BlockName{Name: from.RootName})
+	fid, err := fclient.GetBlockIdByName(bg, &pb.BlockName{Name: from.RootName,
+		Subtree: from.Subtree, SubtreeIno: from.SubtreeIno,
+		Peer: from.OtherRootName, Filters: self.Filters})
 	if err != nil {
 		mlog.Printf2("connector/connector", " unable to get root %s from src: %s", from.RootName, err)
 		return
@@ -106,7 +136,7 @@ func (self *Connector) Sync(from *Connection, to *Connection) (ops int, err erro
 			return 0, errors.New("non-ok SetNameToBlockId")
 		}
 	}
-	r2, err := tclient.MergeBlockNameTo(bg, &pb.MergeRequest{FromName: to.OtherRootName, ToName: to.RootName})
+	r2, err := tclient.MergeBlockNameTo(bg, &pb.MergeRequest{FromName: to.OtherRootName, ToName: to.RootName, Subtree: to.Subtree, SubtreeIno: to.SubtreeIno, Filters: self.Filters})
 	if err != nil {
 		return
 	}
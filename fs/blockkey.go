@@ -84,6 +84,11 @@ func NewBlockKeyOffset(ino uint64, offset uint64) BlockKey {
 	return NewBlockKey(ino, BST_FILE_OFFSET2EXTENT, string(b))
 }
 
+func NewBlockKeyChunk(ino uint64, offset uint64) BlockKey {
+	b := util.Uint64Bytes(offset)
+	return NewBlockKey(ino, BST_FILE_OFFSET2CHUNK, string(b))
+}
+
 func NewBlockKeyNameBlock(name, id string) BlockKey {
 	h := fnv.New64()
 	h.Write([]byte(name))
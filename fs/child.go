@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"sort"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Node ids at or above childNodeIdBase are never used for inodes of
+// the filesystem itself; they identify either virtual directories or
+// inodes within child filesystems.
+const childNodeIdBase uint64 = 1 << 63
+
+// snapshotsNodeId is the node id of the virtual .snapshots directory.
+const snapshotsNodeId = childNodeIdBase
+
+type childNode struct {
+	fs  *Fs
+	ino uint64
+}
+
+// childTracker keeps track of child filesystems (e.g. read-only
+// snapshot views) visible within a filesystem. As the inode numbers
+// of the children overlap with ours, it also maps them to and from
+// node ids visible to the kernel. The mappings are kept as long as
+// the kernel has looked them up, and not forgotten them (or until
+// the child filesystem is removed).
+type childTracker struct {
+	fs         *Fs
+	lock       util.MutexLocked
+	nextNodeId uint64
+	name2fs    map[string]*Fs
+	id2node    map[uint64]childNode
+	node2id    map[childNode]uint64
+	lookups    map[uint64]uint64
+}
+
+func (self *childTracker) Init(fs *Fs) {
+	self.fs = fs
+	self.nextNodeId = childNodeIdBase + 1
+	self.name2fs = make(map[string]*Fs)
+	self.id2node = make(map[uint64]childNode)
+	self.node2id = make(map[childNode]uint64)
+	self.lookups = make(map[uint64]uint64)
+}
+
+// Get returns child filesystem with the given name. If it does not
+// exist yet, create is called to provide it (and it may also return
+// nil).
+func (self *childTracker) Get(name string, create func() *Fs) *Fs {
+	defer self.lock.Locked()()
+	fs := self.name2fs[name]
+	if fs == nil && create != nil {
+		fs = create()
+		if fs != nil {
+			mlog.Printf2("fs/child", "ct.Get created %s", name)
+			self.name2fs[name] = fs
+		}
+	}
+	return fs
+}
+
+// Names returns sorted list of the currently active children.
+func (self *childTracker) Names() (names []string) {
+	defer self.lock.Locked()()
+	for name, _ := range self.name2fs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Remove closes the named child filesystem (if any), and forgets
+// node ids within it.
+func (self *childTracker) Remove(name string) {
+	self.lock.Lock()
+	fs := self.name2fs[name]
+	if fs == nil {
+		self.lock.Unlock()
+		return
+	}
+	mlog.Printf2("fs/child", "ct.Remove %s", name)
+	delete(self.name2fs, name)
+	self.forgetFs(fs)
+	self.lock.Unlock()
+	fs.Close()
+}
+
+func (self *childTracker) forgetFs(fs *Fs) {
+	self.lock.AssertLocked()
+	for node, id := range self.node2id {
+		if node.fs == fs {
+			delete(self.node2id, node)
+			delete(self.id2node, id)
+			delete(self.lookups, id)
+		}
+	}
+}
+
+// Close closes all child filesystems.
+func (self *childTracker) Close() {
+	for _, name := range self.Names() {
+		self.Remove(name)
+	}
+}
+
+// nodeId returns the node id that represents inode number ino of
+// child filesystem fs, or 0 if the kernel does not know it.
+func (self *childTracker) nodeId(fs *Fs, ino uint64) uint64 {
+	defer self.lock.Locked()()
+	return self.node2id[childNode{fs: fs, ino: ino}]
+}
+
+// lookup returns the node id that represents inode number ino of
+// child filesystem fs, and increments its lookup count.
+func (self *childTracker) lookup(fs *Fs, ino uint64) uint64 {
+	defer self.lock.Locked()()
+	node := childNode{fs: fs, ino: ino}
+	id, ok := self.node2id[node]
+	if !ok {
+		id = self.nextNodeId
+		self.nextNodeId++
+		self.node2id[node] = id
+		self.id2node[id] = node
+		mlog.Printf2("fs/child", "ct.lookup %v #%d => %d", fs, ino, id)
+	}
+	self.lookups[id]++
+	return id
+}
+
+// forget decrements the lookup count of the node id, and forgets
+// the mapping once the kernel no longer refers to it.
+func (self *childTracker) forget(nodeId, nlookup uint64) {
+	defer self.lock.Locked()()
+	node, ok := self.id2node[nodeId]
+	if !ok {
+		return
+	}
+	if self.lookups[nodeId] > nlookup {
+		self.lookups[nodeId] -= nlookup
+		return
+	}
+	mlog.Printf2("fs/child", "ct.forget %d", nodeId)
+	delete(self.node2id, node)
+	delete(self.id2node, nodeId)
+	delete(self.lookups, nodeId)
+}
+
+// node returns the child filesystem and inode number within it that
+// the node id represents. If the node id is not known, nil
+// filesystem is returned.
+func (self *childTracker) node(nodeId uint64) (*Fs, uint64) {
+	if nodeId < childNodeIdBase {
+		return nil, 0
+	}
+	defer self.lock.Locked()()
+	node, ok := self.id2node[nodeId]
+	if !ok {
+		return nil, 0
+	}
+	return node.fs, node.ino
+}
+
+// nodeId returns the node id that the kernel sees for the given
+// inode number of the filesystem, or 0 if it has not been looked up.
+func (self *Fs) nodeId(ino uint64) uint64 {
+	if self.parent == nil {
+		return ino
+	}
+	return self.parent.children.nodeId(self, ino)
+}
+
+// lookupNodeId is like nodeId, but for node ids handed to the
+// kernel in lookup replies (to be forgotten later, see Forget).
+func (self *Fs) lookupNodeId(ino uint64) uint64 {
+	if self.parent == nil {
+		return ino
+	}
+	return self.parent.children.lookup(self, ino)
+}
+
+// fuseServer returns the server the filesystem is visible through
+// (if any).
+func (self *Fs) fuseServer() *fuse.Server {
+	if self.parent != nil {
+		return self.parent.fuseServer()
+	}
+	return self.server
+}
+
+// resolveNodeId returns the filesystem and the inode number within
+// it that the given kernel-visible node id refers to.
+func (self *Fs) resolveNodeId(nodeId uint64) (*Fs, uint64) {
+	fs, ino := self.children.node(nodeId)
+	if fs == nil {
+		return self, nodeId
+	}
+	return fs, ino
+}
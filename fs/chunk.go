@@ -0,0 +1,431 @@
+package fs
+
+import (
+	"encoding/binary"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Content-defined chunking: instead of fixed dataExtentSize extents
+// keyed by extent number, file data may be stored in variable-size
+// chunks keyed by their start offset (BST_FILE_OFFSET2CHUNK). Chunk
+// boundaries depend only on the content, so inserting or removing
+// data in the middle of a file changes only chunks around the
+// modification, and the rest are deduplicated by the storage.
+//
+// The mode is per file, and it is determined by the keys the file
+// has; files without any data keys use the Fs default (SetChunking).
+// Holes are simply missing ranges between chunks.
+
+const (
+	chunkMinSize = dataExtentSize / 4
+	chunkAvgSize = dataExtentSize
+	chunkMaxSize = dataExtentSize * 4
+
+	// chunkBufferSize is the amount of contiguous writes gathered
+	// before they are chunked
+	chunkBufferSize = chunkMaxSize * 4
+)
+
+var chunker = util.NewChunker(chunkMinSize, chunkAvgSize, chunkMaxSize)
+
+// SetChunking sets whether data of new files is stored in
+// content-defined chunks. Existing files keep their mode.
+func (self *Fs) SetChunking(enabled bool) {
+	self.chunking = enabled
+	for _, name := range self.volumes {
+		self.Volume(name).SetChunking(enabled)
+	}
+}
+
+// fileChunk is a chunk of file data. The embedded data of a small
+// file is represented as chunk at 0 (without key in the tree).
+type fileChunk struct {
+	start uint64
+	data  []byte
+}
+
+func (self *fileChunk) end() uint64 {
+	return self.start + uint64(len(self.data))
+}
+
+// useChunks returns true if the inode data is (or should be) stored
+// in chunks.
+func (self *inode) useChunks(t *ibtree.Transaction) bool {
+	k := NewBlockKey(self.ino, BST_FILE_OFFSET2EXTENT, "")
+	nkeyp := t.NextKey(k.IB())
+	if nkeyp != nil {
+		nkey := BlockKey(*nkeyp)
+		if nkey.Ino() == self.ino {
+			switch nkey.SubType() {
+			case BST_FILE_OFFSET2EXTENT:
+				return false
+			case BST_FILE_OFFSET2CHUNK:
+				return true
+			}
+		}
+	}
+	return self.Fs().chunking
+}
+
+func (self *inode) loadChunk(key BlockKey, bid string) *fileChunk {
+	bl := self.Fs().storage.GetBlockById(bid)
+	if bl == nil {
+		mlog.Panicf("Block %x not found at all", bid)
+	}
+	defer bl.Close()
+	b := bl.Data()
+	if b[0] != byte(BDT_EXTENT) {
+		mlog.Panicf("Wrong chunk type (%x != %x)", b[0], BDT_EXTENT)
+	}
+	data := make([]byte, len(b)-1)
+	copy(data, b[1:])
+	start := binary.BigEndian.Uint64([]byte(key.SubTypeData()))
+	return &fileChunk{start: start, data: data}
+}
+
+// chunkAt returns the chunk that contains offset, or nil if offset
+// is within a hole (or past the data).
+func (self *inode) chunkAt(t *ibtree.Transaction, meta *InodeMeta, offset uint64) *fileChunk {
+	if meta.StSize <= EmbeddedSize {
+		if offset < uint64(len(meta.Data)) {
+			return &fileChunk{data: meta.Data}
+		}
+		return nil
+	}
+	k := NewBlockKeyChunk(self.ino, offset)
+	bidp := t.Get(k.IB())
+	if bidp == nil {
+		pkeyp := t.PrevKey(k.IB())
+		if pkeyp == nil {
+			return nil
+		}
+		k = BlockKey(*pkeyp)
+		if k.Ino() != self.ino || k.SubType() != BST_FILE_OFFSET2CHUNK {
+			return nil
+		}
+		bidp = t.Get(k.IB())
+	}
+	c := self.loadChunk(k, *bidp)
+	if offset >= c.end() {
+		return nil
+	}
+	return c
+}
+
+// nextChunkKey returns the first chunk key starting at or after
+// offset.
+func (self *inode) nextChunkKey(t *ibtree.Transaction, offset uint64) (key BlockKey, bid string, ok bool) {
+	key = NewBlockKeyChunk(self.ino, offset)
+	bidp := t.Get(key.IB())
+	if bidp == nil {
+		nkeyp := t.NextKey(key.IB())
+		if nkeyp == nil {
+			return
+		}
+		key = BlockKey(*nkeyp)
+		if key.Ino() != self.ino || key.SubType() != BST_FILE_OFFSET2CHUNK {
+			return
+		}
+		bidp = t.Get(key.IB())
+	}
+	return key, *bidp, true
+}
+
+// iterateChunks calls cb with the chunks overlapping [start, end[ in
+// order.
+func (self *inode) iterateChunks(t *ibtree.Transaction, meta *InodeMeta, start, end uint64, cb func(c *fileChunk) bool) {
+	c := self.chunkAt(t, meta, start)
+	if c != nil {
+		if !cb(c) {
+			return
+		}
+		start = c.end()
+	}
+	if meta.StSize <= EmbeddedSize {
+		return
+	}
+	for start < end {
+		key, bid, ok := self.nextChunkKey(t, start)
+		if !ok {
+			return
+		}
+		c = self.loadChunk(key, bid)
+		if c.start >= end || !cb(c) {
+			return
+		}
+		start = c.end()
+	}
+}
+
+// readChunksInTransaction reads [offset, offset+len(buf)[ (bounded by
+// size) to buf. Holes are read as zeros.
+func (self *inode) readChunksInTransaction(t *ibtree.Transaction, meta *InodeMeta, buf []byte, offset uint64) int {
+	end := offset + uint64(len(buf))
+	if end > meta.StSize {
+		end = meta.StSize
+	}
+	if offset >= end {
+		return 0
+	}
+	buf = buf[:end-offset]
+	for i := range buf {
+		buf[i] = 0
+	}
+	self.iterateChunks(t, meta, offset, end, func(c *fileChunk) bool {
+		if c.start >= offset {
+			copy(buf[c.start-offset:], c.data)
+		} else {
+			copy(buf, c.data[offset-c.start:])
+		}
+		return true
+	})
+	return len(buf)
+}
+
+func (self *inode) setChunk(tr *hugger.Transaction, start uint64, data []byte) {
+	b := append([]byte{byte(BDT_EXTENT)}, data...)
+	bl := self.Fs().GetStorageBlock(storage.BS_NORMAL, b, nil, &util.StringList{})
+	mlog.Printf2("fs/chunk", " chunk @%v = %d bytes, bid %x", start, len(data), bl.Id())
+	tr.IB().Set(NewBlockKeyChunk(self.ino, start).IB(), bl.Id())
+}
+
+// deleteChunks removes chunk keys starting within [start, end[.
+func (self *inode) deleteChunks(t *ibtree.Transaction, start, end uint64) {
+	var keys []BlockKey
+	for start < end {
+		key, _, ok := self.nextChunkKey(t, start)
+		if !ok {
+			break
+		}
+		start = binary.BigEndian.Uint64([]byte(key.SubTypeData()))
+		if start >= end {
+			break
+		}
+		keys = append(keys, key)
+		start++
+	}
+	for _, k := range keys {
+		t.Delete(k.IB())
+	}
+}
+
+// writeChunksInTransaction writes buf at offset. The data from the
+// start of the chunk containing offset onward is re-chunked until the
+// chunk boundaries match the old ones again (or the contiguous data
+// ends); only chunks within that range are replaced.
+func (self *inode) writeChunksInTransaction(tr *hugger.Transaction, meta *InodeMeta, buf []byte, offset uint64) {
+	t := tr.IB()
+	end := offset + uint64(len(buf))
+	pos := offset
+	var stream []byte
+	c := self.chunkAt(t, meta, offset)
+	if c == nil && offset > 0 {
+		// Chunk ending at offset may have been cut only
+		// because data ended there; appending to it should
+		// produce same chunks as writing all at once
+		c = self.chunkAt(t, meta, offset-1)
+	}
+	if c != nil {
+		pos = c.start
+		stream = append(stream, c.data[:offset-c.start]...)
+	} else if meta.StSize <= EmbeddedSize && len(meta.Data) > 0 {
+		// Embedded data is not within what we write; it
+		// becomes the first chunk as is
+		self.setChunk(tr, 0, meta.Data)
+	}
+	stream = append(stream, buf...)
+
+	tail := end
+	tailEnded := false
+	resync := make(map[uint64]bool)
+	appendOld := func() {
+		c := self.chunkAt(t, meta, tail)
+		if c == nil {
+			tailEnded = true
+			return
+		}
+		if c.start >= end {
+			resync[c.start] = true
+		}
+		stream = append(stream, c.data[tail-c.start:]...)
+		tail = c.end()
+	}
+
+	start := pos
+	type newChunk struct {
+		start uint64
+		data  []byte
+	}
+	var chunks []newChunk
+	for len(stream) > 0 {
+		for len(stream) < chunkMaxSize && !tailEnded {
+			appendOld()
+		}
+		n, _ := chunker.Cut(stream)
+		chunks = append(chunks, newChunk{pos, stream[:n]})
+		pos += uint64(n)
+		stream = stream[n:]
+		if resync[pos] {
+			// Rest is unchanged
+			break
+		}
+	}
+	mlog.Printf2("fs/chunk", "inode.writeChunks #%d [%v,%v[ rewrote [%v,%v[ in %d chunks", self.ino, offset, end, start, pos, len(chunks))
+	self.deleteChunks(t, start, pos)
+	for _, c := range chunks {
+		self.setChunk(tr, c.start, c.data)
+	}
+}
+
+// truncateChunksInTransaction drops data past size. If the file
+// becomes small enough, the remaining data moves to the metadata.
+// This should be called before the size in meta changes.
+func (self *inode) truncateChunksInTransaction(tr *hugger.Transaction, meta *InodeMeta, size uint64) {
+	t := tr.IB()
+	var c *fileChunk
+	if size > 0 {
+		c = self.chunkAt(t, meta, size-1)
+	}
+	if size <= EmbeddedSize {
+		data := make([]byte, size)
+		self.readChunksInTransaction(t, meta, data, 0)
+		meta.Data = data
+		size = 0
+		c = nil
+	}
+	t.DeleteRange(NewBlockKeyChunk(self.ino, size).IB(),
+		NewBlockKeyChunk(self.ino, 1<<62).IB())
+	if c != nil && c.end() > size {
+		self.setChunk(tr, c.start, c.data[:size-c.start])
+	}
+}
+
+// zeroChunksInTransaction zeroes the range [start, end[ of the
+// file. Chunks wholly within the range are dropped, and partially
+// covered ones are rewritten (with their boundaries intact).
+func (self *inode) zeroChunksInTransaction(tr *hugger.Transaction, meta *InodeMeta, start, end uint64) {
+	var chunks []*fileChunk
+	self.iterateChunks(tr.IB(), meta, start, end, func(c *fileChunk) bool {
+		chunks = append(chunks, c)
+		return true
+	})
+	for _, c := range chunks {
+		if c.start >= start && c.end() <= end {
+			mlog.Printf2("fs/chunk", " dropping chunk @%v", c.start)
+			tr.IB().Delete(NewBlockKeyChunk(self.ino, c.start).IB())
+			continue
+		}
+		for i := range c.data {
+			o := c.start + uint64(i)
+			if o >= start && o < end {
+				c.data[i] = 0
+			}
+		}
+		self.setChunk(tr, c.start, c.data)
+	}
+}
+
+// writeChunked is the chunked counterpart of write. Chunk boundaries
+// depend on the data that follows, so contiguous writes are gathered
+// to a buffer in the handle, and chunked only when the buffer fills
+// or is flushed (e.g. on close, or when the data is read). Only the
+// metadata is updated immediately.
+func (self *inodeFH) writeChunked(buf []byte, offset uint64) (written uint32, code fuse.Status) {
+	defer self.inode.metaWriteLock.Locked()()
+	mlog.Printf2("fs/chunk", "%v.writeChunked %v @%v", self, len(buf), offset)
+	end := offset + uint64(len(buf))
+	fs := self.Fs()
+	defer fs.chunkBufferLock.Locked()()
+	if len(self.chunkBuffer) > 0 && self.chunkOffset+uint64(len(self.chunkBuffer)) != offset {
+		self.flushChunkBuffer()
+	}
+	// Writes of other handles have to land first
+	for file := range fs.chunkBuffers {
+		if file.inode == self.inode && file != self {
+			file.flushChunkBuffer()
+		}
+	}
+	meta := self.inode.Meta()
+	if meta == nil {
+		code = fuse.ENOENT
+		return
+	}
+	// Embedded data moves to chunks along with the write past it
+	// (the metadata has to change with the data)
+	embedded := meta.StSize <= EmbeddedSize
+	if !embedded {
+		if len(self.chunkBuffer) == 0 {
+			self.chunkOffset = offset
+			fs.chunkBuffers[self] = true
+		}
+		self.chunkBuffer = append(self.chunkBuffer, buf...)
+	}
+	fs.Update(func(tr *hugger.Transaction) {
+		meta := self.inode.Meta()
+		if embedded {
+			self.inode.writeChunksInTransaction(tr, meta, buf, offset)
+		}
+		if end > meta.StSize {
+			self.inode.SetMetaSizeInTransaction(meta, end, tr)
+		}
+		meta.setTimesNow(true, true, true)
+		self.inode.SetMetaInTransaction(meta, tr)
+	})
+	if len(self.chunkBuffer) >= chunkBufferSize {
+		self.flushChunkBuffer()
+	}
+	return uint32(len(buf)), fuse.OK
+}
+
+// flushChunkBuffer chunks and stores the buffered writes of the
+// handle. The caller must hold chunkBufferLock.
+func (self *inodeFH) flushChunkBuffer() {
+	fs := self.Fs()
+	fs.chunkBufferLock.AssertLocked()
+	if len(self.chunkBuffer) == 0 {
+		return
+	}
+	mlog.Printf2("fs/chunk", "%v.flushChunkBuffer %v @%v", self, len(self.chunkBuffer), self.chunkOffset)
+	fs.Update(func(tr *hugger.Transaction) {
+		meta := self.inode.Meta()
+		if meta == nil {
+			return
+		}
+		self.inode.writeChunksInTransaction(tr, meta, self.chunkBuffer, self.chunkOffset)
+	})
+	self.chunkBuffer = nil
+	delete(fs.chunkBuffers, self)
+}
+
+// flushChunkBuffers flushes the buffered chunked writes to the inode
+// (or to all inodes, if nil).
+func (self *Fs) flushChunkBuffers(inode *inode) {
+	defer self.chunkBufferLock.Locked()()
+	for file := range self.chunkBuffers {
+		if inode == nil || file.inode == inode {
+			file.flushChunkBuffer()
+		}
+	}
+}
+
+func (self *inode) chunked() bool {
+	tr := self.Fs().GetNestableTransaction()
+	defer tr.Close()
+	return self.useChunks(tr.IB())
+}
+
+// chunked returns true if the data of the file is stored in chunks
+// (or would be, after writing up to end).
+func (self *inodeFH) chunked(end uint64) bool {
+	meta := self.inode.Meta()
+	if meta == nil || (meta.StSize <= EmbeddedSize && end <= EmbeddedSize) {
+		return false
+	}
+	return self.inode.chunked()
+}
@@ -0,0 +1,177 @@
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func chunkBlockIds(fs *Fs, ino uint64) (ids []string) {
+	tr := fs.GetTransaction()
+	defer tr.Close()
+	IterateInoSubTypeKeys(tr.IB(), ino, BST_FILE_OFFSET2CHUNK,
+		func(key BlockKey) bool {
+			ids = append(ids, *tr.IB().Get(key.IB()))
+			return true
+		})
+	return
+}
+
+func TestChunking(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	fs.SetChunking(true)
+	u := NewFSUser(fs)
+
+	data := make([]byte, 1000000)
+	rand.New(rand.NewSource(42)).Read(data)
+	f, err := u.OpenFile("/file", uint32(os.O_CREATE|os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	defer f.Close()
+	for ofs := 0; ofs < len(data); ofs += 100000 {
+		f.Write(data[ofs : ofs+100000])
+	}
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+
+	var eo fuse.EntryOut
+	func() {
+		defer u.lock.Locked()()
+		assert.Nil(t, u.lookup("/file", &eo))
+	}()
+	ino := eo.NodeId
+	assert.Equal(t, countExtents(fs, ino), 0)
+	ids := chunkBlockIds(fs, ino)
+	assert.True(t, len(ids) > 5, "too few chunks ", len(ids))
+	old := make(map[string]bool)
+	for _, id := range ids {
+		old[id] = true
+	}
+
+	// Insert some data in the middle; most of chunks should
+	// stay the same
+	data = append(data[:300000], append([]byte("hello"), data[300000:]...)...)
+	f.Seek(300000, 0)
+	f.Write(data[300000:])
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+	ids = chunkBlockIds(fs, ino)
+	same := 0
+	for _, id := range ids {
+		if old[id] {
+			same++
+		}
+	}
+	assert.True(t, same >= len(ids)-2, "too few same chunks ", same, len(ids))
+
+	// Small overwrite
+	f.Seek(500000, 0)
+	f.Write([]byte("xyz"))
+	copy(data[500000:], "xyz")
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+
+	// Hole after the end
+	f.Seek(2000000, 0)
+	f.Write([]byte("end"))
+	data = append(data, make([]byte, 2000000-len(data))...)
+	data = append(data, []byte("end")...)
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+	drs, err := u.DataRanges("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, len(drs), 2)
+	assert.Equal(t, drs[0].Start, uint64(0))
+	assert.Equal(t, drs[1].End, uint64(2000003))
+
+	// Punching hole
+	assert.Nil(t, f.Fallocate(fallocPunchHole|fallocKeepSize, 100000, 200000))
+	for i := 100000; i < 300000; i++ {
+		data[i] = 0
+	}
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+
+	// Truncate within chunk, and then to embedded size
+	assert.Nil(t, f.Truncate(400000))
+	data = data[:400000]
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+	assert.Nil(t, f.Truncate(500))
+	data = data[:500]
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+	assert.Equal(t, len(chunkBlockIds(fs, ino)), 0)
+
+	// Growing again keeps the data
+	f.Seek(200000, 0)
+	f.Write([]byte("more"))
+	data = append(data, make([]byte, 200000-len(data))...)
+	data = append(data, []byte("more")...)
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/file"), data))
+
+	// Data survives remount
+	fs.Flush()
+	fs2 := NewFs(st, "toor", 0)
+	u2 := NewFSUser(fs2)
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u2, "/file"), data))
+	fs2.Flush()
+}
+
+func TestChunkingBuffered(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	fs.SetChunking(true)
+	u := NewFSUser(fs)
+
+	data := make([]byte, 500000)
+	rand.New(rand.NewSource(42)).Read(data)
+	ino := func(name string) uint64 {
+		var eo fuse.EntryOut
+		defer u.lock.Locked()()
+		assert.Nil(t, u.lookup(name, &eo))
+		return eo.NodeId
+	}
+
+	// Written at once
+	f, err := u.OpenFile("/once", uint32(os.O_CREATE|os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	f.Write(data)
+	f.Close()
+
+	// Written in small pieces; only the first write (which
+	// moves the file out of metadata) is chunked immediately,
+	// and rest only when the handle is closed
+	f, err = u.OpenFile("/small", uint32(os.O_CREATE|os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	for ofs := 0; ofs < len(data); ofs += 4096 {
+		end := ofs + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		f.Write(data[ofs:end])
+	}
+	assert.Equal(t, len(chunkBlockIds(fs, ino("/small"))), 1)
+	fi, err := u.Stat("/small")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), int64(len(data)))
+	f.Close()
+	assert.Equal(t, chunkBlockIds(fs, ino("/small")), chunkBlockIds(fs, ino("/once")))
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/small"), data))
+
+	// Reads see the buffered data
+	f, err = u.OpenFile("/small", uint32(os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	defer f.Close()
+	f.Seek(100000, 0)
+	f.Write([]byte("hello"))
+	copy(data[100000:], "hello")
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/small"), data))
+}
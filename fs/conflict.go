@@ -0,0 +1,251 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// When conflict copies are enabled, non-local merges do not simply
+// drop the changes of the side with older ctime if a regular file
+// was modified on both sides. Instead, the losing version is kept as
+// a new inode next to the original (as 'name (conflict peer time)'),
+// sharing the data blocks with it.
+//
+// The conflicts are recorded in the fsIno pseudo-inode (and are
+// therefore local to this filesystem) until they are resolved, either
+// explicitly, or by removing the conflict copy.
+
+const configConflictCopies = "conflicts"
+
+var ErrConflictNotFound = errors.New("Conflict not found")
+
+type Conflict struct {
+	// Ino is the inode of the conflict copy
+	Ino uint64
+
+	// OriginalIno is the inode the copy was made of
+	OriginalIno uint64
+
+	// Peer the conflicting change was merged from (if known)
+	Peer string
+
+	Time time.Time
+
+	// Path of the conflict copy (if it is still reachable)
+	Path string
+}
+
+func (self *Conflict) String() string {
+	return fmt.Sprintf("%d\t%s\t%s\t%s", self.Ino,
+		self.Time.UTC().Format(time.RFC3339), self.Peer, self.Path)
+}
+
+func newConflictKey(ino uint64) BlockKey {
+	return NewBlockKey(fsIno, BST_CONFLICT, string(util.Uint64Bytes(ino)))
+}
+
+func encodeConflictInfo(ino uint64, now time.Time, peer string) string {
+	b := util.ConcatBytes(util.Uint64Bytes(ino),
+		util.Uint64Bytes(uint64(now.UnixNano())), []byte(peer))
+	return string(b)
+}
+
+func decodeConflictInfo(v string) (ino uint64, t time.Time, peer string) {
+	b := []byte(v)
+	ino = binary.BigEndian.Uint64(b)
+	t = time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	peer = string(b[16:])
+	return
+}
+
+// forgetConflict removes the conflict record of the inode (if any).
+func forgetConflict(t *ibtree.Transaction, ino uint64) bool {
+	k := newConflictKey(ino).IB()
+	if t.Get(k) == nil {
+		return false
+	}
+	t.Delete(k)
+	return true
+}
+
+func conflictCopiesEnabled(t *ibtree.Transaction) (enabled bool) {
+	v := t.Get(NewBlockKey(fsIno, BST_CONFIG, configConflictCopies).IB())
+	if v == nil {
+		return
+	}
+	err := binary.Read(strings.NewReader(*v), binary.BigEndian, &enabled)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// ConflictCopies returns whether merges keep conflict copies.
+func (self *Fs) ConflictCopies() bool {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	return conflictCopiesEnabled(tr.IB())
+}
+
+// SetConflictCopies stores whether merges keep conflict copies in
+// the filesystem.
+func (self *Fs) SetConflictCopies(enabled bool) error {
+	mlog.Printf2("fs/conflict", "fs.SetConflictCopies %v", enabled)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.BigEndian, enabled)
+	if err != nil {
+		log.Panic(err)
+	}
+	self.Update(func(tr *hugger.Transaction) {
+		tr.IB().Set(NewBlockKey(fsIno, BST_CONFIG, configConflictCopies).IB(), b.String())
+	})
+	return nil
+}
+
+// ListConflicts returns the unresolved conflicts, oldest first.
+func (self *Fs) ListConflicts() (conflicts []Conflict) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	t := tr.IB()
+	IterateInoSubTypeKeys(t, fsIno, BST_CONFLICT,
+		func(key BlockKey) bool {
+			c := Conflict{Ino: binary.BigEndian.Uint64([]byte(key.SubTypeData()))}
+			c.OriginalIno, c.Time, c.Peer = decodeConflictInfo(*t.Get(key.IB()))
+			if paths := inodePaths(t, c.Ino); len(paths) > 0 {
+				c.Path = paths[0]
+			}
+			conflicts = append(conflicts, c)
+			return true
+		})
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Time.Before(conflicts[j].Time)
+	})
+	return
+}
+
+// ResolveConflict marks the conflict of the conflict copy resolved,
+// leaving the copy itself alone.
+func (self *Fs) ResolveConflict(ino uint64) (err error) {
+	mlog.Printf2("fs/conflict", "fs.ResolveConflict #%d", ino)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	err = ErrConflictNotFound
+	self.Update(func(tr *hugger.Transaction) {
+		if forgetConflict(tr.IB(), ino) {
+			err = nil
+		}
+	})
+	return
+}
+
+func isRegularFile(meta *InodeMeta) bool {
+	return meta.StMode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+// conflictName returns name for conflict copy of name that is not
+// yet in use in the directory.
+func conflictName(t *ibtree.Transaction, dir uint64, name, peer string, now time.Time) string {
+	base := now.UTC().Format("2006-01-02 150405")
+	if peer != "" {
+		base = fmt.Sprintf("%s %s", peer, base)
+	}
+	cname := fmt.Sprintf("%s (conflict %s)", name, base)
+	for i := 2; t.Get(NewBlockKeyDirFilename(dir, cname).IB()) != nil; i++ {
+		cname = fmt.Sprintf("%s (conflict %s %d)", name, base, i)
+	}
+	return cname
+}
+
+// unusedIno returns random inode number not in use in the tree. It
+// is used for inodes created during merges, outside inodeTracker.
+func unusedIno(t *ibtree.Transaction) uint64 {
+	for {
+		ino := rand.Uint64() &^ childNodeIdBase
+		if ino != fsIno && ino != fuse.FUSE_ROOT_ID && t.Get(NewBlockKey(ino, BST_META, "").IB()) == nil {
+			return ino
+		}
+	}
+}
+
+// keepConflictCopy copies the file ino as it is in from to t as a new
+// inode, next to (the first still existing) name of it, and records
+// the conflict. The data blocks are shared with the original.
+func keepConflictCopy(t, from *ibtree.Transaction, ino uint64, peer string, replica uint64, now time.Time) {
+	v := from.Get(NewBlockKey(ino, BST_META, "").IB())
+	if v == nil {
+		return
+	}
+	var dir uint64
+	var name string
+	IterateInoSubTypeKeys(from, ino, BST_FILE_INODEFILENAME,
+		func(key BlockKey) bool {
+			b := []byte(key.SubTypeData())
+			d := binary.BigEndian.Uint64(b)
+			if t.Get(NewBlockKey(d, BST_META, "").IB()) == nil {
+				return true
+			}
+			dir = d
+			name = string(b[8:])
+			return false
+		})
+	if name == "" {
+		mlog.Printf2("fs/conflict", " #%d has no directory to keep copy in", ino)
+		return
+	}
+	nino := unusedIno(t)
+	cname := conflictName(t, dir, name, peer, now)
+	mlog.Printf2("fs/conflict", " keeping copy of #%d as #%d %s", ino, nino, cname)
+
+	// Copy is local change, and so are its consequences below
+	meta := decodeInodeMeta(*v)
+	meta.StNlink = 1
+	meta.VersionVector = VersionVector("").Increment(replica)
+	b, err := meta.MarshalMsg(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	t.Set(NewBlockKey(nino, BST_META, "").IB(), string(b))
+	chargeUsageInTransaction(t, nil, &meta.InodeMetaData)
+	for _, bst := range []BlockSubType{BST_XATTR, BST_FILE_OFFSET2EXTENT, BST_FILE_OFFSET2CHUNK} {
+		IterateInoSubTypeKeys(from, ino, bst,
+			func(key BlockKey) bool {
+				nk := NewBlockKey(nino, bst, key.SubTypeData())
+				t.Set(nk.IB(), *from.Get(key.IB()))
+				return true
+			})
+	}
+
+	// Directory has to change too, or the new entry would not
+	// propagate further
+	dk := NewBlockKey(dir, BST_META, "")
+	dmeta := decodeInodeMeta(*t.Get(dk.IB()))
+	dmeta.setTimesNow(false, true, true)
+	dmeta.VersionVector = dmeta.VersionVector.Increment(replica)
+	b, err = dmeta.MarshalMsg(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	t.Set(dk.IB(), string(b))
+	t.Set(NewBlockKeyDirFilename(dir, cname).IB(), string(util.Uint64Bytes(nino)))
+	t.Set(NewBlockKeyReverseDirFilename(nino, dir, cname).IB(), "")
+
+	t.Set(newConflictKey(nino).IB(), encodeConflictInfo(ino, now, peer))
+}
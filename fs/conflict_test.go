@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+// forkPeer creates subvolume from the current state to play the
+// role of peer, and lets modify run on it.
+func forkPeer(t *testing.T, fs *Fs, name string, modify func(u *FSUser)) {
+	assert.Nil(t, fs.CreateSnapshot(name))
+	assert.Nil(t, fs.CreateSubvolume(name, name))
+	if modify == nil {
+		return
+	}
+	p := fs.OpenSubvolume(name)
+	modify(NewFSUser(p))
+	p.Close()
+}
+
+func mergeFromPeer(fs *Fs, name string) error {
+	b0, _, _ := fs.LoadNodeByName(fs.snapshotStorageName(name))
+	b, _, _ := fs.LoadNodeByName(fs.subvolumeRootName(name))
+	return fs.MergeFromPeer(b0, b, name)
+}
+
+func TestConflict(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	writeTestFile(t, u, "/f", "v0")
+	writeTestFile(t, u, "/g", "g0")
+	assert.True(t, !fs.ConflictCopies())
+	assert.Nil(t, fs.SetConflictCopies(true))
+	assert.True(t, fs.ConflictCopies())
+
+	// Peer wins; ours is kept as a copy
+	forkPeer(t, fs, "p", nil)
+	rewriteTestFile(t, u, "/f", "local")
+	p := fs.OpenSubvolume("p")
+	rewriteTestFile(t, NewFSUser(p), "/f", "peer")
+	rewriteTestFile(t, NewFSUser(p), "/g", "g1")
+	p.Close()
+	mergeFromPeer(fs, "p")
+	assert.Equal(t, readTestFile(t, u, "/f"), "peer")
+	assert.Equal(t, readTestFile(t, u, "/g"), "g1")
+	l := fs.ListConflicts()
+	assert.Equal(t, len(l), 1)
+	assert.Equal(t, l[0].Peer, "p")
+	assert.True(t, strings.HasPrefix(l[0].Path, "/f (conflict p "), l[0].Path)
+	assert.Equal(t, fs.PathsForInode(l[0].OriginalIno), []string{"/f"})
+	assert.Equal(t, readTestFile(t, u, l[0].Path), "local")
+
+	// We win; peer's is kept as a copy
+	forkPeer(t, fs, "q", func(u *FSUser) {
+		rewriteTestFile(t, u, "/f", "peer2")
+	})
+	rewriteTestFile(t, u, "/f", "local2")
+	mergeFromPeer(fs, "q")
+	assert.Equal(t, readTestFile(t, u, "/f"), "local2")
+	l = fs.ListConflicts()
+	assert.Equal(t, len(l), 2)
+	assert.Equal(t, l[1].Peer, "q")
+	assert.Equal(t, readTestFile(t, u, l[1].Path), "peer2")
+
+	// Without conflict copies, the loser is just dropped
+	assert.Nil(t, fs.SetConflictCopies(false))
+	forkPeer(t, fs, "r", func(u *FSUser) {
+		rewriteTestFile(t, u, "/f", "peer3")
+	})
+	rewriteTestFile(t, u, "/f", "local3")
+	mergeFromPeer(fs, "r")
+	assert.Equal(t, readTestFile(t, u, "/f"), "local3")
+	assert.Equal(t, len(fs.ListConflicts()), 2)
+
+	// Conflicts are resolved either explicitly or by removing
+	// the copy
+	assert.Nil(t, u.Remove(l[0].Path))
+	assert.Nil(t, fs.ResolveConflict(l[1].Ino))
+	assert.Equal(t, fs.ResolveConflict(l[1].Ino), ErrConflictNotFound)
+	fs.Flush()
+	assert.Equal(t, len(fs.ListConflicts()), 0)
+	assert.Equal(t, readTestFile(t, u, l[1].Path), "peer2")
+
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
@@ -0,0 +1,160 @@
+package fs
+
+import (
+	"math"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// copyRange copies length bytes from src at srcOffset to dst at
+// dstOffset. Extents that are wholly copied and aligned in both files
+// are shared: the destination simply refers to the same block (and
+// the tree takes care of the reference). Rest is read and rewritten.
+// Chunked files are always copied by rewriting; the storage
+// deduplicates the resulting chunks anyway. Like writes, copies are
+// subject to quota and save a version of the destination first.
+func (self *inodeFH) copyRange(src *inodeFH, srcOffset, dstOffset, length uint64) (copied uint64, code fuse.Status) {
+	self.saveVersionOnce()
+	self.unflushed = true
+	code = self.inode.checkQuotaSize(dstOffset + length)
+	if !code.Ok() {
+		return
+	}
+	share := !src.inode.chunked() && !self.chunked(dstOffset+length)
+	buf := make([]byte, dataExtentSize)
+	for copied < length {
+		so := srcOffset + copied
+		do := dstOffset + copied
+		left := length - copied
+		if share && so%dataExtentSize == 0 && do%dataExtentSize == 0 && left >= dataExtentSize {
+			self.inode.shareExtent(src.inode, so, do)
+			copied += dataExtentSize
+			continue
+		}
+		n := dataExtentSize - do%dataExtentSize
+		if n > left {
+			n = left
+		}
+		rr, code := src.Read(buf[:n], so)
+		if !code.Ok() {
+			return copied, code
+		}
+		b, code := rr.Bytes(buf)
+		if !code.Ok() {
+			return copied, code
+		}
+		if uint64(len(b)) < n {
+			// Hit EOF; pad with zeros
+			b = buf[:n]
+			for i := rr.Size(); i < len(b); i++ {
+				b[i] = 0
+			}
+		}
+		_, code = self.Write(b, do)
+		if !code.Ok() {
+			return copied, code
+		}
+		copied += n
+	}
+	return
+}
+
+// shareExtent makes the extent at dstOffset of the inode refer to the
+// same block as the extent at srcOffset of src.
+func (self *inode) shareExtent(src *inode, srcOffset, dstOffset uint64) {
+	mlog.Printf2("fs/copy", "inode.shareExtent #%d @%v => #%d @%v", src.ino, srcOffset, self.ino, dstOffset)
+	// Pending write of the source extent lands first
+	src.offsetMap.Locked(srcOffset / dataExtentSize)()
+	defer self.metaWriteLock.Locked()()
+	meta := self.Meta()
+	if meta == nil {
+		return
+	}
+	e := dstOffset / dataExtentSize
+	end := dstOffset + dataExtentSize
+	if e != 0 && end > meta.StSize && meta.StSize <= EmbeddedSize {
+		// Data has to move from metadata to the first extent
+		defer self.offsetMap.Locked(0)()
+	}
+	defer self.offsetMap.Locked(e)()
+	sk := NewBlockKeyOffset(src.ino, srcOffset).IB()
+	dk := NewBlockKeyOffset(self.ino, dstOffset).IB()
+	self.Fs().Update(func(tr *hugger.Transaction) {
+		meta := *meta
+		if end > meta.StSize {
+			self.growInTransaction(&meta, end, tr)
+		}
+		bidp := tr.IB().Get(sk)
+		if bidp == nil {
+			tr.IB().Delete(dk)
+		} else {
+			tr.IB().Set(dk, *bidp)
+		}
+		meta.setTimesNow(false, true, true)
+		self.SetMetaInTransaction(&meta, tr)
+	})
+}
+
+// CopyFileRange implements copy_file_range(2). Flags are not
+// supported.
+func (self *fsOps) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (written uint32, code fuse.Status) {
+	mlog.Printf2("fs/copy", "ops.CopyFileRange %v", input)
+	ops, ino := self.dispatch(input.NodeId)
+	oops, oino := self.dispatch(input.NodeIdOut)
+	if ops != oops {
+		code = fuse.EXDEV
+		return
+	}
+	if ops != self {
+		in := *input
+		in.NodeId = ino
+		in.NodeIdOut = oino
+		return ops.CopyFileRange(cancel, &in)
+	}
+	if self.fs.readOnly {
+		code = fuse.EROFS
+		return
+	}
+	if input.Flags != 0 {
+		code = fuse.EINVAL
+		return
+	}
+	src := self.fs.GetFileByFh(input.FhIn)
+	dst := self.fs.GetFileByFh(input.FhOut)
+	if src == nil || dst == nil || dst.flags&fuse.O_ANYWRITE == 0 {
+		code = fuse.EBADF
+		return
+	}
+	if !src.inode.IsFile() || !dst.inode.IsFile() {
+		code = fuse.EINVAL
+		return
+	}
+	length := input.Len
+	if length > math.MaxUint32 {
+		// Kernel copes with short copies
+		length = math.MaxUint32 &^ (dataExtentSize - 1)
+	}
+	size := src.inode.Meta().StSize
+	if input.OffIn >= size {
+		return
+	}
+	if input.OffIn+length > size {
+		length = size - input.OffIn
+	}
+	if src.inode == dst.inode &&
+		input.OffIn < input.OffOut+length && input.OffOut < input.OffIn+length {
+		code = fuse.EINVAL
+		return
+	}
+	// Buffered chunks of the source have to be visible to the
+	// reads (pending extent writes are waited for per extent)
+	self.fs.flushChunkBuffers(src.inode)
+	copied, code := dst.copyRange(src, input.OffIn, input.OffOut, length)
+	if copied > 0 {
+		code = fuse.OK
+	}
+	written = uint32(copied)
+	return
+}
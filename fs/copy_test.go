@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func readWholeTestFile(t *testing.T, u *FSUser, path string) []byte {
+	fi, err := u.Stat(path)
+	assert.Nil(t, err)
+	f, err := u.OpenFile(path, uint32(os.O_RDONLY), 0)
+	assert.Nil(t, err)
+	defer f.Close()
+	b := make([]byte, fi.Size())
+	for ofs := 0; ofs < len(b); {
+		n, err := f.Read(b[ofs:])
+		assert.Nil(t, err)
+		if n == 0 {
+			break
+		}
+		ofs += n
+	}
+	return b
+}
+
+func extentBlockId(fs *Fs, ino, offset uint64) string {
+	tr := fs.GetTransaction()
+	defer tr.Close()
+	bidp := tr.IB().Get(NewBlockKeyOffset(ino, offset).IB())
+	if bidp == nil {
+		return ""
+	}
+	return *bidp
+}
+
+func TestCopyFileRange(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+
+	data := make([]byte, 3*dataExtentSize+1234)
+	rand.Read(data)
+	f, err := u.OpenFile("/src", uint32(os.O_CREATE|os.O_WRONLY), 0777)
+	assert.Nil(t, err)
+	f.Write(data)
+	f.Close()
+
+	assert.Nil(t, u.CloneFile("/src", "/dst"))
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/dst"), data))
+
+	lookup := func(path string) uint64 {
+		defer u.lock.Locked()()
+		var eo fuse.EntryOut
+		assert.Nil(t, u.lookup(path, &eo))
+		return eo.NodeId
+	}
+	sino := lookup("/src")
+	dino := lookup("/dst")
+	for i := uint64(0); i < 3; i++ {
+		bid := extentBlockId(fs, sino, i*dataExtentSize)
+		assert.True(t, bid != "")
+		assert.Equal(t, extentBlockId(fs, dino, i*dataExtentSize), bid)
+	}
+
+	// Unaligned copy within existing file
+	sf, err := u.OpenFile("/src", uint32(os.O_RDONLY), 0)
+	assert.Nil(t, err)
+	defer sf.Close()
+	df, err := u.OpenFile("/dst", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	defer df.Close()
+	ci := fuse.CopyFileRangeIn{FhIn: sf.fh, OffIn: 10, NodeIdOut: df.ino,
+		FhOut: df.fh, OffOut: dataExtentSize + 5, Len: 100000}
+	ci.NodeId = sf.ino
+	n, code := fs.Ops.CopyFileRange(nil, &ci)
+	assert.True(t, code.Ok())
+	assert.Equal(t, n, uint32(100000))
+	copy(data[dataExtentSize+5:], data[10:100010])
+	assert.True(t, bytes.Equal(readWholeTestFile(t, u, "/dst"), data))
+}
+
+func TestCopyFileRangeChecks(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	root := NewFSUser(fs)
+	assert.Nil(t, root.Mkdir("/d", 0777))
+	assert.Nil(t, root.SetXAttr("/d", keepVersionsXAttr, []byte("2")))
+	u := NewFSUser(fs)
+	u.Uid = 42
+	u.Gid = 7
+
+	data := string(bytes.Repeat([]byte("x"), 2*dataExtentSize))
+	writeTestFile(t, u, "/d/src", data)
+	writeTestFile(t, u, "/d/dst", "dst")
+
+	// Copy over existing content saves a version first
+	sf, err := u.OpenFile("/d/src", uint32(os.O_RDONLY), 0)
+	assert.Nil(t, err)
+	defer sf.Close()
+	df, err := u.OpenFile("/d/dst", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	ci := fuse.CopyFileRangeIn{FhIn: sf.fh, NodeIdOut: df.ino,
+		FhOut: df.fh, Len: dataExtentSize}
+	ci.NodeId = sf.ino
+	n, code := fs.Ops.CopyFileRange(nil, &ci)
+	assert.True(t, code.Ok())
+	assert.Equal(t, n, uint32(dataExtentSize))
+	df.Close()
+	l, err := u.Versions("/d/dst")
+	assert.Nil(t, err)
+	assert.Equal(t, len(l), 1)
+
+	// Shared extents are subject to quota too
+	fs.SetQuotaLimits(QuotaUser, 42, QuotaLimits{HardBytes: 4 * dataExtentSize})
+	assert.True(t, u.CloneFile("/d/src", "/d/dst2") != nil)
+	fs.WithoutParallelWrites(func() {})
+	q := fs.GetQuota(QuotaUser, 42)
+	assert.True(t, q.Bytes <= 4*dataExtentSize)
+}
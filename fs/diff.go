@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/mlog"
+)
+
+// Diff describes what changed between two roots of the filesystem
+// (e.g. snapshots, or before and after a sync merge). The key-level
+// delta of the trees is grouped per inode, and the inodes are then
+// resolved to paths within the respective tree; deleted inodes have
+// the path they had in the old tree, and everything else the one
+// they have in the new one. Only the first path is used for inodes
+// with multiple links.
+//
+// Directories are not reported as modified when their entries
+// change, as those show up as changes of the entries themselves.
+
+var ErrRootNotFound = errors.New("Root not found")
+
+type DiffType int
+
+const (
+	DT_CREATED DiffType = iota
+	DT_DELETED
+	DT_MODIFIED
+	DT_RENAMED
+	DT_METADATA
+)
+
+func (self DiffType) String() string {
+	switch self {
+	case DT_CREATED:
+		return "created"
+	case DT_DELETED:
+		return "deleted"
+	case DT_MODIFIED:
+		return "modified"
+	case DT_RENAMED:
+		return "renamed"
+	case DT_METADATA:
+		return "metadata"
+	}
+	return fmt.Sprintf("DiffType(%d)", int(self))
+}
+
+type DiffEntry struct {
+	Type DiffType
+	Ino  uint64
+	Path string
+
+	// OldPath is the previous path of renamed inode
+	OldPath string
+}
+
+func (self DiffEntry) String() string {
+	if self.Type == DT_RENAMED {
+		return fmt.Sprintf("%v %s -> %s", self.Type, self.OldPath, self.Path)
+	}
+	return fmt.Sprintf("%v %s", self.Type, self.Path)
+}
+
+type diffChange struct {
+	data, xattr bool
+}
+
+// diffFs returns filesystem matching the spec (snapshot name or hex
+// root block id, or empty string for the current state).
+func (self *Fs) diffFs(spec string) *Fs {
+	if spec == "" {
+		if !self.readOnly {
+			self.WithoutParallelWrites(func() {})
+		}
+		return self
+	}
+	bid := ResolveRootBlockId(self.storage, self.RootName, spec)
+	if bid == "" {
+		return nil
+	}
+	return newReadOnlyFs(self.storage, bid, 0, self)
+}
+
+// Diff lists the changes from the root 'from' to the root 'to'. The
+// roots are specified as snapshot names or hex encoded root block
+// ids; empty string refers to the current state of the filesystem.
+// The result is sorted by path.
+func (self *Fs) Diff(from, to string) ([]DiffEntry, error) {
+	mlog.Printf2("fs/diff", "fs.Diff %s %s", from, to)
+	ofs := self.diffFs(from)
+	if ofs == nil {
+		return nil, ErrRootNotFound
+	}
+	if ofs != self {
+		defer ofs.Close()
+	}
+	nfs := self.diffFs(to)
+	if nfs == nil {
+		return nil, ErrRootNotFound
+	}
+	if nfs != self {
+		defer nfs.Close()
+	}
+	otr := ofs.GetNestableTransaction()
+	defer otr.Close()
+	ntr := nfs.GetNestableTransaction()
+	defer ntr.Close()
+	return diffTrees(otr.IB(), ntr.IB()), nil
+}
+
+func diffTrees(ot, nt *ibtree.Transaction) (l []DiffEntry) {
+	changes := make(map[uint64]*diffChange)
+	nt.Root().IterateDelta(ot.Root(),
+		func(oldC, newC *ibtree.NodeDataChild) {
+			c := oldC
+			if c == nil {
+				c = newC
+			}
+			k := BlockKey(c.Key)
+			ino := k.Ino()
+			if ino == fsIno || k.SubType() >= BST_LAST {
+				return
+			}
+			ch := changes[ino]
+			if ch == nil {
+				ch = &diffChange{}
+				changes[ino] = ch
+			}
+			switch k.SubType() {
+			case BST_FILE_OFFSET2EXTENT, BST_FILE_OFFSET2CHUNK:
+				ch.data = true
+			case BST_XATTR:
+				ch.xattr = true
+			}
+		})
+	for ino, ch := range changes {
+		var om, nm *InodeMeta
+		k := NewBlockKey(ino, BST_META, "").IB()
+		if v := ot.Get(k); v != nil {
+			om = decodeInodeMeta(*v)
+		}
+		if v := nt.Get(k); v != nil {
+			nm = decodeInodeMeta(*v)
+		}
+		switch {
+		case om == nil && nm == nil:
+			// data without metadata; fsck problem, not ours
+		case om == nil:
+			l = append(l, DiffEntry{Type: DT_CREATED, Ino: ino,
+				Path: inodePath(nt, ino)})
+		case nm == nil:
+			l = append(l, DiffEntry{Type: DT_DELETED, Ino: ino,
+				Path: inodePath(ot, ino)})
+		default:
+			path := inodePath(nt, ino)
+			if oldPath := inodePath(ot, ino); oldPath != path {
+				l = append(l, DiffEntry{Type: DT_RENAMED, Ino: ino,
+					Path: path, OldPath: oldPath})
+			}
+			if !nm.IsDir() && (ch.data || om.StSize != nm.StSize ||
+				om.StMtimeNs != nm.StMtimeNs ||
+				!bytes.Equal(om.Data, nm.Data)) {
+				l = append(l, DiffEntry{Type: DT_MODIFIED, Ino: ino,
+					Path: path})
+			} else if ch.xattr || om.StMode != nm.StMode ||
+				om.StUid != nm.StUid || om.StGid != nm.StGid ||
+				om.StRdev != nm.StRdev {
+				l = append(l, DiffEntry{Type: DT_METADATA, Ino: ino,
+					Path: path})
+			}
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Path != l[j].Path {
+			return l[i].Path < l[j].Path
+		}
+		return l[i].Type < l[j].Type
+	})
+	return
+}
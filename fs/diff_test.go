@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func diffStrings(t *testing.T, fs *Fs, from, to string) (l []string) {
+	entries, err := fs.Diff(from, to)
+	assert.Nil(t, err)
+	for _, e := range entries {
+		l = append(l, e.String())
+	}
+	return
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	assert.Nil(t, u.Mkdir("/dir", 0777))
+	writeTestFile(t, u, "/dir/same", "same")
+	writeTestFile(t, u, "/dir/modified", "foo")
+	writeTestFile(t, u, "/deleted", "foo")
+	writeTestFile(t, u, "/renamed", "foo")
+	writeTestFile(t, u, "/chmodded", "foo")
+	assert.Nil(t, fs.CreateSnapshot("a"))
+	assert.Equal(t, len(diffStrings(t, fs, "a", "")), 0)
+
+	f, err := u.OpenFile("/dir/modified", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("bar"))
+	assert.Nil(t, err)
+	f.Close()
+	writeTestFile(t, u, "/dir/created", "foo")
+	assert.Nil(t, u.Remove("/deleted"))
+	assert.Nil(t, u.Rename("/renamed", "/dir/renamed2"))
+	assert.Nil(t, u.Chmod("/chmodded", 0700))
+	assert.Nil(t, u.SetXAttr("/dir/same", "user.foo", []byte("bar")))
+	assert.Nil(t, fs.CreateSnapshot("b"))
+
+	assert.Equal(t, diffStrings(t, fs, "a", "b"), []string{
+		"metadata /chmodded",
+		"deleted /deleted",
+		"created /dir/created",
+		"modified /dir/modified",
+		"renamed /renamed -> /dir/renamed2",
+		"metadata /dir/same",
+	})
+
+	// Reverse direction, with hex root block id
+	bid := hex.EncodeToString([]byte(fs.SnapshotBlockId("b")))
+	assert.Equal(t, diffStrings(t, fs, bid, "a"), []string{
+		"metadata /chmodded",
+		"created /deleted",
+		"deleted /dir/created",
+		"modified /dir/modified",
+		"metadata /dir/same",
+		"renamed /dir/renamed2 -> /renamed",
+	})
+
+	_, err = fs.Diff("nonexistent", "")
+	assert.Equal(t, err, ErrRootNotFound)
+}
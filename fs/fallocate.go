@@ -0,0 +1,181 @@
+package fs
+
+import (
+	"syscall"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fallocate(2) mode flags
+const (
+	fallocKeepSize  uint32 = 0x01
+	fallocPunchHole uint32 = 0x02
+	fallocZeroRange uint32 = 0x10
+)
+
+// Fallocate implements fallocate(2) for the inode. As storage is
+// copy-on-write and deduplicated, there is nothing to reserve; plain
+// preallocation just changes the size (unless fallocKeepSize is
+// given). Holes are simply missing extents, so punching (or zeroing)
+// whole extents drops them, and partially covered extents are
+// rewritten. The whole operation happens in a single transaction.
+func (self *inode) Fallocate(offset, length uint64, mode uint32) fuse.Status {
+	mlog.Printf2("fs/fallocate", "inode.Fallocate #%d @%v %v mode:%x", self.ino, offset, length, mode)
+	if mode&^(fallocKeepSize|fallocPunchHole|fallocZeroRange) != 0 {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	punch := mode&fallocPunchHole != 0
+	zero := mode&fallocZeroRange != 0
+	if length == 0 || (punch && (zero || mode&fallocKeepSize == 0)) {
+		return fuse.EINVAL
+	}
+	end := offset + length
+	if end < offset || end > lockEnd {
+		return fuse.Status(syscall.EFBIG)
+	}
+
+	defer self.metaWriteLock.Locked()()
+	// Pending writes of the file have to land first; new ones cannot
+	// start as long as we hold the metaWriteLock.
+	self.Fs().WithoutParallelWrites(func() {})
+	meta := self.Meta()
+	if meta == nil {
+		return fuse.ENOENT
+	}
+	switch meta.StMode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+	case syscall.S_IFDIR:
+		return fuse.Status(syscall.EISDIR)
+	default:
+		return fuse.Status(syscall.ENODEV)
+	}
+
+	size := meta.StSize
+	if mode&fallocKeepSize == 0 && end > size {
+		size = end
+	}
+
+	if code := self.checkQuotaSize(size); !code.Ok() {
+		return code
+	}
+
+	zend := end
+	if zend > meta.StSize {
+		zend = meta.StSize
+	}
+	zeroing := (punch || zero) && offset < zend
+	if !zeroing && size == meta.StSize {
+		return fuse.OK
+	}
+
+	self.Fs().Update(func(tr *hugger.Transaction) {
+		meta := *meta
+		if zeroing {
+			self.zeroInTransaction(tr, &meta, offset, zend)
+		}
+		self.growInTransaction(&meta, size, tr)
+		meta.setTimesNow(false, true, true)
+		self.SetMetaInTransaction(&meta, tr)
+	})
+	return fuse.OK
+}
+
+// zeroInTransaction zeroes the range [start, end[ of the file.
+func (self *inode) zeroInTransaction(tr *hugger.Transaction, meta *InodeMeta, start, end uint64) {
+	if meta.StSize <= EmbeddedSize {
+		data := make([]byte, len(meta.Data))
+		copy(data, meta.Data)
+		for i := start; i < end && i < uint64(len(data)); i++ {
+			data[i] = 0
+		}
+		meta.Data = data
+		return
+	}
+	if self.useChunks(tr.IB()) {
+		self.zeroChunksInTransaction(tr, meta, start, end)
+		return
+	}
+	var extents []uint64
+	self.iterateExtents(tr.IB(), start, func(s, e uint64) bool {
+		if s >= end {
+			return false
+		}
+		extents = append(extents, s/dataExtentSize)
+		return true
+	})
+	for _, e := range extents {
+		self.zeroExtentInTransaction(tr, e, start, end)
+	}
+}
+
+// growInTransaction sets the size of the file, moving the embedded
+// data (if any) to the first extent if the file stops being small.
+// The first extent should be locked by the caller in that case.
+func (self *inode) growInTransaction(meta *InodeMeta, size uint64, tr *hugger.Transaction) {
+	if size > EmbeddedSize && meta.StSize <= EmbeddedSize && len(meta.Data) > 0 {
+		if self.useChunks(tr.IB()) {
+			self.setChunk(tr, 0, meta.Data)
+		} else {
+			b := append([]byte{byte(BDT_EXTENT)}, meta.Data...)
+			bl := self.Fs().GetStorageBlock(storage.BS_NORMAL, b, nil, &util.StringList{})
+			tr.IB().Set(NewBlockKeyOffset(self.ino, 0).IB(), bl.Id())
+		}
+	}
+	self.SetMetaSizeInTransaction(meta, size, tr)
+}
+
+// zeroExtentInTransaction zeroes the range [start, end[ of the file
+// within the e'th extent.
+func (self *inode) zeroExtentInTransaction(tr *hugger.Transaction, e, start, end uint64) {
+	eofs := e * dataExtentSize
+	if start < eofs {
+		start = eofs
+	}
+	if end > eofs+dataExtentSize {
+		end = eofs + dataExtentSize
+	}
+	start -= eofs
+	end -= eofs
+	k := NewBlockKeyOffset(self.ino, eofs).IB()
+	bidp := tr.IB().Get(k)
+	if bidp == nil {
+		return
+	}
+	if start == 0 && end == dataExtentSize {
+		mlog.Printf2("fs/fallocate", " dropping extent %d", e)
+		tr.IB().Delete(k)
+		return
+	}
+	bl := self.Fs().storage.GetBlockById(*bidp)
+	if bl == nil {
+		mlog.Panicf("Block %x not found at all", *bidp)
+	}
+	defer bl.Close()
+	b := bl.Data()
+	if uint64(len(b)) <= start+1 {
+		// Nothing stored within the range
+		return
+	}
+	nb := make([]byte, len(b))
+	copy(nb, b)
+	if uint64(len(nb)) <= end+1 {
+		// Tail is implicitly zero
+		nb = nb[:start+1]
+	} else {
+		for i := start + 1; i < end+1; i++ {
+			nb[i] = 0
+		}
+	}
+	if len(nb) == 1 {
+		mlog.Printf2("fs/fallocate", " extent %d now empty", e)
+		tr.IB().Delete(k)
+		return
+	}
+	mlog.Printf2("fs/fallocate", " rewrote extent %d", e)
+	nbl := self.Fs().GetStorageBlock(storage.BS_NORMAL, nb, nil, &util.StringList{})
+	tr.IB().Set(k, nbl.Id())
+}
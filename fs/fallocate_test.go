@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func countExtents(fs *Fs, ino uint64) (n int) {
+	tr := fs.GetTransaction()
+	defer tr.Close()
+	IterateInoSubTypeKeys(tr.IB(), ino, BST_FILE_OFFSET2EXTENT,
+		func(key BlockKey) bool {
+			n++
+			return true
+		})
+	return
+}
+
+func TestFallocate(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+
+	f, err := u.OpenFile("/file", uint32(os.O_CREATE|os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("small"))
+	assert.Nil(t, err)
+
+	// Unsupported modes are refused
+	assert.NotNil(t, f.Fallocate(0x8, 0, 1))
+	assert.NotNil(t, f.Fallocate(fallocPunchHole, 0, 1))
+
+	// KEEP_SIZE does not change size; plain preallocation grows
+	// it (and retains embedded content)
+	assert.Nil(t, f.Fallocate(fallocKeepSize, 0, 100000))
+	fi, err := u.Stat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), int64(5))
+
+	n := 4 * dataExtentSize
+	assert.Nil(t, f.Fallocate(0, 0, int64(n)))
+	fi, err = u.Stat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), int64(n))
+
+	b := make([]byte, 5)
+	f.Seek(0, 0)
+	_, err = f.Read(b)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "small")
+
+	// Fill the file with data
+	data := bytes.Repeat([]byte{42}, n)
+	f.Seek(0, 0)
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+	fs.WithoutParallelWrites(func() {})
+	assert.Equal(t, countExtents(fs, f.ino), 4)
+
+	// Punch hole covering one whole extent and parts of two
+	// others; whole one goes away
+	start := dataExtentSize / 2
+	end := 2*dataExtentSize + 10
+	assert.Nil(t, f.Fallocate(fallocPunchHole|fallocKeepSize, int64(start), int64(end-start)))
+	assert.Equal(t, countExtents(fs, f.ino), 3)
+	for i := start; i < end; i++ {
+		data[i] = 0
+	}
+
+	// Zero range past the end grows the file
+	assert.Nil(t, f.Fallocate(fallocZeroRange, int64(n-10), 20))
+	for i := n - 10; i < n; i++ {
+		data[i] = 0
+	}
+	data = append(data, make([]byte, 10)...)
+
+	fi, err = u.Stat("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), int64(len(data)))
+
+	rb := make([]byte, len(data))
+	f.Seek(0, 0)
+	for ofs := 0; ofs < len(rb); {
+		r, err := f.Read(rb[ofs:])
+		assert.Nil(t, err)
+		assert.True(t, r > 0)
+		ofs += r
+	}
+	assert.True(t, bytes.Equal(rb, data))
+}
@@ -13,14 +13,16 @@ package fs
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"syscall"
 
 	"github.com/fingon/go-tfhfs/ibtree/hugger"
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/util"
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 // inodeFH represents a single open instance of a file/directory.
@@ -35,6 +37,23 @@ type inodeFH struct {
 	// last key in directory at pos (if any)
 	lastKey *BlockKey
 
+	// versioned is set once the file has been versioned (if
+	// needed) for modifications through this handle
+	versioned bool
+
+	// unflushed is set if the file has been modified through
+	// the handle since the last fsync
+	unflushed bool
+
+	// write error sequence numbers (of inode and storage) up to
+	// which the errors have been reported to this handle
+	inodeErrorSeq, storageErrorSeq uint64
+
+	// chunkBuffer contains buffered writes to chunked file at
+	// chunkOffset (see writeChunked)
+	chunkBuffer []byte
+	chunkOffset uint64
+
 	// statistics for unit tests (these cost some memory but so what)
 	readNextInodeBruteForceCount int
 }
@@ -93,14 +112,13 @@ func (self *inodeFH) ReadDirEntry(l *fuse.DirEntryList) bool {
 	defer inode.Release()
 	name := nkey.Filename()
 	meta := inode.Meta()
-	e := fuse.DirEntry{Mode: meta.StMode, Name: name, Ino: inode.ino}
-	ok, npos := l.AddDirEntry(e)
-	if !ok {
+	e := fuse.DirEntry{Mode: meta.StMode, Name: name, Ino: self.Fs().nodeId(inode.ino)}
+	if !l.AddDirEntry(e) {
 		mlog.Printf2("fs/fh", "AddDirEntry failed")
 		return false
 	}
 	mlog.Printf2("fs/fh", " #%d %s", self.pos, name)
-	self.pos = npos
+	self.pos = l.Offset
 	self.lastKey = &nkey
 	return true
 }
@@ -113,8 +131,8 @@ func (self *inodeFH) ReadDirPlus(input *fuse.ReadIn, l *fuse.DirEntryList) bool
 	defer inode.Release()
 	name := nkey.Filename()
 	meta := inode.Meta()
-	e := fuse.DirEntry{Mode: meta.StMode, Name: name, Ino: inode.ino}
-	entry, npos := l.AddDirLookupEntry(e)
+	e := fuse.DirEntry{Mode: meta.StMode, Name: name, Ino: self.Fs().nodeId(inode.ino)}
+	entry := l.AddDirLookupEntry(e)
 	if entry == nil {
 		mlog.Printf2("fs/fh", "AddDirLookupEntry failed")
 		return false
@@ -122,7 +140,7 @@ func (self *inodeFH) ReadDirPlus(input *fuse.ReadIn, l *fuse.DirEntryList) bool
 	inode.FillEntryOut(entry)
 
 	// Move on with things
-	self.pos = npos
+	self.pos = l.Offset
 	self.lastKey = &nkey
 	return true
 }
@@ -136,9 +154,48 @@ func (self *inodeFH) Ops() *fsOps {
 }
 
 func (self *inodeFH) Release() {
+	self.Fs().chunkBufferLock.Do(self.flushChunkBuffer)
 	self.inode.tracker.RemoveFile(self)
 }
 
+// writeError returns the first error status of deferred writes that
+// has not been reported through this handle yet (if any). Storage
+// does not know which inodes its blocks belong to, so its failures
+// are reported to every handle open for writing at the time.
+func (self *inodeFH) writeError() (code fuse.Status) {
+	if self.flags&fuse.O_ANYWRITE == 0 {
+		return fuse.OK
+	}
+	var ierr, serr error
+	self.inodeErrorSeq, ierr = self.inode.writeErrors.Since(self.inodeErrorSeq)
+	self.storageErrorSeq, serr = self.Fs().storage.WriteErrorSince(self.storageErrorSeq)
+	if ierr == nil {
+		ierr = serr
+	}
+	if ierr == nil {
+		return fuse.OK
+	}
+	mlog.Printf2("fs/fh", "%v.writeError %v", self, ierr)
+	return errorToStatus(ierr)
+}
+
+// needsSync returns true if fsync of the handle has to flush the
+// tree: the file has been modified through it, or there are write
+// errors it has not reported yet.
+func (self *inodeFH) needsSync() bool {
+	return self.unflushed ||
+		self.inode.writeErrors.Seq() != self.inodeErrorSeq ||
+		self.Fs().storage.WriteErrorSeq() != self.storageErrorSeq
+}
+
+// errorToStatus maps write error to the status reported to the user.
+func errorToStatus(err error) fuse.Status {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fuse.Status(syscall.ENOSPC)
+	}
+	return fuse.EIO
+}
+
 func (self *inodeFH) SetPos(pos uint64) {
 	if self.pos == pos {
 		mlog.Printf2("fs/fh", "fh.SetPos still at %d", pos)
@@ -217,6 +274,18 @@ func (self *inodeFH) readInTransaction(tr *hugger.Transaction, buf []byte, offse
 }
 
 func (self *inodeFH) Read(buf []byte, offset uint64) (rr fuse.ReadResult, code fuse.Status) {
+	if self.chunked(0) {
+		self.Fs().flushChunkBuffers(self.inode)
+		tr := self.Fs().GetTransaction()
+		meta := self.inode.Meta()
+		r := 0
+		if meta != nil {
+			r = self.inode.readChunksInTransaction(tr.IB(), meta, buf, offset)
+		}
+		tr.Close()
+		rr = fuse.ReadResultData(buf[:r])
+		return
+	}
 	// ofs == offset in buf, offset == offset in file
 	ofs := 0
 	for ofs < len(buf) {
@@ -258,7 +327,7 @@ func (self *inodeFH) Read(buf []byte, offset uint64) (rr fuse.ReadResult, code f
 
 }
 
-func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction, buf, odata, obuf, wbuf []byte, bofs int, offset, end uint64) {
+func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction, buf, odata, obuf, wbuf []byte, bofs int, offset, end uint64) (code fuse.Status) {
 	if bofs > 0 {
 		// Clear the bytes (in case we're reusing buffer)
 		for i := 0; i < bofs; i++ {
@@ -270,7 +339,8 @@ func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction,
 			}
 			copy(wbuf, odata)
 		} else {
-			r, code := self.readInTransaction(tr, wbuf[:bofs], offset)
+			var r int
+			r, code = self.readInTransaction(tr, wbuf[:bofs], offset)
 			if !code.Ok() {
 				return
 			}
@@ -291,7 +361,8 @@ func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction,
 	}
 	if blockend > end {
 		extra := blockend - end
-		r, code := self.readInTransaction(tr, wbuf[:extra], end)
+		var r int
+		r, code = self.readInTransaction(tr, wbuf[:extra], end)
 		if !code.Ok() {
 			return
 		}
@@ -325,9 +396,19 @@ func (self *inodeFH) writeInTransaction(meta *InodeMeta, tr *hugger.Transaction,
 		// mlog.Printf2("fs/fh", " %x", buf)
 		tr.IB().Set(k.IB(), bid)
 	}
-
+	return
 }
+
 func (self *inodeFH) Write(buf []byte, offset uint64) (written uint32, code fuse.Status) {
+	self.saveVersionOnce()
+	self.unflushed = true
+	code = self.inode.checkQuotaSize(offset + uint64(len(buf)))
+	if !code.Ok() {
+		return
+	}
+	if self.chunked(offset + uint64(len(buf))) {
+		return self.writeChunked(buf, offset)
+	}
 	wwritten := len(buf)
 	for int(written) < wwritten {
 		w, code := self.write(buf[written:], offset+uint64(written))
@@ -437,8 +518,13 @@ func (self *inodeFH) write(buf []byte, offset uint64) (written uint32, code fuse
 		// We inherit the block-lock, and release only when we're done
 
 		tr := self.Fs().GetTransaction()
-		self.writeInTransaction(meta, tr, buf, odata, obuf, wbuf, bofs, offset, end)
+		code := self.writeInTransaction(meta, tr, buf, odata, obuf, wbuf, bofs, offset, end)
 		tr.CommitUntilSucceeds()
+		if !code.Ok() {
+			// The caller is long gone; report it on
+			// fsync/close instead
+			self.inode.writeErrors.Report(syscall.Errno(code))
+		}
 		mlog.Printf2("fs/fh", " updated data block %v", e)
 	})
 
@@ -27,7 +27,7 @@ import (
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/util"
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 const iterations = 1234
@@ -46,26 +46,93 @@ type Fs struct {
 	// These have their own locking or are used in single-threaded way
 	inodeTracker
 	hugger.Hugger
+	children      childTracker
 	closing       chan chan struct{}
 	deleted       deleteNotifyIChannel
 	flushInterval time.Duration
+	locks         lockManager
 	server        *fuse.Server
 	storage       *storage.Storage
 	writeLimiter  util.ParallelLimiter
 	writeBuffers  util.ByteSliceAtomicList
+
+	// parent is set for filesystems that are visible within
+	// other filesystem (e.g. snapshot views, hosted volumes)
+	parent *Fs
+
+	// subvolumeOf is set for subvolumes opened from other
+	// filesystem (see OpenSubvolume)
+	subvolumeOf *Fs
+
+	// subvolumes tracks the subvolumes opened from us
+	subvolumes subvolumeTracker
+
+	// volumes is set for filesystems that only host other
+	// filesystems (see NewVolumeHostFs)
+	volumes []string
+
+	// volumesTime is the time shown for the root of volume host
+	volumesTime time.Time
+
+	// sharedStorage is set for filesystems that share storage
+	// with some other filesystem (e.g. parent), and therefore
+	// must not close it
+	sharedStorage bool
+
+	// readOnly filesystems refuse all mutating operations with
+	// EROFS
+	readOnly bool
+
+	// chunking determines if data of new files is stored in
+	// content-defined chunks instead of fixed-size extents
+	chunking bool
+
+	// chunkBuffers are the file handles with buffered chunked
+	// writes (see inodeFH.writeChunked)
+	chunkBuffers    map[*inodeFH]bool
+	chunkBufferLock util.MutexLocked
+
+	// quotaGrace is the time soft quota limits may be exceeded
+	quotaGrace time.Duration
+
+	// inodeLimit is the maximum number of inodes (0 = no limit)
+	inodeLimit uint64
+
+	// replicaId identifies the filesystem in version vectors
+	replicaId uint64
 }
 
 func (self *Fs) Close() {
 
 	mlog.Printf2("fs/fs", "fs.Close")
 
-	// this will kill the underlying goroutine and ensure it has flushed
-	ch := make(chan struct{})
-	self.closing <- ch
-	<-ch
+	self.locks.Close()
+	self.children.Close()
+	self.flushChunkBuffers(nil)
+
+	if self.closing != nil {
+		// this will kill the underlying goroutine and ensure
+		// it has flushed
+		ch := make(chan struct{})
+		self.closing <- ch
+		<-ch
+	}
+
+	if self.readOnly || self.sharedStorage {
+		// read-only filesystems hold only reference to their
+		// root block, and ones sharing storage (e.g.
+		// subvolumes) have to let go of theirs
+		self.ReleaseRoot()
+	}
 
-	// then we can close storage (which will close backend)
-	self.storage.Close()
+	if !self.sharedStorage {
+		// then we can close storage (which will close backend)
+		self.storage.Close()
+	}
+
+	if self.subvolumeOf != nil {
+		self.subvolumeOf.subvolumes.add(self.RootName, -1)
+	}
 
 	mlog.Printf2("fs/fs", " great success at closing Fs")
 }
@@ -81,6 +148,12 @@ func (self *Fs) Flush() {
 // is binary garbage and I am too lazy to write a decoder for it.
 func (self *Fs) ListDir(ino uint64) (ret []string) {
 	mlog.Printf2("fs/fs", "Fs.ListDir #%d", ino)
+	if fs, cino := self.children.node(ino); fs != nil {
+		return fs.ListDir(cino)
+	}
+	if self.isVirtualDir(ino) {
+		return self.listVirtualDir(ino)
+	}
 	inode := self.GetInode(ino)
 	defer inode.Release()
 
@@ -113,31 +186,62 @@ func iterateNodeReferences(nd *ibtree.NodeData, cb storage.BlockReferenceCallbac
 		switch k.SubType() {
 		case BST_FILE_OFFSET2EXTENT:
 			cb(c.Value)
+		case BST_FILE_OFFSET2CHUNK:
+			cb(c.Value)
+		case BST_FILE_VERSION_DATA:
+			cb(c.Value)
 		case BST_NAMEHASH_NAME_BLOCK:
 			cb(c.Value)
 		}
 	}
 }
 
-func NewFs(st *storage.Storage, RootName string, cacheSize int) *Fs {
+func newFs(st *storage.Storage, cacheSize int) *Fs {
 	fs := &Fs{storage: st}
-	fs.RootName = RootName
 	fs.Hugger.Storage = st
 	fs.Hugger.IterateReferencesCallback = iterateNodeReferences
 	fs.MergeCallback = MergeTo3
 	(&fs.Hugger).Init(cacheSize)
 	fs.Ops.fs = fs
-	fs.closing = make(chan chan struct{})
-	fs.flushInterval = 1 * time.Second
 	fs.inodeTracker.Init(fs)
+	fs.children.Init(fs)
+	fs.locks.Init()
 	fs.writeLimiter.LimitPerCPU = 3 // somewhat IO bound
+	fs.quotaGrace = defaultQuotaGrace
+	fs.chunkBuffers = make(map[*inodeFH]bool)
 	fs.writeBuffers.New = func() []byte {
 		return make([]byte, dataExtentSize+dataHeaderMaximumSize)
 	}
-	st.IterateReferencesCallback = func(id string, data []byte, cb storage.BlockReferenceCallback) {
-		fs.iterateReferencesCallback(id, data, cb)
+	return fs
+}
+
+func NewFs(st *storage.Storage, RootName string, cacheSize int) *Fs {
+	return newNamedFs(st, RootName, cacheSize, nil, false)
+}
+
+// newNamedFs provides filesystem rooted at the given name. If shared
+// is set, the storage is shared with some other filesystem (and
+// left open on close). If parent is set, the filesystem is visible
+// within it.
+func newNamedFs(st *storage.Storage, RootName string, cacheSize int, parent *Fs, shared bool) *Fs {
+	fs := newFs(st, cacheSize)
+	fs.RootName = RootName
+	fs.parent = parent
+	fs.sharedStorage = shared
+	fs.flushInterval = 1 * time.Second
+	// Read-only storage implies read-only filesystem, without
+	// flushing goroutine of its own
+	fs.readOnly = st.ReadOnly
+	if !shared {
+		st.IterateReferencesCallback = func(id string, data []byte, cb storage.BlockReferenceCallback) {
+			fs.iterateReferencesCallback(id, data, cb)
+		}
 	}
-	if fs.RootIsNew() {
+	rootIsNew := fs.RootIsNew()
+	if !fs.readOnly {
+		fs.initReplicaId()
+	}
+	if rootIsNew {
 		// getInode succeeds always; Get does not
 		defer fs.inodeLock.Locked()()
 		root := fs.getInode(fuse.FUSE_ROOT_ID)
@@ -149,20 +253,32 @@ func NewFs(st *storage.Storage, RootName string, cacheSize int) *Fs {
 			root.SetMetaInTransaction(&meta, tr)
 		})
 	}
+	if fs.readOnly {
+		return fs
+	}
+	fs.initCounters()
+	fs.closing = make(chan chan struct{})
 	go func() { // ok, singleton per fs
 		for {
 			select {
 			case deleted := <-fs.deleted.Channel():
-				if fs.server != nil {
-					fs.server.DeleteNotify(deleted.Parent,
-						deleted.Child,
-						deleted.Name)
+				parent := fs.nodeId(deleted.Parent)
+				child := fs.nodeId(deleted.Child)
+				// (Kernel does not know the nodes it has
+				// not looked up)
+				if server := fs.fuseServer(); server != nil && parent != 0 && child != 0 {
+					server.DeleteNotify(parent, child, deleted.Name)
 				}
 			case done := <-fs.closing:
 				fs.Flush()
 				done <- struct{}{}
 				return
 			case <-time.After(fs.flushInterval):
+				fs.runSnapshotSchedule(time.Now())
+				fs.expireTrash(time.Now())
+				// Buffered chunk data should reach the
+				// disk with the sizes already in the tree
+				fs.flushChunkBuffers(nil)
 				fs.Flush()
 			}
 		}
@@ -171,6 +287,21 @@ func NewFs(st *storage.Storage, RootName string, cacheSize int) *Fs {
 	return fs
 }
 
+// newReadOnlyFs provides read-only view of the filesystem rooted at
+// the given block id. It does not have flushing goroutine of its own,
+// and it shares storage with the parent (if any); closing it merely
+// releases the root block. Returns nil if the block does not exist.
+func newReadOnlyFs(st *storage.Storage, bid string, cacheSize int, parent *Fs) *Fs {
+	fs := newFs(st, cacheSize)
+	fs.readOnly = true
+	fs.parent = parent
+	fs.sharedStorage = parent != nil
+	if !fs.LoadRootBlockId(bid) {
+		return nil
+	}
+	return fs
+}
+
 func (self *Fs) hasExternalReferences(id string) bool {
 	return false
 }
@@ -210,6 +341,7 @@ func BytesToNodeData(bd []byte) *ibtree.NodeData {
 // that all pending data has been written to Storage (which will
 // persist it eventually).
 func (self *Fs) WithoutParallelWrites(cb func()) {
+	self.flushChunkBuffers(nil)
 	self.writeLimiter.Exclusive(cb)
 }
 
@@ -37,6 +37,17 @@ const (
 	BST_FILE_INODEFILENAME BlockSubType = 0x20
 	// key: 8 byte offset, value: data block id (for data @ offset)
 	BST_FILE_OFFSET2EXTENT BlockSubType = 0x21
+	// key: 8 byte byte offset, value: data block id (for
+	// variable-size chunk starting @ offset)
+	BST_FILE_OFFSET2CHUNK BlockSubType = 0x22
+	// key: (empty), value: 8 byte deletion time (ns) + original path
+	// (of inode in trash)
+	BST_TRASH_INFO BlockSubType = 0x23
+	// key: 8 byte version id, value: InodeMeta (of file version)
+	BST_FILE_VERSION BlockSubType = 0x24
+	// key: 8 byte version id + 1 byte subtype + data of the
+	// OFFSET2EXTENT/OFFSET2CHUNK key, value: data block id
+	BST_FILE_VERSION_DATA BlockSubType = 0x25
 
 	// should not occur in real world
 	// (can be used as end-of-range marker)
@@ -47,8 +58,54 @@ const (
 	//BST_FS_DATA = 0x30
 
 	BST_NAMEHASH_NAME_BLOCK BlockSubType = 0x30
+
+	// key: snapshot name, value: nothing (the snapshot root
+	// block is held by name in storage)
+	// (this should be only in fsIno pseudo-inode)
+	BST_SNAPSHOT BlockSubType = 0x40
+
+	// key: 1 byte QuotaType, 4 byte uid/gid, value: Quota
+	// (this should be only in fsIno pseudo-inode)
+	BST_QUOTA BlockSubType = 0x41
+
+	// key: counter name, value: 8 byte count
+	// (this should be only in fsIno pseudo-inode)
+	BST_COUNTER BlockSubType = 0x42
+
+	// key: configuration item name, value: depends on the item
+	// (this should be only in fsIno pseudo-inode)
+	BST_CONFIG BlockSubType = 0x43
+
+	// key: subvolume name, value: nothing (the subvolume root
+	// block is held by name in storage)
+	// (this should be only in fsIno pseudo-inode)
+	BST_SUBVOLUME BlockSubType = 0x44
+
+	// key: 8 byte inode (of conflict copy), value: 8 byte inode (of
+	// the original) + 8 byte time (ns) + peer name
+	// (this should be only in fsIno pseudo-inode)
+	BST_CONFLICT BlockSubType = 0x45
+
+	// key: peer name + 0 byte + 8 byte inode (of the peer), value:
+	// 8 byte inode (ours) for the subtree synchronization
+	// (this should be only in fsIno pseudo-inode)
+	BST_SUBTREE_INO BlockSubType = 0x46
+
+	// key: 8 byte inode excluded by synchronization filters, value:
+	// empty (this should be only in fsIno pseudo-inode, and only
+	// in subtree exports)
+	BST_NOSYNC_INO BlockSubType = 0x47
 )
 
+// fsIno is pseudo-inode which is used to store filesystem-wide
+// data. It has no metadata and is therefore never synchronized.
+const fsIno uint64 = 0
+
+// VersionVector is encoded as sorted list of 8 byte replica id + 8
+// byte counter pairs. It is a string so that InodeMetaData remains
+// comparable.
+type VersionVector string
+
 type InodeMetaData struct {
 	// int64 st_ino = 1;
 	// ^ part of key, not data
@@ -66,6 +123,10 @@ type InodeMetaData struct {
 
 	// What is ino of our parent (directory-only)
 	ParentIno uint64 `zid:"9"`
+
+	// Causal history of the inode (see VersionVector); absent in
+	// metadata written by older versions
+	VersionVector VersionVector `zid:"10"`
 }
 
 type InodeMeta struct {
@@ -11,9 +11,9 @@ import (
 func (z *BlockSubType) DecodeMsg(dc *msgp.Reader) (err error) {
 
 	{
-		var zgensym_83ac265a46b03003_0 byte
-		zgensym_83ac265a46b03003_0, err = dc.ReadByte()
-		(*z) = BlockSubType(zgensym_83ac265a46b03003_0)
+		var zgensym_662221b1890454b5_0 byte
+		zgensym_662221b1890454b5_0, err = dc.ReadByte()
+		(*z) = BlockSubType(zgensym_662221b1890454b5_0)
 	}
 	if err != nil {
 		return
@@ -63,13 +63,13 @@ func (z *BlockSubType) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig)
 	}
 
 	{
-		var zgensym_83ac265a46b03003_1 byte
-		zgensym_83ac265a46b03003_1, bts, err = nbs.ReadByteBytes(bts)
+		var zgensym_662221b1890454b5_1 byte
+		zgensym_662221b1890454b5_1, bts, err = nbs.ReadByteBytes(bts)
 
 		if err != nil {
 			return
 		}
-		(*z) = BlockSubType(zgensym_83ac265a46b03003_1)
+		(*z) = BlockSubType(zgensym_662221b1890454b5_1)
 	}
 	if sawTopNil {
 		bts = nbs.PopAlwaysNil()
@@ -92,13 +92,13 @@ func (z BlockSubType) Msgsize() (s int) {
 // We treat empty fields as if we read a Nil from the wire.
 func (z *InodeMeta) DecodeMsg(dc *msgp.Reader) (err error) {
 
-	var zgensym_83ac265a46b03003_2 uint32
-	zgensym_83ac265a46b03003_2, err = dc.ReadArrayHeader()
+	var zgensym_662221b1890454b5_2 uint32
+	zgensym_662221b1890454b5_2, err = dc.ReadArrayHeader()
 	if err != nil {
 		return
 	}
-	if zgensym_83ac265a46b03003_2 != 2 {
-		err = msgp.ArrayError{Wanted: 2, Got: zgensym_83ac265a46b03003_2}
+	if zgensym_662221b1890454b5_2 != 2 {
+		err = msgp.ArrayError{Wanted: 2, Got: zgensym_662221b1890454b5_2}
 		return
 	}
 	err = z.InodeMetaData.DecodeMsg(dc)
@@ -178,13 +178,13 @@ func (z *InodeMeta) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig) (o
 		bts = nbs.PushAlwaysNil(bts[1:])
 	}
 
-	var zgensym_83ac265a46b03003_3 uint32
-	zgensym_83ac265a46b03003_3, bts, err = nbs.ReadArrayHeaderBytes(bts)
+	var zgensym_662221b1890454b5_3 uint32
+	zgensym_662221b1890454b5_3, bts, err = nbs.ReadArrayHeaderBytes(bts)
 	if err != nil {
 		return
 	}
-	if zgensym_83ac265a46b03003_3 != 2 {
-		err = msgp.ArrayError{Wanted: 2, Got: zgensym_83ac265a46b03003_3}
+	if zgensym_662221b1890454b5_3 != 2 {
+		err = msgp.ArrayError{Wanted: 2, Got: zgensym_662221b1890454b5_3}
 		return
 	}
 	bts, err = z.InodeMetaData.UnmarshalMsg(bts)
@@ -227,13 +227,13 @@ func (z *InodeMeta) Msgsize() (s int) {
 // We treat empty fields as if we read a Nil from the wire.
 func (z *InodeMetaData) DecodeMsg(dc *msgp.Reader) (err error) {
 
-	var zgensym_83ac265a46b03003_4 uint32
-	zgensym_83ac265a46b03003_4, err = dc.ReadArrayHeader()
+	var zgensym_662221b1890454b5_4 uint32
+	zgensym_662221b1890454b5_4, err = dc.ReadArrayHeader()
 	if err != nil {
 		return
 	}
-	if zgensym_83ac265a46b03003_4 != 10 {
-		err = msgp.ArrayError{Wanted: 10, Got: zgensym_83ac265a46b03003_4}
+	if zgensym_662221b1890454b5_4 != 11 {
+		err = msgp.ArrayError{Wanted: 11, Got: zgensym_662221b1890454b5_4}
 		return
 	}
 	z.StMode, err = dc.ReadUint32()
@@ -276,6 +276,14 @@ func (z *InodeMetaData) DecodeMsg(dc *msgp.Reader) (err error) {
 	if err != nil {
 		return
 	}
+	{
+		var zgensym_662221b1890454b5_5 string
+		zgensym_662221b1890454b5_5, err = dc.ReadString()
+		z.VersionVector = VersionVector(zgensym_662221b1890454b5_5)
+	}
+	if err != nil {
+		return
+	}
 	if p, ok := interface{}(z).(msgp.PostLoad); ok {
 		p.PostLoadHook()
 	}
@@ -289,8 +297,8 @@ func (z *InodeMetaData) EncodeMsg(en *msgp.Writer) (err error) {
 		p.PreSaveHook()
 	}
 
-	// array header, size 10
-	err = en.Append(0x9a)
+	// array header, size 11
+	err = en.Append(0x9b)
 	if err != nil {
 		return err
 	}
@@ -334,6 +342,10 @@ func (z *InodeMetaData) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	err = en.WriteString(string(z.VersionVector))
+	if err != nil {
+		return
+	}
 	return
 }
 
@@ -344,8 +356,8 @@ func (z *InodeMetaData) MarshalMsg(b []byte) (o []byte, err error) {
 	}
 
 	o = msgp.Require(b, z.Msgsize())
-	// array header, size 10
-	o = append(o, 0x9a)
+	// array header, size 11
+	o = append(o, 0x9b)
 	o = msgp.AppendUint32(o, z.StMode)
 	o = msgp.AppendUint32(o, z.StRdev)
 	o = msgp.AppendUint32(o, z.StUid)
@@ -356,6 +368,7 @@ func (z *InodeMetaData) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.AppendUint64(o, z.StSize)
 	o = msgp.AppendUint32(o, z.StNlink)
 	o = msgp.AppendUint64(o, z.ParentIno)
+	o = msgp.AppendString(o, string(z.VersionVector))
 	return
 }
 
@@ -372,13 +385,13 @@ func (z *InodeMetaData) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig)
 		bts = nbs.PushAlwaysNil(bts[1:])
 	}
 
-	var zgensym_83ac265a46b03003_5 uint32
-	zgensym_83ac265a46b03003_5, bts, err = nbs.ReadArrayHeaderBytes(bts)
+	var zgensym_662221b1890454b5_6 uint32
+	zgensym_662221b1890454b5_6, bts, err = nbs.ReadArrayHeaderBytes(bts)
 	if err != nil {
 		return
 	}
-	if zgensym_83ac265a46b03003_5 != 10 {
-		err = msgp.ArrayError{Wanted: 10, Got: zgensym_83ac265a46b03003_5}
+	if zgensym_662221b1890454b5_6 != 11 {
+		err = msgp.ArrayError{Wanted: 11, Got: zgensym_662221b1890454b5_6}
 		return
 	}
 	z.StMode, bts, err = nbs.ReadUint32Bytes(bts)
@@ -431,6 +444,15 @@ func (z *InodeMetaData) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig)
 	if err != nil {
 		return
 	}
+	{
+		var zgensym_662221b1890454b5_7 string
+		zgensym_662221b1890454b5_7, bts, err = nbs.ReadStringBytes(bts)
+
+		if err != nil {
+			return
+		}
+		z.VersionVector = VersionVector(zgensym_662221b1890454b5_7)
+	}
 	if sawTopNil {
 		bts = nbs.PopAlwaysNil()
 	}
@@ -444,6 +466,88 @@ func (z *InodeMetaData) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig)
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *InodeMetaData) Msgsize() (s int) {
-	s = 1 + msgp.Uint32Size + msgp.Uint32Size + msgp.Uint32Size + msgp.Uint32Size + msgp.Uint64Size + msgp.Uint64Size + msgp.Uint64Size + msgp.Uint64Size + msgp.Uint32Size + msgp.Uint64Size
+	s = 1 + msgp.Uint32Size + msgp.Uint32Size + msgp.Uint32Size + msgp.Uint32Size + msgp.Uint64Size + msgp.Uint64Size + msgp.Uint64Size + msgp.Uint64Size + msgp.Uint32Size + msgp.Uint64Size + msgp.StringPrefixSize + len(string(z.VersionVector))
+	return
+}
+
+// DecodeMsg implements msgp.Decodable
+// We treat empty fields as if we read a Nil from the wire.
+func (z *VersionVector) DecodeMsg(dc *msgp.Reader) (err error) {
+
+	{
+		var zgensym_662221b1890454b5_8 string
+		zgensym_662221b1890454b5_8, err = dc.ReadString()
+		(*z) = VersionVector(zgensym_662221b1890454b5_8)
+	}
+	if err != nil {
+		return
+	}
+	if p, ok := interface{}(z).(msgp.PostLoad); ok {
+		p.PostLoadHook()
+	}
+
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z VersionVector) EncodeMsg(en *msgp.Writer) (err error) {
+	if p, ok := interface{}(z).(msgp.PreSave); ok {
+		p.PreSaveHook()
+	}
+
+	err = en.WriteString(string(z))
+	if err != nil {
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z VersionVector) MarshalMsg(b []byte) (o []byte, err error) {
+	if p, ok := interface{}(z).(msgp.PreSave); ok {
+		p.PreSaveHook()
+	}
+
+	o = msgp.Require(b, z.Msgsize())
+	o = msgp.AppendString(o, string(z))
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *VersionVector) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	return z.UnmarshalMsgWithCfg(bts, nil)
+}
+func (z *VersionVector) UnmarshalMsgWithCfg(bts []byte, cfg *msgp.RuntimeConfig) (o []byte, err error) {
+	var nbs msgp.NilBitsStack
+	nbs.Init(cfg)
+	var sawTopNil bool
+	if msgp.IsNil(bts) {
+		sawTopNil = true
+		bts = nbs.PushAlwaysNil(bts[1:])
+	}
+
+	{
+		var zgensym_662221b1890454b5_9 string
+		zgensym_662221b1890454b5_9, bts, err = nbs.ReadStringBytes(bts)
+
+		if err != nil {
+			return
+		}
+		(*z) = VersionVector(zgensym_662221b1890454b5_9)
+	}
+	if sawTopNil {
+		bts = nbs.PopAlwaysNil()
+	}
+	o = bts
+	if p, ok := interface{}(z).(msgp.PostLoad); ok {
+		p.PostLoadHook()
+	}
+
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z VersionVector) Msgsize() (s int) {
+	s = msgp.StringPrefixSize + len(string(z))
 	return
 }
@@ -0,0 +1,400 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Fsck checks the consistency of the namespace within the tree:
+//
+// - directory entries (BST_DIR_NAME2INODE) refer to existing inodes
+// from existing directories, and have matching reverse entries
+// (BST_FILE_INODEFILENAME), and vice versa
+//
+// - StNlink matches the number of entries, and ParentIno of
+// directories the directory they are in
+//
+// - every inode is reachable from the root, and there is no data of
+// inodes without metadata
+//
+// - the usage counters, and the quota usage of each uid and gid,
+// match the inode metadata
+//
+// Unreachable inodes are moved to lostFoundName directory in the
+// root when repairing. Fsck works directly on the tree, so it should
+// be used only on filesystem that is not in use (e.g. not mounted).
+
+const lostFoundName = "lost+found"
+
+type fsckEntry struct {
+	dir   uint64
+	name  string
+	child uint64
+}
+
+func (self fsckEntry) String() string {
+	return fmt.Sprintf("#%d/%s=#%d", self.dir, self.name, self.child)
+}
+
+// entryString describes the entry, including the paths of the
+// directory it is in (if any).
+func (self *fsck) entryString(e fsckEntry) string {
+	paths := inodePaths(self.tr.IB(), e.dir)
+	if len(paths) == 0 {
+		return e.String()
+	}
+	return fmt.Sprintf("%v %s", e, path.Join(paths[0], e.name))
+}
+
+func (self *fsck) inoString(ino uint64) string {
+	return inodeString(self.tr.IB(), ino)
+}
+
+type fsck struct {
+	fs     *Fs
+	tr     *hugger.Transaction
+	repair bool
+
+	problems []string
+
+	metas   map[uint64]*InodeMeta
+	entries map[fsckEntry]ibtree.Key
+	reverse map[fsckEntry]bool
+	strays  map[uint64]bool
+
+	// links contains the valid entries of each inode
+	links map[uint64][]fsckEntry
+}
+
+func (self *fsck) problem(format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	mlog.Printf2("fs/fsck", "problem: %s", s)
+	self.problems = append(self.problems, s)
+}
+
+func (self *fsck) scan() {
+	t := self.tr.IB()
+	k := ibtree.Key("")
+	for {
+		nkeyp := t.NextKey(k)
+		if nkeyp == nil {
+			return
+		}
+		k = *nkeyp
+		bk := BlockKey(k)
+		ino := bk.Ino()
+		if len(bk) <= inodeDataLength || ino == fsIno || bk.SubType() >= BST_LAST {
+			continue
+		}
+		switch bk.SubType() {
+		case BST_META:
+			self.metas[ino] = decodeInodeMeta(*t.Get(k))
+			delete(self.strays, ino)
+			continue
+		case BST_DIR_NAME2INODE:
+			child := binary.BigEndian.Uint64([]byte(*t.Get(k)))
+			self.entries[fsckEntry{ino, bk.Filename(), child}] = k
+		case BST_FILE_INODEFILENAME:
+			b := []byte(bk.SubTypeData())
+			dir := binary.BigEndian.Uint64(b)
+			self.reverse[fsckEntry{dir, string(b[8:]), ino}] = true
+		}
+		if self.metas[ino] == nil {
+			self.strays[ino] = true
+		}
+	}
+}
+
+func (self *fsck) sortedEntries() (l []fsckEntry) {
+	for e := range self.entries {
+		l = append(l, e)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].dir != l[j].dir {
+			return l[i].dir < l[j].dir
+		}
+		return l[i].name < l[j].name
+	})
+	return
+}
+
+func (self *fsck) sortedInos() (l []uint64) {
+	for ino := range self.metas {
+		l = append(l, ino)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return
+}
+
+func (self *fsck) addEntry(e fsckEntry) {
+	self.entries[e] = NewBlockKeyDirFilename(e.dir, e.name).IB()
+	self.reverse[e] = true
+	self.links[e.child] = append(self.links[e.child], e)
+	if self.repair {
+		t := self.tr.IB()
+		t.Set(NewBlockKeyDirFilename(e.dir, e.name).IB(), string(util.Uint64Bytes(e.child)))
+		t.Set(NewBlockKeyReverseDirFilename(e.child, e.dir, e.name).IB(), "")
+	}
+}
+
+func (self *fsck) removeEntry(e fsckEntry) {
+	k := self.entries[e]
+	hadReverse := self.reverse[e]
+	delete(self.entries, e)
+	delete(self.reverse, e)
+	l := self.links[e.child]
+	for i, e2 := range l {
+		if e2 == e {
+			self.links[e.child] = append(l[:i:i], l[i+1:]...)
+			break
+		}
+	}
+	if self.repair {
+		t := self.tr.IB()
+		if k != "" {
+			t.Delete(k)
+		}
+		if hadReverse {
+			t.Delete(NewBlockKeyReverseDirFilename(e.child, e.dir, e.name).IB())
+		}
+	}
+}
+
+func (self *fsck) checkEntries() {
+	for _, e := range self.sortedEntries() {
+		dmeta := self.metas[e.dir]
+		switch {
+		case dmeta == nil:
+			self.problem("%s: directory does not exist", self.entryString(e))
+		case !dmeta.IsDir():
+			self.problem("%s: not in directory", self.entryString(e))
+		case self.metas[e.child] == nil:
+			self.problem("%s: inode does not exist", self.entryString(e))
+		default:
+			if NewBlockKeyDirFilename(e.dir, e.name).IB() != self.entries[e] {
+				self.problem("%s: wrong key", self.entryString(e))
+				self.removeEntry(e)
+				self.addEntry(e)
+				continue
+			}
+			if !self.reverse[e] {
+				self.problem("%s: reverse entry missing", self.entryString(e))
+				self.removeEntry(e)
+				self.addEntry(e)
+				continue
+			}
+			self.links[e.child] = append(self.links[e.child], e)
+			continue
+		}
+		self.removeEntry(e)
+	}
+	for e := range self.reverse {
+		if _, ok := self.entries[e]; !ok {
+			self.problem("%s: reverse entry without entry", self.entryString(e))
+			self.removeEntry(e)
+		}
+	}
+	for _, ino := range self.sortedInos() {
+		l := self.links[ino]
+		if len(l) > 1 && self.metas[ino].IsDir() {
+			self.problem("%s: directory in %d places", self.inoString(ino), len(l))
+			for _, e := range l[1:] {
+				self.removeEntry(e)
+			}
+		}
+	}
+}
+
+// unreachable returns the inodes not reachable from the root.
+func (self *fsck) unreachable() (l []uint64) {
+	children := make(map[uint64][]uint64)
+	for e := range self.entries {
+		children[e.dir] = append(children[e.dir], e.child)
+	}
+	seen := map[uint64]bool{fuse.FUSE_ROOT_ID: true}
+	todo := []uint64{fuse.FUSE_ROOT_ID}
+	for len(todo) > 0 {
+		ino := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for _, child := range children[ino] {
+			if !seen[child] {
+				seen[child] = true
+				todo = append(todo, child)
+			}
+		}
+	}
+	for _, ino := range self.sortedInos() {
+		if !seen[ino] {
+			l = append(l, ino)
+		}
+	}
+	return
+}
+
+func (self *fsck) lostFound() uint64 {
+	name := lostFoundName
+	for e := range self.entries {
+		if e.dir == fuse.FUSE_ROOT_ID && e.name == name && self.metas[e.child].IsDir() {
+			return e.child
+		}
+	}
+	inode := self.fs.CreateInode()
+	ino := inode.ino
+	inode.Release()
+	meta := &InodeMeta{}
+	meta.StMode = fuse.S_IFDIR | 0700
+	meta.StNlink = 1
+	meta.ParentIno = fuse.FUSE_ROOT_ID
+	meta.setTimesNow(true, true, true)
+	self.metas[ino] = meta
+	self.setMeta(ino, nil)
+	self.addEntry(fsckEntry{fuse.FUSE_ROOT_ID, name, ino})
+	return ino
+}
+
+func (self *fsck) checkReachability() {
+	l := self.unreachable()
+	for _, ino := range l {
+		self.problem("#%d: not reachable", ino)
+	}
+	if !self.repair || len(l) == 0 {
+		return
+	}
+	lf := self.lostFound()
+	for len(l) > 0 {
+		// Move the unreachable inodes without entries (or,
+		// if there are only cycles, first directory in one)
+		var moved []uint64
+		for _, ino := range l {
+			if len(self.links[ino]) == 0 {
+				moved = append(moved, ino)
+			}
+		}
+		if len(moved) == 0 {
+			ino := l[0]
+			for _, e := range self.links[ino] {
+				self.removeEntry(e)
+			}
+			moved = append(moved, ino)
+		}
+		for _, ino := range moved {
+			mlog.Printf2("fs/fsck", " moving #%d to %s", ino, lostFoundName)
+			self.addEntry(fsckEntry{lf, fmt.Sprintf("#%d", ino), ino})
+		}
+		l = self.unreachable()
+	}
+}
+
+func (self *fsck) setMeta(ino uint64, old *InodeMeta) {
+	if !self.repair {
+		return
+	}
+	meta := self.metas[ino]
+	b, err := meta.MarshalMsg(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	var omd *InodeMetaData
+	if old != nil {
+		omd = &old.InodeMetaData
+	}
+	chargeUsageInTransaction(self.tr.IB(), omd, &meta.InodeMetaData)
+	self.tr.IB().Set(NewBlockKey(ino, BST_META, "").IB(), string(b))
+}
+
+func (self *fsck) checkMetas() {
+	for _, ino := range self.sortedInos() {
+		meta := self.metas[ino]
+		old := *meta
+		l := self.links[ino]
+		nlink := uint32(len(l))
+		var parent uint64
+		if ino == fuse.FUSE_ROOT_ID {
+			nlink++
+		} else if meta.IsDir() && len(l) > 0 {
+			parent = l[0].dir
+		}
+		if meta.StNlink != nlink {
+			self.problem("%s: link count %d != %d", self.inoString(ino), meta.StNlink, nlink)
+			meta.StNlink = nlink
+		}
+		if meta.IsDir() && meta.ParentIno != parent {
+			self.problem("%s: parent #%d != #%d", self.inoString(ino), meta.ParentIno, parent)
+			meta.ParentIno = parent
+		}
+		if meta.InodeMetaData != old.InodeMetaData {
+			self.setMeta(ino, &old)
+		}
+	}
+}
+
+func (self *fsck) checkStrays() {
+	for ino := range self.strays {
+		self.problem("#%d: data without metadata", ino)
+		if self.repair {
+			self.tr.IB().DeleteRange(NewBlockKey(ino, BST_NONE, "").IB(),
+				NewBlockKey(ino, BST_LAST, "").IB())
+		}
+	}
+}
+
+func (self *fsck) checkCounters() {
+	// (Without repair the transaction is not committed)
+	for _, s := range rebuildCountersInTransaction(self.tr.IB()) {
+		self.problem("counter %s", s)
+	}
+}
+
+func (self *fsck) checkQuotas() {
+	// (Without repair the transaction is not committed)
+	for _, s := range rebuildQuotaUsageInTransaction(self.tr.IB()) {
+		self.problem("quota %s", s)
+	}
+}
+
+// Fsck checks the namespace consistency of the filesystem, and
+// returns the problems found. If repair is set, the problems are
+// also fixed.
+func (self *Fs) Fsck(repair bool) (problems []string) {
+	mlog.Printf2("fs/fsck", "fs.Fsck repair:%v", repair)
+	if repair && self.readOnly {
+		return []string{ErrReadOnly.Error()}
+	}
+	self.WithoutParallelWrites(func() {})
+	self.Update2(func(tr *hugger.Transaction) bool {
+		f := &fsck{fs: self, tr: tr, repair: repair,
+			metas:   make(map[uint64]*InodeMeta),
+			entries: make(map[fsckEntry]ibtree.Key),
+			reverse: make(map[fsckEntry]bool),
+			strays:  make(map[uint64]bool),
+			links:   make(map[uint64][]fsckEntry)}
+		f.scan()
+		if f.metas[fuse.FUSE_ROOT_ID] == nil {
+			f.problem("root inode missing")
+			problems = f.problems
+			return false
+		}
+		f.checkStrays()
+		f.checkEntries()
+		f.checkReachability()
+		f.checkMetas()
+		f.checkCounters()
+		f.checkQuotas()
+		problems = f.problems
+		return repair && len(problems) > 0
+	})
+	if repair && len(problems) > 0 {
+		// Cached metadata is no longer valid
+		self.inodeTracker.flushMetaCache()
+	}
+	return
+}
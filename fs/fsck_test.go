@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func TestFsck(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+
+	assert.Nil(t, u.Mkdir("/dir", 0777))
+	writeTestFile(t, u, "/dir/a", "foo")
+	writeTestFile(t, u, "/dir/b", "bar")
+	writeTestFile(t, u, "/c", "baz")
+	lookup := func(path string) uint64 {
+		defer u.lock.Locked()()
+		var eo fuse.EntryOut
+		assert.Nil(t, u.lookup(path, &eo))
+		return eo.NodeId
+	}
+	dino := lookup("/dir")
+	aino := lookup("/dir/a")
+	bino := lookup("/dir/b")
+	cino := lookup("/c")
+
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+
+	fs.WithoutParallelWrites(func() {})
+	fs.Update(func(htr *hugger.Transaction) {
+		tr := htr.IB()
+		// Orphan /dir/a
+		tr.Delete(NewBlockKeyDirFilename(dino, "a").IB())
+		tr.Delete(NewBlockKeyReverseDirFilename(aino, dino, "a").IB())
+		// Lose reverse entry of /dir/b
+		tr.Delete(NewBlockKeyReverseDirFilename(bino, dino, "b").IB())
+		// Dangling entry
+		tr.Set(NewBlockKeyDirFilename(dino, "x").IB(),
+			string(util.Uint64Bytes(123456)))
+		// Data without metadata
+		tr.Set(NewBlockKey(123457, BST_XATTR, "foo").IB(), "bar")
+		// Wrong link count
+		meta := decodeInodeMeta(*tr.Get(NewBlockKey(cino, BST_META, "").IB()))
+		meta.StNlink = 3
+		b, _ := meta.MarshalMsg(nil)
+		tr.Set(NewBlockKey(cino, BST_META, "").IB(), string(b))
+	})
+
+	problems := fs.Fsck(false)
+	// (orphan is both unreachable, and has wrong link count)
+	assert.Equal(t, len(problems), 6, problems)
+	// Problems refer to paths when available
+	found := false
+	for _, problem := range problems {
+		found = found || problem == fmt.Sprintf("#%d /c: link count 3 != 1", cino)
+	}
+	assert.True(t, found, problems)
+	// Checking alone does not change anything
+	assert.Equal(t, len(fs.Fsck(false)), 6)
+
+	// Orphan gets link in lost+found, so its count is fine
+	problems = fs.Fsck(true)
+	assert.Equal(t, len(problems), 5, problems)
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+
+	l, err := u.ListDir("/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, l, []string{"b"})
+	l, err = u.ListDir("/" + lostFoundName)
+	assert.Nil(t, err)
+	name := fmt.Sprintf("#%d", aino)
+	assert.Equal(t, l, []string{name})
+	assert.Equal(t, readTestFile(t, u, "/"+lostFoundName+"/"+name), "foo")
+	assert.Equal(t, readTestFile(t, u, "/dir/b"), "bar")
+	assert.Nil(t, u.Remove("/dir/b"))
+	assert.Nil(t, u.Remove("/c"))
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+}
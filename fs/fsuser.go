@@ -27,12 +27,13 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/util"
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func s2e(status fuse.Status) error {
@@ -47,6 +48,10 @@ type FSUser struct {
 	fs   *Fs
 	ops  fuse.RawFileSystem
 	lock util.MutexLocked
+
+	// looked are the node ids looked up during the current
+	// operation; like kernel, we forget them only once done
+	looked []uint64
 }
 
 func (self *FSUser) String() string {
@@ -115,23 +120,35 @@ func (self *FSUser) lookup(path string, eo *fuse.EntryOut) (err error) {
 		}
 		self.NodeId = inode
 		mlog.Printf2("fs/fsuser", " %v", name)
-		err = s2e(self.ops.Lookup(&self.InHeader, name, eo))
+		err = s2e(self.ops.Lookup(nil, &self.InHeader, name, eo))
 		if err != nil {
 			return
 		}
 		inode = eo.Ino
-		self.ops.Forget(inode, 1)
+		self.looked = append(self.looked, inode)
 	}
 	self.NodeId = inode
 	if inode == oinode {
-		err = s2e(self.ops.Lookup(&self.InHeader, ".", eo))
+		err = s2e(self.ops.Lookup(nil, &self.InHeader, ".", eo))
 		self.ops.Forget(inode, 1)
 	}
 	return
 }
 
+// locked locks the user for the duration of an operation.
+func (self *FSUser) locked() func() {
+	unlock := self.lock.Locked()
+	return func() {
+		for _, nodeId := range self.looked {
+			self.ops.Forget(nodeId, 1)
+		}
+		self.looked = nil
+		unlock()
+	}
+}
+
 func (self *FSUser) ListDir(name string) (ret []string, err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	var eo fuse.EntryOut
 	err = self.lookup(name, &eo)
 	if err != nil {
@@ -139,20 +156,25 @@ func (self *FSUser) ListDir(name string) (ret []string, err error) {
 	}
 	// Cheat using backdoor API.
 	ret = self.fs.ListDir(eo.Ino)
+	if self.fs.isVirtualDir(eo.Ino) {
+		// Virtual directory; no file handle to peek at
+		return
+	}
 
 	var oo fuse.OpenOut
-	err = s2e(self.ops.OpenDir(&fuse.OpenIn{InHeader: self.InHeader}, &oo))
+	err = s2e(self.ops.OpenDir(nil, &fuse.OpenIn{InHeader: self.InHeader}, &oo))
 	if err != nil {
 		return
 	}
-	ifile := self.fs.GetFileByFh(oo.Fh)
+	fs, _ := self.fs.resolveNodeId(eo.Ino)
+	ifile := fs.GetFileByFh(oo.Fh)
 
 	// Make sure readdir does not blow up and pretends to iterate
 	// (greybox due to painful binary semantics involved)
 	lofs := uint64(0)
 	for {
 		del := fuse.NewDirEntryList(make([]byte, 1000), lofs)
-		err = s2e(self.ops.ReadDir(&fuse.ReadIn{Fh: oo.Fh,
+		err = s2e(self.ops.ReadDir(nil, &fuse.ReadIn{Fh: oo.Fh,
 			InHeader: self.InHeader, Offset: lofs}, del))
 		if err != nil {
 			return
@@ -179,7 +201,7 @@ func (self *FSUser) ListDir(name string) (ret []string, err error) {
 	lofs = 0
 	for {
 		del := fuse.NewDirEntryList(make([]byte, 1000), lofs)
-		err = s2e(self.ops.ReadDirPlus(&fuse.ReadIn{Fh: oo.Fh,
+		err = s2e(self.ops.ReadDirPlus(nil, &fuse.ReadIn{Fh: oo.Fh,
 			InHeader: self.InHeader, Offset: lofs}, del))
 		if err != nil {
 			return
@@ -226,7 +248,7 @@ func (self *FSUser) ReadDir(dirname string) (ret []os.FileInfo, err error) {
 
 // MkDir is clone of os.MkDir
 func (self *FSUser) Mkdir(path string, perm os.FileMode) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	dirname, basename := filepath.Split(path)
 
 	var eo fuse.EntryOut
@@ -234,14 +256,14 @@ func (self *FSUser) Mkdir(path string, perm os.FileMode) (err error) {
 	if err != nil {
 		return
 	}
-	err = s2e(self.ops.Mkdir(&fuse.MkdirIn{InHeader: self.InHeader,
+	err = s2e(self.ops.Mkdir(nil, &fuse.MkdirIn{InHeader: self.InHeader,
 		Mode: uint32(perm)}, basename, &eo))
 	return
 }
 
 // Stat is clone of os.Stat
 func (self *FSUser) Stat(path string) (fi os.FileInfo, err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "Stat %v", path)
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
@@ -251,7 +273,7 @@ func (self *FSUser) Stat(path string) (fi os.FileInfo, err error) {
 	var gai fuse.GetAttrIn
 	var ao fuse.AttrOut
 	gai.InHeader = self.InHeader
-	err = s2e(self.ops.GetAttr(&gai, &ao))
+	err = s2e(self.ops.GetAttr(nil, &gai, &ao))
 	if err != nil {
 		return
 	}
@@ -269,7 +291,7 @@ func (self *FSUser) Remove(path string) (err error) {
 	if err != nil {
 		return
 	}
-	defer self.lock.Locked()()
+	defer self.locked()()
 	dirname, basename := filepath.Split(path)
 	var eo fuse.EntryOut
 	err = self.lookup(dirname, &eo)
@@ -277,16 +299,16 @@ func (self *FSUser) Remove(path string) (err error) {
 		return
 	}
 	if fi.IsDir() {
-		err = s2e(self.ops.Rmdir(&self.InHeader, basename))
+		err = s2e(self.ops.Rmdir(nil, &self.InHeader, basename))
 	} else {
-		err = s2e(self.ops.Unlink(&self.InHeader, basename))
+		err = s2e(self.ops.Unlink(nil, &self.InHeader, basename))
 	}
 	return
 }
 
 // Chown is clone of os.Chown
 func (self *FSUser) Chown(path string, uid, gid int) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Chown %v : %v %v", self, path, uid, gid)
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
@@ -300,13 +322,13 @@ func (self *FSUser) Chown(path string, uid, gid int) (err error) {
 	sai.Owner.Gid = uint32(gid)
 
 	var ao fuse.AttrOut
-	err = s2e(self.ops.SetAttr(&sai, &ao))
+	err = s2e(self.ops.SetAttr(nil, &sai, &ao))
 	return
 }
 
 // Chmod is clone of os.Chmod
 func (self *FSUser) Chmod(path string, mode os.FileMode) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Chmod %v : %v", self, path, mode)
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
@@ -319,13 +341,13 @@ func (self *FSUser) Chmod(path string, mode os.FileMode) (err error) {
 	sai.Mode = uint32(mode)
 
 	var ao fuse.AttrOut
-	err = s2e(self.ops.SetAttr(&sai, &ao))
+	err = s2e(self.ops.SetAttr(nil, &sai, &ao))
 	return
 }
 
 // Chtimes is clone of os.Chtimes
 func (self *FSUser) Chtimes(path string, atime time.Time, mtime time.Time) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Chtimes %v : %v %v", self, path, atime, mtime)
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
@@ -341,14 +363,14 @@ func (self *FSUser) Chtimes(path string, atime time.Time, mtime time.Time) (err
 	sai.Mtimensec = uint32(mtime.Nanosecond())
 
 	var ao fuse.AttrOut
-	err = s2e(self.ops.SetAttr(&sai, &ao))
+	err = s2e(self.ops.SetAttr(nil, &sai, &ao))
 	return
 
 }
 
 // Link is clone of os.Link
 func (self *FSUser) Link(oldpath, newpath string) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Link %v => %v", self, oldpath, newpath)
 	var eo fuse.EntryOut
 	err = self.lookup(oldpath, &eo)
@@ -366,13 +388,13 @@ func (self *FSUser) Link(oldpath, newpath string) (err error) {
 		return
 	}
 	li.InHeader = self.InHeader
-	err = s2e(self.ops.Link(&li, basename, &eo))
+	err = s2e(self.ops.Link(nil, &li, basename, &eo))
 	return
 }
 
 // Rename is clone of os.Rename
 func (self *FSUser) Rename(oldpath, newpath string) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Rename %v => %v", self, oldpath, newpath)
 	var eo fuse.EntryOut
 	olddirname, oldbasename := filepath.Split(oldpath)
@@ -388,13 +410,13 @@ func (self *FSUser) Rename(oldpath, newpath string) (err error) {
 		return
 	}
 	ri.InHeader = self.InHeader
-	err = s2e(self.ops.Rename(&ri, oldbasename, newbasename))
+	err = s2e(self.ops.Rename(nil, &ri, oldbasename, newbasename))
 	return
 }
 
 // Symlink is clone of os.Symlink
 func (self *FSUser) Symlink(oldpath, newpath string) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Symlink %v => %v %v", self, oldpath, newpath)
 	dirname, basename := filepath.Split(newpath)
 	var eo fuse.EntryOut
@@ -402,20 +424,20 @@ func (self *FSUser) Symlink(oldpath, newpath string) (err error) {
 	if err != nil {
 		return
 	}
-	err = s2e(self.ops.Symlink(&self.InHeader, oldpath, basename, &eo))
+	err = s2e(self.ops.Symlink(nil, &self.InHeader, oldpath, basename, &eo))
 	return
 }
 
 // Readlink is clone of os.Readlink
 func (self *FSUser) Readlink(path string) (s string, err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "%v.Readlink %v", self, path)
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
 	if err != nil {
 		return
 	}
-	out, code := self.ops.Readlink(&self.InHeader)
+	out, code := self.ops.Readlink(nil, &self.InHeader)
 	err = s2e(code)
 	if err != nil {
 		return
@@ -426,36 +448,47 @@ func (self *FSUser) Readlink(path string) (s string, err error) {
 }
 
 func (self *FSUser) GetXAttr(path, attr string) (b []byte, err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
 	if err != nil {
 		return
 	}
-	b, code := self.ops.GetXAttrData(&self.InHeader, attr)
-	err = s2e(code)
-	if err != nil {
-		return
+	l, code := self.ops.GetXAttr(nil, &self.InHeader, attr, nil)
+	if code != fuse.ERANGE {
+		err = s2e(code)
+		if err != nil {
+			return
+		}
 	}
-	l, code := self.ops.GetXAttrSize(&self.InHeader, attr)
+	b = make([]byte, l)
+	n, code := self.ops.GetXAttr(nil, &self.InHeader, attr, b)
 	err = s2e(code)
 	if err != nil {
 		return
 	}
-	if l != len(b) {
-		log.Panic("length mismatch in GetXAttrSize", l, len(b))
+	if n != l {
+		log.Panic("length mismatch in GetXAttr", l, n)
 	}
 	return
 }
 
 func (self *FSUser) ListXAttr(path string) (s []string, err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
 	if err != nil {
 		return
 	}
-	b, code := self.ops.ListXAttr(&self.InHeader)
+	l, code := self.ops.ListXAttr(nil, &self.InHeader, nil)
+	if code != fuse.ERANGE {
+		err = s2e(code)
+		if err != nil {
+			return
+		}
+	}
+	b := make([]byte, l)
+	_, code = self.ops.ListXAttr(nil, &self.InHeader, b)
 	err = s2e(code)
 	if err != nil {
 		return
@@ -469,31 +502,36 @@ func (self *FSUser) ListXAttr(path string) (s []string, err error) {
 }
 
 func (self *FSUser) RemoveXAttr(path, attr string) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
 	if err != nil {
 		return
 	}
-	return s2e(self.ops.RemoveXAttr(&self.InHeader, attr))
+	return s2e(self.ops.RemoveXAttr(nil, &self.InHeader, attr))
 }
 
 func (self *FSUser) SetXAttr(path, attr string, data []byte) (err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	var eo fuse.EntryOut
 	err = self.lookup(path, &eo)
 	if err != nil {
 		return
 	}
-	return s2e(self.ops.SetXAttr(&fuse.SetXAttrIn{InHeader: self.InHeader,
+	return s2e(self.ops.SetXAttr(nil, &fuse.SetXAttrIn{InHeader: self.InHeader,
 		Size: uint32(len(data))}, attr, data))
 }
 
 type fsFile struct {
 	path string
+	ino  uint64
 	fh   uint64
 	u    *FSUser
 	pos  int64
+
+	// looked is set if the file holds lookup of ino to forget
+	// on close
+	looked bool
 }
 
 func (self *fsFile) String() string {
@@ -501,7 +539,7 @@ func (self *fsFile) String() string {
 }
 
 func (self *FSUser) OpenFile(path string, flag uint32, perm uint32) (f *fsFile, err error) {
-	defer self.lock.Locked()()
+	defer self.locked()()
 	mlog.Printf2("fs/fsuser", "OpenFile %s f:%x perm:%x", path, flag, perm)
 	var eo fuse.EntryOut
 	var oo fuse.OpenOut
@@ -513,31 +551,63 @@ func (self *FSUser) OpenFile(path string, flag uint32, perm uint32) (f *fsFile,
 		}
 		ci := fuse.CreateIn{InHeader: self.InHeader, Flags: flag, Mode: perm}
 		var co fuse.CreateOut
-		err = s2e(self.ops.Create(&ci, basename, &co))
+		err = s2e(self.ops.Create(nil, &ci, basename, &co))
 		oo = co.OpenOut
+		eo = co.EntryOut
 	} else {
 		err = self.lookup(path, &eo)
 		if err != nil {
 			return
 		}
 		oi := fuse.OpenIn{InHeader: self.InHeader, Flags: flag, Mode: perm}
-		err = s2e(self.ops.Open(&oi, &oo))
+		err = s2e(self.ops.Open(nil, &oi, &oo))
 	}
 	if err != nil {
 		return
 	}
-	f = &fsFile{path: path, fh: oo.Fh, u: self}
+	f = &fsFile{path: path, ino: eo.NodeId, fh: oo.Fh, u: self}
+	if n := len(self.looked); flag&uint32(os.O_CREATE) == 0 && n > 0 {
+		// The open file holds on to the lookup
+		f.looked = true
+		self.looked = self.looked[:n-1]
+	}
 	return
 }
 
-func (self *fsFile) Close() {
+func (self *fsFile) Close() error {
+	fi := fuse.FlushIn{Fh: self.fh}
+	fi.NodeId = self.ino
+	code := self.u.ops.Flush(nil, &fi)
 	ri := fuse.ReleaseIn{Fh: self.fh}
-	self.u.ops.Release(&ri)
+	ri.NodeId = self.ino
+	self.u.ops.Release(nil, &ri)
+	if self.looked {
+		self.u.ops.Forget(self.ino, 1)
+	}
+	return s2e(code)
+}
+
+func (self *fsFile) Sync() error {
+	fi := fuse.FsyncIn{Fh: self.fh}
+	fi.NodeId = self.ino
+	return s2e(self.u.ops.Fsync(nil, &fi))
 }
 
 func (self *fsFile) Seek(ofs int64, whence int) (ret int64, err error) {
 	var fi os.FileInfo
 	mlog.Printf2("fs/fsuser", "%v.Seek %v %v", self, ofs, whence)
+	if whence == seekData || whence == seekHole {
+		li := fuse.LseekIn{Fh: self.fh, Offset: uint64(ofs), Whence: uint32(whence)}
+		li.NodeId = self.ino
+		var lo fuse.LseekOut
+		err = s2e(self.u.ops.Lseek(nil, &li, &lo))
+		if err != nil {
+			return
+		}
+		self.pos = int64(lo.Offset)
+		ret = self.pos
+		return
+	}
 	fi, err = self.u.Stat(self.path)
 	if err != nil {
 		mlog.Printf2("fs/fsuser", " Seek encountered stat failure: %s", err)
@@ -574,7 +644,8 @@ func (self *fsFile) Read(b []byte) (n int, err error) {
 	ri := fuse.ReadIn{Fh: self.fh,
 		Offset: uint64(self.pos),
 		Size:   size}
-	r, code := self.u.ops.Read(&ri, b)
+	ri.NodeId = self.ino
+	r, code := self.u.ops.Read(nil, &ri, b)
 	err = s2e(code)
 	if err != nil {
 		return
@@ -591,7 +662,8 @@ func (self *fsFile) Write(b []byte) (n int, err error) {
 	wi := fuse.WriteIn{Fh: self.fh,
 		Offset: uint64(self.pos),
 		Size:   size}
-	n32, code := self.u.ops.Write(&wi, b[n:])
+	wi.NodeId = self.ino
+	n32, code := self.u.ops.Write(nil, &wi, b[n:])
 	err = s2e(code)
 	if err != nil {
 		return
@@ -605,3 +677,103 @@ func (self *fsFile) Write(b []byte) (n int, err error) {
 	return
 
 }
+
+func (self *fsFile) Truncate(size int64) (err error) {
+	mlog.Printf2("fs/fsuser", "%v.Truncate %v", self, size)
+	si := fuse.SetAttrIn{}
+	si.Valid = fuse.FATTR_SIZE | fuse.FATTR_FH
+	si.Fh = self.fh
+	si.Size = uint64(size)
+	si.NodeId = self.ino
+	var out fuse.AttrOut
+	return s2e(self.u.ops.SetAttr(nil, &si, &out))
+}
+
+// Fallocate is clone of syscall.Fallocate
+func (self *fsFile) Fallocate(mode uint32, off int64, length int64) (err error) {
+	mlog.Printf2("fs/fsuser", "%v.Fallocate %x %v %v", self, mode, off, length)
+	fi := fuse.FallocateIn{Fh: self.fh,
+		Offset: uint64(off),
+		Length: uint64(length),
+		Mode:   mode}
+	fi.NodeId = self.ino
+	return s2e(self.u.ops.Fallocate(nil, &fi))
+}
+
+// DataRanges provides the ranges of the file that contain data
+// (rest of the file consists of holes).
+func (self *FSUser) DataRanges(path string) (ret []DataRange, err error) {
+	defer self.locked()()
+	var eo fuse.EntryOut
+	err = self.lookup(path, &eo)
+	if err != nil {
+		return
+	}
+	self.fs.WithoutParallelWrites(func() {})
+	fs, ino := self.fs.resolveNodeId(eo.NodeId)
+	inode := fs.GetInode(ino)
+	if inode == nil {
+		err = s2e(fuse.ENOENT)
+		return
+	}
+	defer inode.Release()
+	inode.IterateDataRanges(0, func(r DataRange) bool {
+		ret = append(ret, r)
+		return true
+	})
+	return
+}
+
+// CloneFile copies the file at src to dst (replacing it if it
+// exists), sharing the underlying extent blocks where possible.
+func (self *FSUser) CloneFile(src, dst string) (err error) {
+	mlog.Printf2("fs/fsuser", "%v.CloneFile %v => %v", self, src, dst)
+	fi, err := self.Stat(src)
+	if err != nil {
+		return
+	}
+	sf, err := self.OpenFile(src, uint32(os.O_RDONLY), 0)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	df, err := self.OpenFile(dst, uint32(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), uint32(fi.Mode().Perm()))
+	if err != nil {
+		return
+	}
+	defer df.Close()
+	ci := fuse.CopyFileRangeIn{FhIn: sf.fh, NodeIdOut: df.ino, FhOut: df.fh}
+	ci.NodeId = sf.ino
+	for ci.OffIn < uint64(fi.Size()) {
+		ci.Len = uint64(fi.Size()) - ci.OffIn
+		n, code := self.ops.CopyFileRange(nil, &ci)
+		err = s2e(code)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			break
+		}
+		ci.OffIn += uint64(n)
+		ci.OffOut += uint64(n)
+	}
+	return
+}
+
+// Versions provides the kept versions of the file, oldest first.
+func (self *FSUser) Versions(path string) (ret []FileVersion, err error) {
+	defer self.locked()()
+	var eo fuse.EntryOut
+	err = self.lookup(path, &eo)
+	if err != nil {
+		return
+	}
+	fs, ino := self.fs.resolveNodeId(eo.NodeId)
+	ret = fs.FileVersions(ino)
+	return
+}
+
+// RestoreVersion restores the file to the given version.
+func (self *FSUser) RestoreVersion(path string, id uint64) (err error) {
+	return self.SetXAttr(path, restoreVersionXAttr, []byte(strconv.FormatUint(id, 10)))
+}
@@ -23,8 +23,10 @@ import (
 	"github.com/fingon/go-tfhfs/ibtree"
 	"github.com/fingon/go-tfhfs/ibtree/hugger"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
 	"github.com/fingon/go-tfhfs/util"
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/glycerine/greenpack/msgp"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type inode struct {
@@ -35,6 +37,9 @@ type inode struct {
 	removed       bool
 	meta          InodeMetaAtomicPointer
 	metaWriteLock util.MutexLocked
+
+	// writeErrors keeps track of failed deferred writes
+	writeErrors storage.WriteErrors
 }
 
 func (self *inode) AddChild(name string, child *inode) (code fuse.Status) {
@@ -129,6 +134,10 @@ func (self *inode) deleteInode() {
 			return false
 		}
 		mlog.Printf2("fs/inode", "trying to delete")
+		if v := t.Get(NewBlockKey(self.ino, BST_META, "").IB()); v != nil {
+			chargeUsageInTransaction(t, &decodeInodeMeta(*v).InodeMetaData, nil)
+		}
+		forgetConflict(t, self.ino)
 		k1 := NewBlockKey(self.ino, BST_NONE, "").IB()
 		k2 := NewBlockKey(self.ino, BST_LAST, "").IB()
 		t.DeleteRange(k1, k2)
@@ -146,7 +155,7 @@ func (self *inode) FillAttr(out *fuse.Attr) fuse.Status {
 	if meta == nil {
 		return fuse.ENOENT
 	}
-	out.Ino = self.ino
+	out.Ino = self.Fs().nodeId(self.ino)
 	out.Size = meta.StSize
 	out.Blocks = meta.StSize / blockSize
 	unixNanoToFuse(meta.StAtimeNs, &out.Atime, &out.Atimensec)
@@ -179,7 +188,7 @@ func (self *inode) FillEntryOut(out *fuse.EntryOut) fuse.Status {
 		return fuse.OK
 	}
 	// EntryOut
-	out.NodeId = self.ino
+	out.NodeId = self.Fs().lookupNodeId(self.ino)
 	out.Generation = 0
 	out.EntryValid = entryValidity
 	out.AttrValid = attrValidity
@@ -209,7 +218,9 @@ func (self *inode) GetChildByName(name string) *inode {
 }
 
 func (self *inode) GetFile(flags uint32) *inodeFH {
-	file := &inodeFH{inode: self, flags: flags}
+	file := &inodeFH{inode: self, flags: flags,
+		inodeErrorSeq:   self.writeErrors.Seq(),
+		storageErrorSeq: self.Fs().storage.WriteErrorSeq()}
 	self.tracker.AddFile(file)
 	return file
 }
@@ -275,6 +286,9 @@ func (self *inode) SetXAttr(attr string, data []byte) (code fuse.Status) {
 		k := NewBlockKey(self.ino, BST_XATTR, attr)
 		mlog.Printf2("fs/inode", "SetXAttr %s - setting %x", attr, k)
 		tr.IB().Set(k.IB(), string(data))
+		if attr == nosyncXattr {
+			tr.IB().Set(NewBlockKey(fsIno, BST_CONFIG, configNosync).IB(), "")
+		}
 	})
 	return fuse.OK
 }
@@ -321,7 +335,9 @@ func (self *inode) RemoveChild(child *inode, name string) (code fuse.Status) {
 			return false
 		}
 		cmeta.StNlink--
-		cmeta.ParentIno = 0
+		if cmeta.ParentIno == self.ino {
+			cmeta.ParentIno = 0
+		}
 		cmeta.SetCTimeNow()
 		child.SetMetaInTransaction(cmeta, tr)
 
@@ -358,11 +374,43 @@ func (self *inode) RemoveChild(child *inode, name string) (code fuse.Status) {
 	return
 }
 
+// legacyInodeMetaFields is the number of InodeMetaData fields in
+// metadata written before VersionVector was added
+const legacyInodeMetaFields = 10
+
+// upgradeInodeMeta converts encoded legacy InodeMeta to the current
+// format by appending empty VersionVector to it. Both the InodeMeta
+// and InodeMetaData arrays are small enough to have fixarray
+// headers.
+func upgradeInodeMeta(b []byte) ([]byte, bool) {
+	if len(b) < 2 || b[0] != 0x92 || b[1] != 0x90|legacyInodeMetaFields {
+		return nil, false
+	}
+	rest := b[2:]
+	for i := 0; i < legacyInodeMetaFields; i++ {
+		var err error
+		rest, err = msgp.Skip(rest)
+		if err != nil {
+			return nil, false
+		}
+	}
+	nb := []byte{0x92, 0x90 | (legacyInodeMetaFields + 1)}
+	nb = append(nb, b[2:len(b)-len(rest)]...)
+	nb = msgp.AppendString(nb, "")
+	return append(nb, rest...), true
+}
+
 func decodeInodeMeta(v string) *InodeMeta {
 	var m InodeMeta
 	_, err := m.UnmarshalMsg([]byte(v))
 	if err != nil {
-		log.Panic(err)
+		if b, ok := upgradeInodeMeta([]byte(v)); ok {
+			m = InodeMeta{}
+			_, err = m.UnmarshalMsg(b)
+		}
+		if err != nil {
+			log.Panic(err)
+		}
 	}
 	mlog.Printf2("fs/inode", " = %v", &m)
 	return &m
@@ -427,17 +475,34 @@ func (self *inode) SetMetaInTransaction(meta *InodeMeta, tr *hugger.Transaction)
 	}
 
 	k := NewBlockKey(self.ino, BST_META, "")
+	old := self.meta.Get()
+	if old != nil {
+		// Only changes other than that of version vector count
+		md := meta.InodeMetaData
+		md.VersionVector = old.VersionVector
+		if md == old.InodeMetaData && bytes.Equal(meta.Data, old.Data) {
+			return false
+		}
+	}
+	var prev *InodeMetaData
+	if old != nil {
+		prev = &old.InodeMetaData
+	} else if v := tr.IB().Get(k.IB()); v != nil {
+		prev = &decodeInodeMeta(*v).InodeMetaData
+	}
+	vv := meta.VersionVector
+	if prev != nil {
+		vv = prev.VersionVector.Merge(vv)
+	}
+	meta.VersionVector = vv.Increment(self.Fs().replicaId)
 	b, err := meta.MarshalMsg(nil)
 	if err != nil {
 		log.Panic(err)
 	}
-	old := self.meta.Get()
-	if old == nil || old.InodeMetaData != meta.InodeMetaData || !bytes.Equal(meta.Data, old.Data) {
-		tr.IB().Set(k.IB(), string(b))
-		self.meta.Set(meta)
-		return true
-	}
-	return false
+	chargeUsageInTransaction(tr.IB(), prev, &meta.InodeMetaData)
+	tr.IB().Set(k.IB(), string(b))
+	self.meta.Set(meta)
+	return true
 }
 
 func (self *inode) SetMetaSizeInTransaction(meta *InodeMeta, size uint64, tr *hugger.Transaction) bool {
@@ -447,6 +512,9 @@ func (self *inode) SetMetaSizeInTransaction(meta *InodeMeta, size uint64, tr *hu
 	} else if size < meta.StSize && meta.StSize > dataExtentSize {
 		shrink = true
 	}
+	if size < meta.StSize && meta.StSize > EmbeddedSize && self.useChunks(tr.IB()) {
+		self.truncateChunksInTransaction(tr, meta, size)
+	}
 	meta.StSize = size
 	if size > EmbeddedSize {
 		mlog.Printf2("fs/inode", "SetSize cleared in-place metadata")
@@ -469,7 +537,8 @@ type randomInodeNumberGenerator struct {
 }
 
 func (self *randomInodeNumberGenerator) CreateInodeNumber() uint64 {
-	return rand.Uint64()
+	// upper half of the space is reserved for virtual node ids
+	return rand.Uint64() &^ childNodeIdBase
 }
 
 type inodeTracker struct {
@@ -564,7 +633,7 @@ func (self *inodeTracker) createInode() *inode {
 	for {
 		ino := self.generator.CreateInodeNumber()
 		mlog.Printf2("fs/inode", " %v", ino)
-		if ino == 0 || self.ino2inode[ino] != nil {
+		if ino == 0 || ino >= childNodeIdBase || self.ino2inode[ino] != nil {
 			continue
 		}
 
@@ -580,6 +649,15 @@ func (self *inodeTracker) createInode() *inode {
 	}
 }
 
+// flushMetaCache forgets the cached metadata of all inodes; it is
+// reloaded from the tree when needed.
+func (self *inodeTracker) flushMetaCache() {
+	defer self.inodeLock.Locked()()
+	for _, inode := range self.ino2inode {
+		inode.meta.Set(nil)
+	}
+}
+
 func (self *inodeTracker) CreateInode() *inode {
 	defer self.inodeLock.Locked()()
 	return self.createInode()
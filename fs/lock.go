@@ -0,0 +1,286 @@
+package fs
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Advisory locks are purely local to the process; they are neither
+// persisted nor synchronized elsewhere. Both POSIX (fcntl) byte-range
+// locks and flock-style whole file locks are supported. Like on
+// Linux, the two kinds do not interact with each other.
+
+// lockEnd is the end of 'until end of file' range (see
+// fuse.FileLock.ToFlockT)
+const lockEnd uint64 = (1 << 63) - 1
+
+// FUSE_RELEASE_FLOCK_UNLOCK in the kernel; not in go-fuse
+const releaseFlockUnlock uint32 = 1 << 1
+
+type fileLock struct {
+	owner      uint64
+	pid        uint32
+	typ        uint32 // F_RDLCK or F_WRLCK
+	start, end uint64 // inclusive
+	flock      bool
+}
+
+func (self *fileLock) overlaps(start, end uint64) bool {
+	return self.start <= end && start <= self.end
+}
+
+func (self *fileLock) conflicts(o *fileLock) bool {
+	if self.flock != o.flock || self.owner == o.owner {
+		return false
+	}
+	if self.typ != syscall.F_WRLCK && o.typ != syscall.F_WRLCK {
+		return false
+	}
+	return self.overlaps(o.start, o.end)
+}
+
+// lockWaiter is request blocked waiting for a lock.
+type lockWaiter struct {
+	ino         uint64
+	lk          fileLock
+	interrupted bool
+}
+
+// lockManager keeps track of advisory locks of inodes, and of
+// requests waiting for them.
+type lockManager struct {
+	lock    util.MutexLocked
+	changed sync.Cond
+
+	ino2locks map[uint64][]fileLock
+
+	waiters map[*lockWaiter]bool
+	closed  bool
+}
+
+func (self *lockManager) Init() {
+	self.changed.L = &self.lock
+	self.ino2locks = make(map[uint64][]fileLock)
+	self.waiters = make(map[*lockWaiter]bool)
+}
+
+// conflict returns the first lock conflicting with lk, if any.
+func (self *lockManager) conflict(ino uint64, lk *fileLock) *fileLock {
+	self.lock.AssertLocked()
+	locks := self.ino2locks[ino]
+	for i := range locks {
+		if locks[i].conflicts(lk) {
+			return &locks[i]
+		}
+	}
+	return nil
+}
+
+// set replaces the locks of the owner within the range of lk with
+// lk. Unlocking is done with typ F_UNLCK. Adjacent and overlapping
+// ranges of same type are merged together.
+func (self *lockManager) set(ino uint64, lk fileLock) {
+	self.lock.AssertLocked()
+	var nlocks []fileLock
+	for _, l := range self.ino2locks[ino] {
+		if l.owner != lk.owner || l.flock != lk.flock {
+			nlocks = append(nlocks, l)
+			continue
+		}
+		if l.typ == lk.typ && lk.typ != syscall.F_UNLCK &&
+			(l.overlaps(lk.start, lk.end) ||
+				(l.end != lockEnd && l.end+1 == lk.start) ||
+				(lk.end != lockEnd && lk.end+1 == l.start)) {
+			// Merge into the new one
+			if l.start < lk.start {
+				lk.start = l.start
+			}
+			if l.end > lk.end {
+				lk.end = l.end
+			}
+			continue
+		}
+		if !l.overlaps(lk.start, lk.end) {
+			nlocks = append(nlocks, l)
+			continue
+		}
+		// Split; keep the parts outside the new range
+		if l.start < lk.start {
+			h := l
+			h.end = lk.start - 1
+			nlocks = append(nlocks, h)
+		}
+		if l.end > lk.end {
+			t := l
+			t.start = lk.end + 1
+			nlocks = append(nlocks, t)
+		}
+	}
+	if lk.typ != syscall.F_UNLCK {
+		nlocks = append(nlocks, lk)
+	}
+	if len(nlocks) == 0 {
+		delete(self.ino2locks, ino)
+	} else {
+		self.ino2locks[ino] = nlocks
+	}
+	self.changed.Broadcast()
+}
+
+// Get provides the lock that would prevent lk from being acquired.
+// If there is none, lk is returned with F_UNLCK type.
+func (self *lockManager) Get(ino uint64, lk fileLock) fileLock {
+	defer self.lock.Locked()()
+	if c := self.conflict(ino, &lk); c != nil {
+		return *c
+	}
+	lk.typ = syscall.F_UNLCK
+	return lk
+}
+
+// deadlocks determines if waiting for the lock held by owner would
+// deadlock the owner of lk, i.e. if owner is (transitively) waiting
+// for a lock held by it. Like in Linux, only POSIX locks are checked.
+func (self *lockManager) deadlocks(owner uint64, lk *fileLock) bool {
+	self.lock.AssertLocked()
+	seen := make(map[uint64]bool)
+	for !seen[owner] {
+		if owner == lk.owner {
+			return true
+		}
+		seen[owner] = true
+		var blocker *fileLock
+		for w := range self.waiters {
+			if w.lk.owner == owner && !w.lk.flock {
+				blocker = self.conflict(w.ino, &w.lk)
+				if blocker != nil {
+					break
+				}
+			}
+		}
+		if blocker == nil {
+			return false
+		}
+		owner = blocker.owner
+	}
+	return false
+}
+
+// Set acquires (or releases) the lock. If wait is set, it waits
+// until conflicting locks go away (or cancel is closed); otherwise it
+// fails immediately with EAGAIN. Waits that would deadlock fail with
+// EDEADLK.
+func (self *lockManager) Set(ino uint64, lk fileLock, wait bool, cancel <-chan struct{}) fuse.Status {
+	defer self.lock.Locked()()
+	if lk.typ != syscall.F_UNLCK {
+		var w *lockWaiter
+		for {
+			c := self.conflict(ino, &lk)
+			if c == nil {
+				break
+			}
+			if !wait {
+				return fuse.EAGAIN
+			}
+			if !lk.flock && self.deadlocks(c.owner, &lk) {
+				mlog.Printf2("fs/lock", "lm.Set deadlock #%d", ino)
+				return fuse.Status(syscall.EDEADLK)
+			}
+			if w == nil {
+				w = &lockWaiter{ino: ino, lk: lk}
+				self.waiters[w] = true
+				defer delete(self.waiters, w)
+				if cancel != nil {
+					stop := make(chan struct{})
+					defer close(stop)
+					go self.interruptOnCancel(w, cancel, stop)
+				}
+			}
+			if w.interrupted || self.closed {
+				mlog.Printf2("fs/lock", "lm.Set interrupted #%d", ino)
+				return fuse.Status(syscall.EINTR)
+			}
+			self.changed.Wait()
+		}
+	}
+	self.set(ino, lk)
+	return fuse.OK
+}
+
+// interruptOnCancel interrupts the waiter if cancel is closed before
+// stop.
+func (self *lockManager) interruptOnCancel(w *lockWaiter, cancel, stop <-chan struct{}) {
+	select {
+	case <-cancel:
+		defer self.lock.Locked()()
+		w.interrupted = true
+		self.changed.Broadcast()
+	case <-stop:
+	}
+}
+
+// ReleaseOwner releases locks of the given owner within the inode.
+func (self *lockManager) ReleaseOwner(ino, owner uint64, posix, flock bool) {
+	defer self.lock.Locked()()
+	if posix {
+		self.set(ino, fileLock{owner: owner, typ: syscall.F_UNLCK,
+			start: 0, end: lockEnd})
+	}
+	if flock {
+		self.set(ino, fileLock{owner: owner, typ: syscall.F_UNLCK,
+			start: 0, end: lockEnd, flock: true})
+	}
+}
+
+// Close interrupts all waiters, and makes further blocking calls fail.
+func (self *lockManager) Close() {
+	defer self.lock.Locked()()
+	self.closed = true
+	self.changed.Broadcast()
+}
+
+func lockFromLkIn(input *fuse.LkIn) (lk fileLock, code fuse.Status) {
+	lk = fileLock{owner: input.Owner,
+		pid:   input.Lk.Pid,
+		typ:   input.Lk.Typ,
+		start: input.Lk.Start,
+		end:   input.Lk.End,
+		flock: input.LkFlags&fuse.FUSE_LK_FLOCK != 0}
+	switch lk.typ {
+	case syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK:
+	default:
+		code = fuse.EINVAL
+		return
+	}
+	if lk.flock {
+		lk.start = 0
+		lk.end = lockEnd
+	}
+	if lk.end > lockEnd {
+		lk.end = lockEnd
+	}
+	if lk.start > lk.end {
+		code = fuse.EINVAL
+		return
+	}
+	code = fuse.OK
+	return
+}
+
+func (self *fsOps) setLk(input *fuse.LkIn, wait bool, cancel <-chan struct{}) (code fuse.Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.setLk(&in, wait, cancel)
+	}
+	lk, code := lockFromLkIn(input)
+	if !code.Ok() {
+		return
+	}
+	mlog.Printf2("fs/lock", "ops.setLk #%d %v wait:%v", input.NodeId, lk, wait)
+	return self.fs.locks.Set(input.NodeId, lk, wait, cancel)
+}
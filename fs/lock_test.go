@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func TestLockRanges(t *testing.T) {
+	t.Parallel()
+	var lm lockManager
+	lm.Init()
+
+	wr := func(owner, start, end uint64) fileLock {
+		return fileLock{owner: owner, typ: syscall.F_WRLCK,
+			start: start, end: end}
+	}
+	rd := func(owner, start, end uint64) fileLock {
+		return fileLock{owner: owner, typ: syscall.F_RDLCK,
+			start: start, end: end}
+	}
+	un := func(owner, start, end uint64) fileLock {
+		return fileLock{owner: owner, typ: syscall.F_UNLCK,
+			start: start, end: end}
+	}
+
+	assert.Equal(t, lm.Set(1, wr(1, 0, 9), false, nil), fuse.OK)
+	assert.Equal(t, lm.Set(1, wr(1, 10, 19), false, nil), fuse.OK)
+	// adjacent ranges are merged
+	assert.Equal(t, len(lm.ino2locks[1]), 1)
+
+	assert.Equal(t, lm.Set(1, rd(2, 5, 5), false, nil), fuse.EAGAIN)
+	assert.Equal(t, lm.Get(1, rd(2, 5, 5)).owner, uint64(1))
+	assert.Equal(t, lm.Set(1, rd(2, 20, 30), false, nil), fuse.OK)
+
+	// unlocking the middle splits the range
+	assert.Equal(t, lm.Set(1, un(1, 5, 14), false, nil), fuse.OK)
+	assert.Equal(t, len(lm.ino2locks[1]), 3)
+	assert.Equal(t, lm.Get(1, wr(2, 5, 14)).typ, uint32(syscall.F_UNLCK))
+	assert.Equal(t, lm.Get(1, wr(2, 14, 15)).start, uint64(15))
+
+	// shared locks do not conflict
+	assert.Equal(t, lm.Set(1, rd(3, 20, 20), false, nil), fuse.OK)
+
+	// flock locks do not interact with POSIX locks
+	fl := wr(4, 0, lockEnd)
+	fl.flock = true
+	assert.Equal(t, lm.Set(1, fl, false, nil), fuse.OK)
+	fl.owner = 5
+	assert.Equal(t, lm.Set(1, fl, false, nil), fuse.EAGAIN)
+	lm.ReleaseOwner(1, 4, false, true)
+	assert.Equal(t, lm.Set(1, fl, false, nil), fuse.OK)
+
+	lm.ReleaseOwner(1, 1, true, false)
+	lm.ReleaseOwner(1, 2, true, false)
+	lm.ReleaseOwner(1, 3, true, false)
+	lm.ReleaseOwner(1, 5, false, true)
+	assert.Equal(t, len(lm.ino2locks), 0)
+}
+
+func TestLockWait(t *testing.T) {
+	t.Parallel()
+	var lm lockManager
+	lm.Init()
+
+	lk := fileLock{owner: 1, typ: syscall.F_WRLCK, start: 0, end: lockEnd}
+	assert.Equal(t, lm.Set(1, lk, false, nil), fuse.OK)
+
+	// Waiting ends once the lock is released
+	lk2 := lk
+	lk2.owner = 2
+	done := make(chan fuse.Status)
+	go func() {
+		done <- lm.Set(1, lk2, true, nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	lm.ReleaseOwner(1, 1, true, false)
+	assert.Equal(t, <-done, fuse.OK)
+
+	// Waiting ends also if interrupted
+	lk.owner = 3
+	cancel := make(chan struct{})
+	go func() {
+		done <- lm.Set(1, lk, true, cancel)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(cancel)
+	assert.Equal(t, <-done, fuse.Status(syscall.EINTR))
+	assert.Equal(t, len(lm.waiters), 0)
+}
+
+func TestLockDeadlock(t *testing.T) {
+	t.Parallel()
+	var lm lockManager
+	lm.Init()
+
+	wr := func(owner uint64) fileLock {
+		return fileLock{owner: owner, typ: syscall.F_WRLCK,
+			start: 0, end: lockEnd}
+	}
+	assert.Equal(t, lm.Set(1, wr(1), false, nil), fuse.OK)
+	assert.Equal(t, lm.Set(2, wr(2), false, nil), fuse.OK)
+	assert.Equal(t, lm.Set(3, wr(3), false, nil), fuse.OK)
+
+	// 1 waits for 2 which waits for 3; 3 waiting for 1 would
+	// deadlock
+	done := make(chan fuse.Status)
+	go func() {
+		done <- lm.Set(2, wr(1), true, nil)
+	}()
+	go func() {
+		done <- lm.Set(3, wr(2), true, nil)
+	}()
+	for {
+		lm.lock.Lock()
+		n := len(lm.waiters)
+		lm.lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, lm.Set(1, wr(3), true, nil), fuse.Status(syscall.EDEADLK))
+
+	lm.ReleaseOwner(3, 3, true, false)
+	assert.Equal(t, <-done, fuse.OK)
+	lm.ReleaseOwner(2, 2, true, false)
+	assert.Equal(t, <-done, fuse.OK)
+}
@@ -12,9 +12,14 @@
 package fs
 
 import (
+	"encoding/binary"
+	"log"
+	"time"
+
 	"github.com/fingon/go-tfhfs/ibtree"
 	"github.com/fingon/go-tfhfs/ibtree/hugger"
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type mergeVerdict int
@@ -36,12 +41,133 @@ const (
 // handed in as the Transaction.  If local is set, all changes are
 // assumed to be dealt with on per-leaf node difference
 // basis. Otherwise metadata of the particular inode is used to
-// determine which version of the truth is preferrable.
+// determine which version of the truth is preferrable: version
+// vectors determine if one has seen the changes of the other, and
+// only if they do not (or the vectors are equal) ctime is used. The
+// namespace is then repaired (see repairNamespace), as merging the
+// inodes separately may leave it inconsistent.
 func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
+	err := mergeTo3(tr, src, dst, local, "", 0, nil)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// MergeFromPeer performs non-local 3-way merge of changes made by the
+// peer (from src to dst) to the filesystem. If conflict copies are
+// enabled, the losing versions of files changed on both sides are
+// kept (see keepConflictCopy). If the changes are invalid, nothing is
+// merged and error is returned.
+func (self *Fs) MergeFromPeer(src, dst *ibtree.Node, peer string) (err error) {
+	mlog.Printf2("fs/merge", "fs.MergeFromPeer %s", peer)
+	self.Update2(func(tr *hugger.Transaction) bool {
+		err = mergeTo3(tr, src, dst, false, peer, self.replicaId, nil)
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+	// Metadata of any inode may have changed under us
+	self.inodeTracker.flushMetaCache()
+	return
+}
+
+// mergeScope confines the merge to the included inodes within a
+// subtree, and ones that do not exist locally. Excluded entries (and
+// inodes excluded by either side) are left alone.
+type mergeScope struct {
+	root         uint64
+	filter       *subtreeFilter
+	peerExcluded map[uint64]bool
+	allowed      map[uint64]bool
+}
+
+func (self *mergeScope) allows(t *ibtree.Transaction, ino uint64) bool {
+	if self.peerExcluded[ino] || self.filter.excluded[ino] {
+		return false
+	}
+	if self.filter.inodes[ino] {
+		return true
+	}
+	v, ok := self.allowed[ino]
+	if !ok {
+		// Decided on first sight, as the merge may add the
+		// metadata
+		v = t.Get(NewBlockKey(ino, BST_META, "").IB()) == nil
+		self.allowed[ino] = v
+	}
+	return v
+}
+
+// allowsEntry determines if the (reverse) entry key with the value
+// may be merged.
+func (self *mergeScope) allowsEntry(t, dt *ibtree.Transaction, k BlockKey, v string) bool {
+	var e fsckEntry
+	switch k.SubType() {
+	case BST_DIR_NAME2INODE:
+		e = fsckEntry{k.Ino(), k.Filename(), binary.BigEndian.Uint64([]byte(v))}
+	case BST_FILE_INODEFILENAME:
+		b := []byte(k.SubTypeData())
+		e = fsckEntry{binary.BigEndian.Uint64(b), string(b[8:]), k.Ino()}
+	default:
+		return true
+	}
+	// Entries of excluded inodes stay as they are, even if the
+	// peer renamed them to be excluded
+	if self.peerExcluded[e.child] || self.filter.excluded[e.child] {
+		return false
+	}
+	isDir, ok := isDirInTree(dt, e.child)
+	if !ok {
+		isDir, _ = isDirInTree(t, e.child)
+	}
+	return self.filter.includesEntry(e, isDir)
+}
+
+// validMetaChild determines if the (peer) metadata in the child can be
+// merged.
+func validMetaChild(c *ibtree.NodeDataChild) bool {
+	return c == nil || decodeInodeMeta(c.Value).VersionVector.Valid()
+}
+
+func mergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool, peer string, replica uint64, scope *mergeScope) (err error) {
 	t := tr.IB()
+	conflicts := !local && conflictCopiesEnabled(t)
+	now := time.Now()
+	// dt provides access to dst (if needed)
+	var dt *ibtree.Transaction
+	getDt := func() *ibtree.Transaction {
+		if dt == nil {
+			dt = ibtree.NewTransaction(dst)
+		}
+		return dt
+	}
 	m := make(map[uint64]mergeVerdict)
 	isdir := make(map[uint64]bool)
 	isdir[1] = true
+	chunked := make(map[uint64]bool)
+	// merged contains the version vectors of inodes that were
+	// changed concurrently; result has seen changes of both
+	merged := make(map[uint64]VersionVector)
+	// touched contains the inodes with changes in the delta, for
+	// repairNamespace
+	touched := make(map[uint64]bool)
+	// removed contains the (last) reverse entry removed from each
+	// inode, for repairNamespace
+	removed := make(map[uint64]fsckEntry)
+	chargeMeta := func(k BlockKey, cv, nv *string) {
+		if k.SubType() != BST_META {
+			return
+		}
+		var old, new *InodeMetaData
+		if cv != nil {
+			old = &decodeInodeMeta(*cv).InodeMetaData
+		}
+		if nv != nil {
+			new = &decodeInodeMeta(*nv).InodeMetaData
+		}
+		chargeUsageInTransaction(t, old, new)
+	}
 	dst.IterateDelta(src,
 		func(oldC, newC *ibtree.NodeDataChild) {
 			var k BlockKey
@@ -53,8 +179,35 @@ func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
 				c = oldC
 			}
 			k = BlockKey(c.Key)
+			if err != nil {
+				return
+			}
+			if k.SubType() == BST_META && (!validMetaChild(oldC) || !validMetaChild(newC)) {
+				mlog.Printf2("fs/merge", " invalid version vector in %x", c.Key)
+				err = ErrInvalidVersionVector
+				return
+			}
+
+			// Usage accounting is derived from the
+			// metadata changes that are merged
+			if k.Ino() == fsIno {
+				switch k.SubType() {
+				case BST_QUOTA:
+					if local {
+						mergeQuotaLimits(t, oldC, newC)
+					}
+					return
+				case BST_COUNTER:
+					return
+				}
+			}
 
 			ino := k.Ino()
+			if scope != nil && (!scope.allows(t, ino) || !scope.allowsEntry(t, getDt(), k, c.Value)) {
+				mlog.Printf2("fs/merge", " out of scope %x", c.Key)
+				return
+			}
+			touched[ino] = true
 			v, ok := m[ino]
 			if !ok {
 				// Peculiar, this should not happen;
@@ -73,9 +226,19 @@ func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
 								isdir[k.Ino()] = true
 							}
 							otherMeta := decodeInodeMeta(*op)
-							if srcMeta.StCtimeNs >= otherMeta.StCtimeNs {
+							// Deletion wins unless we
+							// have changes peer had not
+							// seen
+							switch srcMeta.VersionVector.Compare(otherMeta.VersionVector) {
+							case VV_AFTER:
 								v = MV_NONE
-							} else {
+							case VV_EQUAL:
+								if srcMeta.StCtimeNs >= otherMeta.StCtimeNs {
+									v = MV_NONE
+								} else {
+									v = MV_EXISTING
+								}
+							default:
 								v = MV_EXISTING
 							}
 						}
@@ -91,10 +254,45 @@ func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
 							if dstMeta.IsDir() {
 								isdir[k.Ino()] = true
 							}
-							if dstMeta.StCtimeNs > otherMeta.StCtimeNs {
+							order := dstMeta.VersionVector.Compare(otherMeta.VersionVector)
+							// Inodes last changed by
+							// older versions have no
+							// vector, so only the
+							// content tells if both
+							// sides changed them
+							if dstMeta.VersionVector == "" || otherMeta.VersionVector == "" {
+								if oldC != nil && *op != oldC.Value && *op != newC.Value {
+									order = VV_CONCURRENT
+								}
+							}
+							switch order {
+							case VV_AFTER:
 								v = MV_NEW
-							} else {
+							case VV_BEFORE:
 								v = MV_EXISTING
+							default:
+								// Concurrent (or
+								// unversioned)
+								// changes; ctime
+								// decides
+								if dstMeta.StCtimeNs > otherMeta.StCtimeNs {
+									v = MV_NEW
+								} else {
+									v = MV_EXISTING
+								}
+							}
+							if order == VV_CONCURRENT {
+								merged[ino] = dstMeta.VersionVector.Merge(otherMeta.VersionVector)
+								// If file changed on
+								// both sides, keep
+								// the loser
+								if conflicts && isRegularFile(dstMeta) && isRegularFile(otherMeta) {
+									from := t
+									if v == MV_EXISTING {
+										from = getDt()
+									}
+									keepConflictCopy(t, from, ino, peer, replica, now)
+								}
 							}
 						}
 					}
@@ -132,11 +330,24 @@ func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
 			if !local && v != MV_NEW && !isdir[k.Ino()] {
 				return
 			}
+
+			// Chunks may overlap with ones we have, so
+			// chunked data is replaced as a whole
+			// afterwards.
+			if !local && k.SubType() == BST_FILE_OFFSET2CHUNK {
+				chunked[ino] = true
+				return
+			}
 			if newC == nil {
 				// Delete
 				cv := t.Get(oldC.Key)
 				if cv != nil && (*cv == oldC.Value || v == MV_NEW) {
 					mlog.Printf2("fs/merge", " delete %x", oldC.Key)
+					if k.SubType() == BST_FILE_INODEFILENAME {
+						b := []byte(k.SubTypeData())
+						removed[ino] = fsckEntry{binary.BigEndian.Uint64(b), string(b[8:]), ino}
+					}
+					chargeMeta(k, cv, nil)
 					t.Delete(oldC.Key)
 				}
 			} else if oldC == nil {
@@ -144,6 +355,7 @@ func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
 				cv := t.Get(newC.Key)
 				if cv == nil || v == MV_NEW {
 					mlog.Printf2("fs/merge", " insert %x", newC.Key)
+					chargeMeta(k, cv, &newC.Value)
 					t.Set(newC.Key, newC.Value)
 				}
 			} else {
@@ -151,15 +363,68 @@ func MergeTo3(tr *hugger.Transaction, src, dst *ibtree.Node, local bool) {
 				cv := t.Get(oldC.Key)
 				if (cv != nil && *cv == oldC.Value) || v == MV_NEW {
 					mlog.Printf2("fs/merge", " update %x", newC.Key)
+					chargeMeta(k, cv, &newC.Value)
 					t.Set(newC.Key, newC.Value)
 				}
 			}
 		})
+	if err != nil {
+		return
+	}
+	for ino, vv := range merged {
+		mk := NewBlockKey(ino, BST_META, "").IB()
+		mv := t.Get(mk)
+		if mv == nil {
+			continue
+		}
+		meta := decodeInodeMeta(*mv)
+		meta.VersionVector = vv
+		b, err := meta.MarshalMsg(nil)
+		if err != nil {
+			log.Panic(err)
+		}
+		t.Set(mk, string(b))
+	}
 	for ino, v := range m {
 		if v == MV_NONE {
+			// Entries pointing at the inode, as well as
+			// entries in it, need to be checked
+			IterateInoSubTypeKeys(t, ino, BST_FILE_INODEFILENAME,
+				func(key BlockKey) bool {
+					touched[binary.BigEndian.Uint64([]byte(key.SubTypeData()))] = true
+					return true
+				})
+			IterateInoSubTypeKeys(t, ino, BST_DIR_NAME2INODE,
+				func(key BlockKey) bool {
+					touched[binary.BigEndian.Uint64([]byte(*t.Get(key.IB())))] = true
+					return true
+				})
+			mk := NewBlockKey(ino, BST_META, "")
+			chargeMeta(mk, t.Get(mk.IB()), nil)
 			k1 := NewBlockKey(ino, BST_NONE, "").IB()
 			k2 := NewBlockKey(ino, BST_LAST, "").IB()
 			t.DeleteRange(k1, k2)
+			forgetConflict(t, ino)
+		}
+	}
+	for ino := range chunked {
+		nt := getDt()
+		mlog.Printf2("fs/merge", " replacing chunks of #%d", ino)
+		k1 := NewBlockKey(ino, BST_FILE_OFFSET2CHUNK, "").IB()
+		k2 := NewBlockKey(ino, BST_FILE_OFFSET2CHUNK+1, "").IB()
+		t.DeleteRange(k1, k2)
+		IterateInoSubTypeKeys(nt, ino, BST_FILE_OFFSET2CHUNK,
+			func(key BlockKey) bool {
+				t.Set(key.IB(), *nt.Get(key.IB()))
+				return true
+			})
+	}
+	if !local {
+		lostFoundDir := uint64(fuse.FUSE_ROOT_ID)
+		if scope != nil {
+			lostFoundDir = scope.root
 		}
+		repairNamespace(t, touched, removed, lostFoundDir, peer, replica, now)
 	}
+	return
 }
@@ -0,0 +1,329 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Non-local merge decides the fate of each inode separately, so even
+// if both sides were consistent, the result may not be: e.g. a
+// directory removed by the peer may have gained entries locally, the
+// same name may have been created on both sides, and concurrent
+// renames may leave a directory in two places, or in a cycle detached
+// from the root.
+//
+// repairNamespace fixes this within the merge transaction, looking
+// only at the inodes touched by the merge (and the children of the
+// directories it removed). Dangling and duplicate entries are
+// removed, and orphaned inodes are reattached next to their former
+// name (like conflict copies), or in lostFoundName directory if the
+// former directory is gone or the inode is a directory in a
+// cycle. Inodes with neither links nor StNlink are unlinked but still
+// open files, and are left alone.
+//
+// Repairs are local changes, so the metadata of the changed inodes is
+// updated (with version vector incremented) for them to propagate
+// further.
+
+type namespaceRepair struct {
+	t       *ibtree.Transaction
+	peer    string
+	now     time.Time
+	replica uint64
+
+	metas map[uint64]*InodeMeta
+
+	// orig contains the metadata of existing inodes as it was
+	// before the repair
+	orig map[uint64]InodeMeta
+
+	// removed contains entries removed by the merge
+	removed map[uint64]fsckEntry
+
+	// modified inodes have had their entries (or reverse entries)
+	// changed
+	modified map[uint64]bool
+
+	// lostFoundDir is the directory in which lostFoundName is
+	// created
+	lostFoundDir uint64
+	lostFound    uint64
+}
+
+func (self *namespaceRepair) meta(ino uint64) *InodeMeta {
+	meta, ok := self.metas[ino]
+	if !ok {
+		if v := self.t.Get(NewBlockKey(ino, BST_META, "").IB()); v != nil {
+			meta = decodeInodeMeta(*v)
+			self.orig[ino] = *meta
+		}
+		self.metas[ino] = meta
+	}
+	return meta
+}
+
+func (self *namespaceRepair) isDir(ino uint64) bool {
+	meta := self.meta(ino)
+	return meta != nil && meta.IsDir()
+}
+
+func (self *namespaceRepair) entryChild(dir uint64, name string) (uint64, bool) {
+	v := self.t.Get(NewBlockKeyDirFilename(dir, name).IB())
+	if v == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64([]byte(*v)), true
+}
+
+func (self *namespaceRepair) addEntry(e fsckEntry) {
+	mlog.Printf2("fs/mergerepair", " adding %v", e)
+	self.t.Set(NewBlockKeyDirFilename(e.dir, e.name).IB(), string(util.Uint64Bytes(e.child)))
+	self.t.Set(NewBlockKeyReverseDirFilename(e.child, e.dir, e.name).IB(), "")
+	self.modified[e.dir] = true
+	self.modified[e.child] = true
+}
+
+func (self *namespaceRepair) removeEntry(e fsckEntry) {
+	mlog.Printf2("fs/mergerepair", " removing %v", e)
+	if child, ok := self.entryChild(e.dir, e.name); ok && child == e.child {
+		self.t.Delete(NewBlockKeyDirFilename(e.dir, e.name).IB())
+		self.modified[e.dir] = true
+	}
+	rk := NewBlockKeyReverseDirFilename(e.child, e.dir, e.name).IB()
+	if self.t.Get(rk) != nil {
+		self.t.Delete(rk)
+		self.modified[e.child] = true
+	}
+}
+
+// checkEntries removes the entries of the directory that refer to
+// inodes that do not exist, and adds the missing reverse entries. The
+// children are added to candidates.
+func (self *namespaceRepair) checkEntries(dir uint64, candidates map[uint64]bool) {
+	var l []fsckEntry
+	IterateInoSubTypeKeys(self.t, dir, BST_DIR_NAME2INODE,
+		func(key BlockKey) bool {
+			child := binary.BigEndian.Uint64([]byte(*self.t.Get(key.IB())))
+			l = append(l, fsckEntry{dir, key.Filename(), child})
+			return true
+		})
+	for _, e := range l {
+		if self.meta(e.child) == nil {
+			self.removeEntry(e)
+			continue
+		}
+		candidates[e.child] = true
+		rk := NewBlockKeyReverseDirFilename(e.child, e.dir, e.name).IB()
+		if self.t.Get(rk) == nil {
+			self.addEntry(e)
+		}
+	}
+}
+
+// links returns the valid entries of the inode, removing reverse
+// entries without matching entry. If any were removed (now or by the
+// merge), one within still existing directory is returned as former.
+func (self *namespaceRepair) links(ino uint64) (l []fsckEntry, former *fsckEntry) {
+	var all []fsckEntry
+	IterateInoSubTypeKeys(self.t, ino, BST_FILE_INODEFILENAME,
+		func(key BlockKey) bool {
+			b := []byte(key.SubTypeData())
+			dir := binary.BigEndian.Uint64(b)
+			all = append(all, fsckEntry{dir, string(b[8:]), ino})
+			return true
+		})
+	for _, e := range all {
+		if !self.isDir(e.dir) {
+			self.removeEntry(e)
+			continue
+		}
+		if child, ok := self.entryChild(e.dir, e.name); ok && child == ino {
+			l = append(l, e)
+			continue
+		}
+		if former == nil {
+			fe := e
+			former = &fe
+		}
+		self.removeEntry(e)
+	}
+	if e, ok := self.removed[ino]; ok && former == nil && self.isDir(e.dir) {
+		former = &e
+	}
+	return
+}
+
+func (self *namespaceRepair) getLostFound() uint64 {
+	if self.lostFound != 0 {
+		return self.lostFound
+	}
+	name := lostFoundName
+	if child, ok := self.entryChild(self.lostFoundDir, name); ok {
+		if self.isDir(child) {
+			self.lostFound = child
+			return child
+		}
+		name = conflictName(self.t, self.lostFoundDir, name, self.peer, self.now)
+	}
+	ino := unusedIno(self.t)
+	mlog.Printf2("fs/mergerepair", " creating %s #%d", name, ino)
+	meta := &InodeMeta{}
+	meta.StMode = fuse.S_IFDIR | 0700
+	meta.setTimesNow(true, true, true)
+	self.metas[ino] = meta
+	self.addEntry(fsckEntry{self.lostFoundDir, name, ino})
+	self.lostFound = ino
+	return ino
+}
+
+// reattach adds entry for the inode next to the former one, or in
+// lost+found if there is no former one.
+func (self *namespaceRepair) reattach(ino uint64, former *fsckEntry) {
+	mlog.Printf2("fs/mergerepair", " reattaching #%d", ino)
+	if former != nil {
+		name := conflictName(self.t, former.dir, former.name, self.peer, self.now)
+		self.addEntry(fsckEntry{former.dir, name, ino})
+		return
+	}
+	self.addEntry(fsckEntry{self.getLostFound(), fmt.Sprintf("#%d", ino), ino})
+}
+
+// reachable determines if the directory is reachable from the root.
+func (self *namespaceRepair) reachable(ino uint64) bool {
+	seen := make(map[uint64]bool)
+	for ino != fuse.FUSE_ROOT_ID {
+		if seen[ino] {
+			return false
+		}
+		seen[ino] = true
+		l, _ := self.links(ino)
+		if len(l) == 0 {
+			return false
+		}
+		ino = l[0].dir
+	}
+	return true
+}
+
+// fixMeta updates the link count (and parent) of the inode, and
+// stores the metadata if it or the entries of the inode changed.
+func (self *namespaceRepair) fixMeta(ino uint64) {
+	meta := self.meta(ino)
+	if meta == nil {
+		return
+	}
+	l, _ := self.links(ino)
+	nlink := uint32(len(l))
+	if ino == fuse.FUSE_ROOT_ID {
+		nlink++
+	}
+	if meta.StNlink != nlink {
+		mlog.Printf2("fs/mergerepair", " #%d link count %d -> %d", ino, meta.StNlink, nlink)
+		meta.StNlink = nlink
+	}
+	if meta.IsDir() {
+		var parent uint64
+		if len(l) > 0 {
+			parent = l[0].dir
+		}
+		meta.ParentIno = parent
+	}
+	orig, existed := self.orig[ino]
+	if existed && !self.modified[ino] && meta.InodeMetaData == orig.InodeMetaData {
+		return
+	}
+	meta.setTimesNow(false, true, self.modified[ino] && meta.IsDir())
+	meta.VersionVector = meta.VersionVector.Increment(self.replica)
+	b, err := meta.MarshalMsg(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	var omd *InodeMetaData
+	if existed {
+		omd = &orig.InodeMetaData
+	}
+	chargeUsageInTransaction(self.t, omd, &meta.InodeMetaData)
+	self.t.Set(NewBlockKey(ino, BST_META, "").IB(), string(b))
+}
+
+func sortedInoSet(m map[uint64]bool) (l []uint64) {
+	for ino := range m {
+		l = append(l, ino)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return
+}
+
+// repairNamespace fixes the namespace consistency of the touched
+// inodes after non-local merge. lost+found is created in lostFoundDir.
+func repairNamespace(t *ibtree.Transaction, touched map[uint64]bool, removed map[uint64]fsckEntry, lostFoundDir uint64, peer string, replica uint64, now time.Time) {
+	mlog.Printf2("fs/mergerepair", "repairNamespace %d inodes", len(touched))
+	self := &namespaceRepair{t: t, peer: peer, now: now,
+		replica:      replica,
+		removed:      removed,
+		lostFoundDir: lostFoundDir,
+		metas:        make(map[uint64]*InodeMeta),
+		orig:         make(map[uint64]InodeMeta),
+		modified:     make(map[uint64]bool)}
+	candidates := make(map[uint64]bool)
+	for ino := range touched {
+		candidates[ino] = true
+	}
+	for _, ino := range sortedInoSet(touched) {
+		if self.isDir(ino) {
+			self.checkEntries(ino, candidates)
+		}
+	}
+
+	inos := sortedInoSet(candidates)
+	for _, ino := range inos {
+		meta := self.meta(ino)
+		if meta == nil || ino == fuse.FUSE_ROOT_ID {
+			continue
+		}
+		l, former := self.links(ino)
+		if meta.IsDir() && len(l) > 1 {
+			// Prefer the place the metadata agrees with
+			keep := 0
+			for i, e := range l {
+				if e.dir == meta.ParentIno {
+					keep = i
+					break
+				}
+			}
+			for i, e := range l {
+				if i != keep {
+					self.removeEntry(e)
+				}
+			}
+		} else if len(l) == 0 && meta.StNlink > 0 {
+			self.reattach(ino, former)
+		}
+	}
+
+	// Concurrent renames may produce cycles
+	for _, ino := range inos {
+		if ino != fuse.FUSE_ROOT_ID && self.isDir(ino) && !self.reachable(ino) {
+			l, _ := self.links(ino)
+			for _, e := range l {
+				self.removeEntry(e)
+			}
+			self.reattach(ino, nil)
+		}
+	}
+
+	for ino := range self.modified {
+		candidates[ino] = true
+	}
+	for _, ino := range sortedInoSet(candidates) {
+		self.fixMeta(ino)
+	}
+}
@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+// conflictNames returns the names in the directory that start with
+// name and are conflict copies.
+func conflictNames(t *testing.T, u *FSUser, dir, name string) (l []string) {
+	names, err := u.ListDir(dir)
+	assert.Nil(t, err)
+	for _, n := range names {
+		if strings.HasPrefix(n, name+" (conflict ") {
+			l = append(l, n)
+		}
+	}
+	sort.Strings(l)
+	return
+}
+
+func TestMergeRepair(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+	check := func() {
+		assert.Equal(t, len(fs.Fsck(false)), 0)
+	}
+
+	// Directory removed by peer while we added to it
+	assert.Nil(t, u.Mkdir("/d", 0777))
+	writeTestFile(t, u, "/d/x", "x")
+	forkPeer(t, fs, "p", func(u *FSUser) {
+		assert.Nil(t, u.Remove("/d/x"))
+		assert.Nil(t, u.Remove("/d"))
+	})
+	writeTestFile(t, u, "/d/y", "y")
+	mergeFromPeer(fs, "p")
+	check()
+	l := conflictNames(t, u, "/", "d")
+	assert.Equal(t, len(l), 1)
+	assert.Equal(t, readTestFile(t, u, "/"+l[0]+"/y"), "y")
+	assert.Nil(t, u.Remove("/"+l[0]+"/y"))
+	assert.Nil(t, u.Remove("/"+l[0]))
+
+	// Same name created on both sides
+	forkPeer(t, fs, "q", func(u *FSUser) {
+		writeTestFile(t, u, "/n", "peer")
+	})
+	writeTestFile(t, u, "/n", "local")
+	mergeFromPeer(fs, "q")
+	check()
+	l = conflictNames(t, u, "/", "n")
+	assert.Equal(t, len(l), 1)
+	contents := []string{readTestFile(t, u, "/n"), readTestFile(t, u, "/"+l[0])}
+	sort.Strings(contents)
+	assert.Equal(t, contents, []string{"local", "peer"})
+
+	// Concurrent renames of directories into each other
+	assert.Nil(t, u.Mkdir("/a", 0777))
+	assert.Nil(t, u.Mkdir("/b", 0777))
+	forkPeer(t, fs, "r", func(u *FSUser) {
+		assert.Nil(t, u.Rename("/a", "/b/a"))
+	})
+	assert.Nil(t, u.Rename("/b", "/a/b"))
+	mergeFromPeer(fs, "r")
+	check()
+	names, err := u.ListDir("/" + lostFoundName)
+	assert.Nil(t, err)
+	assert.Equal(t, len(names), 1)
+
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
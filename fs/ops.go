@@ -13,14 +13,17 @@ package fs
 
 import (
 	"bytes"
+	"encoding/hex"
+	"log"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fingon/go-tfhfs/ibtree/hugger"
 	"github.com/fingon/go-tfhfs/mlog"
-	. "github.com/hanwen/go-fuse/fuse"
+	. "github.com/hanwen/go-fuse/v2/fuse"
 )
 
 // Whether to implement our own Access and associated other security
@@ -48,20 +51,58 @@ func (self *fsOps) SetDebug(dbg bool) {
 	// debug is covered by mlog
 }
 
-func (self *fsOps) StatFs(input *InHeader, out *StatfsOut) Status {
+func (self *fsOps) OnUnmount() {
+}
+
+// dispatch returns the fsOps responsible for the given node id, and
+// the node id to use with it. Node ids of child filesystems (e.g.
+// snapshot views) are translated to their own inode numbers.
+func (self *fsOps) dispatch(nodeId uint64) (*fsOps, uint64) {
+	fs, ino := self.fs.children.node(nodeId)
+	if fs == nil {
+		return self, nodeId
+	}
+	return &fs.Ops, ino
+}
+
+func (self *fsOps) StatFs(cancel <-chan struct{}, input *InHeader, out *StatfsOut) Status {
 	bsize := uint64(blockSize)
 	out.Bsize = uint32(bsize)
 	out.Frsize = uint32(bsize)
-	avail := self.fs.storage.Backend.GetBytesAvailable() / bsize
+	usage := self.fs.Usage()
+	avail := usage.AvailableBytes / bsize
 	out.Bfree = avail
 	out.Bavail = avail
-	used := self.fs.storage.Backend.GetBytesUsed() / bsize
-	total := used + avail
+	// Used space is the logical size of the data (what e.g. du
+	// would show); savings from deduplication and compression
+	// show up as larger total size.
+	used := usage.PhysicalBytes
+	if usage.LogicalBytes > used {
+		used = usage.LogicalBytes
+	}
+	total := used/bsize + avail
 	out.Blocks = total
+	if usage.InodeLimit != 0 {
+		out.Files = usage.InodeLimit
+		if usage.Inodes < usage.InodeLimit {
+			out.Ffree = usage.InodeLimit - usage.Inodes
+		}
+	} else {
+		// Inode is at least a block, so that is the most
+		// there can be
+		out.Files = usage.Inodes + avail
+		out.Ffree = avail
+	}
+	if input.Uid != 0 {
+		u := self.fs.GetQuota(QuotaUser, input.Uid)
+		applyQuotaToStatfs(&u, out)
+		g := self.fs.GetQuota(QuotaGroup, input.Gid)
+		applyQuotaToStatfs(&g, out)
+	}
 	return OK
 }
 
-func (self *fsOps) access(inode *inode, mode uint32, orOwn bool, ctx *Context) Status {
+func (self *fsOps) access(inode *inode, mode uint32, orOwn bool, ctx *Caller) Status {
 	if inode == nil {
 		mlog.Printf2("fs/ops", "access: -does not exist")
 		return ENOENT
@@ -98,7 +139,7 @@ func (self *fsOps) access(inode *inode, mode uint32, orOwn bool, ctx *Context) S
 }
 
 // lookup gets child of a parent.
-func (self *fsOps) lookup(parent *inode, name string, ctx *Context) (child *inode, code Status) {
+func (self *fsOps) lookup(parent *inode, name string, ctx *Caller) (child *inode, code Status) {
 	if parent == nil {
 		code = ENOENT
 		return
@@ -124,7 +165,21 @@ func (self *fsOps) lookup(parent *inode, name string, ctx *Context) (child *inod
 	return
 }
 
-func (self *fsOps) Lookup(input *InHeader, name string, out *EntryOut) (code Status) {
+func (self *fsOps) Lookup(cancel <-chan struct{}, input *InHeader, name string, out *EntryOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Lookup(cancel, &in, name, out)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		if name == "." {
+			return self.fillVirtualDirEntryOut(input.NodeId, out)
+		}
+		return self.fillVirtualDirChildEntryOut(input.NodeId, name, out)
+	}
+	if self.fs.isReservedName(input.NodeId, name) {
+		return self.fillSnapshotsEntryOut(out)
+	}
 	parent := self.fs.GetInode(input.NodeId)
 	defer parent.Release()
 
@@ -132,7 +187,7 @@ func (self *fsOps) Lookup(input *InHeader, name string, out *EntryOut) (code Sta
 		return ENOENT
 	}
 
-	child, code := self.lookup(parent, name, &input.Context)
+	child, code := self.lookup(parent, name, &input.Caller)
 	defer child.Release()
 
 	if code.Ok() {
@@ -142,10 +197,28 @@ func (self *fsOps) Lookup(input *InHeader, name string, out *EntryOut) (code Sta
 }
 
 func (self *fsOps) Forget(nodeID, nlookup uint64) {
+	if ops, ino := self.dispatch(nodeID); ops != self {
+		ops.Forget(ino, nlookup)
+		self.fs.children.forget(nodeID, nlookup)
+		return
+	}
+	if self.fs.isVirtualDir(nodeID) {
+		return
+	}
 	self.fs.GetInode(nodeID).Forget(nlookup)
 }
 
-func (self *fsOps) GetAttr(input *GetAttrIn, out *AttrOut) (code Status) {
+func (self *fsOps) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.GetAttr(cancel, &in, out)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		out.AttrValid = attrValidity
+		out.AttrValidNsec = 0
+		return self.fillVirtualDirAttr(input.NodeId, &out.Attr)
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	if inode == nil {
 		return ENOENT
@@ -160,8 +233,16 @@ func (self *fsOps) GetAttr(input *GetAttrIn, out *AttrOut) (code Status) {
 	return
 }
 
-func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
+func (self *fsOps) SetAttr(cancel <-chan struct{}, input *SetAttrIn, out *AttrOut) (code Status) {
 	mlog.Printf2("fs/ops", "SetAttr")
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.SetAttr(cancel, &in, out)
+	}
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	if inode == nil {
 		mlog.Printf2("fs/ops", " no such file")
@@ -170,11 +251,26 @@ func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
 	defer inode.Release()
 	defer inode.metaWriteLock.Locked()()
 
-	uid := input.Context.Uid
+	if input.Valid&FATTR_SIZE != 0 && inode.IsFile() && inode.Meta().StSize != input.Size {
+		self.fs.flushChunkBuffers(inode)
+		var file *inodeFH
+		if input.Valid&FATTR_FH != 0 {
+			file = self.fs.GetFileByFh(input.Fh)
+		}
+		if file == nil || !file.versioned {
+			inode.saveVersion()
+		}
+		if file != nil {
+			file.versioned = true
+			file.unflushed = true
+		}
+	}
+
+	uid := input.Caller.Uid
 	root := uid == 0
 	ownGid := func(gid uint32) bool {
 		// Eventually could check supplementary groups too
-		return gid == input.Context.Gid
+		return gid == input.Caller.Gid
 	}
 
 	self.fs.Update(func(tr *hugger.Transaction) {
@@ -241,6 +337,10 @@ func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
 		if input.Valid&FATTR_SIZE != 0 {
 			newmeta.StSize = input.Size
 		}
+		code = self.fs.checkQuota(tr.IB(), &meta.InodeMetaData, &newmeta)
+		if !code.Ok() {
+			return
+		}
 
 		oldmode := meta.StMode
 		mode := oldmode
@@ -267,7 +367,7 @@ func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
 		if newmeta != meta.InodeMetaData {
 			isTruncate := input.Valid&FATTR_SIZE != 0
 			if !useKernelPermissions {
-				code = self.access(inode, W_OK, !isTruncate, &input.Context)
+				code = self.access(inode, W_OK, !isTruncate, &input.Caller)
 				if !code.Ok() {
 					if isTruncate {
 						// Truncate says EACCES
@@ -293,19 +393,52 @@ func (self *fsOps) SetAttr(input *SetAttrIn, out *AttrOut) (code Status) {
 	return
 }
 
-func (self *fsOps) Release(input *ReleaseIn) {
-	self.fs.GetFileByFh(input.Fh).Release()
+func (self *fsOps) Release(cancel <-chan struct{}, input *ReleaseIn) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		ops.Release(cancel, &in)
+		return
+	}
+	self.fs.locks.ReleaseOwner(input.NodeId, input.LockOwner, true,
+		input.ReleaseFlags&releaseFlockUnlock != 0)
+	file := self.fs.GetFileByFh(input.Fh)
+	// Release has no way to return errors; whatever is left
+	// unreported at this point can only be logged
+	if code := file.writeError(); !code.Ok() {
+		log.Printf("Unreported write error on release of %v: %v", file, code)
+	}
+	file.Release()
 }
 
 func (self *fsOps) ReleaseDir(input *ReleaseIn) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		ops.ReleaseDir(&in)
+		return
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		return
+	}
 	self.fs.GetFileByFh(input.Fh).Release()
 }
 
-func (self *fsOps) OpenDir(input *OpenIn, out *OpenOut) (code Status) {
+func (self *fsOps) OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.OpenDir(cancel, &in, out)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		// ReadDir is handled based on the node id
+		out.Fh = 0
+		return OK
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, R_OK|X_OK, false, &input.Context)
+	code = self.access(inode, R_OK|X_OK, false, &input.Caller)
 	if !code.Ok() {
 		return
 	}
@@ -318,7 +451,18 @@ func (self *fsOps) OpenDir(input *OpenIn, out *OpenOut) (code Status) {
 
 }
 
-func (self *fsOps) Open(input *OpenIn, out *OpenOut) (code Status) {
+func (self *fsOps) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Open(cancel, &in, out)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		return EISDIR
+	}
+	if self.fs.readOnly && input.Flags&(O_ANYWRITE|uint32(os.O_TRUNC)) != 0 {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	mlog.Printf2("fs/ops", "ops.Open %v", input.NodeId)
 	defer inode.Release()
@@ -330,11 +474,20 @@ func (self *fsOps) Open(input *OpenIn, out *OpenOut) (code Status) {
 	} else if input.Flags&O_ANYWRITE != 0 {
 		mode |= W_OK
 	}
-	code = self.access(inode, mode, false, &input.Context)
+	code = self.access(inode, mode, false, &input.Caller)
 	if !code.Ok() {
 		return
 	}
 
+	if self.fs.readOnly {
+		out.Fh = inode.GetFile(input.Flags).fh
+		return OK
+	}
+
+	truncate := input.Flags&uint32(os.O_TRUNC) != 0
+	if truncate {
+		inode.saveVersion()
+	}
 	self.fs.Update(func(tr *hugger.Transaction) {
 		meta := inode.Meta()
 		// No ATime for now
@@ -342,17 +495,27 @@ func (self *fsOps) Open(input *OpenIn, out *OpenOut) (code Status) {
 			meta.SetMTimeNow()
 		}
 
-		if input.Flags&uint32(os.O_TRUNC) != 0 {
+		if truncate {
 			inode.SetMetaSizeInTransaction(meta, 0, tr)
 		}
 		inode.SetMetaInTransaction(meta, tr)
 	})
 
-	out.Fh = inode.GetFile(input.Flags).fh
+	file := inode.GetFile(input.Flags)
+	file.versioned = truncate
+	out.Fh = file.fh
 	return OK
 }
 
-func (self *fsOps) ReadDir(input *ReadIn, l *DirEntryList) Status {
+func (self *fsOps) ReadDir(cancel <-chan struct{}, input *ReadIn, l *DirEntryList) Status {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.ReadDir(cancel, &in, l)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		return self.readVirtualDir(input, l, false)
+	}
 	dir := self.fs.GetFileByFh(input.Fh)
 	dir.SetPos(input.Offset)
 	for dir.ReadDirEntry(l) {
@@ -360,7 +523,15 @@ func (self *fsOps) ReadDir(input *ReadIn, l *DirEntryList) Status {
 	return OK
 }
 
-func (self *fsOps) ReadDirPlus(input *ReadIn, l *DirEntryList) Status {
+func (self *fsOps) ReadDirPlus(cancel <-chan struct{}, input *ReadIn, l *DirEntryList) Status {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.ReadDirPlus(cancel, &in, l)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		return self.readVirtualDir(input, l, true)
+	}
 	dir := self.fs.GetFileByFh(input.Fh)
 	dir.SetPos(input.Offset)
 	for dir.ReadDirPlus(input, l) {
@@ -368,11 +539,16 @@ func (self *fsOps) ReadDirPlus(input *ReadIn, l *DirEntryList) Status {
 	return OK
 }
 
-func (self *fsOps) Readlink(input *InHeader) (out []byte, code Status) {
+func (self *fsOps) Readlink(cancel <-chan struct{}, input *InHeader) (out []byte, code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Readlink(cancel, &in)
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, R_OK, false, &input.Context)
+	code = self.access(inode, R_OK, false, &input.Caller)
 	if !code.Ok() {
 		return
 	}
@@ -393,10 +569,19 @@ func (self *fsOps) Readlink(input *InHeader) (out []byte, code Status) {
 
 func (self *fsOps) create(input *InHeader, name string, meta *InodeMeta, allowReplace bool) (child *inode, code Status) {
 	mlog.Printf2("fs/ops", " create %v", name)
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) {
+		code = EROFS
+		return
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, W_OK|X_OK, false, &input.Context)
+	if self.fs.isReservedName(inode.ino, name) || self.fs.isTrashName(inode.ino, name) {
+		code = Status(syscall.EEXIST)
+		return
+	}
+
+	code = self.access(inode, W_OK|X_OK, false, &input.Caller)
 	if !code.Ok() {
 		return
 	}
@@ -404,13 +589,24 @@ func (self *fsOps) create(input *InHeader, name string, meta *InodeMeta, allowRe
 
 	child = inode.GetChildByName(name)
 	defer child.Release()
-	if child != nil {
+	if child == nil {
+		tr := self.fs.GetNestableTransaction()
+		if !self.fs.inodesAvailable(tr.IB(), 1) {
+			code = Status(syscall.ENOSPC)
+		} else {
+			code = self.fs.checkQuota(tr.IB(), nil, &meta.InodeMetaData)
+		}
+		tr.Close()
+		if !code.Ok() {
+			return
+		}
+	} else {
 		if !allowReplace {
 			code = Status(syscall.EEXIST)
 			return
 		}
 		b := false
-		code = self.unlinkInInode(inode, name, &b, &input.Context)
+		code = self.unlinkInInode(inode, name, &b, &input.Caller)
 		if !code.Ok() {
 			return
 		}
@@ -425,7 +621,12 @@ func (self *fsOps) create(input *InHeader, name string, meta *InodeMeta, allowRe
 	return
 }
 
-func (self *fsOps) Mkdir(input *MkdirIn, name string, out *EntryOut) (code Status) {
+func (self *fsOps) Mkdir(cancel <-chan struct{}, input *MkdirIn, name string, out *EntryOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Mkdir(cancel, &in, name, out)
+	}
 	var meta InodeMeta
 	meta.SetMkdirIn(input)
 	child, code := self.create(&input.InHeader, name, &meta, false)
@@ -437,7 +638,17 @@ func (self *fsOps) Mkdir(input *MkdirIn, name string, out *EntryOut) (code Statu
 	return OK
 }
 
-func (self *fsOps) unlinkInodeInInode(inode, child *inode, name string, isdir *bool, ctx *Context) (code Status) {
+func (self *fsOps) unlinkInodeInInode(inode, child *inode, name string, isdir *bool, ctx *Caller) (code Status) {
+	code = self.unlinkCheck(inode, child, isdir, ctx)
+	if !code.Ok() {
+		return
+	}
+	inode.RemoveChild(child, name)
+	return OK
+}
+
+// unlinkCheck checks whether child may be unlinked from inode.
+func (self *fsOps) unlinkCheck(inode, child *inode, isdir *bool, ctx *Caller) (code Status) {
 	inode.metaWriteLock.AssertLocked()
 	child.metaWriteLock.AssertLocked()
 
@@ -466,11 +677,10 @@ func (self *fsOps) unlinkInodeInInode(inode, child *inode, name string, isdir *b
 		code = EPERM
 		return
 	}
-	inode.RemoveChild(child, name)
 	return OK
 }
 
-func (self *fsOps) unlinkInInode(inode *inode, name string, isdir *bool, ctx *Context) (code Status) {
+func (self *fsOps) unlinkInInode(inode *inode, name string, isdir *bool, ctx *Caller) (code Status) {
 	inode.metaWriteLock.AssertLocked()
 	child, code := self.lookup(inode, name, ctx)
 	defer child.Release()
@@ -484,7 +694,7 @@ func (self *fsOps) unlinkInInode(inode *inode, name string, isdir *bool, ctx *Co
 // stickyMutateCheck check handles sticky bit handling of directories.
 // If sticky bit is set, users cannot remove non-owned files unless
 // they own the directory as well.
-func (self *fsOps) stickyMutateCheck(inode, child *inode, ctx *Context) Status {
+func (self *fsOps) stickyMutateCheck(inode, child *inode, ctx *Caller) Status {
 	meta := inode.Meta()
 	if meta == nil {
 		return ENOENT
@@ -510,13 +720,25 @@ func (self *fsOps) stickyMutateCheck(inode, child *inode, ctx *Context) Status {
 }
 
 func (self *fsOps) unlink(input *InHeader, name string, isdir *bool) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.unlink(&in, name, isdir)
+	}
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
+	if trash := self.fs.trashFor(inode); trash != nil {
+		defer trash.Release()
+		return self.trashInInode(inode, trash, name, isdir, &input.Caller)
+	}
 	defer inode.metaWriteLock.Locked()()
-	return self.unlinkInInode(inode, name, isdir, &input.Context)
+	return self.unlinkInInode(inode, name, isdir, &input.Caller)
 }
 
-func (self *fsOps) Unlink(input *InHeader, name string) (code Status) {
+func (self *fsOps) Unlink(cancel <-chan struct{}, input *InHeader, name string) (code Status) {
 	mlog.Printf2("fs/ops", "ops.Unlink %s", name)
 	b := false
 	bp := &b
@@ -526,7 +748,7 @@ func (self *fsOps) Unlink(input *InHeader, name string) (code Status) {
 	return self.unlink(input, name, bp)
 }
 
-func (self *fsOps) Rmdir(input *InHeader, name string) (code Status) {
+func (self *fsOps) Rmdir(cancel <-chan struct{}, input *InHeader, name string) (code Status) {
 	mlog.Printf2("fs/ops", "ops.Rmdir %s", name)
 	b := true
 	if name == ".." {
@@ -535,45 +757,110 @@ func (self *fsOps) Rmdir(input *InHeader, name string) (code Status) {
 	return self.unlink(input, name, &b)
 }
 
-func (self *fsOps) GetXAttrSize(input *InHeader, attr string) (size int, code Status) {
-	b, code := self.GetXAttrData(input, attr)
+// xattrResult provides the result of getxattr(2)/listxattr(2) in
+// dest; if it is too small, only the size is returned.
+func xattrResult(data, dest []byte, code Status) (uint32, Status) {
 	if !code.Ok() {
-		return
+		return 0, code
+	}
+	sz := uint32(len(data))
+	if len(dest) < len(data) {
+		return sz, ERANGE
 	}
-	return len(b), code
+	copy(dest, data)
+	return sz, OK
 }
 
-func (self *fsOps) GetXAttrData(input *InHeader, attr string) (data []byte, code Status) {
+func (self *fsOps) GetXAttr(cancel <-chan struct{}, input *InHeader, attr string, dest []byte) (uint32, Status) {
+	data, code := self.getXAttr(input, attr)
+	return xattrResult(data, dest, code)
+}
+
+func (self *fsOps) getXAttr(input *InHeader, attr string) (data []byte, code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.getXAttr(&in, attr)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		code = ENOATTR
+		return
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, R_OK, false, &input.Context)
+	code = self.access(inode, R_OK, false, &input.Caller)
 	if !code.Ok() {
 		return
 	}
 
+	if strings.HasPrefix(attr, quotaXAttr) {
+		return self.fs.getQuotaXAttr(attr, &input.Caller)
+	}
+	if attr == usageXAttr {
+		usage := self.fs.Usage()
+		return []byte(usage.String() + "\n"), OK
+	}
+	if attr == pathsXAttr {
+		paths := self.fs.PathsForInode(input.NodeId)
+		return []byte(strings.Join(paths, "\n") + "\n"), OK
+	}
+	if attr == versionsXAttr {
+		return self.getVersionsXAttr(inode), OK
+	}
+	if attr == rootBlockXAttr {
+		return []byte(hex.EncodeToString([]byte(self.fs.RootBlockId())) + "\n"), OK
+	}
 	return inode.GetXAttr(attr)
 }
 
-func (self *fsOps) SetXAttr(input *SetXAttrIn, attr string, data []byte) (code Status) {
+func (self *fsOps) SetXAttr(cancel <-chan struct{}, input *SetXAttrIn, attr string, data []byte) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.SetXAttr(cancel, &in, attr, data)
+	}
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, W_OK, true, &input.Context)
+	if strings.HasPrefix(attr, quotaXAttr) {
+		return self.fs.setQuotaXAttr(attr, data, &input.Caller)
+	}
+
+	code = self.access(inode, W_OK, true, &input.Caller)
 	if !code.Ok() {
 		return
 	}
 
+	if code, handled := self.setVersionXAttr(inode, attr, data); handled {
+		return code
+	}
 	return inode.SetXAttr(attr, data)
 }
 
-func (self *fsOps) ListXAttr(input *InHeader) (data []byte, code Status) {
+func (self *fsOps) ListXAttr(cancel <-chan struct{}, input *InHeader, dest []byte) (uint32, Status) {
+	data, code := self.listXAttr(input)
+	return xattrResult(data, dest, code)
+}
+
+func (self *fsOps) listXAttr(input *InHeader) (data []byte, code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.listXAttr(&in)
+	}
+	if self.fs.isVirtualDir(input.NodeId) {
+		return []byte{}, OK
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
 	defer inode.offsetMap.Locked(-1)()
 
-	code = self.access(inode, R_OK, false, &input.Context)
+	code = self.access(inode, R_OK, false, &input.Caller)
 	if !code.Ok() {
 		return
 	}
@@ -589,41 +876,64 @@ func (self *fsOps) ListXAttr(input *InHeader) (data []byte, code Status) {
 	return
 }
 
-func (self *fsOps) RemoveXAttr(input *InHeader, attr string) (code Status) {
+func (self *fsOps) RemoveXAttr(cancel <-chan struct{}, input *InHeader, attr string) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.RemoveXAttr(cancel, &in, attr)
+	}
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, W_OK, true, &input.Context)
+	code = self.access(inode, W_OK, true, &input.Caller)
 	if !code.Ok() {
 		return
 	}
 	return inode.RemoveXAttr(attr)
 }
 
-func (self *fsOps) Rename(input *RenameIn, oldName string, newName string) (code Status) {
+func (self *fsOps) Rename(cancel <-chan struct{}, input *RenameIn, oldName string, newName string) (code Status) {
 	mlog.Printf2("fs/ops", "Rename")
 
 	if input.NodeId == input.Newdir && oldName == newName {
 		return OK
 	}
 
+	ops, ino := self.dispatch(input.NodeId)
+	newops, newino := self.dispatch(input.Newdir)
+	if ops != newops {
+		return EXDEV
+	}
+	if ops != self {
+		in := *input
+		in.NodeId = ino
+		in.Newdir = newino
+		return ops.Rename(cancel, &in, oldName, newName)
+	}
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) || self.fs.isVirtualDir(input.Newdir) {
+		return EROFS
+	}
+
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
 
-	code = self.access(inode, W_OK|X_OK, true, &input.Context)
+	code = self.access(inode, W_OK|X_OK, true, &input.Caller)
 	if !code.Ok() {
 		mlog.Printf2("fs/ops", " no permissions")
 		return
 	}
 
-	child, code := self.lookup(inode, oldName, &input.Context)
+	child, code := self.lookup(inode, oldName, &input.Caller)
 	defer child.Release()
 	if !code.Ok() {
 		mlog.Printf2("fs/ops", " no oldName")
 		return
 	}
 
-	code = self.stickyMutateCheck(inode, child, &input.Context)
+	code = self.stickyMutateCheck(inode, child, &input.Caller)
 	if !code.Ok() {
 		mlog.Printf2("fs/ops", " stickyMutateCheck src failed")
 		return
@@ -631,13 +941,13 @@ func (self *fsOps) Rename(input *RenameIn, oldName string, newName string) (code
 
 	new_inode := self.fs.GetInode(input.Newdir)
 	defer new_inode.Release()
-	code = self.access(new_inode, W_OK|X_OK, true, &input.Context)
+	code = self.access(new_inode, W_OK|X_OK, true, &input.Caller)
 	if !code.Ok() {
 		mlog.Printf2("fs/ops", " no write permission to newdir")
 		return
 	}
 
-	code = self.stickyMutateCheck(new_inode, child, &input.Context)
+	code = self.stickyMutateCheck(new_inode, child, &input.Caller)
 	if !code.Ok() {
 		mlog.Printf2("fs/ops", " stickyMutateCheck dst failed")
 		return
@@ -657,22 +967,25 @@ func (self *fsOps) Rename(input *RenameIn, oldName string, newName string) (code
 
 	defer child.metaWriteLock.Locked()()
 	// First add new link
-	code = self.linkInInode(new_inode, child, newName, true, &input.Context)
+	code = self.linkInInode(new_inode, child, newName, true, &input.Caller)
 	if !code.Ok() {
 		return
 	}
 
 	// Then remove old link
-	code = self.unlinkInodeInInode(inode, child, oldName, nil, &input.Context)
+	code = self.unlinkInodeInInode(inode, child, oldName, nil, &input.Caller)
 	if !code.Ok() {
 		// Attempt to undo the newly added link
-		self.unlinkInodeInInode(new_inode, child, newName, nil, &input.Context)
+		self.unlinkInodeInInode(new_inode, child, newName, nil, &input.Caller)
 	}
 	return
 }
 
-func (self *fsOps) linkInInode(inode, child *inode, name string, override bool, ctx *Context) (code Status) {
+func (self *fsOps) linkInInode(inode, child *inode, name string, override bool, ctx *Caller) (code Status) {
 	inode.metaWriteLock.AssertLocked()
+	if self.fs.isReservedName(inode.ino, name) || self.fs.isTrashName(inode.ino, name) {
+		return Status(syscall.EEXIST)
+	}
 	code = self.access(inode, W_OK|X_OK, true, ctx)
 	if !code.Ok() {
 		mlog.Printf2("fs/ops", " no access to containing directory")
@@ -698,8 +1011,22 @@ func (self *fsOps) linkInInode(inode, child *inode, name string, override bool,
 	return OK
 }
 
-func (self *fsOps) Link(input *LinkIn, name string, out *EntryOut) (code Status) {
+func (self *fsOps) Link(cancel <-chan struct{}, input *LinkIn, name string, out *EntryOut) (code Status) {
 	mlog.Printf2("fs/ops", "Link")
+	ops, ino := self.dispatch(input.NodeId)
+	oldops, oldino := self.dispatch(input.Oldnodeid)
+	if ops != oldops {
+		return EXDEV
+	}
+	if ops != self {
+		in := *input
+		in.NodeId = ino
+		in.Oldnodeid = oldino
+		return ops.Link(cancel, &in, name, out)
+	}
+	if self.fs.readOnly || self.fs.isVirtualDir(input.NodeId) {
+		return EROFS
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	if inode == nil {
 		mlog.Printf2("fs/ops", " containing directory not found")
@@ -716,39 +1043,63 @@ func (self *fsOps) Link(input *LinkIn, name string, out *EntryOut) (code Status)
 	}
 	defer child.Release()
 	defer child.metaWriteLock.Locked()()
-	code = self.linkInInode(inode, child, name, false, &input.Context)
+	code = self.linkInInode(inode, child, name, false, &input.Caller)
 	if code.Ok() {
 		child.FillEntryOut(out)
 	}
 	return
 }
 
-func (self *fsOps) Access(input *AccessIn) (code Status) {
+func (self *fsOps) Access(cancel <-chan struct{}, input *AccessIn) (code Status) {
 	if useKernelPermissions {
 		return ENOSYS
 	}
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Access(cancel, &in)
+	}
 	inode := self.fs.GetInode(input.NodeId)
 	defer inode.Release()
-	return self.access(inode, input.Mask, false, &input.Context)
+	return self.access(inode, input.Mask, false, &input.Caller)
 }
 
-func (self *fsOps) Read(input *ReadIn, buf []byte) (ReadResult, Status) {
+func (self *fsOps) Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status) {
 	// Check perm?
 	// NOTE: This has to return len(data), less if EOF, or
 	// error. (unlike e.g. C API)
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Read(cancel, &in, buf)
+	}
 	file := self.fs.GetFileByFh(input.Fh)
 	return file.Read(buf, input.Offset)
 }
 
-func (self *fsOps) Write(input *WriteIn, data []byte) (written uint32, code Status) {
+func (self *fsOps) Write(cancel <-chan struct{}, input *WriteIn, data []byte) (written uint32, code Status) {
 	// Check perm?
 	// NOTE: This has to return len(data) or error. (unlike e.g. C API)
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Write(cancel, &in, data)
+	}
+	if self.fs.readOnly {
+		code = EROFS
+		return
+	}
 	file := self.fs.GetFileByFh(input.Fh)
 	return file.Write(data, input.Offset)
 }
 
-func (self *fsOps) Create(input *CreateIn, name string, out *CreateOut) (code Status) {
+func (self *fsOps) Create(cancel <-chan struct{}, input *CreateIn, name string, out *CreateOut) (code Status) {
 	mlog.Printf2("fs/ops", "ops.Create %s", name)
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Create(cancel, &in, name, out)
+	}
 	// first create file
 	var meta InodeMeta
 	meta.SetCreateIn(input)
@@ -762,7 +1113,7 @@ func (self *fsOps) Create(input *CreateIn, name string, out *CreateOut) (code St
 	ih := input.InHeader
 	ih.NodeId = child.ino
 	var oo OpenOut
-	code = self.Open(&OpenIn{InHeader: ih, Flags: input.Flags}, &oo)
+	code = self.Open(cancel, &OpenIn{InHeader: ih, Flags: input.Flags}, &oo)
 	if !code.Ok() {
 		return
 	}
@@ -771,7 +1122,12 @@ func (self *fsOps) Create(input *CreateIn, name string, out *CreateOut) (code St
 	return OK
 }
 
-func (self *fsOps) Mknod(input *MknodIn, name string, out *EntryOut) (code Status) {
+func (self *fsOps) Mknod(cancel <-chan struct{}, input *MknodIn, name string, out *EntryOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Mknod(cancel, &in, name, out)
+	}
 	var meta InodeMeta
 	meta.SetMknodIn(input)
 	child, code := self.create(&input.InHeader, name, &meta, false)
@@ -783,7 +1139,12 @@ func (self *fsOps) Mknod(input *MknodIn, name string, out *EntryOut) (code Statu
 	return OK
 }
 
-func (self *fsOps) Symlink(input *InHeader, pointedTo string, linkName string, out *EntryOut) (code Status) {
+func (self *fsOps) Symlink(cancel <-chan struct{}, input *InHeader, pointedTo string, linkName string, out *EntryOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Symlink(cancel, &in, pointedTo, linkName, out)
+	}
 	meta := InodeMeta{InodeMetaData: InodeMetaData{StUid: input.Uid,
 		StGid:  input.Gid,
 		StMode: S_IFLNK | 0777,
@@ -799,46 +1160,102 @@ func (self *fsOps) Symlink(input *InHeader, pointedTo string, linkName string, o
 	return OK
 }
 
-func (self *fsOps) Fsync(input *FsyncIn) (code Status) {
+func (self *fsOps) Fsync(cancel <-chan struct{}, input *FsyncIn) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Fsync(cancel, &in)
+	}
 	// After this call, everything up to this point has been
 	// committed to disk. Expensive, and potentially time
 	// consuming, but life is.
 	self.fs.WithoutParallelWrites(
 		func() {
 		})
-	// Then, we ensure that the storage has actually flushed
-	// things (this is somewhat expensive, should think if this is
-	// really sane way to handle this)
-	self.fs.storage.Flush()
+	file := self.fs.GetFileByFh(input.Fh)
+	if file == nil || !file.needsSync() {
+		// Then, we ensure that the storage has actually
+		// flushed things
+		self.fs.storage.Flush()
+		return OK
+	}
+	// Data reaches the backend only with the tree referring to it
+	file.unflushed = false
+	self.fs.Flush()
+	return file.writeError()
+}
+
+func (self *fsOps) FsyncDir(cancel <-chan struct{}, input *FsyncIn) (code Status) {
+	self.Fsync(cancel, input)
 	return OK
 }
 
-func (self *fsOps) FsyncDir(input *FsyncIn) (code Status) {
-	self.Fsync(nil)
+func (self *fsOps) Flush(cancel <-chan struct{}, input *FlushIn) Status {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Flush(cancel, &in)
+	}
+	// POSIX locks are released when any file descriptor of the
+	// owner is closed
+	self.fs.locks.ReleaseOwner(input.NodeId, input.LockOwner, true, false)
+	if file := self.fs.GetFileByFh(input.Fh); file != nil {
+		self.fs.chunkBufferLock.Do(file.flushChunkBuffer)
+		return file.writeError()
+	}
 	return OK
 }
 
-func (self *fsOps) Flush(input *FlushIn) Status {
-	// TBD - needed only if we implement locking support someday
-	return ENOSYS
+func (self *fsOps) Fallocate(cancel <-chan struct{}, in *FallocateIn) (code Status) {
+	if ops, ino := self.dispatch(in.NodeId); ops != self {
+		nin := *in
+		nin.NodeId = ino
+		return ops.Fallocate(cancel, &nin)
+	}
+	if self.fs.readOnly {
+		return EROFS
+	}
+	file := self.fs.GetFileByFh(in.Fh)
+	if file == nil || file.flags&O_ANYWRITE == 0 {
+		return EBADF
+	}
+	file.unflushed = true
+	return file.inode.Fallocate(in.Offset, in.Length, in.Mode)
 }
 
-func (self *fsOps) Fallocate(in *FallocateIn) (code Status) {
-	// TBD - we have rather loose definition of space :p
-	return ENOSYS
+func (self *fsOps) GetLk(cancel <-chan struct{}, input *LkIn, out *LkOut) (code Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.GetLk(cancel, &in, out)
+	}
+	lk, code := lockFromLkIn(input)
+	if !code.Ok() {
+		return
+	}
+	lk = self.fs.locks.Get(input.NodeId, lk)
+	out.Lk = FileLock{Start: lk.start, End: lk.end, Typ: lk.typ,
+		Pid: lk.pid}
+	return OK
 }
 
-func (self *fsOps) GetLk(input *LkIn, out *LkOut) (code Status) {
-	// TBD - implement locking someday?
-	return ENOSYS
+func (self *fsOps) SetLk(cancel <-chan struct{}, input *LkIn) (code Status) {
+	return self.setLk(input, false, cancel)
 }
 
-func (self *fsOps) SetLk(input *LkIn) (code Status) {
-	// TBD - implement locking someday?
-	return ENOSYS
+func (self *fsOps) SetLkw(cancel <-chan struct{}, input *LkIn) (code Status) {
+	return self.setLk(input, true, cancel)
+}
+
+// Ioctl supports no ioctls. Notably FICLONE and FICLONERANGE never
+// get here, as kernel handles them itself (and FUSE has no
+// remap_file_range); cp and friends fall back to copy_file_range,
+// which shares the extents (see CopyFileRange).
+func (self *fsOps) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, outbuf []byte) (code Status) {
+	return Status(syscall.ENOTTY)
 }
 
-func (self *fsOps) SetLkw(input *LkIn) (code Status) {
-	// TBD - implement locking someday?
+func (self *fsOps) Statx(cancel <-chan struct{}, input *StatxIn, out *StatxOut) (code Status) {
+	// Kernel falls back to GetAttr
 	return ENOSYS
 }
@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Inodes are linked back to the directories they are in by the
+// reverse (BST_FILE_INODEFILENAME) keys, one per hard link. Following
+// them up to the root yields the paths of the inode. In broken trees
+// there may be loops or directories in multiple places, so the
+// directories already on the path are skipped, and the number of
+// paths is bounded.
+
+// pathsXAttr is the virtual extended attribute that provides the
+// (newline separated) paths of the inode.
+const pathsXAttr = "user.tfhfs.paths"
+
+// maxPathDepth is the maximum number of components in paths followed
+// via parent directories
+const maxPathDepth = 2048
+
+// maxInodePaths is the maximum number of paths resolved per inode
+const maxInodePaths = 256
+
+// inodePathsRec adds the paths of ino to paths; visited contains the
+// inodes already on the path (below ino).
+func inodePathsRec(t *ibtree.Transaction, ino uint64, visited map[uint64]bool, suffix string, paths *[]string) {
+	if ino == fuse.FUSE_ROOT_ID {
+		if suffix == "" {
+			suffix = "/"
+		}
+		*paths = append(*paths, suffix)
+		return
+	}
+	if visited[ino] {
+		return
+	}
+	visited[ino] = true
+	defer delete(visited, ino)
+	IterateInoSubTypeKeys(t, ino, BST_FILE_INODEFILENAME,
+		func(key BlockKey) bool {
+			b := []byte(key.SubTypeData())
+			dir := binary.BigEndian.Uint64(b)
+			inodePathsRec(t, dir, visited, "/"+string(b[8:])+suffix, paths)
+			return len(*paths) < maxInodePaths
+		})
+}
+
+// inodePaths returns the sorted paths of the inode within the tree.
+func inodePaths(t *ibtree.Transaction, ino uint64) []string {
+	var paths []string
+	inodePathsRec(t, ino, make(map[uint64]bool), "", &paths)
+	sort.Strings(paths)
+	return paths
+}
+
+// inodePath returns the first path of the inode within the tree, or
+// #ino if it is not reachable from the root.
+func inodePath(t *ibtree.Transaction, ino uint64) string {
+	paths := inodePaths(t, ino)
+	if len(paths) == 0 {
+		return fmt.Sprintf("#%d", ino)
+	}
+	return paths[0]
+}
+
+// inodeString returns human readable description of the inode: its
+// number and paths (if any).
+func inodeString(t *ibtree.Transaction, ino uint64) string {
+	paths := inodePaths(t, ino)
+	if len(paths) == 0 {
+		return fmt.Sprintf("#%d", ino)
+	}
+	return fmt.Sprintf("#%d %s", ino, strings.Join(paths, ","))
+}
+
+// PathsForInode returns every path of the inode in sorted order (one
+// per hard link), or nothing if it is not reachable from the root.
+func (self *Fs) PathsForInode(ino uint64) []string {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	return inodePaths(tr.IB(), ino)
+}
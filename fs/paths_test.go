@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func TestPathsForInode(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	assert.Nil(t, u.Mkdir("/dir", 0777))
+	assert.Nil(t, u.Mkdir("/dir/sub", 0777))
+	writeTestFile(t, u, "/dir/sub/file", "foo")
+	assert.Nil(t, u.Link("/dir/sub/file", "/link"))
+	lookup := func(path string) uint64 {
+		defer u.lock.Locked()()
+		var eo fuse.EntryOut
+		assert.Nil(t, u.lookup(path, &eo))
+		return eo.NodeId
+	}
+	ino := lookup("/link")
+	dino := lookup("/dir")
+	assert.Equal(t, fs.PathsForInode(fuse.FUSE_ROOT_ID), []string{"/"})
+	assert.Equal(t, fs.PathsForInode(dino), []string{"/dir"})
+	assert.Equal(t, fs.PathsForInode(ino), []string{"/dir/sub/file", "/link"})
+	assert.Equal(t, len(fs.PathsForInode(123456)), 0)
+
+	b, err := u.GetXAttr("/link", pathsXAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "/dir/sub/file\n/link\n")
+
+	// Loops do not cause trouble
+	sino := lookup("/dir/sub")
+	fs.WithoutParallelWrites(func() {})
+	fs.Update(func(tr *hugger.Transaction) {
+		tr.IB().Delete(NewBlockKeyReverseDirFilename(dino, fuse.FUSE_ROOT_ID, "dir").IB())
+		tr.IB().Set(NewBlockKeyReverseDirFilename(dino, sino, "loop").IB(), "")
+	})
+	assert.Equal(t, fs.PathsForInode(ino), []string{"/link"})
+}
@@ -0,0 +1,445 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Quotas track the bytes (file sizes) and inodes used per uid and
+// gid. The usage is kept in the fsIno pseudo-inode, and it is updated
+// in the same transaction as the inode metadata (see
+// chargeUsageInTransaction); merges account for the metadata changes
+// they make the same way.
+//
+// Exceeding hard limit, or soft limit for longer than the grace
+// period, results in EDQUOT when writing or creating files. Files
+// owned by root are exempt.
+
+type QuotaType byte
+
+const (
+	QuotaUser  QuotaType = 'u'
+	QuotaGroup QuotaType = 'g'
+)
+
+// quotaXAttr is the virtual extended attribute that provides quota
+// information of the caller; quotaXAttr.user.<uid> and
+// quotaXAttr.group.<gid> provide (and, for root, set) that of the
+// particular uid/gid.
+const quotaXAttr = "user.tfhfs.quota"
+
+const defaultQuotaGrace = 7 * 24 * time.Hour
+
+// QuotaLimits of zero mean no limit.
+type QuotaLimits struct {
+	SoftBytes, HardBytes, SoftInodes, HardInodes uint64
+}
+
+type quotaId struct {
+	typ QuotaType
+	id  uint32
+}
+
+type Quota struct {
+	Bytes, Inodes uint64
+	QuotaLimits
+
+	// Times (unix ns) when soft limits were exceeded (0 = not)
+	BytesOverNs, InodesOverNs uint64
+}
+
+func (self QuotaType) String() string {
+	switch self {
+	case QuotaUser:
+		return "user"
+	case QuotaGroup:
+		return "group"
+	}
+	return fmt.Sprintf("quota%d", self)
+}
+
+func (self *Quota) String() string {
+	return fmt.Sprintf("bytes %d soft %d hard %d inodes %d soft %d hard %d",
+		self.Bytes, self.SoftBytes, self.HardBytes,
+		self.Inodes, self.SoftInodes, self.HardInodes)
+}
+
+func (self *Quota) updateOver(nowNs uint64) {
+	update := func(usage, soft uint64, overNs *uint64) {
+		if soft == 0 || usage <= soft {
+			*overNs = 0
+		} else if *overNs == 0 {
+			*overNs = nowNs
+		}
+	}
+	update(self.Bytes, self.SoftBytes, &self.BytesOverNs)
+	update(self.Inodes, self.SoftInodes, &self.InodesOverNs)
+}
+
+// allows returns true if adding bytes and inodes to the usage is
+// within the limits.
+func (self *Quota) allows(bytes, inodes, nowNs uint64, grace time.Duration) bool {
+	exceeds := func(usage, delta, soft, hard, overNs uint64) bool {
+		if delta == 0 {
+			return false
+		}
+		usage += delta
+		if hard != 0 && usage > hard {
+			return true
+		}
+		if soft != 0 && usage > soft && overNs != 0 && nowNs-overNs > uint64(grace) {
+			return true
+		}
+		return false
+	}
+	return !exceeds(self.Bytes, bytes, self.SoftBytes, self.HardBytes, self.BytesOverNs) &&
+		!exceeds(self.Inodes, inodes, self.SoftInodes, self.HardInodes, self.InodesOverNs)
+}
+
+func NewBlockKeyQuota(typ QuotaType, id uint32) BlockKey {
+	b := util.ConcatBytes([]byte{byte(typ)}, util.Uint32Bytes(id))
+	return NewBlockKey(fsIno, BST_QUOTA, string(b))
+}
+
+func quotaIdFromKey(bk BlockKey) quotaId {
+	typ := QuotaType(bk.SubTypeData()[0])
+	id := binary.BigEndian.Uint32([]byte(bk.SubTypeData()[1:]))
+	return quotaId{typ, id}
+}
+
+func decodeQuota(v string) (q Quota) {
+	err := binary.Read(strings.NewReader(v), binary.BigEndian, &q)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+func getQuotaInTransaction(t *ibtree.Transaction, typ QuotaType, id uint32) (q Quota) {
+	v := t.Get(NewBlockKeyQuota(typ, id).IB())
+	if v != nil {
+		q = decodeQuota(*v)
+	}
+	return
+}
+
+func setQuotaInTransaction(t *ibtree.Transaction, typ QuotaType, id uint32, q *Quota) {
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.BigEndian, q)
+	if err != nil {
+		log.Panic(err)
+	}
+	t.Set(NewBlockKeyQuota(typ, id).IB(), b.String())
+}
+
+// mergeQuotaLimits merges concurrent local changes to limits of a
+// quota entry. The usage is accounted for separately, based on the
+// merged metadata changes.
+func mergeQuotaLimits(t *ibtree.Transaction, oldC, newC *ibtree.NodeDataChild) {
+	if newC == nil {
+		return
+	}
+	var oq Quota
+	if oldC != nil {
+		oq = decodeQuota(oldC.Value)
+	}
+	nq := decodeQuota(newC.Value)
+	if nq.QuotaLimits == oq.QuotaLimits {
+		return
+	}
+	qi := quotaIdFromKey(BlockKey(newC.Key))
+	q := getQuotaInTransaction(t, qi.typ, qi.id)
+	q.QuotaLimits = nq.QuotaLimits
+	q.updateOver(uint64(time.Now().UnixNano()))
+	mlog.Printf2("fs/quota", " merged quota %v %v: %v", qi.typ, qi.id, &q)
+	setQuotaInTransaction(t, qi.typ, qi.id, &q)
+}
+
+// chargeQuotaInTransaction moves the usage of old metadata to the new
+// metadata; either may be nil (inode creation or deletion).
+func chargeQuotaInTransaction(t *ibtree.Transaction, old, new *InodeMetaData) {
+	if old != nil && new != nil && old.StSize == new.StSize && old.StUid == new.StUid && old.StGid == new.StGid {
+		return
+	}
+	type quotaDelta struct {
+		bytes, inodes int64
+	}
+	deltas := make(map[quotaId]quotaDelta)
+	add := func(meta *InodeMetaData, sign int64) {
+		if meta == nil {
+			return
+		}
+		for _, qi := range []quotaId{{QuotaUser, meta.StUid}, {QuotaGroup, meta.StGid}} {
+			d := deltas[qi]
+			d.bytes += sign * int64(meta.StSize)
+			d.inodes += sign
+			deltas[qi] = d
+		}
+	}
+	add(old, -1)
+	add(new, 1)
+	now := uint64(time.Now().UnixNano())
+	for qi, d := range deltas {
+		if d.bytes == 0 && d.inodes == 0 {
+			continue
+		}
+		q := getQuotaInTransaction(t, qi.typ, qi.id)
+		q.Bytes += uint64(d.bytes)
+		q.Inodes += uint64(d.inodes)
+		q.updateOver(now)
+		setQuotaInTransaction(t, qi.typ, qi.id, &q)
+	}
+}
+
+// iterateInodeMetaInTransaction calls cb with the metadata of every
+// inode.
+func iterateInodeMetaInTransaction(t *ibtree.Transaction, cb func(ino uint64, meta *InodeMeta)) {
+	k := ibtree.Key("")
+	for {
+		nkeyp := t.NextKey(k)
+		if nkeyp == nil {
+			return
+		}
+		k = *nkeyp
+		bk := BlockKey(k)
+		if len(bk) <= inodeDataLength || bk.Ino() == fsIno || bk.SubType() != BST_META {
+			continue
+		}
+		cb(bk.Ino(), decodeInodeMeta(*t.Get(k)))
+	}
+}
+
+// quotasEnabledInTransaction returns true if any uid/gid has limits.
+func quotasEnabledInTransaction(t *ibtree.Transaction) (enabled bool) {
+	IterateInoSubTypeKeys(t, fsIno, BST_QUOTA, func(key BlockKey) bool {
+		q := decodeQuota(*t.Get(key.IB()))
+		enabled = q.QuotaLimits != QuotaLimits{}
+		return !enabled
+	})
+	return
+}
+
+// rebuildQuotaUsageInTransaction recomputes the usage of every uid
+// and gid from the inode metadata, and returns descriptions of the
+// quotas whose usage was wrong (e.g. as the filesystem predates
+// quotas).
+func rebuildQuotaUsageInTransaction(t *ibtree.Transaction) (wrong []string) {
+	usage := make(map[quotaId]Quota)
+	iterateInodeMetaInTransaction(t, func(ino uint64, meta *InodeMeta) {
+		for _, qi := range []quotaId{{QuotaUser, meta.StUid}, {QuotaGroup, meta.StGid}} {
+			q := usage[qi]
+			q.Bytes += meta.StSize
+			q.Inodes++
+			usage[qi] = q
+		}
+	})
+	IterateInoSubTypeKeys(t, fsIno, BST_QUOTA, func(key BlockKey) bool {
+		qi := quotaIdFromKey(key)
+		if _, ok := usage[qi]; !ok {
+			usage[qi] = Quota{}
+		}
+		return true
+	})
+	now := uint64(time.Now().UnixNano())
+	for qi, u := range usage {
+		q := getQuotaInTransaction(t, qi.typ, qi.id)
+		if q.Bytes == u.Bytes && q.Inodes == u.Inodes {
+			continue
+		}
+		wrong = append(wrong, fmt.Sprintf("%v %d: usage %d bytes %d inodes != %d bytes %d inodes",
+			qi.typ, qi.id, q.Bytes, q.Inodes, u.Bytes, u.Inodes))
+		q.Bytes = u.Bytes
+		q.Inodes = u.Inodes
+		q.updateOver(now)
+		setQuotaInTransaction(t, qi.typ, qi.id, &q)
+	}
+	sort.Strings(wrong)
+	return
+}
+
+// checkQuota returns EDQUOT if changing metadata from old (nil if new
+// inode) to new would exceed the quota of its owner.
+func (self *Fs) checkQuota(t *ibtree.Transaction, old, new *InodeMetaData) fuse.Status {
+	if new.StUid == 0 {
+		return fuse.OK
+	}
+	var grow uint64
+	if old != nil && new.StSize > old.StSize {
+		grow = new.StSize - old.StSize
+	}
+	now := uint64(time.Now().UnixNano())
+	check := func(typ QuotaType, oid, nid uint32) bool {
+		bytes, inodes := grow, uint64(0)
+		if old == nil || oid != nid {
+			bytes, inodes = new.StSize, 1
+		}
+		if bytes == 0 && inodes == 0 {
+			return true
+		}
+		q := getQuotaInTransaction(t, typ, nid)
+		return q.allows(bytes, inodes, now, self.quotaGrace)
+	}
+	var ouid, ogid uint32
+	if old != nil {
+		ouid = old.StUid
+		ogid = old.StGid
+	}
+	if !check(QuotaUser, ouid, new.StUid) || !check(QuotaGroup, ogid, new.StGid) {
+		mlog.Printf2("fs/quota", "quota exceeded for %d/%d", new.StUid, new.StGid)
+		return fuse.Status(syscall.EDQUOT)
+	}
+	return fuse.OK
+}
+
+// checkQuotaSize returns EDQUOT if growing the file to size would
+// exceed the quota of its owner.
+func (self *inode) checkQuotaSize(size uint64) fuse.Status {
+	meta := self.Meta()
+	if meta == nil || size <= meta.StSize {
+		return fuse.OK
+	}
+	nmeta := meta.InodeMetaData
+	nmeta.StSize = size
+	tr := self.Fs().GetNestableTransaction()
+	defer tr.Close()
+	return self.Fs().checkQuota(tr.IB(), &meta.InodeMetaData, &nmeta)
+}
+
+// SetQuotaGrace sets the time soft limits may be exceeded.
+func (self *Fs) SetQuotaGrace(grace time.Duration) {
+	self.quotaGrace = grace
+}
+
+// GetQuota returns the usage and limits of the uid/gid. Like Usage,
+// it does not wait for writes in progress.
+func (self *Fs) GetQuota(typ QuotaType, id uint32) Quota {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	return getQuotaInTransaction(tr.IB(), typ, id)
+}
+
+// SetQuotaLimits sets the limits of the uid/gid.
+func (self *Fs) SetQuotaLimits(typ QuotaType, id uint32, limits QuotaLimits) error {
+	mlog.Printf2("fs/quota", "fs.SetQuotaLimits %v %v %v", typ, id, limits)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	self.Update(func(tr *hugger.Transaction) {
+		if !quotasEnabledInTransaction(tr.IB()) {
+			// Usage is tracked also without limits, but
+			// the filesystem may predate quotas
+			rebuildQuotaUsageInTransaction(tr.IB())
+		}
+		q := getQuotaInTransaction(tr.IB(), typ, id)
+		q.QuotaLimits = limits
+		q.updateOver(uint64(time.Now().UnixNano()))
+		setQuotaInTransaction(tr.IB(), typ, id, &q)
+	})
+	return nil
+}
+
+// applyQuotaToStatfs limits out to what the quota allows.
+func applyQuotaToStatfs(q *Quota, out *fuse.StatfsOut) {
+	limit := func(soft, hard uint64) uint64 {
+		if soft != 0 && (hard == 0 || soft < hard) {
+			return soft
+		}
+		return hard
+	}
+	apply := func(l, used uint64, total, free, avail *uint64) {
+		if l == 0 || (*total != 0 && l >= *total) {
+			return
+		}
+		// zero total = unknown
+		unknown := *total == 0
+		*total = l
+		left := uint64(0)
+		if used < l {
+			left = l - used
+		}
+		if unknown || left < *free {
+			*free = left
+		}
+		if avail != nil && (unknown || left < *avail) {
+			*avail = left
+		}
+	}
+	bsize := uint64(out.Bsize)
+	apply(limit(q.SoftBytes, q.HardBytes)/bsize, q.Bytes/bsize,
+		&out.Blocks, &out.Bfree, &out.Bavail)
+	apply(limit(q.SoftInodes, q.HardInodes), q.Inodes,
+		&out.Files, &out.Ffree, nil)
+}
+
+// parseQuotaXAttr parses quotaXAttr.user.<uid> / .group.<gid>.
+func parseQuotaXAttr(attr string) (typ QuotaType, id uint32, ok bool) {
+	l := strings.Split(attr[len(quotaXAttr):], ".")
+	if len(l) != 3 || l[0] != "" {
+		return
+	}
+	switch l[1] {
+	case QuotaUser.String():
+		typ = QuotaUser
+	case QuotaGroup.String():
+		typ = QuotaGroup
+	default:
+		return
+	}
+	n, err := strconv.ParseUint(l[2], 10, 32)
+	if err != nil {
+		return
+	}
+	return typ, uint32(n), true
+}
+
+func (self *Fs) getQuotaXAttr(attr string, ctx *fuse.Caller) (data []byte, code fuse.Status) {
+	if attr == quotaXAttr {
+		u := self.GetQuota(QuotaUser, ctx.Uid)
+		g := self.GetQuota(QuotaGroup, ctx.Gid)
+		s := fmt.Sprintf("user %d: %v\ngroup %d: %v\n", ctx.Uid, &u, ctx.Gid, &g)
+		return []byte(s), fuse.OK
+	}
+	typ, id, ok := parseQuotaXAttr(attr)
+	if !ok {
+		return nil, fuse.ENOATTR
+	}
+	if ctx.Uid != 0 && !(typ == QuotaUser && id == ctx.Uid) && !(typ == QuotaGroup && id == ctx.Gid) {
+		return nil, fuse.EPERM
+	}
+	q := self.GetQuota(typ, id)
+	return []byte(q.String() + "\n"), fuse.OK
+}
+
+// setQuotaXAttr sets the limits of quotaXAttr.user.<uid> /
+// .group.<gid>; the value is "softbytes hardbytes softinodes
+// hardinodes".
+func (self *Fs) setQuotaXAttr(attr string, data []byte, ctx *fuse.Caller) fuse.Status {
+	typ, id, ok := parseQuotaXAttr(attr)
+	if !ok {
+		return fuse.EINVAL
+	}
+	if ctx.Uid != 0 {
+		return fuse.EPERM
+	}
+	var l QuotaLimits
+	_, err := fmt.Sscanf(string(data), "%d %d %d %d",
+		&l.SoftBytes, &l.HardBytes, &l.SoftInodes, &l.HardInodes)
+	if err != nil {
+		return fuse.EINVAL
+	}
+	self.SetQuotaLimits(typ, id, l)
+	return fuse.OK
+}
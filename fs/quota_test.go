@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func writeQuotaTestFile(u *FSUser, path string, size int) error {
+	// (FSUser O_CREATE replaces existing file)
+	f, err := u.OpenFile(path, uint32(os.O_WRONLY), 0)
+	if err != nil {
+		f, err = u.OpenFile(path, uint32(os.O_CREATE|os.O_WRONLY), 0777)
+		if err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	f.Seek(0, 2)
+	_, err = f.Write(make([]byte, size))
+	return err
+}
+
+func TestQuota(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	root := NewFSUser(fs)
+	assert.Nil(t, root.Mkdir("/q", 0777))
+
+	u := NewFSUser(fs)
+	u.Uid = 42
+	u.Gid = 7
+
+	fs.SetQuotaLimits(QuotaUser, 42, QuotaLimits{HardBytes: 10000, HardInodes: 3})
+
+	assert.Nil(t, writeQuotaTestFile(u, "/q/a", 5000))
+	// (GetQuota does not wait for the pending writes)
+	fs.WithoutParallelWrites(func() {})
+	q := fs.GetQuota(QuotaUser, 42)
+	assert.Equal(t, q.Bytes, uint64(5000))
+	assert.Equal(t, q.Inodes, uint64(1))
+	assert.True(t, writeQuotaTestFile(u, "/q/a", 6000) != nil)
+	assert.Nil(t, writeQuotaTestFile(u, "/q/b", 0))
+	assert.Nil(t, writeQuotaTestFile(u, "/q/c", 0))
+	assert.True(t, writeQuotaTestFile(u, "/q/d", 0) != nil)
+	fs.WithoutParallelWrites(func() {})
+	q = fs.GetQuota(QuotaGroup, 7)
+	assert.Equal(t, q.Bytes, uint64(5000))
+	assert.Equal(t, q.Inodes, uint64(3))
+
+	// Root is not limited
+	assert.Nil(t, writeQuotaTestFile(root, "/q/r", 20000))
+
+	// StatFs reflects the quota
+	fs.WithoutParallelWrites(func() {})
+	var sfo fuse.StatfsOut
+	assert.Equal(t, fs.Ops.StatFs(nil, &u.InHeader, &sfo), fuse.OK)
+	assert.Equal(t, sfo.Files, uint64(3))
+	assert.Equal(t, sfo.Ffree, uint64(0))
+	assert.Equal(t, sfo.Blocks, uint64(10000/blockSize))
+
+	// Removal releases the usage
+	assert.Nil(t, u.Remove("/q/a"))
+	fs.WithoutParallelWrites(func() {})
+	q = fs.GetQuota(QuotaUser, 42)
+	assert.Equal(t, q.Bytes, uint64(0))
+	assert.Equal(t, q.Inodes, uint64(2))
+
+	// Reporting and setting via xattr
+	b, err := u.GetXAttr("/q", quotaXAttr)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(b), "user 42: bytes 0 soft 0 hard 10000 inodes 2"), string(b))
+	_, err = u.GetXAttr("/q", quotaXAttr+".user.43")
+	assert.True(t, err != nil)
+	assert.True(t, u.SetXAttr("/q", quotaXAttr+".user.42", []byte("0 0 0 0")) != nil)
+	assert.Nil(t, root.SetXAttr("/q", quotaXAttr+".user.42", []byte("100 0 0 0")))
+	b, err = root.GetXAttr("/q", quotaXAttr+".user.42")
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "bytes 0 soft 100 hard 0 inodes 2 soft 0 hard 0\n")
+
+	// Soft limit may be exceeded until grace period is over
+	assert.Nil(t, writeQuotaTestFile(u, "/q/d", 200))
+	assert.Nil(t, writeQuotaTestFile(u, "/q/d", 200))
+	fs.WithoutParallelWrites(func() {})
+	assert.True(t, fs.GetQuota(QuotaUser, 42).BytesOverNs != 0)
+	fs.SetQuotaGrace(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	assert.True(t, writeQuotaTestFile(u, "/q/d", 200) != nil)
+}
+
+func TestQuotaPopulated(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	root := NewFSUser(fs)
+	assert.Nil(t, root.Mkdir("/q", 0777))
+
+	u := NewFSUser(fs)
+	u.Uid = 42
+	u.Gid = 7
+	assert.Nil(t, writeQuotaTestFile(u, "/q/a", 5000))
+	assert.Nil(t, writeQuotaTestFile(u, "/q/b", 3000))
+
+	// Pretend the filesystem predates quotas
+	fs.WithoutParallelWrites(func() {})
+	fs.Update(func(tr *hugger.Transaction) {
+		tr.IB().DeleteRange(NewBlockKey(fsIno, BST_QUOTA, "").IB(),
+			NewBlockKey(fsIno, BST_COUNTER, "").IB())
+	})
+	assert.Equal(t, fs.GetQuota(QuotaUser, 42).Bytes, uint64(0))
+
+	// Enabling quota accounts for the existing files
+	fs.SetQuotaLimits(QuotaUser, 42, QuotaLimits{HardBytes: 10000})
+	q := fs.GetQuota(QuotaUser, 42)
+	assert.Equal(t, q.Bytes, uint64(8000))
+	assert.Equal(t, q.Inodes, uint64(2))
+	assert.Equal(t, q.HardBytes, uint64(10000))
+	q = fs.GetQuota(QuotaGroup, 7)
+	assert.Equal(t, q.Bytes, uint64(8000))
+	assert.True(t, writeQuotaTestFile(u, "/q/c", 3000) != nil)
+
+	// Fsck notices wrong usage, and fixes it
+	fs.Update(func(tr *hugger.Transaction) {
+		q := getQuotaInTransaction(tr.IB(), QuotaGroup, 7)
+		q.Inodes = 5
+		setQuotaInTransaction(tr.IB(), QuotaGroup, 7, &q)
+	})
+	assert.Equal(t, len(fs.Fsck(false)), 1)
+	assert.Equal(t, fs.GetQuota(QuotaGroup, 7).Inodes, uint64(5))
+	assert.Equal(t, len(fs.Fsck(true)), 1)
+	// (/q/c exists, even if writing it failed)
+	assert.Equal(t, fs.GetQuota(QuotaGroup, 7).Inodes, uint64(3))
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+}
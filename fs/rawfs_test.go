@@ -24,7 +24,7 @@ import (
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/storage/factory"
 	"github.com/fingon/go-tfhfs/util"
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/stvp/assert"
 )
 
@@ -303,7 +303,7 @@ func ProdFs(t *testing.T, fs *Fs) {
 
 	wg.Go(func() {
 		var sfo fuse.StatfsOut
-		code := fs.Ops.StatFs(&root.InHeader, &sfo)
+		code := fs.Ops.StatFs(nil, &root.InHeader, &sfo)
 		assert.True(t, code.Ok())
 	})
 
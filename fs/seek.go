@@ -0,0 +1,158 @@
+package fs
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// lseek(2) whence values not in os
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// DataRange is [Start, End[ range of a file that contains data.
+type DataRange struct {
+	Start, End uint64
+}
+
+// IterateDataRanges calls cb with the ranges of the file, at or after
+// offset, that contain data. Data is tracked at extent (or chunk)
+// granularity; missing extents are holes. Embedded small files
+// consist only of data.
+func (self *inode) IterateDataRanges(offset uint64, cb func(r DataRange) bool) {
+	meta := self.Meta()
+	if meta == nil || offset >= meta.StSize {
+		return
+	}
+	size := meta.StSize
+	if size <= EmbeddedSize {
+		cb(DataRange{offset, size})
+		return
+	}
+	tr := self.Fs().GetNestableTransaction()
+	defer tr.Close()
+
+	var r DataRange
+	add := func(start, end uint64) bool {
+		if start >= size {
+			return false
+		}
+		if end > size {
+			end = size
+		}
+		if start < offset {
+			start = offset
+		}
+		if r.End == start && r.End != 0 {
+			r.End = end
+			return true
+		}
+		if r.End != 0 && !cb(r) {
+			r.End = 0
+			return false
+		}
+		r = DataRange{start, end}
+		return true
+	}
+	if self.useChunks(tr.IB()) {
+		self.iterateChunks(tr.IB(), meta, offset, size, func(c *fileChunk) bool {
+			return add(c.start, c.end())
+		})
+	} else {
+		self.iterateExtents(tr.IB(), offset, add)
+	}
+	if r.End != 0 {
+		cb(r)
+	}
+}
+
+// iterateExtents calls add with the range of each extent at or after
+// offset until it returns false.
+func (self *inode) iterateExtents(t *ibtree.Transaction, offset uint64, add func(start, end uint64) bool) {
+	handle := func(key BlockKey) bool {
+		e := binary.BigEndian.Uint64([]byte(key.SubTypeData()))
+		start := e * dataExtentSize
+		return add(start, start+dataExtentSize)
+	}
+	k := NewBlockKeyOffset(self.ino, offset)
+	if t.Get(k.IB()) == nil || handle(k) {
+		for {
+			nkeyp := t.NextKey(k.IB())
+			if nkeyp == nil {
+				break
+			}
+			k = BlockKey(*nkeyp)
+			if k.Ino() != self.ino || k.SubType() != BST_FILE_OFFSET2EXTENT || !handle(k) {
+				break
+			}
+		}
+	}
+}
+
+// Seek provides the SEEK_DATA/SEEK_HOLE offset at or after offset.
+func (self *inode) Seek(offset uint64, whence int) (uint64, fuse.Status) {
+	meta := self.Meta()
+	if meta == nil {
+		return 0, fuse.ENOENT
+	}
+	if offset >= meta.StSize {
+		return 0, fuse.Status(syscall.ENXIO)
+	}
+	switch whence {
+	case seekData:
+		found := false
+		self.IterateDataRanges(offset, func(r DataRange) bool {
+			offset = r.Start
+			found = true
+			return false
+		})
+		if !found {
+			return 0, fuse.Status(syscall.ENXIO)
+		}
+	case seekHole:
+		// End of file is always considered a hole
+		self.IterateDataRanges(offset, func(r DataRange) bool {
+			if r.Start > offset {
+				return false
+			}
+			offset = r.End
+			return true
+		})
+	default:
+		return 0, fuse.EINVAL
+	}
+	return offset, fuse.OK
+}
+
+// Lseek implements SEEK_DATA and SEEK_HOLE; kernel handles the rest of
+// the whence values itself.
+func (self *fsOps) Lseek(cancel <-chan struct{}, input *fuse.LseekIn, out *fuse.LseekOut) (code fuse.Status) {
+	if ops, ino := self.dispatch(input.NodeId); ops != self {
+		in := *input
+		in.NodeId = ino
+		return ops.Lseek(cancel, &in, out)
+	}
+	mlog.Printf2("fs/seek", "ops.Lseek #%d @%v whence:%v", input.NodeId, input.Offset, input.Whence)
+	inode := self.fs.GetInode(input.NodeId)
+	if inode == nil {
+		return fuse.ENOENT
+	}
+	defer inode.Release()
+
+	// Make sure pending writes of the inode are visible in the
+	// tree; new ones cannot start while we hold metaWriteLock, and
+	// the ones in flight hold their extent lock until they are done.
+	self.fs.flushChunkBuffers(inode)
+	defer inode.metaWriteLock.Locked()()
+	for _, e := range inode.offsetMap.Names() {
+		inode.offsetMap.Locked(e)()
+	}
+
+	out.Offset, code = inode.Seek(input.Offset, int(input.Whence))
+	return
+}
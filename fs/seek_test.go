@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func TestSeekDataHole(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+
+	f, err := u.OpenFile("/file", uint32(os.O_CREATE|os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	// Small files are all data
+	f.Write([]byte("foo"))
+	r, err := u.DataRanges("/file")
+	assert.Nil(t, err)
+	assert.Equal(t, r, []DataRange{{0, 3}})
+
+	f, err = u.OpenFile("/sparse", uint32(os.O_CREATE|os.O_RDWR), 0777)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	// data in extents 1, 2 and 4 (and hole at the end)
+	de := int64(dataExtentSize)
+	for _, e := range []int64{1, 2, 4} {
+		f.Seek(e*de+10, 0)
+		f.Write([]byte("bar"))
+	}
+	assert.Nil(t, f.Fallocate(0, 0, 6*de))
+
+	r, err = u.DataRanges("/sparse")
+	assert.Nil(t, err)
+	assert.Equal(t, r, []DataRange{{uint64(de), uint64(3 * de)},
+		{uint64(4 * de), uint64(5 * de)}})
+
+	seek := func(ofs int64, whence int) int64 {
+		pos, err := f.Seek(ofs, whence)
+		if err != nil {
+			return -1
+		}
+		return pos
+	}
+	assert.Equal(t, seek(0, seekData), de)
+	assert.Equal(t, seek(de+5, seekData), de+5)
+	assert.Equal(t, seek(de+5, seekHole), 3*de)
+	assert.Equal(t, seek(3*de, seekData), 4*de)
+	assert.Equal(t, seek(0, seekHole), int64(0))
+	assert.Equal(t, seek(4*de, seekHole), 5*de)
+	assert.Equal(t, seek(5*de, seekData), int64(-1))
+	assert.Equal(t, seek(5*de, seekHole), 5*de)
+	assert.Equal(t, seek(6*de, seekHole), int64(-1))
+}
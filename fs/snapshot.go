@@ -0,0 +1,203 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Snapshots are named, read-only point-in-time copies of the
+// filesystem. As the tree is copy-on-write, snapshot is simply the
+// root block id at the time, held in storage under its own name
+// (which also keeps the blocks referred from it alive). The list of
+// snapshots lives within the tree itself, in the fsIno
+// pseudo-inode, so that it can be iterated.
+//
+// The snapshots are visible (read-only) in the virtual .snapshots
+// directory at the root of the filesystem. It does not show up in
+// directory listings, but it can be looked up.
+
+const snapshotsName = ".snapshots"
+
+var ErrInvalidSnapshotName = errors.New("Invalid snapshot name")
+var ErrSnapshotExists = errors.New("Snapshot already exists")
+var ErrSnapshotNotFound = errors.New("Snapshot not found")
+var ErrReadOnly = errors.New("Read-only filesystem")
+
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func snapshotStorageName(rootName, name string) string {
+	return fmt.Sprintf("%s.snapshot.%s", rootName, name)
+}
+
+func (self *Fs) snapshotStorageName(name string) string {
+	return snapshotStorageName(self.RootName, name)
+}
+
+// CreateSnapshot pins the current state of the filesystem under the
+// given name.
+func (self *Fs) CreateSnapshot(name string) error {
+	mlog.Printf2("fs/snapshot", "fs.CreateSnapshot %s", name)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	if !validSnapshotName(name) {
+		return ErrInvalidSnapshotName
+	}
+	k := NewBlockKey(fsIno, BST_SNAPSHOT, name).IB()
+	if !self.Update2(func(tr *hugger.Transaction) bool {
+		if tr.IB().Get(k) != nil {
+			return false
+		}
+		tr.IB().Set(k, "")
+		return true
+	}) {
+		return ErrSnapshotExists
+	}
+	self.WithoutParallelWrites(func() {
+		block := self.RootBlock()
+		defer block.Close()
+		self.storage.SetNameToBlockId(self.snapshotStorageName(name), block.Id())
+	})
+	return nil
+}
+
+// DeleteSnapshot removes the named snapshot. The blocks referred
+// only by the snapshot are released once the storage is flushed.
+func (self *Fs) DeleteSnapshot(name string) error {
+	mlog.Printf2("fs/snapshot", "fs.DeleteSnapshot %s", name)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	k := NewBlockKey(fsIno, BST_SNAPSHOT, name).IB()
+	if !self.Update2(func(tr *hugger.Transaction) bool {
+		if tr.IB().Get(k) == nil {
+			return false
+		}
+		tr.IB().Delete(k)
+		return true
+	}) {
+		return ErrSnapshotNotFound
+	}
+	self.children.Remove(name)
+	self.storage.SetNameToBlockId(self.snapshotStorageName(name), "")
+	return nil
+}
+
+// ListSnapshots returns names of the current snapshots in sorted
+// order.
+func (self *Fs) ListSnapshots() (names []string) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	IterateInoSubTypeKeys(tr.IB(), fsIno, BST_SNAPSHOT,
+		func(key BlockKey) bool {
+			names = append(names, key.SubTypeData())
+			return true
+		})
+	return
+}
+
+// SnapshotBlockId returns the root block id of the named snapshot,
+// or empty string if it does not exist.
+func (self *Fs) SnapshotBlockId(name string) string {
+	if !validSnapshotName(name) {
+		return ""
+	}
+	return self.storage.GetBlockIdByName(self.snapshotStorageName(name))
+}
+
+// snapshotFs returns read-only view of the named snapshot.
+func (self *Fs) snapshotFs(name string) *Fs {
+	return self.children.Get(name, func() *Fs {
+		bid := self.SnapshotBlockId(name)
+		if bid == "" {
+			return nil
+		}
+		return newReadOnlyFs(self.storage, bid, 0, self)
+	})
+}
+
+// isReservedName checks if the name within given directory is
+// reserved for virtual use.
+func (self *Fs) isReservedName(dirIno uint64, name string) bool {
+	return dirIno == fuse.FUSE_ROOT_ID && self.parent == nil && name == snapshotsName
+}
+
+func (self *fsOps) fillSnapshotsAttr(out *fuse.Attr) fuse.Status {
+	root := self.fs.GetInode(fuse.FUSE_ROOT_ID)
+	if root == nil {
+		return fuse.ENOENT
+	}
+	defer root.Release()
+	code := root.FillAttr(out)
+	out.Ino = snapshotsNodeId
+	out.Size = 0
+	out.Blocks = 0
+	out.Mode = fuse.S_IFDIR | 0555
+	out.Nlink = 2
+	return code
+}
+
+func (self *fsOps) fillSnapshotsEntryOut(out *fuse.EntryOut) fuse.Status {
+	out.NodeId = snapshotsNodeId
+	out.Generation = 0
+	out.EntryValid = entryValidity
+	out.AttrValid = attrValidity
+	out.EntryValidNsec = 0
+	out.AttrValidNsec = 0
+	return self.fillSnapshotsAttr(&out.Attr)
+}
+
+// fillChildRootEntryOut fills entry of the root of the child
+// filesystem.
+func fillChildRootEntryOut(fs *Fs, out *fuse.EntryOut) fuse.Status {
+	if fs == nil {
+		return fuse.ENOENT
+	}
+	root := fs.GetInode(fuse.FUSE_ROOT_ID)
+	if root == nil {
+		return fuse.ENOENT
+	}
+	defer root.Release()
+	return root.FillEntryOut(out)
+}
+
+// readChildRoots reads directory which contains the roots of the
+// named child filesystems.
+func readChildRoots(input *fuse.ReadIn, l *fuse.DirEntryList, plus bool, names []string, childFs func(name string) *Fs) fuse.Status {
+	for i := input.Offset; i < uint64(len(names)); i++ {
+		name := names[i]
+		e := fuse.DirEntry{Mode: fuse.S_IFDIR, Name: name}
+		if !plus {
+			if fs := childFs(name); fs != nil {
+				e.Ino = fs.nodeId(fuse.FUSE_ROOT_ID)
+			}
+			if !l.AddDirEntry(e) {
+				break
+			}
+			continue
+		}
+		entry := l.AddDirLookupEntry(e)
+		if entry == nil {
+			break
+		}
+		fillChildRootEntryOut(childFs(name), entry)
+	}
+	return fuse.OK
+}
+
+// fillSnapshotEntryOut fills entry of the root of the named snapshot.
+func (self *fsOps) fillSnapshotEntryOut(name string, out *fuse.EntryOut) fuse.Status {
+	return fillChildRootEntryOut(self.fs.snapshotFs(name), out)
+}
+
+func (self *fsOps) readSnapshots(input *fuse.ReadIn, l *fuse.DirEntryList, plus bool) fuse.Status {
+	return readChildRoots(input, l, plus, self.fs.ListSnapshots(),
+		self.fs.snapshotFs)
+}
@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func writeTestFile(t *testing.T, u *FSUser, path, content string) {
+	f, err := u.OpenFile(path, uint32(os.O_CREATE|os.O_TRUNC|os.O_WRONLY), 0777)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(content))
+	assert.Nil(t, err)
+	f.Close()
+}
+
+func readTestFile(t *testing.T, u *FSUser, path string) string {
+	f, err := u.OpenFile(path, uint32(os.O_RDONLY), 0)
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b := make([]byte, 1000)
+	n, err := f.Read(b)
+	assert.Nil(t, err)
+	return string(b[:n])
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	RootName := "toor"
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, RootName, 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+
+	err := u.Mkdir("/dir", 0777)
+	assert.Nil(t, err)
+	writeTestFile(t, u, "/dir/file", "old")
+
+	assert.Equal(t, fs.CreateSnapshot("a/b"), ErrInvalidSnapshotName)
+	assert.Nil(t, fs.CreateSnapshot("snap"))
+	assert.Equal(t, fs.CreateSnapshot("snap"), ErrSnapshotExists)
+	assert.Equal(t, fs.ListSnapshots(), []string{"snap"})
+
+	writeTestFile(t, u, "/dir/file", "new")
+	writeTestFile(t, u, "/dir/file2", "x")
+
+	// .snapshots is hidden from listings, and reserved
+	l, err := u.ListDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, l, []string{"dir"})
+	assert.NotNil(t, u.Mkdir("/.snapshots", 0777))
+
+	l, err = u.ListDir("/.snapshots")
+	assert.Nil(t, err)
+	assert.Equal(t, l, []string{"snap"})
+
+	l, err = u.ListDir("/.snapshots/snap/dir")
+	assert.Nil(t, err)
+	assert.Equal(t, l, []string{"file"})
+	assert.Equal(t, readTestFile(t, u, "/.snapshots/snap/dir/file"), "old")
+	assert.Equal(t, readTestFile(t, u, "/dir/file"), "new")
+
+	// Node ids within it are let go once forgotten as many
+	// times as looked up
+	var eo fuse.EntryOut
+	h := fuse.InHeader{NodeId: snapshotsNodeId}
+	assert.Equal(t, fs.Ops.Lookup(nil, &h, "snap", &eo), fuse.OK)
+	id := eo.NodeId
+	assert.Equal(t, fs.Ops.Lookup(nil, &h, "snap", &eo), fuse.OK)
+	assert.Equal(t, eo.NodeId, id)
+	fs.Ops.Forget(id, 1)
+	assert.Equal(t, fs.snapshotFs("snap").nodeId(fuse.FUSE_ROOT_ID), id)
+	fs.Ops.Forget(id, 1)
+	assert.Equal(t, fs.snapshotFs("snap").nodeId(fuse.FUSE_ROOT_ID), uint64(0))
+
+	// snapshot is read-only
+	_, err = u.OpenFile("/.snapshots/snap/dir/file", uint32(os.O_WRONLY), 0)
+	assert.NotNil(t, err)
+	_, err = u.OpenFile("/.snapshots/snap/dir/file3", uint32(os.O_CREATE|os.O_WRONLY), 0777)
+	assert.NotNil(t, err)
+	assert.NotNil(t, u.Remove("/.snapshots/snap/dir/file"))
+	assert.NotNil(t, u.Rename("/.snapshots/snap/dir/file", "/dir/file3"))
+
+	fs.Flush()
+
+	// snapshots survive remount
+	fs2 := NewFs(st, RootName, 0)
+	u = NewFSUser(fs2)
+	assert.Equal(t, fs2.ListSnapshots(), []string{"snap"})
+	assert.Equal(t, readTestFile(t, u, "/.snapshots/snap/dir/file"), "old")
+
+	assert.Nil(t, fs2.DeleteSnapshot("snap"))
+	assert.Equal(t, fs2.DeleteSnapshot("snap"), ErrSnapshotNotFound)
+	assert.Equal(t, len(fs2.ListSnapshots()), 0)
+	_, err = u.Stat("/.snapshots/snap")
+	assert.NotNil(t, err)
+	fs2.Flush()
+}
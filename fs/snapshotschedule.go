@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+)
+
+// Automatic snapshots are taken at the configured interval, named
+// after the (UTC) time they were taken at. They are pruned using
+// grandfather-father-son retention policy: the latest automatic
+// snapshot of each of the last Hourly hours, Daily days, Weekly
+// (ISO) weeks and Monthly months is kept, as well as the latest
+// one. If no retention counts are set, nothing is pruned. Snapshots
+// with other names are never touched.
+//
+// The schedule is stored in the fsIno pseudo-inode, so it persists
+// within the volume. It is checked by the flushing goroutine of the
+// filesystem.
+
+const autoSnapshotPrefix = "auto-"
+const autoSnapshotTimeFormat = "20060102T150405Z"
+
+const configSnapshotSchedule = "snapshot-schedule"
+
+type SnapshotSchedule struct {
+	// Interval between snapshots (0 = no automatic snapshots)
+	Interval time.Duration
+
+	// Retention counts
+	Hourly, Daily, Weekly, Monthly uint32
+}
+
+func (self *SnapshotSchedule) String() string {
+	return fmt.Sprintf("interval %v hourly %d daily %d weekly %d monthly %d",
+		self.Interval, self.Hourly, self.Daily, self.Weekly, self.Monthly)
+}
+
+func autoSnapshotName(t time.Time) string {
+	return autoSnapshotPrefix + t.UTC().Format(autoSnapshotTimeFormat)
+}
+
+func parseAutoSnapshotName(name string) (t time.Time, ok bool) {
+	if !strings.HasPrefix(name, autoSnapshotPrefix) {
+		return
+	}
+	t, err := time.Parse(autoSnapshotTimeFormat, name[len(autoSnapshotPrefix):])
+	return t, err == nil
+}
+
+// SnapshotSchedule returns the current snapshot schedule.
+func (self *Fs) SnapshotSchedule() (s SnapshotSchedule) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	v := tr.IB().Get(NewBlockKey(fsIno, BST_CONFIG, configSnapshotSchedule).IB())
+	if v == nil {
+		return
+	}
+	err := binary.Read(strings.NewReader(*v), binary.BigEndian, &s)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// SetSnapshotSchedule stores the snapshot schedule in the filesystem.
+func (self *Fs) SetSnapshotSchedule(s SnapshotSchedule) error {
+	mlog.Printf2("fs/snapshotschedule", "fs.SetSnapshotSchedule %v", &s)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.BigEndian, &s)
+	if err != nil {
+		log.Panic(err)
+	}
+	self.Update(func(tr *hugger.Transaction) {
+		tr.IB().Set(NewBlockKey(fsIno, BST_CONFIG, configSnapshotSchedule).IB(), b.String())
+	})
+	return nil
+}
+
+// keep returns the times of snapshots (sorted newest first) that
+// should be kept.
+func (self *SnapshotSchedule) keep(times []time.Time) map[time.Time]bool {
+	keep := make(map[time.Time]bool)
+	if self.Hourly+self.Daily+self.Weekly+self.Monthly == 0 {
+		for _, t := range times {
+			keep[t] = true
+		}
+		return keep
+	}
+	if len(times) > 0 {
+		keep[times[0]] = true
+	}
+	periods := []struct {
+		count  uint32
+		period func(t time.Time) string
+	}{
+		{self.Hourly, func(t time.Time) string {
+			return t.Format("2006010215")
+		}},
+		{self.Daily, func(t time.Time) string {
+			return t.Format("20060102")
+		}},
+		{self.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		}},
+		{self.Monthly, func(t time.Time) string {
+			return t.Format("200601")
+		}},
+	}
+	for _, p := range periods {
+		seen := make(map[string]bool)
+		for _, t := range times {
+			k := p.period(t.UTC())
+			if seen[k] {
+				continue
+			}
+			if uint32(len(seen)) >= p.count {
+				break
+			}
+			seen[k] = true
+			keep[t] = true
+		}
+	}
+	return keep
+}
+
+// autoSnapshots returns names and times of the automatic snapshots,
+// newest first.
+func (self *Fs) autoSnapshots() (names []string, times []time.Time) {
+	l := self.ListSnapshots()
+	for i := len(l) - 1; i >= 0; i-- {
+		if t, ok := parseAutoSnapshotName(l[i]); ok {
+			names = append(names, l[i])
+			times = append(times, t)
+		}
+	}
+	return
+}
+
+// PruneSnapshots removes the automatic snapshots not covered by the
+// retention policy. Storage reclaims the blocks referred to only by
+// them on the next flush.
+func (self *Fs) PruneSnapshots() {
+	s := self.SnapshotSchedule()
+	names, times := self.autoSnapshots()
+	keep := s.keep(times)
+	for i, name := range names {
+		if !keep[times[i]] {
+			mlog.Printf2("fs/snapshotschedule", " pruning %s", name)
+			self.DeleteSnapshot(name)
+		}
+	}
+}
+
+// runSnapshotSchedule takes automatic snapshot if it is due at the
+// given time, and prunes the old ones.
+func (self *Fs) runSnapshotSchedule(now time.Time) {
+	s := self.SnapshotSchedule()
+	if s.Interval <= 0 || self.readOnly {
+		return
+	}
+	_, times := self.autoSnapshots()
+	if len(times) > 0 && now.Sub(times[0]) < s.Interval {
+		return
+	}
+	name := autoSnapshotName(now)
+	mlog.Printf2("fs/snapshotschedule", "fs.runSnapshotSchedule creating %s", name)
+	err := self.CreateSnapshot(name)
+	if err != nil {
+		mlog.Printf2("fs/snapshotschedule", " failed: %v", err)
+		return
+	}
+	self.PruneSnapshots()
+}
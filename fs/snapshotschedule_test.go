@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func TestSnapshotScheduleKeep(t *testing.T) {
+	t.Parallel()
+	// Snapshot every 6 hours for 60 days, newest first
+	t0 := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for i := 0; i < 4*60; i++ {
+		times = append(times, t0.Add(-time.Duration(i)*6*time.Hour))
+	}
+	s := SnapshotSchedule{}
+	assert.Equal(t, len(s.keep(times)), len(times))
+
+	s = SnapshotSchedule{Hourly: 3}
+	keep := s.keep(times)
+	assert.Equal(t, len(keep), 3)
+	assert.True(t, keep[times[0]] && keep[times[1]] && keep[times[2]])
+
+	s = SnapshotSchedule{Daily: 2, Monthly: 3}
+	keep = s.keep(times)
+	// 2 days (latest of each) + 2 more months (Oct is covered by daily)
+	assert.Equal(t, len(keep), 4)
+	assert.True(t, keep[times[0]])
+	assert.True(t, keep[t0.Add(-18*time.Hour)])
+	assert.True(t, keep[time.Date(2026, 9, 30, 18, 0, 0, 0, time.UTC)])
+	assert.True(t, keep[time.Date(2026, 8, 31, 18, 0, 0, 0, time.UTC)])
+
+	s = SnapshotSchedule{Weekly: 2}
+	keep = s.keep(times)
+	assert.Equal(t, len(keep), 2)
+	// 2026-10-20 is Tuesday; previous week ends Sunday 18th
+	assert.True(t, keep[time.Date(2026, 10, 18, 18, 0, 0, 0, time.UTC)])
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	u := NewFSUser(fs)
+
+	assert.Equal(t, fs.SnapshotSchedule(), SnapshotSchedule{})
+	t0 := time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)
+	fs.runSnapshotSchedule(t0)
+	assert.Equal(t, len(fs.ListSnapshots()), 0)
+
+	s := SnapshotSchedule{Interval: time.Hour, Hourly: 2}
+	fs.SetSnapshotSchedule(s)
+	assert.Equal(t, fs.SnapshotSchedule(), s)
+
+	writeTestFile(t, u, "/file", "v0")
+	fs.runSnapshotSchedule(t0)
+	assert.Equal(t, fs.ListSnapshots(), []string{"auto-20261020T120000Z"})
+
+	// Not due yet
+	writeTestFile(t, u, "/file", "v1")
+	fs.runSnapshotSchedule(t0.Add(30 * time.Minute))
+	assert.Equal(t, len(fs.ListSnapshots()), 1)
+
+	fs.runSnapshotSchedule(t0.Add(time.Hour))
+	writeTestFile(t, u, "/file", "v2")
+	fs.runSnapshotSchedule(t0.Add(2 * time.Hour))
+	assert.Equal(t, fs.ListSnapshots(), []string{"auto-20261020T130000Z",
+		"auto-20261020T140000Z"})
+	name0 := snapshotStorageName("toor", "auto-20261020T120000Z")
+	assert.Equal(t, st.GetBlockIdByName(name0), "")
+	assert.Equal(t, readTestFile(t, u, "/.snapshots/auto-20261020T130000Z/file"), "v1")
+
+	// Manually created ones are not pruned
+	assert.Nil(t, fs.CreateSnapshot("manual"))
+	fs.runSnapshotSchedule(t0.Add(3 * time.Hour))
+	assert.Equal(t, fs.ListSnapshots(), []string{"auto-20261020T140000Z",
+		"auto-20261020T150000Z", "manual"})
+
+	// Schedule persists
+	fs.Close()
+	st = storage.Storage{Backend: backend}.Init()
+	fs = NewFs(st, "toor", 0)
+	defer fs.Close()
+	assert.Equal(t, fs.SnapshotSchedule(), s)
+}
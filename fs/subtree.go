@@ -0,0 +1,534 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Instead of whole filesystems, subtrees (rooted at a directory) can
+// be synchronized with peers. The subtree is exported as a tree of
+// its own that contains only the keys of the inodes within it, so
+// only the blocks reachable from them are transferred. The peer then
+// merges the changes to its own subtree, confining the merge to the
+// inodes within it (and ones that are new to it).
+//
+// Both sides number their inodes independently, and the numbers may
+// collide with the ones in the rest of the volume (most notably, the
+// subtree roots are different inodes). Therefore each side keeps a
+// map (BST_SUBTREE_INO in fsIno) per peer of the inodes whose number
+// differs on the peer's side. Received inodes are renumbered using
+// it (and new inodes are added to it if their number is already in
+// use outside the subtree), and exports are made in the numbering of
+// the peer using it in reverse.
+//
+// Entries of the subtree root in directories outside the subtree are
+// not exported, and the link counts of the other inodes count only
+// the entries within the subtree. The link count and parent of the
+// root are always those of our own root.
+//
+// The export is rebuilt from scratch each time, so its cost is
+// proportional to the size of the subtree. It is kept by name (see
+// SubtreeExportName) until the subtree or the peer is removed.
+
+// configSubtreeRoot is the configuration item of subtree exports
+// that contains the (8 byte) inode of the subtree root
+const configSubtreeRoot = "subtree"
+
+var ErrSubtreeNotFound = errors.New("Subtree root directory not found")
+var ErrSubtreeInvalid = errors.New("Invalid subtree export")
+
+func newSubtreeInoKey(peer string, ino uint64) BlockKey {
+	b := util.ConcatBytes([]byte(peer), []byte{0}, util.Uint64Bytes(ino))
+	return NewBlockKey(fsIno, BST_SUBTREE_INO, string(b))
+}
+
+// subtreeInoMap maps the inode numbers of the peer to ours (where
+// they differ).
+type subtreeInoMap struct {
+	t       *ibtree.Transaction
+	peer    string
+	toLocal map[uint64]uint64
+	toPeer  map[uint64]uint64
+}
+
+func loadSubtreeInoMap(t *ibtree.Transaction, peer string) *subtreeInoMap {
+	self := &subtreeInoMap{t: t, peer: peer,
+		toLocal: make(map[uint64]uint64),
+		toPeer:  make(map[uint64]uint64)}
+	prefix := peer + "\x00"
+	IterateInoSubTypeKeys(t, fsIno, BST_SUBTREE_INO,
+		func(key BlockKey) bool {
+			data := key.SubTypeData()
+			if !strings.HasPrefix(data, prefix) || len(data) != len(prefix)+8 {
+				return true
+			}
+			pino := binary.BigEndian.Uint64([]byte(data[len(prefix):]))
+			ino := binary.BigEndian.Uint64([]byte(*t.Get(key.IB())))
+			self.toLocal[pino] = ino
+			self.toPeer[ino] = pino
+			return true
+		})
+	return self
+}
+
+func (self *subtreeInoMap) forget(pino uint64) {
+	ino, ok := self.toLocal[pino]
+	if !ok {
+		return
+	}
+	self.t.Delete(newSubtreeInoKey(self.peer, pino).IB())
+	delete(self.toLocal, pino)
+	delete(self.toPeer, ino)
+}
+
+// set records that inode pino of the peer is our ino.
+func (self *subtreeInoMap) set(pino, ino uint64) {
+	if old, ok := self.toLocal[pino]; ok && old == ino {
+		return
+	}
+	self.forget(pino)
+	if old, ok := self.toPeer[ino]; ok {
+		self.forget(old)
+	}
+	if pino == ino {
+		return
+	}
+	mlog.Printf2("fs/subtree", " mapping %s #%d to #%d", self.peer, pino, ino)
+	self.t.Set(newSubtreeInoKey(self.peer, pino).IB(), string(util.Uint64Bytes(ino)))
+	self.toLocal[pino] = ino
+	self.toPeer[ino] = pino
+}
+
+// unused returns random inode number that is neither in use by us,
+// nor by the map.
+func (self *subtreeInoMap) unused() uint64 {
+	for {
+		ino := unusedIno(self.t)
+		_, ok1 := self.toLocal[ino]
+		_, ok2 := self.toPeer[ino]
+		if !ok1 && !ok2 {
+			return ino
+		}
+	}
+}
+
+// local returns our inode for the inode of the peer. Inodes that are
+// new to the map keep their number, unless it is in use outside the
+// subtree.
+func (self *subtreeInoMap) local(pino uint64, inodes map[uint64]bool) uint64 {
+	if ino, ok := self.toLocal[pino]; ok {
+		return ino
+	}
+	_, taken := self.toPeer[pino]
+	if !taken && (inodes[pino] || self.t.Get(NewBlockKey(pino, BST_META, "").IB()) == nil) {
+		return pino
+	}
+	ino := self.unused()
+	self.set(pino, ino)
+	return ino
+}
+
+// remote returns the peer's inode for our inode. If the peer already
+// knows some other inode by its number, alias is allocated for it.
+func (self *subtreeInoMap) remote(ino uint64) uint64 {
+	if pino, ok := self.toPeer[ino]; ok {
+		return pino
+	}
+	if _, ok := self.toLocal[ino]; !ok {
+		return ino
+	}
+	var pino uint64
+	for {
+		pino = rand.Uint64() &^ childNodeIdBase
+		_, ok1 := self.toLocal[pino]
+		_, ok2 := self.toPeer[pino]
+		if pino != fsIno && !ok1 && !ok2 {
+			break
+		}
+	}
+	self.set(pino, ino)
+	return pino
+}
+
+// iterateSubtreeKeys calls cb with the keys and values of the
+// included inodes within the subtree rooted at root, numbered using
+// mapIno.
+func iterateSubtreeKeys(t *ibtree.Transaction, root uint64, filter *subtreeFilter, mapIno func(uint64) uint64, cb func(k ibtree.Key, v string)) {
+	inodes := filter.inodes
+	for _, ino := range sortedInoSet(inodes) {
+		mino := mapIno(ino)
+		var meta *InodeMeta
+		var nlink uint32
+		k := NewBlockKey(ino, BST_NONE, "").IB()
+		end := NewBlockKey(ino, BST_LAST, "").IB()
+		for {
+			nkeyp := t.NextKey(k)
+			if nkeyp == nil || *nkeyp >= end {
+				break
+			}
+			k = *nkeyp
+			bk := BlockKey(k)
+			v := *t.Get(k)
+			data := bk.SubTypeData()
+			switch bk.SubType() {
+			case BST_META:
+				meta = decodeInodeMeta(v)
+				continue
+			case BST_DIR_NAME2INODE:
+				child := binary.BigEndian.Uint64([]byte(v))
+				if filter.hidden[fsckEntry{ino, bk.Filename(), child}] {
+					continue
+				}
+				v = string(util.Uint64Bytes(mapIno(child)))
+			case BST_FILE_INODEFILENAME:
+				b := []byte(data)
+				dir := binary.BigEndian.Uint64(b)
+				if !inodes[dir] || filter.hidden[fsckEntry{dir, string(b[8:]), ino}] {
+					continue
+				}
+				nlink++
+				data = string(util.ConcatBytes(util.Uint64Bytes(mapIno(dir)), b[8:]))
+			}
+			cb(NewBlockKey(mino, bk.SubType(), data).IB(), v)
+		}
+		if meta == nil {
+			continue
+		}
+		if ino != root {
+			meta.StNlink = nlink
+			if meta.IsDir() {
+				meta.ParentIno = mapIno(meta.ParentIno)
+			}
+		}
+		b, err := meta.MarshalMsg(nil)
+		if err != nil {
+			log.Panic(err)
+		}
+		cb(NewBlockKey(mino, BST_META, "").IB(), string(b))
+	}
+}
+
+// exportKeys returns the keys of export of the subtree rooted at
+// root. The excluded inodes are listed using their number for the
+// peer, if any.
+func exportKeys(t *ibtree.Transaction, root uint64, filter *subtreeFilter, mapIno func(uint64) uint64, excludedIno func(uint64) (uint64, bool)) map[ibtree.Key]string {
+	keys := make(map[ibtree.Key]string)
+	iterateSubtreeKeys(t, root, filter, mapIno,
+		func(k ibtree.Key, v string) {
+			keys[k] = v
+		})
+	k := NewBlockKey(fsIno, BST_CONFIG, configSubtreeRoot).IB()
+	keys[k] = string(util.Uint64Bytes(mapIno(root)))
+	for ino := range filter.excluded {
+		if pino, ok := excludedIno(ino); ok {
+			k := NewBlockKey(fsIno, BST_NOSYNC_INO, string(util.Uint64Bytes(pino)))
+			keys[k.IB()] = ""
+		}
+	}
+	return keys
+}
+
+// IsSubtreeExport determines if the tree is a subtree export (as
+// opposed to whole filesystem).
+func IsSubtreeExport(node *ibtree.Node) bool {
+	t := ibtree.NewTransaction(node)
+	return t.Get(NewBlockKey(fsIno, BST_CONFIG, configSubtreeRoot).IB()) != nil
+}
+
+// saveTree stores the keys as tree of its own under name.
+func (self *Fs) saveTree(name string, keys map[ibtree.Key]string) {
+	h := &hugger.Hugger{RootName: name, Storage: self.storage,
+		IterateReferencesCallback: iterateNodeReferences}
+	h.Init(0)
+	h.RootIsNew()
+	h.Update(func(tr *hugger.Transaction) {
+		t := tr.IB()
+		var l []ibtree.Key
+		for k := ibtree.Key(""); ; {
+			nkeyp := t.NextKey(k)
+			if nkeyp == nil {
+				break
+			}
+			k = *nkeyp
+			if _, ok := keys[k]; !ok {
+				l = append(l, k)
+			}
+		}
+		for _, k := range l {
+			t.Delete(k)
+		}
+		for k, v := range keys {
+			if ov := t.Get(k); ov == nil || *ov != v {
+				t.Set(k, v)
+			}
+		}
+	})
+	h.Flush()
+	h.ReleaseRoot()
+}
+
+// ResolveSubtree returns the directory at the given path, or if the
+// path is empty, ino (if it is directory).
+func (self *Fs) ResolveSubtree(path string, ino uint64) (uint64, error) {
+	if path != "" {
+		inode := self.lookupPath(path)
+		if inode == nil {
+			return 0, ErrSubtreeNotFound
+		}
+		ino = inode.ino
+		inode.Release()
+	}
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	v := tr.IB().Get(NewBlockKey(ino, BST_META, "").IB())
+	if ino == fsIno || v == nil || !decodeInodeMeta(*v).IsDir() {
+		return 0, ErrSubtreeNotFound
+	}
+	return ino, nil
+}
+
+// SubtreeExportName returns the name subtree exports for the peer
+// are stored under.
+func (self *Fs) SubtreeExportName(peer string) string {
+	return fmt.Sprintf("%s.subtree.%s", self.RootName, peer)
+}
+
+// releaseName lets go of the blocks held by the name (if any).
+func (self *Fs) releaseName(name string) {
+	if self.storage.GetBlockIdByName(name) != "" {
+		mlog.Printf2("fs/subtree", " releasing %s", name)
+		self.storage.SetNameToBlockId(name, "")
+	}
+}
+
+// ExportSubtree stores the subtree rooted at directory ino under
+// name, numbered for the peer. Paths matching the filters (see
+// syncFilter) are not exported. If the subtree no longer exists, the
+// previous export is released.
+func (self *Fs) ExportSubtree(ino uint64, peer, name string, filters []string) error {
+	mlog.Printf2("fs/subtree", "fs.ExportSubtree #%d for %s as %s", ino, peer, name)
+	if _, err := self.ResolveSubtree("", ino); err != nil {
+		self.releaseName(name)
+		return err
+	}
+	if !self.readOnly {
+		self.WithoutParallelWrites(func() {})
+	}
+	var keys map[ibtree.Key]string
+	update := func(tr *hugger.Transaction) {
+		t := tr.IB()
+		m := loadSubtreeInoMap(t, peer)
+		keys = exportKeys(t, ino, filterSubtree(t, ino, filters), m.remote,
+			func(ino uint64) (uint64, bool) {
+				// Aliases are not needed, as the peer
+				// does not know the inode if its
+				// number differs
+				if pino, ok := m.toPeer[ino]; ok {
+					return pino, true
+				}
+				_, ok := m.toLocal[ino]
+				return ino, !ok
+			})
+	}
+	if self.readOnly {
+		// Aliases cannot be stored, but they are needed only
+		// if the peer has sent us something
+		tr := self.GetNestableTransaction()
+		update(tr)
+		tr.Close()
+	} else {
+		self.Update(update)
+	}
+	self.saveTree(name, keys)
+	return nil
+}
+
+// ForgetSubtreePeer releases the subtree export for the peer, and
+// forgets the mapping of its inodes; synchronizing with it again
+// starts from scratch.
+func (self *Fs) ForgetSubtreePeer(peer string) {
+	mlog.Printf2("fs/subtree", "fs.ForgetSubtreePeer %s", peer)
+	self.releaseName(self.SubtreeExportName(peer))
+	if self.readOnly {
+		return
+	}
+	self.Update(func(tr *hugger.Transaction) {
+		m := loadSubtreeInoMap(tr.IB(), peer)
+		for pino := range m.toLocal {
+			m.forget(pino)
+		}
+	})
+}
+
+// renumberTree returns copy of the inode keys of the tree (built on
+// empty) with the inodes renumbered using mapIno. The root gets the
+// given link count and parent.
+func renumberTree(node, empty *ibtree.Node, mapIno func(uint64) uint64, root uint64, rootMeta *InodeMeta) *ibtree.Node {
+	it := ibtree.NewTransaction(node)
+	nt := ibtree.NewTransaction(empty)
+	for k := ibtree.Key(""); ; {
+		nkeyp := it.NextKey(k)
+		if nkeyp == nil {
+			break
+		}
+		k = *nkeyp
+		bk := BlockKey(k)
+		if len(bk) <= inodeDataLength || bk.Ino() == fsIno || bk.SubType() >= BST_LAST {
+			continue
+		}
+		v := *it.Get(k)
+		ino := mapIno(bk.Ino())
+		data := bk.SubTypeData()
+		switch bk.SubType() {
+		case BST_META:
+			meta := decodeInodeMeta(v)
+			if ino == root {
+				meta.StNlink = rootMeta.StNlink
+				meta.ParentIno = rootMeta.ParentIno
+			} else if meta.IsDir() {
+				meta.ParentIno = mapIno(meta.ParentIno)
+			}
+			b, err := meta.MarshalMsg(nil)
+			if err != nil {
+				log.Panic(err)
+			}
+			v = string(b)
+		case BST_DIR_NAME2INODE:
+			child := binary.BigEndian.Uint64([]byte(v))
+			v = string(util.Uint64Bytes(mapIno(child)))
+		case BST_FILE_INODEFILENAME:
+			b := []byte(data)
+			dir := mapIno(binary.BigEndian.Uint64(b))
+			data = string(util.ConcatBytes(util.Uint64Bytes(dir), b[8:]))
+		}
+		nt.Set(NewBlockKey(ino, bk.SubType(), data).IB(), v)
+	}
+	return nt.Root()
+}
+
+// translateSubtree renumbers the subtree export of the peer (dst) for
+// us. Inodes that are renumbered only now are known by their old
+// number in the previous state (src), so they are removed from it to
+// make them entirely new to the merge. The inodes the peer excluded
+// are returned too.
+func translateSubtree(t *ibtree.Transaction, src, dst, empty *ibtree.Node, m *subtreeInoMap, root uint64, inodes map[uint64]bool) (nsrc, ndst *ibtree.Node, excluded map[uint64]bool, err error) {
+	it := ibtree.NewTransaction(dst)
+	v := it.Get(NewBlockKey(fsIno, BST_CONFIG, configSubtreeRoot).IB())
+	if v == nil || len(*v) != 8 {
+		err = ErrSubtreeInvalid
+		return
+	}
+	proot := binary.BigEndian.Uint64([]byte(*v))
+	if it.Get(NewBlockKey(proot, BST_META, "").IB()) == nil {
+		err = ErrSubtreeInvalid
+		return
+	}
+	m.set(proot, root)
+	excluded = make(map[uint64]bool)
+	IterateInoSubTypeKeys(it, fsIno, BST_NOSYNC_INO,
+		func(key BlockKey) bool {
+			pino := binary.BigEndian.Uint64([]byte(key.SubTypeData()))
+			if ino, ok := m.toLocal[pino]; ok {
+				pino = ino
+			}
+			excluded[pino] = true
+			return true
+		})
+	rootMeta := decodeInodeMeta(*t.Get(NewBlockKey(root, BST_META, "").IB()))
+	renumbered := make(map[uint64]uint64)
+	ndst = renumberTree(dst, empty, func(pino uint64) uint64 {
+		_, known := m.toLocal[pino]
+		ino := m.local(pino, inodes)
+		if !known && ino != pino {
+			renumbered[pino] = ino
+		}
+		return ino
+	}, root, rootMeta)
+	nsrc = src
+	if len(renumbered) > 0 {
+		st := ibtree.NewTransaction(src)
+		for pino := range renumbered {
+			st.DeleteRange(NewBlockKey(pino, BST_NONE, "").IB(),
+				NewBlockKey(pino, BST_LAST, "").IB())
+		}
+		nsrc = st.Root()
+	}
+	return
+}
+
+// MergeSubtreeFromPeer performs non-local 3-way merge of changes in
+// the subtree export of the peer (from src to dst) to the subtree
+// rooted at the directory ino. The merge is confined to the inodes
+// within the subtree, and ones that are new to us, and paths matching
+// the filters (see syncFilter) are left alone. Our subtree is then
+// stored under baseName, to be used as src of the next merge.
+//
+// If ino is the root, dst may be also whole filesystem.
+func (self *Fs) MergeSubtreeFromPeer(src, dst *ibtree.Node, ino uint64, peer, baseName string, filters []string) (err error) {
+	mlog.Printf2("fs/subtree", "fs.MergeSubtreeFromPeer #%d from %s", ino, peer)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	if _, err = self.ResolveSubtree("", ino); err != nil {
+		return
+	}
+	if !IsSubtreeExport(dst) {
+		if ino != fuse.FUSE_ROOT_ID {
+			return ErrSubtreeInvalid
+		}
+		dt := ibtree.NewTransaction(dst)
+		identity := func(ino uint64) uint64 { return ino }
+		keys := exportKeys(dt, ino, filterSubtree(dt, ino, filters),
+			identity, func(ino uint64) (uint64, bool) {
+				return ino, true
+			})
+		nt := ibtree.NewTransaction(self.NewRootNode())
+		for k, v := range keys {
+			nt.Set(k, v)
+		}
+		dst = nt.Root()
+	}
+	self.Update2(func(tr *hugger.Transaction) bool {
+		t := tr.IB()
+		filter := filterSubtree(t, ino, filters)
+		m := loadSubtreeInoMap(t, peer)
+		var nsrc, ndst *ibtree.Node
+		var excluded map[uint64]bool
+		nsrc, ndst, excluded, err = translateSubtree(t, src, dst, self.NewRootNode(), m, ino, filter.inodes)
+		if err != nil {
+			return false
+		}
+		scope := &mergeScope{root: ino, filter: filter,
+			peerExcluded: excluded,
+			allowed:      make(map[uint64]bool)}
+		err = mergeTo3(tr, nsrc, ndst, false, peer, self.replicaId, scope)
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+	// Metadata of any inode may have changed under us
+	self.inodeTracker.flushMetaCache()
+
+	keys := make(map[ibtree.Key]string)
+	tr := self.GetNestableTransaction()
+	t := tr.IB()
+	iterateSubtreeKeys(t, ino, filterSubtree(t, ino, filters),
+		func(ino uint64) uint64 { return ino },
+		func(k ibtree.Key, v string) {
+			keys[k] = v
+		})
+	tr.Close()
+	self.saveTree(baseName, keys)
+	return
+}
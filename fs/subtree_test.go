@@ -0,0 +1,158 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+// syncSubtree propagates the subtree at path of from to the subtree at
+// path of to (with the filters), much like the server does.
+func syncSubtree(t *testing.T, from *Fs, fpath string, to *Fs, tpath string, filters ...string) {
+	fino, err := from.ResolveSubtree(fpath, 0)
+	assert.Nil(t, err)
+	exportName := from.SubtreeExportName(to.RootName)
+	assert.Nil(t, from.ExportSubtree(fino, to.RootName, exportName, filters))
+	tino, err := to.ResolveSubtree(tpath, 0)
+	assert.Nil(t, err)
+	baseName := fmt.Sprintf("%s.%s", exportName, to.RootName)
+	b0, _, _ := to.LoadNodeByName(baseName)
+	b, _, ok := to.LoadNodeByName(exportName)
+	assert.True(t, ok)
+	assert.Nil(t, to.MergeSubtreeFromPeer(b0, b, tino, from.RootName, baseName, filters))
+}
+
+func listTestDir(t *testing.T, u *FSUser, path string) []string {
+	names, err := u.ListDir(path)
+	assert.Nil(t, err)
+	sort.Strings(names)
+	return names
+}
+
+func TestSubtree(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	a := NewFs(st, "a", 0)
+	defer a.Close()
+	ua := NewFSUser(a)
+	b := newNamedFs(st, "b", 0, nil, true)
+	defer b.Close()
+	ub := NewFSUser(b)
+	check := func() {
+		assert.Equal(t, len(a.Fsck(false)), 0)
+		assert.Equal(t, len(b.Fsck(false)), 0)
+	}
+
+	assert.Nil(t, ua.Mkdir("/sync", 0777))
+	assert.Nil(t, ua.Mkdir("/sync/d", 0777))
+	writeTestFile(t, ua, "/sync/x", "x")
+	writeTestFile(t, ua, "/sync/d/y", "y")
+	writeTestFile(t, ua, "/other", "other")
+	assert.Nil(t, ub.Mkdir("/laptop", 0777))
+	assert.Nil(t, ub.Mkdir("/elsewhere", 0777))
+
+	_, err := a.ResolveSubtree("/other", 0)
+	assert.Equal(t, err, ErrSubtreeNotFound)
+	_, err = a.ResolveSubtree("/nonexistent", 0)
+	assert.Equal(t, err, ErrSubtreeNotFound)
+
+	// Only the subtree is transferred
+	syncSubtree(t, a, "/sync", b, "/laptop")
+	check()
+	assert.Equal(t, listTestDir(t, ub, "/"), []string{"elsewhere", "laptop"})
+	assert.Equal(t, listTestDir(t, ub, "/laptop"), []string{"d", "x"})
+	assert.Equal(t, readTestFile(t, ub, "/laptop/d/y"), "y")
+
+	// Nothing changes if it is repeated, or synced back
+	syncSubtree(t, a, "/sync", b, "/laptop")
+	syncSubtree(t, b, "/laptop", a, "/sync")
+	check()
+	assert.Equal(t, listTestDir(t, ua, "/"), []string{"other", "sync"})
+	assert.Equal(t, listTestDir(t, ua, "/sync"), []string{"d", "x"})
+	assert.Equal(t, listTestDir(t, ub, "/laptop"), []string{"d", "x"})
+
+	// Inode that left the subtree collides with the one peer
+	// still has there, so it is renumbered (and as its entry was
+	// removed here, it ends up as conflict copy)
+	assert.Nil(t, ub.Rename("/laptop/x", "/elsewhere/x"))
+	rewriteTestFile(t, ua, "/sync/x", "x2")
+	syncSubtree(t, a, "/sync", b, "/laptop")
+	check()
+	l := conflictNames(t, ub, "/laptop", "x")
+	assert.Equal(t, len(l), 1)
+	assert.Equal(t, readTestFile(t, ub, "/laptop/"+l[0]), "x2")
+	assert.Equal(t, readTestFile(t, ub, "/elsewhere/x"), "x")
+	assert.Nil(t, ub.Rename("/laptop/"+l[0], "/laptop/x"))
+
+	// Changes propagate back without duplicates
+	writeTestFile(t, ub, "/laptop/d/z", "z")
+	rewriteTestFile(t, ub, "/laptop/x", "x3")
+	syncSubtree(t, b, "/laptop", a, "/sync")
+	check()
+	assert.Equal(t, listTestDir(t, ua, "/sync"), []string{"d", "x"})
+	assert.Equal(t, listTestDir(t, ua, "/sync/d"), []string{"y", "z"})
+	assert.Equal(t, readTestFile(t, ua, "/sync/x"), "x3")
+	syncSubtree(t, a, "/sync", b, "/laptop")
+	check()
+	assert.Equal(t, listTestDir(t, ub, "/laptop/d"), []string{"y", "z"})
+	assert.Equal(t, listTestDir(t, ub, "/elsewhere"), []string{"x"})
+	assert.Equal(t, readTestFile(t, ub, "/elsewhere/x"), "x")
+
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
+
+func TestSubtreeRelease(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	a := NewFs(st, "a", 0)
+	defer a.Close()
+	ua := NewFSUser(a)
+	b := newNamedFs(st, "b", 0, nil, true)
+	defer b.Close()
+	ub := NewFSUser(b)
+
+	assert.Nil(t, ua.Mkdir("/sync", 0777))
+	writeTestFile(t, ua, "/sync/x", "x")
+	assert.Nil(t, ub.Mkdir("/laptop", 0777))
+	exportName := a.SubtreeExportName("b")
+	exported := func() string {
+		syncSubtree(t, a, "/sync", b, "/laptop")
+		id := st.GetBlockIdByName(exportName)
+		assert.True(t, id != "")
+		return id
+	}
+	reclaimed := func(id string) bool {
+		a.Flush()
+		st.Flush()
+		if st.GetBlockIdByName(exportName) != "" {
+			return false
+		}
+		bl := st.GetBlockById(id)
+		if bl != nil {
+			bl.Close()
+			return false
+		}
+		return true
+	}
+
+	// Removed peer
+	id := exported()
+	a.ForgetSubtreePeer("b")
+	assert.True(t, reclaimed(id))
+
+	// Removed subtree
+	id = exported()
+	ino, err := a.ResolveSubtree("/sync", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, ua.Remove("/sync/x"))
+	assert.Nil(t, ua.Remove("/sync"))
+	assert.Equal(t, a.ExportSubtree(ino, "b", exportName, nil), ErrSubtreeNotFound)
+	assert.True(t, reclaimed(id))
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
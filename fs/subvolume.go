@@ -0,0 +1,198 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// Subvolumes are writable clones of the filesystem. A subvolume is
+// simply another named root in storage that starts from the root
+// block of a snapshot (or the current state), and then diverges
+// independently; unchanged blocks are shared by reference
+// counting. Like snapshots, the list of subvolumes lives within the
+// tree in the fsIno pseudo-inode.
+//
+// Snapshots and subvolumes of the origin are not carried over to the
+// clone, as they are held by the origin's names in storage.
+// Subvolumes have snapshots and subvolumes of their own, and
+// deleting a subvolume deletes them as well.
+
+var ErrSubvolumeExists = errors.New("Subvolume already exists")
+var ErrSubvolumeNotFound = errors.New("Subvolume not found")
+var ErrSubvolumeBusy = errors.New("Subvolume is in use")
+
+// subvolumeTracker keeps count of the subvolumes opened from a
+// filesystem (by root name), so that they are not deleted while in
+// use.
+type subvolumeTracker struct {
+	lock util.MutexLocked
+	open map[string]int
+}
+
+func (self *subvolumeTracker) add(rootName string, n int) {
+	defer self.lock.Locked()()
+	if self.open == nil {
+		self.open = make(map[string]int)
+	}
+	self.open[rootName] += n
+	if self.open[rootName] == 0 {
+		delete(self.open, rootName)
+	}
+}
+
+func (self *subvolumeTracker) inUse(rootName string) bool {
+	defer self.lock.Locked()()
+	return self.open[rootName] > 0
+}
+
+func SubvolumeRootName(rootName, name string) string {
+	return fmt.Sprintf("%s.subvolume.%s", rootName, name)
+}
+
+func (self *Fs) subvolumeRootName(name string) string {
+	return SubvolumeRootName(self.RootName, name)
+}
+
+// NewSubvolumeFs provides filesystem for the named subvolume of the
+// filesystem called rootName. The Fs owns the storage, i.e. closing
+// it closes the storage as well. Returns nil if the subvolume does
+// not exist.
+func NewSubvolumeFs(st *storage.Storage, rootName, name string, cacheSize int) *Fs {
+	if !validSnapshotName(name) {
+		return nil
+	}
+	subRootName := SubvolumeRootName(rootName, name)
+	if st.GetBlockIdByName(subRootName) == "" {
+		return nil
+	}
+	return NewFs(st, subRootName, cacheSize)
+}
+
+// CreateSubvolume creates writable clone of the named snapshot (or
+// the current state if snapshot is empty string).
+func (self *Fs) CreateSubvolume(name, snapshot string) error {
+	mlog.Printf2("fs/subvolume", "fs.CreateSubvolume %s %s", name, snapshot)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	if !validSnapshotName(name) {
+		return ErrInvalidSnapshotName
+	}
+	var bid string
+	if snapshot != "" {
+		bid = self.SnapshotBlockId(snapshot)
+		if bid == "" {
+			return ErrSnapshotNotFound
+		}
+	}
+	k := NewBlockKey(fsIno, BST_SUBVOLUME, name).IB()
+	if !self.Update2(func(tr *hugger.Transaction) bool {
+		if tr.IB().Get(k) != nil {
+			return false
+		}
+		tr.IB().Set(k, "")
+		return true
+	}) {
+		return ErrSubvolumeExists
+	}
+	rootName := self.subvolumeRootName(name)
+	if bid != "" {
+		self.storage.SetNameToBlockId(rootName, bid)
+	} else {
+		self.WithoutParallelWrites(func() {
+			block := self.RootBlock()
+			defer block.Close()
+			self.storage.SetNameToBlockId(rootName, block.Id())
+		})
+	}
+
+	// Get rid of the origin's snapshots and subvolumes
+	fs := newNamedFs(self.storage, rootName, 0, nil, true)
+	fs.Update(func(tr *hugger.Transaction) {
+		for _, bst := range []BlockSubType{BST_SNAPSHOT, BST_SUBVOLUME} {
+			tr.IB().DeleteRange(NewBlockKey(fsIno, bst, "").IB(),
+				NewBlockKey(fsIno, bst+1, "").IB())
+		}
+	})
+	fs.Close()
+	return nil
+}
+
+// OpenSubvolume provides writable filesystem of the named
+// subvolume, sharing storage with us. Returns nil if it does not
+// exist.
+func (self *Fs) OpenSubvolume(name string) *Fs {
+	mlog.Printf2("fs/subvolume", "fs.OpenSubvolume %s", name)
+	if !validSnapshotName(name) {
+		return nil
+	}
+	tr := self.GetNestableTransaction()
+	exists := tr.IB().Get(NewBlockKey(fsIno, BST_SUBVOLUME, name).IB()) != nil
+	tr.Close()
+	if !exists {
+		return nil
+	}
+	rootName := self.subvolumeRootName(name)
+	fs := newNamedFs(self.storage, rootName, 0, nil, true)
+	fs.subvolumeOf = self
+	self.subvolumes.add(rootName, 1)
+	return fs
+}
+
+// DeleteSubvolume removes the named subvolume, as well as its
+// snapshots and subvolumes. Blocks referred to only by it are then
+// freed by storage. The subvolume must not be in use, i.e. open
+// (see OpenSubvolume) or hosted as a volume alongside us.
+func (self *Fs) DeleteSubvolume(name string) error {
+	mlog.Printf2("fs/subvolume", "fs.DeleteSubvolume %s", name)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	rootName := self.subvolumeRootName(name)
+	if self.subvolumes.inUse(rootName) ||
+		(self.parent != nil && self.parent.Volume(rootName) != nil) {
+		return ErrSubvolumeBusy
+	}
+	fs := self.OpenSubvolume(name)
+	if fs == nil {
+		return ErrSubvolumeNotFound
+	}
+	for _, snapshot := range fs.ListSnapshots() {
+		fs.DeleteSnapshot(snapshot)
+	}
+	for _, subvolume := range fs.ListSubvolumes() {
+		fs.DeleteSubvolume(subvolume)
+	}
+	fs.Close()
+	k := NewBlockKey(fsIno, BST_SUBVOLUME, name).IB()
+	if !self.Update2(func(tr *hugger.Transaction) bool {
+		if tr.IB().Get(k) == nil {
+			return false
+		}
+		tr.IB().Delete(k)
+		return true
+	}) {
+		return ErrSubvolumeNotFound
+	}
+	self.storage.SetNameToBlockId(rootName, "")
+	self.storage.SetNameToBlockId(replicaStorageName(rootName), "")
+	return nil
+}
+
+// ListSubvolumes returns names of the current subvolumes in sorted
+// order.
+func (self *Fs) ListSubvolumes() (names []string) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	IterateInoSubTypeKeys(tr.IB(), fsIno, BST_SUBVOLUME,
+		func(key BlockKey) bool {
+			names = append(names, key.SubTypeData())
+			return true
+		})
+	return
+}
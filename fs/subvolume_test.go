@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func TestSubvolume(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	u := NewFSUser(fs)
+
+	writeTestFile(t, u, "/file", "v0")
+	writeTestFile(t, u, "/shared", "shared")
+	assert.Nil(t, fs.CreateSnapshot("s"))
+	writeTestFile(t, u, "/file", "v1")
+
+	assert.Equal(t, fs.CreateSubvolume("v", "nonexistent"), ErrSnapshotNotFound)
+	assert.Nil(t, fs.CreateSubvolume("v", "s"))
+	assert.Equal(t, fs.CreateSubvolume("v", "s"), ErrSubvolumeExists)
+	assert.Nil(t, fs.CreateSubvolume("w", ""))
+	assert.Equal(t, fs.ListSubvolumes(), []string{"v", "w"})
+	assert.True(t, fs.OpenSubvolume("nonexistent") == nil)
+
+	// Subvolume starts from the snapshot, and diverges
+	// independently
+	v := fs.OpenSubvolume("v")
+	vu := NewFSUser(v)
+	assert.Equal(t, readTestFile(t, vu, "/file"), "v0")
+	assert.Equal(t, readTestFile(t, vu, "/shared"), "shared")
+	assert.Equal(t, len(v.ListSnapshots()), 0)
+	assert.Equal(t, len(v.ListSubvolumes()), 0)
+	writeTestFile(t, vu, "/file", "v2")
+	writeTestFile(t, vu, "/new", "new")
+	assert.Nil(t, v.CreateSnapshot("vs"))
+	assert.Nil(t, v.CreateSubvolume("nested", "vs"))
+	vbid := v.RootBlockId()
+	assert.Equal(t, fs.DeleteSubvolume("v"), ErrSubvolumeBusy)
+	v.Close()
+
+	assert.Equal(t, readTestFile(t, u, "/file"), "v1")
+	_, err := u.Stat("/new")
+	assert.True(t, err != nil)
+	w := fs.OpenSubvolume("w")
+	assert.Equal(t, readTestFile(t, NewFSUser(w), "/file"), "v1")
+	w.Close()
+
+	// Deletion releases the subvolume (and what is within it),
+	// but not what is shared with others
+	assert.Nil(t, fs.DeleteSubvolume("v"))
+	assert.Equal(t, fs.DeleteSubvolume("v"), ErrSubvolumeNotFound)
+	assert.Equal(t, fs.ListSubvolumes(), []string{"w"})
+	for _, name := range []string{"toor.subvolume.v",
+		"toor.subvolume.v.snapshot.vs",
+		"toor.subvolume.v.subvolume.nested"} {
+		assert.Equal(t, st.GetBlockIdByName(name), "")
+	}
+	fs.Flush()
+	assert.True(t, backend.GetBlockById(vbid) == nil)
+	assert.Equal(t, readTestFile(t, u, "/shared"), "shared")
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+
+	// Standalone use
+	fs.Close()
+	st = storage.Storage{Backend: backend}.Init()
+	assert.True(t, NewSubvolumeFs(st, "toor", "v", 0) == nil)
+	w = NewSubvolumeFs(st, "toor", "w", 0)
+	assert.Equal(t, readTestFile(t, NewFSUser(w), "/file"), "v1")
+	w.Close()
+}
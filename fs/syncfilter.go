@@ -0,0 +1,256 @@
+package fs
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+)
+
+// Synchronization filters are gitignore-style patterns of paths that
+// are neither exported to, nor merged from peers. They are given
+// either by the connector (e.g. from a file), in which case they are
+// relative to the synchronized (sub)tree root, or in nosyncXattr of
+// directories (one per line), in which case they are relative to the
+// directory.
+//
+// Like in git, later patterns (and those of deeper directories) take
+// precedence, '!' negates a pattern, trailing '/' matches only
+// directories, pattern with '/' elsewhere is relative to the
+// directory it is defined in (and otherwise matches at any depth),
+// and '**' matches any number of path components. Contents of
+// excluded directories are excluded too.
+//
+// Exclusion is decided per directory entry, from the current
+// namespace of each side whenever they synchronize. Excluded entries
+// (and the inodes reachable only through them) are not in the
+// exports, nor in the merge bases, so renaming a directory moves its
+// excluded contents along locally without the merge touching
+// them. The exports also list the excluded inodes, so that inodes
+// that the peer renamed to be excluded are not deleted either.
+//
+// Once nosyncXattr has been set on any directory, synchronization of
+// the whole filesystem is filtered too (see HasSyncFilters).
+
+const nosyncXattr = "user.tfhfs.nosync"
+
+// configNosync is the configuration item that indicates nosyncXattr
+// has been set
+const configNosync = "nosync"
+
+type syncRule struct {
+	// base is the directory (relative to the root) the rule is
+	// relative to
+	base string
+
+	segments []string
+
+	dirOnly, negate bool
+}
+
+type syncFilter []syncRule
+
+// with returns filter that has the given patterns (relative to base)
+// added to it.
+func (self syncFilter) with(base string, patterns []string) syncFilter {
+	var rules []syncRule
+	for _, p := range patterns {
+		p = strings.TrimRight(p, " \r")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		rule := syncRule{base: base}
+		if strings.HasPrefix(p, "!") {
+			rule.negate = true
+			p = p[1:]
+		} else if strings.HasPrefix(p, "\\") {
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			rule.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if p == "" {
+			continue
+		}
+		if strings.Contains(p, "/") {
+			rule.segments = strings.Split(strings.TrimLeft(p, "/"), "/")
+		} else {
+			rule.segments = []string{"**", p}
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return self
+	}
+	// Copy, as the filter of the parent may have other children
+	nf := make(syncFilter, 0, len(self)+len(rules))
+	return append(append(nf, self...), rules...)
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// excludes determines if the path (relative to the root) is excluded.
+func (self syncFilter) excludes(rel string, isDir bool) bool {
+	for i := len(self) - 1; i >= 0; i-- {
+		rule := self[i]
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		p := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			p = rel[len(rule.base)+1:]
+		}
+		if matchSegments(rule.segments, strings.Split(p, "/")) {
+			return !rule.negate
+		}
+	}
+	return false
+}
+
+type filteredDir struct {
+	// path is relative to the root
+	path   string
+	filter syncFilter
+}
+
+func (self *filteredDir) excludes(name string, isDir bool) bool {
+	rel := name
+	if self.path != "" {
+		rel = self.path + "/" + name
+	}
+	return self.filter.excludes(rel, isDir)
+}
+
+// subtreeFilter describes which parts of a subtree are synchronized.
+type subtreeFilter struct {
+	// inodes are reachable via entries that are not excluded
+	inodes map[uint64]bool
+
+	// excluded inodes are reachable only via excluded entries
+	excluded map[uint64]bool
+
+	// hidden entries are excluded
+	hidden map[fsckEntry]bool
+
+	// dirs contains the included directories
+	dirs map[uint64]*filteredDir
+}
+
+func nosyncPatterns(t *ibtree.Transaction, ino uint64) []string {
+	v := t.Get(NewBlockKey(ino, BST_XATTR, nosyncXattr).IB())
+	if v == nil {
+		return nil
+	}
+	return strings.Split(*v, "\n")
+}
+
+func isDirInTree(t *ibtree.Transaction, ino uint64) (isDir, exists bool) {
+	v := t.Get(NewBlockKey(ino, BST_META, "").IB())
+	if v == nil {
+		return false, false
+	}
+	return decodeInodeMeta(*v).IsDir(), true
+}
+
+// filterSubtree walks the subtree rooted at root, applying the
+// patterns as well as the ones in nosyncXattr of directories.
+func filterSubtree(t *ibtree.Transaction, root uint64, patterns []string) *subtreeFilter {
+	self := &subtreeFilter{inodes: map[uint64]bool{root: true},
+		excluded: make(map[uint64]bool),
+		hidden:   make(map[fsckEntry]bool),
+		dirs:     make(map[uint64]*filteredDir)}
+	filter := syncFilter(nil).with("", patterns).with("", nosyncPatterns(t, root))
+	self.dirs[root] = &filteredDir{filter: filter}
+	todo := []uint64{root}
+	var hidden []uint64
+	for len(todo) > 0 {
+		dir := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		fd := self.dirs[dir]
+		IterateInoSubTypeKeys(t, dir, BST_DIR_NAME2INODE,
+			func(key BlockKey) bool {
+				child := binary.BigEndian.Uint64([]byte(*t.Get(key.IB())))
+				name := key.Filename()
+				isDir, _ := isDirInTree(t, child)
+				if fd.excludes(name, isDir) {
+					self.hidden[fsckEntry{dir, name, child}] = true
+					hidden = append(hidden, child)
+					return true
+				}
+				if self.inodes[child] {
+					return true
+				}
+				self.inodes[child] = true
+				if isDir {
+					p := name
+					if fd.path != "" {
+						p = fd.path + "/" + name
+					}
+					self.dirs[child] = &filteredDir{path: p,
+						filter: fd.filter.with(p, nosyncPatterns(t, child))}
+					todo = append(todo, child)
+				}
+				return true
+			})
+	}
+	for len(hidden) > 0 {
+		ino := hidden[len(hidden)-1]
+		hidden = hidden[:len(hidden)-1]
+		if self.inodes[ino] || self.excluded[ino] {
+			continue
+		}
+		self.excluded[ino] = true
+		IterateInoSubTypeKeys(t, ino, BST_DIR_NAME2INODE,
+			func(key BlockKey) bool {
+				hidden = append(hidden, binary.BigEndian.Uint64([]byte(*t.Get(key.IB()))))
+				return true
+			})
+	}
+	return self
+}
+
+// includesEntry determines if the entry is synchronized. Entries
+// of directories outside the subtree are left for the caller to
+// decide.
+func (self *subtreeFilter) includesEntry(e fsckEntry, isDir bool) bool {
+	if self.hidden[e] {
+		return false
+	}
+	fd, ok := self.dirs[e.dir]
+	if !ok {
+		return true
+	}
+	return !fd.excludes(e.name, isDir)
+}
+
+// HasSyncFilters determines if nosyncXattr has ever been set in the
+// filesystem.
+func (self *Fs) HasSyncFilters() bool {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	return tr.IB().Get(NewBlockKey(fsIno, BST_CONFIG, configNosync).IB()) != nil
+}
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func TestSyncFilterMatch(t *testing.T) {
+	t.Parallel()
+	f := syncFilter(nil).with("", []string{"# comment", "", "*.o", "!keep.o",
+		"build/", "/top", "doc/**/*.tmp"}).with("sub", []string{"x"})
+	for _, c := range []struct {
+		path          string
+		isDir, result bool
+	}{
+		{"a.o", false, true},
+		{"a/b/c.o", false, true},
+		{"a/keep.o", false, false},
+		{"a/build", true, true},
+		{"a/build", false, false},
+		{"top", false, true},
+		{"a/top", false, false},
+		{"doc/a.tmp", false, true},
+		{"doc/a/b/c.tmp", false, true},
+		{"a/doc/c.tmp", false, false},
+		{"sub/x", false, true},
+		{"sub/y/x", true, true},
+		{"x", false, false},
+		{"a.c", false, false},
+	} {
+		assert.Equal(t, f.excludes(c.path, c.isDir), c.result, c.path)
+	}
+}
+
+func TestSyncFilter(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	a := NewFs(st, "a", 0)
+	defer a.Close()
+	ua := NewFSUser(a)
+	b := newNamedFs(st, "b", 0, nil, true)
+	defer b.Close()
+	ub := NewFSUser(b)
+	check := func() {
+		assert.Equal(t, len(a.Fsck(false)), 0)
+		assert.Equal(t, len(b.Fsck(false)), 0)
+	}
+	filters := []string{"build/", "*.o", "!keep.o"}
+
+	for _, dir := range []string{"/proj", "/proj/src", "/proj/build", "/proj/cache"} {
+		assert.Nil(t, ua.Mkdir(dir, 0777))
+	}
+	writeTestFile(t, ua, "/proj/src/main.c", "main")
+	writeTestFile(t, ua, "/proj/build/out", "out")
+	writeTestFile(t, ua, "/proj/x.o", "x")
+	writeTestFile(t, ua, "/proj/keep.o", "keep")
+	writeTestFile(t, ua, "/proj/cache/c", "c")
+	assert.True(t, !a.HasSyncFilters())
+	assert.Nil(t, ua.SetXAttr("/proj", nosyncXattr, []byte("cache/\n")))
+	assert.True(t, a.HasSyncFilters())
+
+	syncSubtree(t, a, "/", b, "/", filters...)
+	check()
+	assert.Equal(t, listTestDir(t, ub, "/proj"), []string{"keep.o", "src"})
+	assert.Equal(t, readTestFile(t, ub, "/proj/src/main.c"), "main")
+
+	// Excluded paths of the destination are left alone
+	assert.Nil(t, ub.Mkdir("/proj/build", 0777))
+	writeTestFile(t, ub, "/proj/build/b", "b")
+	writeTestFile(t, ub, "/proj/src/b.c", "b")
+	syncSubtree(t, b, "/", a, "/", filters...)
+	check()
+	assert.Equal(t, listTestDir(t, ua, "/proj/src"), []string{"b.c", "main.c"})
+	assert.Equal(t, listTestDir(t, ua, "/proj/build"), []string{"out"})
+	assert.Equal(t, listTestDir(t, ua, "/proj/cache"), []string{"c"})
+
+	// Excluded contents move along with renamed directory
+	assert.Nil(t, ua.Mkdir("/moved", 0777))
+	assert.Nil(t, ua.Rename("/proj", "/moved/proj2"))
+	syncSubtree(t, a, "/", b, "/", filters...)
+	check()
+	assert.Equal(t, listTestDir(t, ub, "/"), []string{"moved"})
+	assert.Equal(t, listTestDir(t, ub, "/moved/proj2"), []string{"build", "keep.o", "src"})
+	assert.Equal(t, listTestDir(t, ub, "/moved/proj2/build"), []string{"b"})
+	syncSubtree(t, b, "/", a, "/", filters...)
+	check()
+	assert.Equal(t, listTestDir(t, ua, "/moved/proj2"), []string{"build", "cache", "keep.o", "src", "x.o"})
+	assert.Equal(t, listTestDir(t, ua, "/moved/proj2/build"), []string{"out"})
+
+	// File renamed to be excluded is not removed from the peer
+	assert.Nil(t, ua.Rename("/moved/proj2/src/main.c", "/moved/proj2/src/main.o"))
+	syncSubtree(t, a, "/", b, "/", filters...)
+	check()
+	assert.Equal(t, listTestDir(t, ub, "/moved/proj2/src"), []string{"b.c", "main.c"})
+
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
@@ -0,0 +1,65 @@
+package fs
+
+import (
+	"encoding/hex"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+)
+
+// Any root block id that is still held in storage (current root,
+// snapshots, or anything else referring to it) can be viewed as-is,
+// read-only. The current root block id is available in the
+// rootBlockXAttr extended attribute; note that it is released once
+// the filesystem changes, unless e.g. a snapshot refers to it.
+
+// rootBlockXAttr is the virtual extended attribute that provides the
+// (hex encoded) root block id of the filesystem.
+const rootBlockXAttr = "user.tfhfs.rootblock"
+
+// ResolveRootBlockId returns the root block id referred to by spec,
+// which is either name of a snapshot of the filesystem called
+// rootName, or hex encoded root block id. Empty string is returned
+// if neither matches.
+func ResolveRootBlockId(st *storage.Storage, rootName, spec string) string {
+	if validSnapshotName(spec) {
+		bid := st.GetBlockIdByName(snapshotStorageName(rootName, spec))
+		if bid != "" {
+			return bid
+		}
+	}
+	b, err := hex.DecodeString(spec)
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+	return string(b)
+}
+
+// NewReadOnlyFs provides read-only view of the filesystem at the
+// given root block id; all mutating operations fail with EROFS. The
+// Fs owns the storage, i.e. closing it closes the storage as well.
+// Returns nil if the block does not exist.
+func NewReadOnlyFs(st *storage.Storage, bid string, cacheSize int) *Fs {
+	mlog.Printf2("fs/timetravel", "NewReadOnlyFs %x", bid)
+	fs := newReadOnlyFs(st, bid, cacheSize, nil)
+	if fs == nil {
+		return nil
+	}
+	st.IterateReferencesCallback = func(id string, data []byte, cb storage.BlockReferenceCallback) {
+		fs.iterateReferencesCallback(id, data, cb)
+	}
+	return fs
+}
+
+// RootBlockId returns the current root block id of the filesystem.
+func (self *Fs) RootBlockId() string {
+	if !self.readOnly {
+		self.WithoutParallelWrites(func() {})
+	}
+	block := self.RootBlock()
+	if block == nil {
+		return ""
+	}
+	defer block.Close()
+	return block.Id()
+}
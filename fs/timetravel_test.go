@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func isEROFS(err error) bool {
+	return err != nil && err.Error() == s2e(fuse.EROFS).Error()
+}
+
+func TestTimeTravel(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	u := NewFSUser(fs)
+	writeTestFile(t, u, "/file", "yesterday")
+	assert.Nil(t, fs.CreateSnapshot("snap"))
+	writeTestFile(t, u, "/file", "today")
+	assert.Nil(t, fs.CreateSnapshot("snap2"))
+	today := hex.EncodeToString([]byte(fs.SnapshotBlockId("snap2")))
+	writeTestFile(t, u, "/file", "tomorrow")
+	b, err := u.GetXAttr("/", rootBlockXAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.TrimSpace(string(b)),
+		hex.EncodeToString([]byte(fs.RootBlockId())))
+	// (closing does not affect in-memory backend)
+	fs.Close()
+
+	for spec, content := range map[string]string{"snap": "yesterday",
+		today: "today"} {
+		st = storage.Storage{Backend: backend}.Init()
+		bid := ResolveRootBlockId(st, "toor", spec)
+		assert.True(t, bid != "", spec)
+		rofs := NewReadOnlyFs(st, bid, 0)
+		assert.True(t, rofs != nil, spec)
+		u = NewFSUser(rofs)
+		assert.Equal(t, readTestFile(t, u, "/file"), content)
+		_, err = u.OpenFile("/file", uint32(os.O_WRONLY), 0)
+		assert.True(t, isEROFS(err), err)
+		_, err = u.OpenFile("/new", uint32(os.O_CREATE|os.O_WRONLY), 0777)
+		assert.True(t, isEROFS(err), err)
+		assert.True(t, isEROFS(u.Mkdir("/dir", 0777)))
+		assert.True(t, isEROFS(u.Remove("/file")))
+		assert.True(t, isEROFS(u.SetXAttr("/file", "user.foo", []byte("bar"))))
+		assert.Equal(t, rofs.CreateSnapshot("x"), ErrReadOnly)
+		rofs.Close()
+	}
+
+	st = storage.Storage{Backend: backend}.Init()
+	assert.Equal(t, ResolveRootBlockId(st, "toor", "nosuchsnapshot"), "")
+	assert.Nil(t, NewReadOnlyFs(st, "nosuchblock", 0))
+	st.Close()
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	u := NewFSUser(fs)
+	writeTestFile(t, u, "/file", "content")
+	fs.Close()
+
+	backend.Init(storage.BackendConfiguration{ReadOnly: true})
+	st = storage.Storage{Backend: backend, ReadOnly: true}.Init()
+	fs = NewFs(st, "toor", 0)
+	defer fs.Close()
+	u = NewFSUser(fs)
+	assert.Equal(t, readTestFile(t, u, "/file"), "content")
+	_, err := u.OpenFile("/file", uint32(os.O_WRONLY), 0)
+	assert.True(t, isEROFS(err), err)
+	assert.True(t, isEROFS(u.Mkdir("/dir", 0777)))
+	assert.True(t, isEROFS(u.Rename("/file", "/file2")))
+	assert.True(t, isEROFS(u.Chmod("/file", 0700)))
+	assert.Equal(t, fs.CreateSnapshot("x"), ErrReadOnly)
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+	// (backend would panic if written to)
+	fs.Flush()
+}
@@ -0,0 +1,423 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// When trash is enabled, unlinking the last link of a file (or
+// removing a directory) moves it to the (root-owned) trash directory
+// at the root of the volume instead. The entry is named after the
+// inode number, and the original path and deletion time are stored in
+// the BST_TRASH_INFO key of the inode; it goes away with the inode
+// itself. Removing things within the trash deletes them for real.
+// While trash is enabled, the name is reserved at the root; enabling
+// it fails if some other entry already has the name.
+//
+// Trashed inodes are still charged against quotas. They are purged
+// by the flushing goroutine once they are older than MaxAge, or
+// (oldest first) while available space is below MinFreeBytes. The
+// space freed by purging an entry is estimated from its own size
+// only.
+//
+// The policy is stored in the fsIno pseudo-inode, like the snapshot
+// schedule.
+
+const trashName = ".trash"
+
+const trashMode = fuse.S_IFDIR | 0700
+
+const configTrashPolicy = "trash"
+
+var ErrTrashEntryNotFound = errors.New("Trash entry not found")
+var ErrTrashRestoreExists = errors.New("Restore target already exists")
+var ErrTrashRestoreNoParent = errors.New("Restore target directory not found")
+var ErrTrashNameInUse = errors.New("Trash directory name is in use")
+
+type TrashPolicy struct {
+	// Move removed inodes to trash
+	Enabled bool
+
+	// Purge entries older than this (0 = never)
+	MaxAge time.Duration
+
+	// Purge oldest entries while less space is available (0 = never)
+	MinFreeBytes uint64
+}
+
+func (self *TrashPolicy) String() string {
+	return fmt.Sprintf("enabled %v maxage %v minfree %d",
+		self.Enabled, self.MaxAge, self.MinFreeBytes)
+}
+
+type TrashEntry struct {
+	// Name within the trash directory
+	Name string
+
+	Ino     uint64
+	Size    uint64
+	Path    string
+	Deleted time.Time
+}
+
+func (self *TrashEntry) String() string {
+	return fmt.Sprintf("%s\t%s\t%d\t%s", self.Name,
+		self.Deleted.UTC().Format(time.RFC3339), self.Size, self.Path)
+}
+
+func encodeTrashInfo(deleted time.Time, path string) string {
+	b := util.ConcatBytes(util.Uint64Bytes(uint64(deleted.UnixNano())), []byte(path))
+	return string(b)
+}
+
+func decodeTrashInfo(v string) (deleted time.Time, path string) {
+	b := []byte(v)
+	deleted = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	path = string(b[8:])
+	return
+}
+
+// TrashPolicy returns the current trash policy.
+func (self *Fs) TrashPolicy() (p TrashPolicy) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	v := tr.IB().Get(NewBlockKey(fsIno, BST_CONFIG, configTrashPolicy).IB())
+	if v == nil {
+		return
+	}
+	err := binary.Read(strings.NewReader(*v), binary.BigEndian, &p)
+	if err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// SetTrashPolicy stores the trash policy in the filesystem.
+func (self *Fs) SetTrashPolicy(p TrashPolicy) error {
+	mlog.Printf2("fs/trash", "fs.SetTrashPolicy %v", &p)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	if p.Enabled {
+		// Do not adopt some other entry as the trash
+		trash := self.trashDir(false)
+		if trash != nil {
+			defer trash.Release()
+			meta := trash.Meta()
+			if meta == nil || meta.StMode != trashMode || meta.StUid != 0 {
+				return ErrTrashNameInUse
+			}
+		}
+	}
+	var b bytes.Buffer
+	err := binary.Write(&b, binary.BigEndian, &p)
+	if err != nil {
+		log.Panic(err)
+	}
+	self.Update(func(tr *hugger.Transaction) {
+		tr.IB().Set(NewBlockKey(fsIno, BST_CONFIG, configTrashPolicy).IB(), b.String())
+	})
+	return nil
+}
+
+// trashDir returns the trash directory, optionally creating it. The
+// caller is responsible for releasing it.
+func (self *Fs) trashDir(create bool) *inode {
+	root := self.GetInode(fuse.FUSE_ROOT_ID)
+	defer root.Release()
+	trash := root.GetChildByName(trashName)
+	if trash != nil || !create {
+		return trash
+	}
+	// Not via create, as the name is reserved while trash is enabled
+	defer root.metaWriteLock.Locked()()
+	trash = root.GetChildByName(trashName)
+	if trash != nil {
+		// Someone else created it in the meanwhile
+		return trash
+	}
+	var meta InodeMeta
+	meta.StMode = trashMode
+	trash = self.CreateInode()
+	defer trash.metaWriteLock.Locked()()
+	self.Update(func(tr *hugger.Transaction) {
+		trash.SetMetaInTransaction(&meta, tr)
+	})
+	root.AddChild(trashName, trash)
+	return trash
+}
+
+// isTrashName checks if the name within given directory is reserved
+// for the trash directory.
+func (self *Fs) isTrashName(dirIno uint64, name string) bool {
+	return dirIno == fuse.FUSE_ROOT_ID && name == trashName && self.TrashPolicy().Enabled
+}
+
+// inTrash checks if the directory is the trash directory or within it.
+func inTrash(t *ibtree.Transaction, trashIno, ino uint64) bool {
+	for depth := 0; depth < maxPathDepth && ino != fuse.FUSE_ROOT_ID; depth++ {
+		if ino == trashIno {
+			return true
+		}
+		v := t.Get(NewBlockKey(ino, BST_META, "").IB())
+		if v == nil {
+			return false
+		}
+		ino = decodeInodeMeta(*v).ParentIno
+	}
+	return false
+}
+
+// trashFor returns the trash directory that removals from dir should
+// go to, or nil if they should be removed for real.
+func (self *Fs) trashFor(dir *inode) *inode {
+	if !self.TrashPolicy().Enabled {
+		return nil
+	}
+	trash := self.trashDir(false)
+	if trash != nil {
+		tr := self.GetNestableTransaction()
+		within := inTrash(tr.IB(), trash.ino, dir.ino)
+		tr.Close()
+		if within {
+			trash.Release()
+			return nil
+		}
+		return trash
+	}
+	return self.trashDir(true)
+}
+
+// trashInInode moves the named child of inode to trash, unless it is
+// the trash directory itself or a file with other links left.
+func (self *fsOps) trashInInode(inode, trash *inode, name string, isdir *bool, ctx *fuse.Caller) (code fuse.Status) {
+	child, code := self.lookup(inode, name, ctx)
+	defer child.Release()
+	if !code.Ok() {
+		return
+	}
+	meta := child.Meta()
+	if meta == nil {
+		return fuse.ENOENT
+	}
+	if child.ino == trash.ino || (!meta.IsDir() && meta.StNlink > 1) {
+		defer inode.metaWriteLock.Locked()()
+		defer child.metaWriteLock.Locked()()
+		return self.unlinkInodeInInode(inode, child, name, isdir, ctx)
+	}
+
+	tr := self.fs.GetNestableTransaction()
+	path := strings.TrimSuffix(inodePath(tr.IB(), inode.ino), "/") + "/" + name
+	tr.Close()
+	entry := fmt.Sprintf("%x", child.ino)
+
+	// Take locks in id order as in Rename
+	if inode.ino < trash.ino {
+		defer inode.metaWriteLock.Locked()()
+		defer trash.metaWriteLock.Locked()()
+	} else {
+		defer trash.metaWriteLock.Locked()()
+		defer inode.metaWriteLock.Locked()()
+	}
+	defer child.metaWriteLock.Locked()()
+
+	code = self.unlinkCheck(inode, child, isdir, ctx)
+	if !code.Ok() {
+		return
+	}
+	if echild := trash.GetChildByName(entry); echild != nil {
+		echild.Release()
+		mlog.Printf2("fs/trash", " %s already in trash, removing", entry)
+		inode.RemoveChild(child, name)
+		return fuse.OK
+	}
+	mlog.Printf2("fs/trash", "trashing %s as %s", path, entry)
+	trash.AddChild(entry, child)
+	inode.RemoveChild(child, name)
+	self.fs.Update(func(tr *hugger.Transaction) {
+		tr.IB().Set(NewBlockKey(child.ino, BST_TRASH_INFO, "").IB(),
+			encodeTrashInfo(time.Now(), path))
+	})
+	return fuse.OK
+}
+
+// ListTrash returns the entries in the trash, oldest first.
+func (self *Fs) ListTrash() (entries []TrashEntry) {
+	trash := self.trashDir(false)
+	if trash == nil {
+		return
+	}
+	defer trash.Release()
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	t := tr.IB()
+	IterateInoSubTypeKeys(t, trash.ino, BST_DIR_NAME2INODE,
+		func(key BlockKey) bool {
+			v := t.Get(key.IB())
+			e := TrashEntry{Name: key.Filename(),
+				Ino: binary.BigEndian.Uint64([]byte(*v))}
+			if v := t.Get(NewBlockKey(e.Ino, BST_TRASH_INFO, "").IB()); v != nil {
+				e.Deleted, e.Path = decodeTrashInfo(*v)
+			}
+			if v := t.Get(NewBlockKey(e.Ino, BST_META, "").IB()); v != nil {
+				e.Size = decodeInodeMeta(*v).StSize
+			}
+			entries = append(entries, e)
+			return true
+		})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+	return
+}
+
+// lookupPath returns the inode at the given path, or nil. The caller
+// is responsible for releasing it.
+func (self *Fs) lookupPath(path string) *inode {
+	inode := self.GetInode(fuse.FUSE_ROOT_ID)
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		child := inode.GetChildByName(name)
+		inode.Release()
+		if child == nil {
+			return nil
+		}
+		inode = child
+	}
+	return inode
+}
+
+// RestoreTrash moves the named trash entry back to its original
+// path. The directory it was in has to exist (e.g. by being restored
+// first), and the original name has to be free.
+func (self *Fs) RestoreTrash(name string) error {
+	mlog.Printf2("fs/trash", "fs.RestoreTrash %s", name)
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	trash := self.trashDir(false)
+	if trash == nil {
+		return ErrTrashEntryNotFound
+	}
+	defer trash.Release()
+	child := trash.GetChildByName(name)
+	if child == nil {
+		return ErrTrashEntryNotFound
+	}
+	defer child.Release()
+
+	tr := self.GetNestableTransaction()
+	v := tr.IB().Get(NewBlockKey(child.ino, BST_TRASH_INFO, "").IB())
+	tr.Close()
+	if v == nil {
+		return ErrTrashEntryNotFound
+	}
+	_, path := decodeTrashInfo(*v)
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return ErrTrashRestoreNoParent
+	}
+	parent := self.lookupPath(path[:i])
+	if parent == nil {
+		return ErrTrashRestoreNoParent
+	}
+	defer parent.Release()
+	if !parent.IsDir() || parent.ino == trash.ino {
+		return ErrTrashRestoreNoParent
+	}
+	base := path[i+1:]
+
+	if parent.ino < trash.ino {
+		defer parent.metaWriteLock.Locked()()
+		defer trash.metaWriteLock.Locked()()
+	} else {
+		defer trash.metaWriteLock.Locked()()
+		defer parent.metaWriteLock.Locked()()
+	}
+	defer child.metaWriteLock.Locked()()
+
+	if self.isReservedName(parent.ino, base) {
+		return ErrTrashRestoreExists
+	}
+	if echild := parent.GetChildByName(base); echild != nil {
+		echild.Release()
+		return ErrTrashRestoreExists
+	}
+	parent.AddChild(base, child)
+	trash.RemoveChild(child, name)
+	self.Update(func(tr *hugger.Transaction) {
+		tr.IB().Delete(NewBlockKey(child.ino, BST_TRASH_INFO, "").IB())
+	})
+	return nil
+}
+
+// removeTree removes the named child of dir, and everything below it.
+func (self *Fs) removeTree(dir *inode, name string) {
+	child := dir.GetChildByName(name)
+	if child == nil {
+		return
+	}
+	if child.IsDir() {
+		var names []string
+		child.IterateSubTypeKeys(BST_DIR_NAME2INODE,
+			func(key BlockKey) bool {
+				names = append(names, key.Filename())
+				return true
+			})
+		for _, n := range names {
+			self.removeTree(child, n)
+		}
+	}
+	child.Release()
+	defer dir.metaWriteLock.Locked()()
+	var ctx fuse.Caller
+	self.Ops.unlinkInInode(dir, name, nil, &ctx)
+}
+
+// expireTrash purges the trash entries that should go according to
+// the policy at the given time.
+func (self *Fs) expireTrash(now time.Time) {
+	p := self.TrashPolicy()
+	if self.readOnly || (p.MaxAge <= 0 && p.MinFreeBytes == 0) {
+		return
+	}
+	entries := self.ListTrash()
+	if len(entries) == 0 {
+		return
+	}
+	var need, freed uint64
+	if p.MinFreeBytes > 0 {
+		avail := self.storage.Backend.GetBytesAvailable()
+		if avail < p.MinFreeBytes {
+			need = p.MinFreeBytes - avail
+		}
+	}
+	trash := self.trashDir(false)
+	if trash == nil {
+		return
+	}
+	defer trash.Release()
+	for _, e := range entries {
+		expired := p.MaxAge > 0 && now.Sub(e.Deleted) >= p.MaxAge
+		if !expired && freed >= need {
+			break
+		}
+		mlog.Printf2("fs/trash", "fs.expireTrash purging %v", &e)
+		self.removeTree(trash, e.Name)
+		freed += e.Size
+	}
+}
@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/stvp/assert"
+)
+
+func trashPaths(fs *Fs) (paths []string) {
+	for _, e := range fs.ListTrash() {
+		paths = append(paths, e.Path)
+	}
+	return
+}
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	// Disabled by default
+	writeTestFile(t, u, "/x", "x")
+	assert.Nil(t, u.Remove("/x"))
+	assert.Equal(t, len(fs.ListTrash()), 0)
+
+	// Some other entry is not taken over as trash
+	trashPath := "/" + trashName
+	writeTestFile(t, u, trashPath, "x")
+	assert.Equal(t, fs.SetTrashPolicy(TrashPolicy{Enabled: true}), ErrTrashNameInUse)
+	assert.Nil(t, u.Remove(trashPath))
+
+	assert.Nil(t, fs.SetTrashPolicy(TrashPolicy{Enabled: true}))
+	assert.Equal(t, fs.TrashPolicy(), TrashPolicy{Enabled: true})
+
+	// The name is reserved while trash is enabled
+	assert.True(t, u.Mkdir(trashPath, 0777) != nil)
+	writeTestFile(t, u, "/x", "x")
+	assert.True(t, u.Rename("/x", trashPath) != nil)
+	assert.Nil(t, u.Remove("/x"))
+	assert.Equal(t, len(fs.ListTrash()), 1)
+	assert.Nil(t, u.Remove(trashPath+"/"+fs.ListTrash()[0].Name))
+	assert.Nil(t, u.Mkdir("/d", 0777))
+	writeTestFile(t, u, "/d/f", "f")
+	writeTestFile(t, u, "/g", "g")
+	writeTestFile(t, u, "/h", "h")
+	assert.Nil(t, u.Link("/h", "/l"))
+
+	assert.Nil(t, u.Remove("/d/f"))
+	assert.Nil(t, u.Remove("/d"))
+	assert.Equal(t, trashPaths(fs), []string{"/d/f", "/d"})
+	_, err := u.Stat("/d")
+	assert.True(t, err != nil)
+
+	// Removing one of multiple links does not trash anything
+	assert.Nil(t, u.Remove("/l"))
+	assert.Equal(t, len(fs.ListTrash()), 2)
+	assert.Equal(t, readTestFile(t, u, "/h"), "h")
+
+	// Parent has to be restored first
+	entries := fs.ListTrash()
+	assert.Equal(t, fs.RestoreTrash(entries[0].Name), ErrTrashRestoreNoParent)
+	assert.Nil(t, fs.RestoreTrash(entries[1].Name))
+	assert.Nil(t, fs.RestoreTrash(entries[0].Name))
+	assert.Equal(t, fs.RestoreTrash(entries[0].Name), ErrTrashEntryNotFound)
+	assert.Equal(t, readTestFile(t, u, "/d/f"), "f")
+	assert.Equal(t, len(fs.ListTrash()), 0)
+
+	// Restoring on top of something is not allowed
+	assert.Nil(t, u.Remove("/g"))
+	writeTestFile(t, u, "/g", "g2")
+	entries = fs.ListTrash()
+	assert.Equal(t, fs.RestoreTrash(entries[0].Name), ErrTrashRestoreExists)
+
+	// Removing within trash is for real
+	assert.Nil(t, u.Remove(fmt.Sprintf("/%s/%s", trashName, entries[0].Name)))
+	assert.Equal(t, len(fs.ListTrash()), 0)
+
+	// Expiry by age
+	assert.Nil(t, u.Remove("/d/f"))
+	assert.Nil(t, u.Remove("/d"))
+	assert.Nil(t, fs.SetTrashPolicy(TrashPolicy{Enabled: true, MaxAge: time.Hour}))
+	fs.expireTrash(time.Now())
+	assert.Equal(t, len(fs.ListTrash()), 2)
+	fs.expireTrash(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, len(fs.ListTrash()), 0)
+
+	// Expiry by space (in-memory backend never has any); trashed
+	// directories are purged with their contents
+	assert.Nil(t, u.Mkdir("/d", 0777))
+	writeTestFile(t, u, "/d/f", "f")
+	assert.True(t, u.Remove("/d") != nil)
+	assert.Nil(t, u.Remove("/d/f"))
+	assert.Nil(t, u.Remove("/d"))
+	entries = fs.ListTrash()
+	assert.Equal(t, len(entries), 2)
+	assert.Nil(t, u.Rename("/h", fmt.Sprintf("/%s/%s/h", trashName, entries[1].Name)))
+	assert.Nil(t, fs.SetTrashPolicy(TrashPolicy{Enabled: true, MinFreeBytes: 1}))
+	fs.expireTrash(time.Now())
+	assert.Equal(t, trashPaths(fs), []string{"/d"})
+	assert.Nil(t, fs.SetTrashPolicy(TrashPolicy{Enabled: true, MinFreeBytes: 1 << 40}))
+	fs.expireTrash(time.Now())
+	assert.Equal(t, len(fs.ListTrash()), 0)
+
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+}
@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// Filesystem-wide usage counters live in the fsIno pseudo-inode. Like
+// quotas, they are updated whenever inode metadata is set or removed,
+// both locally and by merges.
+
+const (
+	counterInodes = "inodes"
+	counterBytes  = "bytes"
+
+	// counterRebuild marks the counters to be rebuilt on next
+	// mount, as they have drifted from the inode metadata
+	counterRebuild = "rebuild"
+)
+
+// usageXAttr is the virtual extended attribute that provides the
+// filesystem usage.
+const usageXAttr = "user.tfhfs.usage"
+
+// FsUsage describes the usage of the filesystem. Logical bytes is the
+// sum of file sizes, whereas physical bytes is what the (deduplicated
+// and compressed) storage actually uses.
+type FsUsage struct {
+	Inodes, InodeLimit                          uint64
+	LogicalBytes, PhysicalBytes, AvailableBytes uint64
+}
+
+func (self *FsUsage) String() string {
+	return fmt.Sprintf("inodes %d limit %d logical %d physical %d available %d",
+		self.Inodes, self.InodeLimit,
+		self.LogicalBytes, self.PhysicalBytes, self.AvailableBytes)
+}
+
+func getCounterInTransaction(t *ibtree.Transaction, name string) uint64 {
+	v := t.Get(NewBlockKey(fsIno, BST_COUNTER, name).IB())
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64([]byte(*v))
+}
+
+func setCounterInTransaction(t *ibtree.Transaction, name string, n uint64) {
+	t.Set(NewBlockKey(fsIno, BST_COUNTER, name).IB(), string(util.Uint64Bytes(n)))
+}
+
+func addCounterInTransaction(t *ibtree.Transaction, name string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	n := getCounterInTransaction(t, name)
+	if delta < 0 && uint64(-delta) > n {
+		log.Printf("Counter %s would go negative: %d%+d; marking it for rebuild", name, n, delta)
+		t.Set(NewBlockKey(fsIno, BST_COUNTER, counterRebuild).IB(), "")
+		setCounterInTransaction(t, name, 0)
+		return
+	}
+	setCounterInTransaction(t, name, n+uint64(delta))
+}
+
+// rebuildCountersInTransaction recomputes the counters from the inode
+// metadata, and returns descriptions of the counters that were wrong.
+func rebuildCountersInTransaction(t *ibtree.Transaction) (wrong []string) {
+	var inodes, bytes uint64
+	iterateInodeMetaInTransaction(t, func(ino uint64, meta *InodeMeta) {
+		inodes++
+		bytes += meta.StSize
+	})
+	for _, c := range []struct {
+		name string
+		n    uint64
+	}{{counterInodes, inodes}, {counterBytes, bytes}} {
+		// (Counter that has not changed from zero is not set)
+		n := getCounterInTransaction(t, c.name)
+		if n == c.n {
+			continue
+		}
+		wrong = append(wrong, fmt.Sprintf("%s %d != %d", c.name, n, c.n))
+		setCounterInTransaction(t, c.name, c.n)
+	}
+	if k := NewBlockKey(fsIno, BST_COUNTER, counterRebuild).IB(); t.Get(k) != nil {
+		t.Delete(k)
+	}
+	return
+}
+
+// initCounters builds the counters if the filesystem predates them,
+// or if they have been marked for rebuild.
+func (self *Fs) initCounters() {
+	self.Update(func(tr *hugger.Transaction) {
+		if tr.IB().Get(NewBlockKey(fsIno, BST_COUNTER, counterInodes).IB()) != nil &&
+			tr.IB().Get(NewBlockKey(fsIno, BST_COUNTER, counterRebuild).IB()) == nil {
+			return
+		}
+		mlog.Printf2("fs/usage", "fs.initCounters rebuilding %v", rebuildCountersInTransaction(tr.IB()))
+	})
+}
+
+// chargeUsageInTransaction updates the counters and quotas when inode
+// metadata changes from old to new; either may be nil (inode creation
+// or deletion).
+func chargeUsageInTransaction(t *ibtree.Transaction, old, new *InodeMetaData) {
+	var inodes, bytes int64
+	if old != nil {
+		inodes--
+		bytes -= int64(old.StSize)
+	}
+	if new != nil {
+		inodes++
+		bytes += int64(new.StSize)
+	}
+	addCounterInTransaction(t, counterInodes, inodes)
+	addCounterInTransaction(t, counterBytes, bytes)
+	chargeQuotaInTransaction(t, old, new)
+}
+
+// SetInodeLimit sets the maximum number of inodes (0 = no limit).
+func (self *Fs) SetInodeLimit(limit uint64) {
+	self.inodeLimit = limit
+}
+
+// Usage returns the current usage of the filesystem. Writes still in
+// progress may not be reflected in it yet.
+func (self *Fs) Usage() (u FsUsage) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	u.Inodes = getCounterInTransaction(tr.IB(), counterInodes)
+	u.InodeLimit = self.inodeLimit
+	u.LogicalBytes = getCounterInTransaction(tr.IB(), counterBytes)
+	u.PhysicalBytes = self.storage.Backend.GetBytesUsed()
+	u.AvailableBytes = self.storage.Backend.GetBytesAvailable()
+	self.addVolumesUsage(&u)
+	return
+}
+
+// inodesAvailable returns true if n more inodes may be created.
+func (self *Fs) inodesAvailable(t *ibtree.Transaction, n uint64) bool {
+	return self.inodeLimit == 0 || getCounterInTransaction(t, counterInodes)+n <= self.inodeLimit
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func TestUsage(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+
+	// Root directory exists from the start
+	assert.Equal(t, fs.Usage().Inodes, uint64(1))
+
+	writeTestFile(t, u, "/a", "foo")
+	writeTestFile(t, u, "/b", "barbaz")
+	assert.Nil(t, u.Mkdir("/dir", 0777))
+	// (Usage does not wait for the pending writes)
+	fs.WithoutParallelWrites(func() {})
+	usage := fs.Usage()
+	assert.Equal(t, usage.Inodes, uint64(4))
+	assert.Equal(t, usage.LogicalBytes, uint64(9))
+
+	assert.Nil(t, u.Remove("/a"))
+	fs.WithoutParallelWrites(func() {})
+	usage = fs.Usage()
+	assert.Equal(t, usage.Inodes, uint64(3))
+	assert.Equal(t, usage.LogicalBytes, uint64(6))
+
+	b, err := u.GetXAttr("/", usageXAttr)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "inodes 3 limit 0 logical 6 "), string(b))
+
+	// Concurrent local changes are merged, not overwritten
+	setMeta := func(ino uint64, size uint64) *hugger.Transaction {
+		tr := fs.GetTransaction()
+		meta := InodeMeta{InodeMetaData: InodeMetaData{StMode: fuse.S_IFREG, StSize: size}}
+		chargeUsageInTransaction(tr.IB(), nil, &meta.InodeMetaData)
+		b, _ := meta.MarshalMsg(nil)
+		tr.IB().Set(NewBlockKey(ino, BST_META, "").IB(), string(b))
+		return tr
+	}
+	tr1 := setMeta(12345, 10)
+	tr2 := setMeta(12346, 20)
+	tr1.CommitUntilSucceeds()
+	tr2.CommitUntilSucceeds()
+	tr1.Close()
+	tr2.Close()
+	usage = fs.Usage()
+	assert.Equal(t, usage.Inodes, uint64(5))
+	assert.Equal(t, usage.LogicalBytes, uint64(36))
+
+	// Inode limit
+	fs.SetInodeLimit(6)
+	var sfo fuse.StatfsOut
+	assert.Equal(t, fs.Ops.StatFs(nil, &u.InHeader, &sfo), fuse.OK)
+	assert.Equal(t, sfo.Files, uint64(6))
+	assert.Equal(t, sfo.Ffree, uint64(1))
+	assert.Nil(t, u.Mkdir("/dir2", 0777))
+	assert.True(t, u.Mkdir("/dir3", 0777) != nil)
+}
+
+func TestUsageRebuild(t *testing.T) {
+	t.Parallel()
+
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.closeWithoutTransactions()
+	u := NewFSUser(fs)
+	writeTestFile(t, u, "/a", "foo")
+	writeTestFile(t, u, "/b", "barbaz")
+
+	// Pretend the filesystem predates the counters
+	fs.WithoutParallelWrites(func() {})
+	fs.Update(func(tr *hugger.Transaction) {
+		tr.IB().DeleteRange(NewBlockKey(fsIno, BST_COUNTER, "").IB(),
+			NewBlockKey(fsIno, BST_COUNTER+1, "").IB())
+	})
+	assert.Equal(t, fs.Usage().Inodes, uint64(0))
+	assert.Equal(t, len(fs.Fsck(false)), 2)
+
+	// They are rebuilt on mount
+	fs.Flush()
+	fs2 := NewFs(st, "toor", 0)
+	usage := fs2.Usage()
+	assert.Equal(t, usage.Inodes, uint64(3))
+	assert.Equal(t, usage.LogicalBytes, uint64(9))
+
+	// .. and by fsck
+	fs2.Update(func(tr *hugger.Transaction) {
+		setCounterInTransaction(tr.IB(), counterBytes, 42)
+	})
+	assert.Equal(t, len(fs2.Fsck(true)), 1)
+	assert.Equal(t, fs2.Usage().LogicalBytes, uint64(9))
+	assert.Equal(t, len(fs2.Fsck(false)), 0)
+
+	// Drift below zero is clamped, and rebuilt on next mount
+	fs2.Update(func(tr *hugger.Transaction) {
+		setCounterInTransaction(tr.IB(), counterBytes, 1)
+	})
+	assert.Nil(t, NewFSUser(fs2).Remove("/b"))
+	fs2.WithoutParallelWrites(func() {})
+	assert.Equal(t, fs2.Usage().LogicalBytes, uint64(0))
+	fs2.Flush()
+	fs3 := NewFs(st, "toor", 0)
+	assert.Equal(t, fs3.Usage().LogicalBytes, uint64(3))
+	assert.Equal(t, len(fs3.Fsck(false)), 0)
+	fs3.Flush()
+}
@@ -0,0 +1,304 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fingon/go-tfhfs/ibtree"
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Files in directories with keepVersionsXAttr set to N keep their N
+// previous versions. Version is saved when the file is first
+// modified (written or truncated) through a file handle, so each
+// open-modify-close session yields (at most) one version; truncates
+// without file handle save one each.
+//
+// Version record consists of the InodeMeta (BST_FILE_VERSION) and
+// copies of the data keys (BST_FILE_VERSION_DATA) of the file, so
+// the unchanged data blocks are shared with the live file (and other
+// versions). Version ids are the times they were saved at (in ns).
+// Versions are not charged against quotas.
+
+// keepVersionsXAttr is the extended attribute of directory that
+// determines how many versions of the files in it are kept.
+const keepVersionsXAttr = "user.tfhfs.keepversions"
+
+// versionsXAttr is the virtual extended attribute that lists the
+// versions of a file, one per line (see FileVersion.String).
+const versionsXAttr = "user.tfhfs.versions"
+
+// restoreVersionXAttr is the virtual extended attribute that
+// restores the file to the version with the given id when set.
+const restoreVersionXAttr = "user.tfhfs.restoreversion"
+
+type FileVersion struct {
+	// Id of the version (time it was saved at, in ns)
+	Id uint64
+
+	Size  uint64
+	MTime time.Time
+}
+
+func (self *FileVersion) String() string {
+	return fmt.Sprintf("%d\t%s\t%d", self.Id,
+		self.MTime.UTC().Format(time.RFC3339Nano), self.Size)
+}
+
+func newVersionKey(ino, id uint64) BlockKey {
+	return NewBlockKey(ino, BST_FILE_VERSION, string(util.Uint64Bytes(id)))
+}
+
+func newVersionDataKey(ino, id uint64, key BlockKey) BlockKey {
+	b := util.ConcatBytes(util.Uint64Bytes(id),
+		[]byte{byte(key.SubType())}, []byte(key.SubTypeData()))
+	return NewBlockKey(ino, BST_FILE_VERSION_DATA, string(b))
+}
+
+// versionIds returns the ids of versions of the inode, oldest first.
+func versionIds(t *ibtree.Transaction, ino uint64) (ids []uint64) {
+	IterateInoSubTypeKeys(t, ino, BST_FILE_VERSION,
+		func(key BlockKey) bool {
+			ids = append(ids, binary.BigEndian.Uint64([]byte(key.SubTypeData())))
+			return true
+		})
+	return
+}
+
+// iterateVersionData calls cb with the keys of the version data
+// records, and the corresponding keys of the live file.
+func iterateVersionData(t *ibtree.Transaction, ino, id uint64, cb func(vkey, key BlockKey)) {
+	idb := util.Uint64Bytes(id)
+	k := NewBlockKey(ino, BST_FILE_VERSION_DATA, string(idb))
+	for {
+		nkeyp := t.NextKey(k.IB())
+		if nkeyp == nil {
+			return
+		}
+		nkey := BlockKey(*nkeyp)
+		if nkey.Ino() != ino || nkey.SubType() != BST_FILE_VERSION_DATA {
+			return
+		}
+		b := []byte(nkey.SubTypeData())
+		if !strings.HasPrefix(string(b), string(idb)) {
+			return
+		}
+		cb(nkey, NewBlockKey(ino, BlockSubType(b[8]), string(b[9:])))
+		k = nkey
+	}
+}
+
+// dataKeys returns the data (extent or chunk) keys of the inode.
+func dataKeys(t *ibtree.Transaction, ino uint64) (keys []BlockKey) {
+	for _, bst := range []BlockSubType{BST_FILE_OFFSET2EXTENT, BST_FILE_OFFSET2CHUNK} {
+		IterateInoSubTypeKeys(t, ino, bst,
+			func(key BlockKey) bool {
+				keys = append(keys, key)
+				return true
+			})
+	}
+	return
+}
+
+func deleteVersion(t *ibtree.Transaction, ino, id uint64) {
+	var keys []BlockKey
+	iterateVersionData(t, ino, id, func(vkey, key BlockKey) {
+		keys = append(keys, vkey)
+	})
+	for _, k := range keys {
+		t.Delete(k.IB())
+	}
+	t.Delete(newVersionKey(ino, id).IB())
+}
+
+// keepVersions returns the number of versions the inode should keep,
+// i.e. the largest keepVersionsXAttr of the directories it is in.
+func keepVersions(t *ibtree.Transaction, ino uint64) (keep int) {
+	IterateInoSubTypeKeys(t, ino, BST_FILE_INODEFILENAME,
+		func(key BlockKey) bool {
+			dir := binary.BigEndian.Uint64([]byte(key.SubTypeData()))
+			v := t.Get(NewBlockKey(dir, BST_XATTR, keepVersionsXAttr).IB())
+			if v == nil {
+				return true
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(*v))
+			if err == nil && n > keep {
+				keep = n
+			}
+			return true
+		})
+	return
+}
+
+// saveVersionInTransaction stores the current state of the inode as
+// new version, and removes the oldest ones beyond keep.
+func (self *inode) saveVersionInTransaction(t *ibtree.Transaction, meta *InodeMeta, keep int) {
+	ids := versionIds(t, self.ino)
+	id := uint64(time.Now().UnixNano())
+	if n := len(ids); n > 0 && ids[n-1] >= id {
+		id = ids[n-1] + 1
+	}
+	mlog.Printf2("fs/version", "%v.saveVersion %d", self, id)
+	b, err := meta.MarshalMsg(nil)
+	if err != nil {
+		log.Panic(err)
+	}
+	t.Set(newVersionKey(self.ino, id).IB(), string(b))
+	for _, k := range dataKeys(t, self.ino) {
+		t.Set(newVersionDataKey(self.ino, id, k).IB(), *t.Get(k.IB()))
+	}
+	ids = append(ids, id)
+	for len(ids) > keep {
+		mlog.Printf2("fs/version", " dropping %d", ids[0])
+		deleteVersion(t, self.ino, ids[0])
+		ids = ids[1:]
+	}
+}
+
+// saveVersion stores the current state of the file as a version, if
+// the directory it is in wants versions kept. The caller must hold
+// metaWriteLock.
+func (self *inode) saveVersion() {
+	self.metaWriteLock.AssertLocked()
+	if !self.IsFile() {
+		return
+	}
+	fs := self.Fs()
+	tr := fs.GetNestableTransaction()
+	keep := keepVersions(tr.IB(), self.ino)
+	tr.Close()
+	if keep <= 0 {
+		return
+	}
+	// Pending writes have to be in the tree before we look
+	fs.WithoutParallelWrites(func() {})
+	meta := self.Meta()
+	if meta == nil || meta.StSize == 0 {
+		return
+	}
+	fs.Update(func(tr *hugger.Transaction) {
+		self.saveVersionInTransaction(tr.IB(), meta, keep)
+	})
+}
+
+// saveVersionOnce saves version on the first modification through the
+// file handle.
+func (self *inodeFH) saveVersionOnce() {
+	if self.versioned {
+		return
+	}
+	self.versioned = true
+	defer self.inode.metaWriteLock.Locked()()
+	self.inode.saveVersion()
+}
+
+// restoreVersion replaces the data of the file with that of the
+// version. If versions are kept, the current state is saved as a
+// version first.
+func (self *inode) restoreVersion(id uint64) (code fuse.Status) {
+	mlog.Printf2("fs/version", "%v.restoreVersion %d", self, id)
+	if !self.IsFile() {
+		return fuse.EINVAL
+	}
+	fs := self.Fs()
+	defer self.metaWriteLock.Locked()()
+	fs.WithoutParallelWrites(func() {})
+	fs.Update2(func(tr *hugger.Transaction) bool {
+		t := tr.IB()
+		v := t.Get(newVersionKey(self.ino, id).IB())
+		meta := self.Meta()
+		if v == nil || meta == nil {
+			code = fuse.ENOENT
+			return false
+		}
+		vmeta := decodeInodeMeta(*v)
+		nmeta := *meta
+		nmeta.StSize = vmeta.StSize
+		nmeta.Data = vmeta.Data
+		nmeta.setTimesNow(false, true, true)
+		code = fs.checkQuota(t, &meta.InodeMetaData, &nmeta.InodeMetaData)
+		if !code.Ok() {
+			return false
+		}
+
+		// Saving current state may drop the version, so
+		// gather it first
+		vdata := make(map[string]string)
+		iterateVersionData(t, self.ino, id, func(vkey, key BlockKey) {
+			vdata[string(key)] = *t.Get(vkey.IB())
+		})
+		if keep := keepVersions(t, self.ino); keep > 0 && meta.StSize > 0 {
+			self.saveVersionInTransaction(t, meta, keep)
+		}
+		for _, k := range dataKeys(t, self.ino) {
+			t.Delete(k.IB())
+		}
+		for k, bid := range vdata {
+			t.Set(BlockKey(k).IB(), bid)
+		}
+		self.SetMetaInTransaction(&nmeta, tr)
+		return true
+	})
+	return
+}
+
+// FileVersions returns the versions of the file, oldest first.
+func (self *Fs) FileVersions(ino uint64) (versions []FileVersion) {
+	tr := self.GetNestableTransaction()
+	defer tr.Close()
+	t := tr.IB()
+	for _, id := range versionIds(t, ino) {
+		meta := decodeInodeMeta(*t.Get(newVersionKey(ino, id).IB()))
+		versions = append(versions, FileVersion{Id: id,
+			Size:  meta.StSize,
+			MTime: time.Unix(0, int64(meta.StMtimeNs))})
+	}
+	return
+}
+
+// RestoreFileVersion restores the file to the version with the given
+// id.
+func (self *Fs) RestoreFileVersion(ino, id uint64) error {
+	if self.readOnly {
+		return ErrReadOnly
+	}
+	inode := self.GetInode(ino)
+	if inode == nil {
+		return s2e(fuse.ENOENT)
+	}
+	defer inode.Release()
+	return s2e(inode.restoreVersion(id))
+}
+
+func (self *fsOps) getVersionsXAttr(inode *inode) []byte {
+	var b strings.Builder
+	for _, v := range self.fs.FileVersions(inode.ino) {
+		b.WriteString(v.String())
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+func (self *fsOps) setVersionXAttr(inode *inode, attr string, data []byte) (code fuse.Status, handled bool) {
+	switch attr {
+	case keepVersionsXAttr:
+		_, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 31)
+		if err != nil {
+			return fuse.EINVAL, true
+		}
+	case restoreVersionXAttr:
+		id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fuse.EINVAL, true
+		}
+		return inode.restoreVersion(id), true
+	}
+	return fuse.OK, false
+}
@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func rewriteTestFile(t *testing.T, u *FSUser, path, content string) {
+	f, err := u.OpenFile(path, uint32(os.O_TRUNC|os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte(content))
+	assert.Nil(t, err)
+	f.Close()
+}
+
+func TestVersion(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	assert.Nil(t, u.Mkdir("/d", 0777))
+	assert.True(t, u.SetXAttr("/d", keepVersionsXAttr, []byte("x")) != nil)
+	assert.Nil(t, u.SetXAttr("/d", keepVersionsXAttr, []byte("2")))
+
+	// Only modifications of existing content produce versions
+	writeTestFile(t, u, "/d/f", "v1")
+	writeTestFile(t, u, "/g", "g1")
+	rewriteTestFile(t, u, "/g", "g2")
+	l, err := u.Versions("/d/f")
+	assert.Nil(t, err)
+	assert.Equal(t, len(l), 0)
+	l, err = u.Versions("/g")
+	assert.Nil(t, err)
+	assert.Equal(t, len(l), 0)
+
+	for _, s := range []string{"v2", "v3", "v4"} {
+		rewriteTestFile(t, u, "/d/f", s)
+	}
+	l, err = u.Versions("/d/f")
+	assert.Nil(t, err)
+	assert.Equal(t, len(l), 2)
+	b, err := u.GetXAttr("/d/f", versionsXAttr)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Count(string(b), "\n"), 2)
+
+	// Restoring saves the current state as a version too
+	assert.Nil(t, u.RestoreVersion("/d/f", l[0].Id))
+	assert.Equal(t, readTestFile(t, u, "/d/f"), "v2")
+	assert.True(t, u.RestoreVersion("/d/f", l[0].Id) != nil)
+	nl, err := u.Versions("/d/f")
+	assert.Nil(t, err)
+	assert.Equal(t, len(nl), 2)
+	assert.Equal(t, nl[0].Id, l[1].Id)
+	assert.Nil(t, u.RestoreVersion("/d/f", nl[1].Id))
+	assert.Equal(t, readTestFile(t, u, "/d/f"), "v4")
+
+	// Unchanged extents are shared with the version
+	big := bytes.Repeat([]byte("x"), 3*dataExtentSize)
+	writeTestFile(t, u, "/d/big", string(big))
+	f, err := u.OpenFile("/d/big", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("y"))
+	assert.Nil(t, err)
+	f.Close()
+	fs.WithoutParallelWrites(func() {})
+	root := fs.GetInode(fuse.FUSE_ROOT_ID)
+	d := root.GetChildByName("d")
+	bi := d.GetChildByName("big")
+	ino := bi.ino
+	bi.Release()
+	d.Release()
+	root.Release()
+	vl := fs.FileVersions(ino)
+	assert.Equal(t, len(vl), 1)
+	tr := fs.GetNestableTransaction()
+	for i := uint64(0); i < 3; i++ {
+		k := NewBlockKeyOffset(ino, i*dataExtentSize)
+		v1 := tr.IB().Get(k.IB())
+		v2 := tr.IB().Get(newVersionDataKey(ino, vl[0].Id, k).IB())
+		assert.True(t, v1 != nil && v2 != nil)
+		assert.Equal(t, *v1 == *v2, i > 0)
+	}
+	tr.Close()
+	assert.Nil(t, u.RestoreVersion("/d/big", vl[0].Id))
+	assert.Equal(t, readTestFile(t, u, "/d/big")[:10], "xxxxxxxxxx")
+
+	// Versions go away with the file
+	assert.Nil(t, u.Remove("/d/big"))
+	assert.Nil(t, u.Remove("/d/f"))
+	fs.Flush()
+	assert.Equal(t, len(fs.FileVersions(ino)), 0)
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
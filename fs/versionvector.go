@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// Each (writable) filesystem has a persistent random replica id,
+// held in storage under its own name (so it is neither synced nor
+// inherited by subvolumes, and the tree does not differ between
+// replicas because of it). Every local modification of inode
+// metadata increments the counter of the replica in the version
+// vector of the inode, so the merges can tell whether one side has
+// seen all changes of the other, or whether they were made
+// concurrently.
+
+var ErrInvalidVersionVector = errors.New("Invalid version vector")
+
+type vvOrder int
+
+const (
+	// VV_EQUAL indicates both have seen the same changes
+	VV_EQUAL vvOrder = iota
+
+	// VV_BEFORE indicates the other has seen all of our changes
+	// and then some
+	VV_BEFORE
+
+	// VV_AFTER indicates we have seen all changes of the other
+	// and then some
+	VV_AFTER
+
+	// VV_CONCURRENT indicates both have changes the other has not
+	// seen
+	VV_CONCURRENT
+)
+
+// Valid determines if the vector is well-formed. Vectors from peers
+// must be validated before use (see mergeTo3); invalid ones are
+// treated as empty.
+func (self VersionVector) Valid() bool {
+	return len(self)%16 == 0
+}
+
+func (self VersionVector) decode() map[uint64]uint64 {
+	b := []byte(self)
+	if !self.Valid() {
+		b = nil
+	}
+	m := make(map[uint64]uint64, len(b)/16)
+	for ; len(b) > 0; b = b[16:] {
+		m[binary.BigEndian.Uint64(b)] = binary.BigEndian.Uint64(b[8:])
+	}
+	return m
+}
+
+func encodeVersionVector(m map[uint64]uint64) VersionVector {
+	replicas := make([]uint64, 0, len(m))
+	for replica := range m {
+		replicas = append(replicas, replica)
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i] < replicas[j]
+	})
+	var b []byte
+	for _, replica := range replicas {
+		b = util.ConcatBytes(b, util.Uint64Bytes(replica),
+			util.Uint64Bytes(m[replica]))
+	}
+	return VersionVector(b)
+}
+
+// Get returns the counter of the replica.
+func (self VersionVector) Get(replica uint64) uint64 {
+	return self.decode()[replica]
+}
+
+// Increment returns vector with the counter of the replica
+// incremented.
+func (self VersionVector) Increment(replica uint64) VersionVector {
+	m := self.decode()
+	m[replica]++
+	return encodeVersionVector(m)
+}
+
+// Merge returns the element-wise maximum of the vectors, i.e. vector
+// that has seen the changes of both.
+func (self VersionVector) Merge(other VersionVector) VersionVector {
+	if self == other || other == "" {
+		return self
+	}
+	if self == "" {
+		return other
+	}
+	m := self.decode()
+	for replica, n := range other.decode() {
+		if n > m[replica] {
+			m[replica] = n
+		}
+	}
+	return encodeVersionVector(m)
+}
+
+// Compare returns the causal order of the vector relative to the
+// other.
+func (self VersionVector) Compare(other VersionVector) vvOrder {
+	if self == other {
+		return VV_EQUAL
+	}
+	m1 := self.decode()
+	m2 := other.decode()
+	var before, after bool
+	for replica, n := range m1 {
+		if n > m2[replica] {
+			after = true
+		} else if n < m2[replica] {
+			before = true
+		}
+	}
+	for replica, n := range m2 {
+		if _, ok := m1[replica]; !ok && n > 0 {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return VV_CONCURRENT
+	case before:
+		return VV_BEFORE
+	case after:
+		return VV_AFTER
+	}
+	return VV_EQUAL
+}
+
+func replicaStorageName(rootName string) string {
+	return fmt.Sprintf("%s.replica", rootName)
+}
+
+// initReplicaId loads the replica id of the filesystem, creating it
+// first if necessary.
+func (self *Fs) initReplicaId() {
+	name := replicaStorageName(self.RootName)
+	if bid := self.storage.GetBlockIdByName(name); bid != "" {
+		if block := self.storage.GetBlockById(bid); block != nil {
+			defer block.Close()
+			self.replicaId = binary.BigEndian.Uint64(block.Data()[1:])
+			return
+		}
+	}
+	var id uint64
+	for id == 0 {
+		id = rand.Uint64()
+	}
+	mlog.Printf2("fs/versionvector", "fs.initReplicaId created %x", id)
+	// (Data block without references, like chunks)
+	b := append([]byte{byte(BDT_EXTENT)}, util.Uint64Bytes(id)...)
+	block := self.storage.ReferOrStoreBlockBytes0(storage.BS_NORMAL, b, nil)
+	defer block.Close()
+	self.storage.SetNameToBlockId(name, block.Id())
+	self.replicaId = id
+}
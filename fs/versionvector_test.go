@@ -0,0 +1,233 @@
+package fs
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/ibtree/hugger"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func TestVersionVectorOrder(t *testing.T) {
+	t.Parallel()
+	var v0 VersionVector
+	v1 := v0.Increment(1)
+	v2 := v1.Increment(2)
+	v3 := v1.Increment(3)
+	assert.Equal(t, v2.Get(1), uint64(1))
+	assert.Equal(t, v2.Get(2), uint64(1))
+	assert.Equal(t, v2.Get(3), uint64(0))
+	assert.Equal(t, v0.Compare(v0), VV_EQUAL)
+	assert.Equal(t, v0.Compare(v1), VV_BEFORE)
+	assert.Equal(t, v2.Compare(v1), VV_AFTER)
+	assert.Equal(t, v2.Compare(v3), VV_CONCURRENT)
+	m := v2.Merge(v3)
+	assert.Equal(t, m, v3.Merge(v2))
+	assert.Equal(t, m.Compare(v2), VV_AFTER)
+	assert.Equal(t, m.Compare(v3), VV_AFTER)
+	assert.Equal(t, m.Compare(v2.Increment(3)), VV_EQUAL)
+}
+
+func TestVersionVectorDecodeOld(t *testing.T) {
+	t.Parallel()
+	var meta InodeMeta
+	meta.StSize = 42
+	b, err := meta.MarshalMsg(nil)
+	assert.Nil(t, err)
+	// Older encoding lacks the (here empty) vector that
+	// precedes the (empty) Data
+	assert.Equal(t, b[1], byte(0x9b))
+	assert.Equal(t, b[len(b)-3], byte(0xa0))
+	b[1] = 0x9a
+	b = append(b[:len(b)-3], b[len(b)-2:]...)
+	assert.Equal(t, *decodeInodeMeta(string(b)), meta)
+
+	meta.VersionVector = meta.VersionVector.Increment(7)
+	b, err = meta.MarshalMsg(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, *decodeInodeMeta(string(b)), meta)
+}
+
+func TestVersionVectorReplicaId(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	assert.True(t, fs.replicaId != 0)
+	fs.Flush()
+
+	// Same id on remount
+	fs2 := NewFs(st, "toor", 0)
+	assert.Equal(t, fs2.replicaId, fs.replicaId)
+	fs2.Flush()
+}
+
+// setTestCtime rewrites the file as if the clock was at ctime.
+func setTestCtime(t *testing.T, fs *Fs, name string, ctime uint64) {
+	root := fs.GetInode(fuse.FUSE_ROOT_ID)
+	defer root.Release()
+	inode := root.GetChildByName(name)
+	assert.True(t, inode != nil)
+	defer inode.Release()
+	defer inode.metaWriteLock.Locked()()
+	meta := *inode.Meta()
+	meta.StCtimeNs = ctime
+	fs.Update(func(tr *hugger.Transaction) {
+		inode.SetMetaInTransaction(&meta, tr)
+	})
+}
+
+func TestVersionVectorMerge(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+	assert.Nil(t, fs.SetConflictCopies(true))
+
+	writeTestFile(t, u, "/f", "v0")
+	writeTestFile(t, u, "/g", "g0")
+
+	// Peer has replica id of its own, and its change wins even
+	// if its clock is behind ours
+	forkPeer(t, fs, "p", nil)
+	p := fs.OpenSubvolume("p")
+	assert.True(t, p.replicaId != 0 && p.replicaId != fs.replicaId)
+	rewriteTestFile(t, NewFSUser(p), "/f", "peer")
+	setTestCtime(t, p, "f", 1)
+	p.Close()
+	setTestCtime(t, fs, "g", 1<<62)
+	mergeFromPeer(fs, "p")
+	assert.Equal(t, readTestFile(t, u, "/f"), "peer")
+	assert.Equal(t, readTestFile(t, u, "/g"), "g0")
+	assert.Equal(t, len(fs.ListConflicts()), 0)
+
+	// Our later changes succeed the merged ones; merging the
+	// same peer state again changes nothing
+	rewriteTestFile(t, u, "/f", "local")
+	mergeFromPeer(fs, "p")
+	assert.Equal(t, readTestFile(t, u, "/f"), "local")
+	assert.Equal(t, len(fs.ListConflicts()), 0)
+
+	// Concurrent changes are conflicts even if our clock is
+	// ahead; the result has seen both
+	p = fs.OpenSubvolume("p")
+	rewriteTestFile(t, NewFSUser(p), "/f", "peer2")
+	p.Close()
+	setTestCtime(t, fs, "f", 1<<62)
+	mergeFromPeer(fs, "p")
+	assert.Equal(t, readTestFile(t, u, "/f"), "local")
+	l := fs.ListConflicts()
+	assert.Equal(t, len(l), 1)
+	assert.Equal(t, readTestFile(t, u, l[0].Path), "peer2")
+	root := fs.GetInode(fuse.FUSE_ROOT_ID)
+	f := root.GetChildByName("f")
+	vv := f.Meta().VersionVector
+	f.Release()
+	root.Release()
+	assert.True(t, vv.Get(fs.replicaId) > 0)
+	assert.True(t, vv.Get(replicaIdOf(t, fs, "p")) > 0)
+
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
+
+// setTestVersionVector rewrites the metadata of the file with the vector.
+func setTestVersionVector(t *testing.T, fs *Fs, name string, vv VersionVector) {
+	// (Metadata is set directly, so pending writes have to land first)
+	fs.WithoutParallelWrites(func() {})
+	root := fs.GetInode(fuse.FUSE_ROOT_ID)
+	defer root.Release()
+	inode := root.GetChildByName(name)
+	assert.True(t, inode != nil)
+	defer inode.Release()
+	meta := *inode.Meta()
+	meta.VersionVector = vv
+	b, err := meta.MarshalMsg(nil)
+	assert.Nil(t, err)
+	fs.Update(func(tr *hugger.Transaction) {
+		tr.IB().Set(NewBlockKey(inode.ino, BST_META, "").IB(), string(b))
+	})
+	fs.inodeTracker.flushMetaCache()
+}
+
+func TestVersionVectorUnversioned(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+	assert.Nil(t, fs.SetConflictCopies(true))
+
+	// Files written by older versions have no vectors; ones
+	// changed on both sides are still conflicts, even if only
+	// one side has been changed since
+	writeTestFile(t, u, "/f", "v0")
+	writeTestFile(t, u, "/g", "v0")
+	setTestVersionVector(t, fs, "f", "")
+	setTestVersionVector(t, fs, "g", "")
+	forkPeer(t, fs, "p", func(pu *FSUser) {
+		rewriteTestFile(t, pu, "/f", "peer")
+		rewriteTestFile(t, pu, "/g", "peer")
+		setTestVersionVector(t, pu.fs, "f", "")
+	})
+	rewriteTestFile(t, u, "/f", "local")
+	rewriteTestFile(t, u, "/g", "local")
+	setTestVersionVector(t, fs, "f", "")
+	assert.Nil(t, mergeFromPeer(fs, "p"))
+	l := fs.ListConflicts()
+	assert.Equal(t, len(l), 2)
+	for _, c := range l {
+		name := c.Path[1:2]
+		got := []string{readTestFile(t, u, "/"+name), readTestFile(t, u, c.Path)}
+		sort.Strings(got)
+		assert.Equal(t, got, []string{"local", "peer"})
+	}
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+}
+
+func TestVersionVectorInvalid(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	writeTestFile(t, u, "/f", "v0")
+	forkPeer(t, fs, "p", func(u *FSUser) {
+		rewriteTestFile(t, u, "/f", "peer")
+	})
+	p := fs.OpenSubvolume("p")
+	root := p.GetInode(fuse.FUSE_ROOT_ID)
+	f := root.GetChildByName("f")
+	meta := *f.Meta()
+	ino := f.ino
+	f.Release()
+	root.Release()
+	meta.VersionVector = "bogus"
+	b, err := meta.MarshalMsg(nil)
+	assert.Nil(t, err)
+	p.Update(func(tr *hugger.Transaction) {
+		tr.IB().Set(NewBlockKey(ino, BST_META, "").IB(), string(b))
+	})
+	p.Close()
+
+	// Nothing at all is merged
+	assert.Equal(t, mergeFromPeer(fs, "p"), ErrInvalidVersionVector)
+	assert.Equal(t, readTestFile(t, u, "/f"), "v0")
+	assert.Equal(t, len(fs.Fsck(false)), 0)
+}
+
+func replicaIdOf(t *testing.T, fs *Fs, subvolume string) uint64 {
+	p := fs.OpenSubvolume(subvolume)
+	assert.True(t, p != nil)
+	defer p.Close()
+	return p.replicaId
+}
@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Several independent filesystems (named roots, e.g. subvolumes)
+// sharing the same storage can be served from a single mount by a
+// volume host. Its root is a virtual read-only directory containing
+// the root of each volume; the volumes have inode spaces and
+// flushing of their own. The snapshots of the volumes are not
+// visible within the host.
+
+// volumeChildPrefix distinguishes volumes from snapshots in
+// childTracker (snapshot names can not contain /)
+const volumeChildPrefix = "/"
+
+// NewVolumeHostFs provides filesystem which root directory contains
+// the filesystems of the given root names. The Fs owns the storage,
+// i.e. closing it closes the storage (and the volumes) as well.
+// Returns nil if the names are not valid directory names, or if
+// they are not unique.
+func NewVolumeHostFs(st *storage.Storage, rootNames []string, cacheSize int) *Fs {
+	mlog.Printf2("fs/volume", "NewVolumeHostFs %v", rootNames)
+	names := append([]string{}, rootNames...)
+	sort.Strings(names)
+	for i, name := range names {
+		if !validSnapshotName(name) || (i > 0 && names[i-1] == name) {
+			return nil
+		}
+	}
+	fs := newFs(st, cacheSize)
+	// The host itself has only empty in-memory tree which is
+	// never persisted
+	fs.readOnly = true
+	fs.volumes = names
+	fs.volumesTime = time.Now()
+	fs.RootIsNew()
+	st.IterateReferencesCallback = func(id string, data []byte, cb storage.BlockReferenceCallback) {
+		fs.iterateReferencesCallback(id, data, cb)
+	}
+	for _, name := range names {
+		fs.children.Get(volumeChildPrefix+name, func() *Fs {
+			return newNamedFs(st, name, cacheSize, fs, true)
+		})
+	}
+	return fs
+}
+
+// Volumes returns the sorted names of the hosted volumes.
+func (self *Fs) Volumes() []string {
+	return self.volumes
+}
+
+// Volume returns the filesystem of the named hosted volume, or nil
+// if there is no such volume.
+func (self *Fs) Volume(name string) *Fs {
+	return self.children.Get(volumeChildPrefix+name, nil)
+}
+
+func (self *Fs) isVirtualDir(nodeId uint64) bool {
+	return nodeId == snapshotsNodeId || (self.volumes != nil && nodeId == fuse.FUSE_ROOT_ID)
+}
+
+func (self *Fs) listVirtualDir(nodeId uint64) []string {
+	if nodeId == snapshotsNodeId {
+		return self.ListSnapshots()
+	}
+	return self.Volumes()
+}
+
+// addVolumesUsage adds the usage of the hosted volumes to u.
+func (self *Fs) addVolumesUsage(u *FsUsage) {
+	for _, name := range self.volumes {
+		vu := self.Volume(name).Usage()
+		u.Inodes += vu.Inodes
+		u.LogicalBytes += vu.LogicalBytes
+	}
+}
+
+func (self *fsOps) fillVirtualDirAttr(nodeId uint64, out *fuse.Attr) fuse.Status {
+	if nodeId == snapshotsNodeId {
+		return self.fillSnapshotsAttr(out)
+	}
+	t := self.fs.volumesTime
+	out.Ino = nodeId
+	out.Size = 0
+	out.Blocks = 0
+	out.SetTimes(&t, &t, &t)
+	out.Mode = fuse.S_IFDIR | 0555
+	out.Nlink = uint32(2 + len(self.fs.volumes))
+	return fuse.OK
+}
+
+func (self *fsOps) fillVirtualDirEntryOut(nodeId uint64, out *fuse.EntryOut) fuse.Status {
+	if nodeId == snapshotsNodeId {
+		return self.fillSnapshotsEntryOut(out)
+	}
+	out.NodeId = nodeId
+	out.Generation = 0
+	out.EntryValid = entryValidity
+	out.AttrValid = attrValidity
+	out.EntryValidNsec = 0
+	out.AttrValidNsec = 0
+	return self.fillVirtualDirAttr(nodeId, &out.Attr)
+}
+
+func (self *fsOps) fillVirtualDirChildEntryOut(nodeId uint64, name string, out *fuse.EntryOut) fuse.Status {
+	if nodeId == snapshotsNodeId {
+		return self.fillSnapshotEntryOut(name, out)
+	}
+	return fillChildRootEntryOut(self.fs.Volume(name), out)
+}
+
+func (self *fsOps) readVirtualDir(input *fuse.ReadIn, l *fuse.DirEntryList, plus bool) fuse.Status {
+	if input.NodeId == snapshotsNodeId {
+		return self.readSnapshots(input, l, plus)
+	}
+	return readChildRoots(input, l, plus, self.fs.volumes, self.fs.Volume)
+}
@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stvp/assert"
+)
+
+func TestVolumeHost(t *testing.T) {
+	t.Parallel()
+	backend := factory.New("inmemory", "")
+	st := storage.Storage{Backend: backend}.Init()
+	assert.True(t, NewVolumeHostFs(st, []string{"a", "a"}, 0) == nil)
+	assert.True(t, NewVolumeHostFs(st, []string{"a", "x/y"}, 0) == nil)
+
+	fs := NewVolumeHostFs(st, []string{"b", "a"}, 0)
+	u := NewFSUser(fs)
+	assert.Equal(t, fs.Volumes(), []string{"a", "b"})
+	l, err := u.ListDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, l, []string{"a", "b"})
+	fi, err := u.Stat("/")
+	assert.Nil(t, err)
+	assert.True(t, fi.IsDir())
+
+	// Volumes have their own inode spaces
+	writeTestFile(t, u, "/a/file", "foo")
+	writeTestFile(t, u, "/b/file", "bar")
+	assert.Nil(t, u.Mkdir("/b/dir", 0777))
+	assert.Equal(t, readTestFile(t, u, "/a/file"), "foo")
+	assert.Equal(t, readTestFile(t, u, "/b/file"), "bar")
+	l, err = u.ListDir("/b")
+	assert.Nil(t, err)
+	assert.Equal(t, l, []string{"dir", "file"})
+	fi, err = u.Stat("/a")
+	assert.Nil(t, err)
+	assert.True(t, fi.IsDir())
+
+	// The host itself is read-only, and volumes are distinct
+	_, err = u.OpenFile("/c", uint32(os.O_CREATE|os.O_WRONLY), 0777)
+	assert.Equal(t, err, s2e(fuse.EROFS))
+	assert.Equal(t, u.Rename("/a/file", "/b/file2"), s2e(fuse.EXDEV))
+	assert.Nil(t, u.Rename("/a/file", "/a/file2"))
+
+	fs.Volume("a").WithoutParallelWrites(func() {})
+	fs.Volume("b").WithoutParallelWrites(func() {})
+	assert.Equal(t, fs.Volume("a").Usage().Inodes, uint64(2))
+	assert.Equal(t, fs.Volume("b").Usage().Inodes, uint64(3))
+	assert.Equal(t, fs.Usage().Inodes, uint64(5))
+	fs.Close()
+
+	// Volumes are ordinary named roots in storage
+	st = storage.Storage{Backend: backend}.Init()
+	fs = NewFs(st, "a", 0)
+	assert.Equal(t, readTestFile(t, NewFSUser(fs), "/file2"), "foo")
+	fs.Close()
+}
@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/fingon/go-tfhfs/storage"
+	"github.com/fingon/go-tfhfs/storage/factory"
+	"github.com/fingon/go-tfhfs/util"
+	"github.com/stvp/assert"
+)
+
+// failingBackend fails block stores while fail is set.
+type failingBackend struct {
+	storage.Backend
+	lock util.MutexLocked
+	fail error
+}
+
+func (self *failingBackend) setFail(err error) {
+	defer self.lock.Locked()()
+	self.fail = err
+}
+
+func (self *failingBackend) StoreBlock(b *storage.Block) error {
+	self.lock.Lock()
+	err := self.fail
+	self.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return self.Backend.StoreBlock(b)
+}
+
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+	backend := &failingBackend{Backend: factory.New("inmemory", "")}
+	st := storage.Storage{Backend: backend}.Init()
+	fs := NewFs(st, "toor", 0)
+	defer fs.Close()
+	u := NewFSUser(fs)
+
+	writeTestFile(t, u, "/f", "x")
+	f, err := u.OpenFile("/f", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	g, err := u.OpenFile("/f", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	r, err := u.OpenFile("/f", uint32(os.O_RDONLY), 0)
+	assert.Nil(t, err)
+
+	backend.setFail(syscall.ENOSPC)
+	_, err = f.Write(make([]byte, 3*dataExtentSize))
+	assert.Nil(t, err)
+	enospc := s2e(errorToStatus(syscall.ENOSPC)).Error()
+	err = f.Sync()
+	assert.True(t, err != nil)
+	assert.Equal(t, err.Error(), enospc, err.Error())
+	backend.setFail(nil)
+
+	// Each handle open for writing sees the error once
+	assert.Nil(t, f.Close())
+	err = g.Close()
+	assert.True(t, err != nil)
+	assert.Equal(t, err.Error(), enospc, err.Error())
+	assert.Nil(t, r.Close())
+
+	// Failed blocks are retried on the next flush
+	f, err = u.OpenFile("/f", uint32(os.O_WRONLY), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Close())
+	assert.Equal(t, len(st.AuditReferences(false, false).Problems()), 0)
+}
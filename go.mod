@@ -1,27 +1,45 @@
 module github.com/fingon/go-tfhfs
 
+go 1.27.1
+
 require (
-	github.com/AndreasBriese/bbloom v0.0.0-20180913140656-343706a395b7 // indirect
 	github.com/dgraph-io/badger v1.5.3
-	github.com/dgryski/go-farm v0.0.0-20190104051053-3adb47b1fb0f // indirect
 	github.com/glycerine/greenpack v5.0.8+incompatible
 	github.com/golang/protobuf v1.3.0
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
-	github.com/hanwen/go-fuse v0.0.0-20190204193553-d0fca860a575
+	github.com/hanwen/go-fuse/v2 v2.11.0
 	github.com/jacobsa/crypto v0.0.0-20180924003735-d95898ceee07
+	github.com/minio/sha256-simd v0.0.0-20190131020904-2d45a736cd16
+	github.com/stvp/assert v0.0.0-20170616060220-4bc16443988b
+	github.com/twitchtv/twirp v5.5.2+incompatible
+	github.com/ugorji/go/codec v0.0.0-20190204201341-e444a5086c43
+	golang.org/x/crypto v0.0.0-20190131182504-b8fe1690c613
+)
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20180913140656-343706a395b7 // indirect
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/dgryski/go-farm v0.0.0-20190104051053-3adb47b1fb0f // indirect
 	github.com/jacobsa/oglematchers v0.0.0-20150720000706-141901ea67cd // indirect
 	github.com/jacobsa/oglemock v0.0.0-20150831005832-e94d794d06ff // indirect
 	github.com/jacobsa/ogletest v0.0.0-20170503003838-80d50a735a11 // indirect
 	github.com/jacobsa/reqtrace v0.0.0-20150505043853-245c9e0234cb // indirect
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/minio/sha256-simd v0.0.0-20190131020904-2d45a736cd16
+	github.com/kr/pty v1.1.1 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/moby/sys/mountinfo v0.7.2 // indirect
 	github.com/philhofer/fwd v1.0.0 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.0 // indirect
 	github.com/stretchr/testify v1.3.0 // indirect
-	github.com/stvp/assert v0.0.0-20170616060220-4bc16443988b
-	github.com/twitchtv/twirp v5.5.2+incompatible
-	github.com/ugorji/go/codec v0.0.0-20190204201341-e444a5086c43
-	golang.org/x/crypto v0.0.0-20190131182504-b8fe1690c613
-	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4 // indirect
+	github.com/ugorji/go v1.1.2 // indirect
+	golang.org/x/net v0.0.0-20190213061140-3a22650c66bd // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.3.0 // indirect
 	golang.org/x/tools v0.0.0-20190306162903-69e0dcfa1121 // indirect
+	google.golang.org/appengine v1.4.0 // indirect
+	google.golang.org/genproto v0.0.0-20180831171423-11092d34479b // indirect
 )
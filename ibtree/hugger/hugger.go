@@ -271,6 +271,38 @@ func (self *Hugger) RootIsNew() bool {
 	return !ok
 }
 
+// LoadRootBlockId sets the root of the hugger to the given block id
+// instead of the one referred to by RootName. It is intended for
+// read-only use, as the loaded root is also considered to be the
+// flushed one (and Flush therefore never persists anything unless
+// the tree is changed). Returns false if the block does not exist.
+func (self *Hugger) LoadRootBlockId(bid string) bool {
+	block := self.Storage.GetBlockById(bid)
+	if block == nil {
+		return false
+	}
+	node := self.tree.LoadRoot(ibtree.BlockId(bid))
+	if node == nil {
+		block.Close()
+		return false
+	}
+	root := &treeRoot{node: node, block: block}
+	self.root.Set(root)
+	self.oldRoot.Set(root)
+	return true
+}
+
+// ReleaseRoot lets go of the reference the hugger holds to its
+// current root block. The hugger should not be used afterwards.
+func (self *Hugger) ReleaseRoot() {
+	defer self.lock.Locked()()
+	r := self.root.Get()
+	if r != nil && r.block != nil {
+		r.block.Close()
+		r.block = nil
+	}
+}
+
 func (self *Hugger) NewRootNode() *ibtree.Node {
 	return self.tree.NewRoot()
 }
@@ -1803,35 +1803,39 @@ func callError(ctx context.Context, h *twirp.ServerHooks, err twirp.Error) conte
 }
 
 var twirpFileDescriptor0 = []byte{
-	// 478 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x51, 0x6f, 0xd3, 0x30,
-	0x10, 0x6e, 0xb3, 0x76, 0x64, 0xd7, 0x6c, 0x14, 0x4f, 0x42, 0x25, 0x82, 0x2d, 0x18, 0x1e, 0xfa,
-	0x14, 0xa1, 0xc1, 0x2f, 0x08, 0x08, 0x94, 0x87, 0x4e, 0xc2, 0x2b, 0x9a, 0x40, 0x42, 0xc8, 0x9d,
-	0x9d, 0x12, 0xa5, 0x8d, 0x4b, 0xec, 0x0a, 0xed, 0xe7, 0xf2, 0x4f, 0x50, 0x2e, 0x69, 0x08, 0xc3,
-	0x0d, 0x7b, 0xf3, 0xf9, 0xbb, 0xfb, 0xfc, 0xdd, 0x77, 0x97, 0x80, 0x9b, 0xe8, 0x70, 0x53, 0x28,
-	0xa3, 0xc8, 0x69, 0x92, 0xe6, 0x4b, 0x95, 0x87, 0x69, 0x96, 0x86, 0x49, 0x1a, 0x9a, 0xe4, 0x7b,
-	0xa2, 0xe9, 0x0d, 0x0c, 0xa3, 0x95, 0xba, 0xc9, 0xc8, 0x09, 0x38, 0xa9, 0x98, 0xf4, 0x83, 0xfe,
-	0xd4, 0x63, 0x4e, 0x2a, 0xc8, 0x63, 0x38, 0xd4, 0x86, 0x9b, 0xad, 0x9e, 0x38, 0x41, 0x7f, 0x3a,
-	0x64, 0x75, 0x44, 0x08, 0x0c, 0x04, 0x37, 0x7c, 0x72, 0x80, 0x99, 0x78, 0x26, 0x67, 0x00, 0xeb,
-	0x54, 0xeb, 0x34, 0x5f, 0xc6, 0x42, 0x4f, 0x06, 0xc1, 0xc1, 0xd4, 0x63, 0xad, 0x1b, 0x7a, 0x0e,
-	0x47, 0xf8, 0xc8, 0x25, 0x5f, 0xcb, 0x92, 0x20, 0xe7, 0x6b, 0x89, 0x4f, 0x1d, 0x31, 0x3c, 0xd3,
-	0x27, 0xf0, 0x00, 0x13, 0x62, 0x71, 0x57, 0x07, 0xfd, 0x06, 0x0f, 0x3f, 0x48, 0x83, 0x28, 0x93,
-	0x3f, 0xb6, 0x52, 0x9b, 0x7f, 0xa4, 0xfa, 0xe0, 0xfe, 0xe4, 0xb9, 0x79, 0x57, 0xca, 0x2a, 0xc5,
-	0xba, 0xac, 0x89, 0x49, 0x00, 0xa3, 0xf2, 0x3c, 0xab, 0xc4, 0xa0, 0x6a, 0x97, 0xb5, 0xaf, 0x68,
-	0x04, 0xde, 0x4c, 0x16, 0x4b, 0xb9, 0x63, 0xf7, 0xc1, 0x4d, 0x0a, 0xb5, 0xbe, 0xfc, 0xa3, 0xb1,
-	0x89, 0x4b, 0x53, 0x8c, 0x42, 0xc4, 0x41, 0xa4, 0x8e, 0xe8, 0x1c, 0xbc, 0x2b, 0xa3, 0x8a, 0x86,
-	0xc3, 0xd2, 0x23, 0x79, 0x05, 0xc3, 0x45, 0xd9, 0x05, 0x96, 0x8e, 0x2e, 0xfc, 0xd0, 0x32, 0x8e,
-	0xb0, 0xea, 0xb3, 0x4a, 0xa4, 0x6f, 0xe0, 0xe4, 0x4a, 0x9a, 0xf2, 0x81, 0x2e, 0xde, 0xca, 0x0d,
-	0xa7, 0x31, 0xec, 0x19, 0x8c, 0xea, 0x7e, 0xf4, 0x76, 0x85, 0x66, 0xa9, 0x0c, 0x0b, 0x5c, 0xe6,
-	0xa8, 0x8c, 0x9e, 0xc3, 0x71, 0x43, 0x6a, 0x4d, 0x38, 0x86, 0xd1, 0xdb, 0x95, 0xe4, 0x45, 0x05,
-	0x5f, 0xfc, 0x1a, 0x80, 0xf3, 0x5e, 0x93, 0x6b, 0x78, 0x84, 0xb7, 0x28, 0x50, 0xc7, 0x39, 0xda,
-	0x71, 0xb6, 0xbf, 0x87, 0x12, 0xf7, 0x03, 0x2b, 0xde, 0x62, 0xa7, 0x3d, 0xc2, 0x60, 0xbc, 0x9b,
-	0x6f, 0x2c, 0xa2, 0xdb, 0x7b, 0xf1, 0x3e, 0xdd, 0x8f, 0xc7, 0x02, 0x39, 0xbd, 0x1d, 0x67, 0x74,
-	0x1b, 0x0b, 0xf2, 0xd2, 0x9a, 0x7f, 0x67, 0xad, 0xfc, 0x8e, 0x89, 0xd0, 0x1e, 0xf9, 0x0c, 0x63,
-	0xb4, 0xb5, 0x51, 0x31, 0x57, 0xe4, 0xb9, 0xb5, 0xa2, 0xbd, 0x4d, 0x7b, 0x2c, 0x68, 0x0d, 0x88,
-	0xf6, 0xc8, 0x57, 0x18, 0xd7, 0x23, 0x99, 0xab, 0xdd, 0x67, 0xf0, 0xc2, 0x5a, 0xf7, 0xf7, 0x3a,
-	0xf8, 0xb4, 0x3b, 0xa9, 0xa6, 0x9f, 0x01, 0xe0, 0x72, 0x56, 0xdf, 0xb9, 0x5d, 0x73, 0x7b, 0x7b,
-	0xff, 0x63, 0xc4, 0x47, 0x38, 0xfd, 0xb4, 0x59, 0x16, 0x5c, 0xd4, 0x56, 0xa8, 0xfc, 0x5a, 0xf2,
-	0x8c, 0x74, 0xce, 0xa4, 0x9b, 0x32, 0x1a, 0x7c, 0x71, 0x36, 0x8b, 0xc5, 0x21, 0xfe, 0xa6, 0x5e,
-	0xff, 0x0e, 0x00, 0x00, 0xff, 0xff, 0xce, 0xa8, 0xbe, 0x62, 0xb2, 0x04, 0x00, 0x00,
+	// 537 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x94, 0xdf, 0x6e, 0xd3, 0x30,
+	0x14, 0xc6, 0x97, 0x34, 0xdd, 0xd2, 0xd3, 0x6c, 0x14, 0x4f, 0x42, 0x21, 0x82, 0x11, 0x0c, 0x17,
+	0xbd, 0x8a, 0xd0, 0xe0, 0x09, 0x0a, 0x02, 0xe5, 0xa2, 0x93, 0xf0, 0x8a, 0x26, 0x90, 0x10, 0x4a,
+	0x17, 0xa7, 0x44, 0x69, 0xe3, 0x12, 0xbb, 0x42, 0x7b, 0x02, 0xde, 0x80, 0xf7, 0xe3, 0x4d, 0x90,
+	0x4f, 0xfe, 0x10, 0xb6, 0x34, 0x70, 0xe7, 0xe3, 0x73, 0xfc, 0xf9, 0xf3, 0xef, 0x9c, 0x04, 0xec,
+	0x44, 0x06, 0xdb, 0x42, 0x28, 0x41, 0x4e, 0x93, 0x34, 0x5f, 0x89, 0x3c, 0x48, 0xb3, 0x34, 0x48,
+	0xd2, 0x40, 0x25, 0x5f, 0x13, 0x49, 0xaf, 0x61, 0x38, 0x5b, 0x8b, 0xeb, 0x8c, 0x9c, 0x80, 0x99,
+	0xc6, 0xae, 0xe1, 0x1b, 0x53, 0x87, 0x99, 0x69, 0x4c, 0x1e, 0xc0, 0xa1, 0x54, 0x91, 0xda, 0x49,
+	0xd7, 0xf4, 0x8d, 0xe9, 0x90, 0x55, 0x11, 0x21, 0x60, 0xc5, 0x91, 0x8a, 0xdc, 0x01, 0x56, 0xe2,
+	0x9a, 0x9c, 0x01, 0x6c, 0x52, 0x29, 0xd3, 0x7c, 0x15, 0xc6, 0xd2, 0xb5, 0xfc, 0xc1, 0xd4, 0x61,
+	0xad, 0x1d, 0xfa, 0xc3, 0x80, 0x11, 0xde, 0x72, 0x11, 0x6d, 0xb8, 0x56, 0xc8, 0xa3, 0x0d, 0xc7,
+	0xbb, 0x46, 0x0c, 0xd7, 0xc4, 0x85, 0x23, 0xb9, 0x5b, 0xaa, 0x82, 0x73, 0xbc, 0x6e, 0xc4, 0xea,
+	0x50, 0x6b, 0x57, 0xcb, 0x30, 0x17, 0x78, 0xab, 0xc5, 0x5a, 0x3b, 0x5a, 0x6d, 0xcb, 0x79, 0xe1,
+	0x5a, 0xa5, 0x9a, 0x5e, 0x6b, 0xb5, 0x24, 0x5d, 0x2b, 0x5e, 0x48, 0x77, 0xe8, 0x0f, 0xb4, 0x5a,
+	0x15, 0xd2, 0x87, 0x70, 0x84, 0x46, 0xc2, 0xf8, 0xf6, 0x83, 0xe9, 0x17, 0xb8, 0xf7, 0x8e, 0x2b,
+	0xcc, 0x32, 0xfe, 0x6d, 0xc7, 0xa5, 0xba, 0xc3, 0xc4, 0x03, 0xfb, 0x7b, 0x94, 0xab, 0x37, 0xfa,
+	0xfd, 0xda, 0xa6, 0xcd, 0x9a, 0x98, 0xf8, 0x30, 0xd6, 0xeb, 0x79, 0xf9, 0x6a, 0x34, 0x6a, 0xb3,
+	0xf6, 0x16, 0xfd, 0x69, 0x80, 0x33, 0xe7, 0xc5, 0x8a, 0xd7, 0xf2, 0x1e, 0xd8, 0x49, 0x21, 0x36,
+	0x17, 0x7f, 0x60, 0x34, 0xb1, 0xc6, 0xaf, 0x04, 0x66, 0x4a, 0x1e, 0x55, 0xd4, 0x06, 0x35, 0xe8,
+	0x03, 0x65, 0xdd, 0x01, 0xb5, 0x1f, 0xca, 0x02, 0x9c, 0x4b, 0x25, 0x8a, 0xc6, 0x57, 0x57, 0x83,
+	0x5e, 0xc0, 0x70, 0xa9, 0xd1, 0xa0, 0x9d, 0xf1, 0xb9, 0x17, 0x74, 0x0c, 0x53, 0x50, 0xc2, 0x2b,
+	0x0b, 0xe9, 0x2b, 0x38, 0xb9, 0xe4, 0x4a, 0x9b, 0xee, 0xd3, 0x2d, 0x11, 0x9b, 0x4d, 0x17, 0x1e,
+	0xc3, 0xb8, 0x62, 0x24, 0x77, 0x6b, 0xec, 0x80, 0xc8, 0xf0, 0x80, 0xcd, 0x4c, 0x91, 0xd1, 0x27,
+	0x70, 0xdc, 0x88, 0x76, 0x16, 0x1c, 0xc3, 0xf8, 0xf5, 0x9a, 0x47, 0x45, 0x99, 0x3e, 0xff, 0x65,
+	0x81, 0xf9, 0x56, 0x92, 0x2b, 0xb8, 0x8f, 0xbb, 0x68, 0x50, 0x86, 0x39, 0xa2, 0x3c, 0xdb, 0xff,
+	0x06, 0x9d, 0xf7, 0xfc, 0xce, 0x7c, 0x4b, 0x9d, 0x1e, 0x10, 0x06, 0x93, 0x7a, 0x68, 0xc2, 0x78,
+	0x76, 0xf3, 0x5f, 0xba, 0x8f, 0xf6, 0xe7, 0xc3, 0x18, 0x35, 0x9d, 0x5a, 0x73, 0x76, 0x13, 0xc6,
+	0xe4, 0x79, 0x67, 0xfd, 0xad, 0x59, 0xf5, 0x7a, 0x3a, 0x42, 0x0f, 0xc8, 0x47, 0x98, 0x20, 0xd6,
+	0xc6, 0xc5, 0x42, 0x90, 0xa7, 0x9d, 0x27, 0xda, 0x13, 0xea, 0xf9, 0x7d, 0x25, 0x15, 0x82, 0xcf,
+	0x30, 0xa9, 0x5a, 0xb2, 0x10, 0xf5, 0xb7, 0xf5, 0xac, 0xf3, 0xdc, 0xdf, 0xe3, 0xe0, 0xd1, 0xfe,
+	0xa2, 0x4a, 0x7e, 0x0e, 0x80, 0xc3, 0x59, 0xfe, 0xa5, 0xba, 0x3d, 0xb7, 0xa7, 0xf7, 0x1f, 0x20,
+	0xde, 0xc3, 0xe9, 0x87, 0xed, 0xaa, 0x88, 0xe2, 0x0a, 0x85, 0xc8, 0xaf, 0x78, 0x94, 0x91, 0xde,
+	0x9e, 0xf4, 0x4b, 0xce, 0xac, 0x4f, 0xe6, 0x76, 0xb9, 0x3c, 0xc4, 0x9f, 0xec, 0xcb, 0xdf, 0x03,
+	0x00, 0x4c, 0x34, 0xa3, 0x00, 0x70, 0x05, 0x00, 0x00,
 }
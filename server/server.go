@@ -25,6 +25,7 @@ import (
 	"github.com/fingon/go-tfhfs/pb"
 	. "github.com/fingon/go-tfhfs/pb"
 	"github.com/fingon/go-tfhfs/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 const rootName = "sync"
@@ -77,8 +78,31 @@ func (self *Server) ClearBlocksInName(ctx context.Context, n *BlockName) (*Clear
 	return &ClearResult{}, nil
 }
 
+// resolveSubtree returns the root of the subtree to synchronize;
+// filtered synchronization of the whole filesystem is done as if it
+// was subtree.
+func (self *Server) resolveSubtree(path string, ino uint64) (uint64, error) {
+	if path == "" && ino == 0 {
+		return fuse.FUSE_ROOT_ID, nil
+	}
+	return self.Fs.ResolveSubtree(path, ino)
+}
+
 func (self *Server) GetBlockIdByName(ctx context.Context, name *BlockName) (*BlockId, error) {
 	mlog.Printf2("server/server", "s.GetBlockIdByName %s", name.Name)
+	if name.Name == self.Fs.RootName && (name.Subtree != "" || name.SubtreeIno != 0 || len(name.Filters) > 0 || self.Fs.HasSyncFilters()) {
+		ino, err := self.resolveSubtree(name.Subtree, name.SubtreeIno)
+		if err != nil {
+			return nil, err
+		}
+		exportName := self.Fs.SubtreeExportName(name.Peer)
+		err = self.Fs.ExportSubtree(ino, name.Peer, exportName, name.Filters)
+		if err != nil {
+			return nil, err
+		}
+		id := self.Storage.GetBlockIdByName(exportName)
+		return pb.StringToBlockId(id), nil
+	}
 	if name.Name == self.Fs.RootName {
 		var bid string
 		self.Fs.WithoutParallelWrites(
@@ -147,9 +171,21 @@ func (self *Server) MergeBlockNameTo(ctx context.Context, req *MergeRequest) (*M
 	if req.ToName != self.Fs.RootName {
 		log.Panic("non-fs merges not supported")
 	}
-	self.Fs.Update(func(tr *hugger.Transaction) {
-		fs.MergeTo3(tr, b0, b, false)
-	})
+	if req.Subtree != "" || req.SubtreeIno != 0 || len(req.Filters) > 0 || self.Fs.HasSyncFilters() || fs.IsSubtreeExport(b) {
+		ino, err := self.resolveSubtree(req.Subtree, req.SubtreeIno)
+		if err != nil {
+			return nil, err
+		}
+		err = self.Fs.MergeSubtreeFromPeer(b0, b, ino, req.FromName, n0, req.Filters)
+		if err != nil {
+			return nil, err
+		}
+		return &MergeResult{Ok: true}, nil
+	}
+	err := self.Fs.MergeFromPeer(b0, b, req.FromName)
+	if err != nil {
+		return nil, err
+	}
 	block := self.Fs.RootBlock()
 	defer block.Close()
 	self.Storage.SetNameToBlockId(n0, block.Id())
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fingon/go-tfhfs/mlog"
+)
+
+// BlockAuditEntry describes a block which metadata in the backend
+// differs from what it is expected to be.
+type BlockAuditEntry struct {
+	Id               string
+	Stored, Expected BlockMetadata
+}
+
+func (self BlockAuditEntry) String() string {
+	return fmt.Sprintf("%x: refcount %d status %v, expected refcount %d status %v",
+		self.Id, self.Stored.RefCount, self.Stored.Status,
+		self.Expected.RefCount, self.Expected.Status)
+}
+
+// ReferenceAudit is the result of Storage.AuditReferences.
+type ReferenceAudit struct {
+	// Names and Blocks are the number of names and blocks in the
+	// backend
+	Names, Blocks int
+
+	// Missing block ids are referred to, but not in the backend
+	Missing []string
+
+	// Mismatched blocks are referred to, but have wrong metadata
+	Mismatched []BlockAuditEntry
+
+	// Unreachable blocks are not referred to at all
+	Unreachable []BlockAuditEntry
+
+	// Repaired is the number of blocks fixed or removed
+	Repaired int
+}
+
+// Problems returns human readable description of the differences.
+func (self *ReferenceAudit) Problems() (l []string) {
+	for _, id := range self.Missing {
+		l = append(l, fmt.Sprintf("%x: missing", id))
+	}
+	for _, e := range self.Mismatched {
+		l = append(l, e.String())
+	}
+	for _, e := range self.Unreachable {
+		l = append(l, fmt.Sprintf("%v (unreachable)", e))
+	}
+	return
+}
+
+// auditStatus returns the status block should have; unknown ones are
+// treated as BS_NORMAL.
+func auditStatus(st BlockStatus) BlockStatus {
+	if st == BS_UNSET || st > BS_WANT_WEAK {
+		return BS_NORMAL
+	}
+	return st
+}
+
+func (self *Storage) auditReferences(rebuild, gc bool) *ReferenceAudit {
+	mlog.Printf2("storage/audit", "st.auditReferences rebuild:%v gc:%v", rebuild, gc)
+	a := &ReferenceAudit{}
+	if self.ReadOnly {
+		// Repairs would not be persisted anyway
+		rebuild = false
+		gc = false
+	}
+
+	// Make sure everything we know of is in the backend
+	self.flush()
+
+	stored := make(map[string]BlockMetadata)
+	self.Backend.IterateBlocks(func(id string, metadata BlockMetadata) {
+		stored[id] = metadata
+	})
+	a.Blocks = len(stored)
+
+	var ids []string
+	self.Backend.IterateNames(func(name, id string) {
+		ids = append(ids, id)
+	})
+	a.Names = len(ids)
+
+	// Breadth-first traversal from the names; each name and each
+	// reference from within a block with dependencies is a
+	// reference
+	expected := make(map[string]int32)
+	refer := func(id string) {
+		expected[id]++
+		if expected[id] == 1 {
+			ids = append(ids, id)
+		}
+	}
+	todo := ids
+	ids = nil
+	for _, id := range todo {
+		refer(id)
+	}
+	for len(ids) > 0 {
+		id := ids[0]
+		ids = ids[1:]
+		md, ok := stored[id]
+		if !ok {
+			a.Missing = append(a.Missing, id)
+			continue
+		}
+		if auditStatus(md.Status) >= BS_WANT_NORMAL {
+			continue
+		}
+		b := self.getBlockById(id)
+		b.iterateReferences(refer)
+		// Let it leave the cache on next flush if unused
+		b.addStorageRefCount(0)
+	}
+	sort.Strings(a.Missing)
+
+	var sids []string
+	for id := range stored {
+		sids = append(sids, id)
+	}
+	sort.Strings(sids)
+	for _, id := range sids {
+		md := stored[id]
+		emd := BlockMetadata{RefCount: expected[id],
+			Status: auditStatus(md.Status)}
+		if md == emd {
+			continue
+		}
+		e := BlockAuditEntry{Id: id, Stored: md, Expected: emd}
+		mlog.Printf2("storage/audit", " %v", e)
+		if emd.RefCount == 0 {
+			a.Unreachable = append(a.Unreachable, e)
+			if !gc {
+				continue
+			}
+		} else {
+			a.Mismatched = append(a.Mismatched, e)
+			if !rebuild {
+				continue
+			}
+		}
+		b := self.getBlockById(id)
+		b.markDirty()
+		b.RefCount = emd.RefCount
+		b.Status = emd.Status
+		// The references from this block are already
+		// accounted for in the expected counts, so they
+		// should not change during flush
+		b.haveDiskRefs = emd.RefCount != 0
+		a.Repaired++
+	}
+	if a.Repaired > 0 {
+		self.flush()
+	}
+	return a
+}
@@ -12,6 +12,7 @@
 package storage
 
 import (
+	"log"
 	"time"
 
 	"github.com/fingon/go-tfhfs/codec"
@@ -38,6 +39,17 @@ type BackendConfiguration struct {
 
 	// Unsafe mode (if possible) ; non-sync writes mostly
 	Unsafe bool
+
+	// ReadOnly backends never write anything
+	ReadOnly bool
+}
+
+// AssertWritable panics if the backend is read-only. Backends call it
+// before every write, as Storage should not attempt any then.
+func (self *BackendConfiguration) AssertWritable() {
+	if self.ReadOnly {
+		log.Panic("Write attempt to read-only backend")
+	}
 }
 
 // BlockBackend is subset of the storage Backend which deals with raw
@@ -50,13 +62,17 @@ type BlockBackend interface {
 	GetBlockById(id string) *Block
 
 	// DeleteBlock removes block from storage, and it MUST exist.
-	DeleteBlock(b *Block)
+	DeleteBlock(b *Block) error
 
 	// StoreBlock adds new block to  It MUST NOT exist.
-	StoreBlock(b *Block)
+	StoreBlock(b *Block) error
 
 	// UpdateBlock updates block metadata in  It MUST exist.
-	UpdateBlock(b *Block) int
+	UpdateBlock(b *Block) (int, error)
+
+	// IterateBlocks calls cb with id and metadata of every block
+	// in the backend. The callback MUST NOT call the backend.
+	IterateBlocks(cb func(id string, metadata BlockMetadata))
 }
 
 // NameBackend is subset of storage Backend which deals with names.
@@ -66,7 +82,11 @@ type NameBackend interface {
 	GetBlockIdByName(name string) string
 
 	// SetBlockIdName sets the logical name to map to particular block id.
-	SetNameToBlockId(name, block_id string)
+	SetNameToBlockId(name, block_id string) error
+
+	// IterateNames calls cb for every name that maps to a block
+	// id. The callback MUST NOT call the backend.
+	IterateNames(cb func(name, block_id string))
 }
 
 type BackendFeature int
@@ -82,6 +102,10 @@ const (
 // is no guarantee it will not be called from multiple goroutines at
 // once, and it is again the problem of the implementor to ensure that
 // the results are consistent.
+//
+// Failures to write (e.g. I/O errors or running out of space) are
+// returned as errors, and Storage reports them to its users (see
+// WriteErrors); the backend state should not change if a write fails.
 type Backend interface {
 	// Initialize the backend with the given configuration; this
 	// is typically called only for real storage backends and not
@@ -91,8 +115,9 @@ type Backend interface {
 	// Flush is used to hint that currently is good time to
 	// snapshot state, if any; storage is done with flushing its
 	// current state so e.g. names and block hierarchies are most
-	// consistent right now
-	Flush()
+	// consistent right now. Failure to persist the state is
+	// returned as error, and the flush is retried later.
+	Flush() error
 
 	// Close the backend
 	Close()
@@ -55,6 +55,7 @@ func (self *badgerBackend) Init(config storage.BackendConfiguration) {
 	if config.Unsafe {
 		opts.SyncWrites = false
 	}
+	opts.ReadOnly = config.ReadOnly
 	db, err := badger.Open(opts)
 	if err != nil {
 		log.Panic("badger.Open", err)
@@ -62,8 +63,11 @@ func (self *badgerBackend) Init(config storage.BackendConfiguration) {
 	self.db = db
 }
 
-func (self *badgerBackend) Flush() {
+func (self *badgerBackend) Flush() error {
 	mlog.Printf2("storage/badger/badger", "bad.Flush start")
+	if self.ReadOnly {
+		return nil
+	}
 	// 0.5 = 2x write amplification (but 50% storage efficiency)
 	// 0.2 = 5x write amplification (but 80% storage efficiency)
 	// TBD: This should be a parameter..
@@ -73,6 +77,7 @@ func (self *badgerBackend) Flush() {
 		log.Panic(err)
 	}
 	mlog.Printf2("storage/badger/badger", " gc done %v", err)
+	return nil
 }
 
 func (self *badgerBackend) Close() {
@@ -80,18 +85,15 @@ func (self *badgerBackend) Close() {
 	self.db.Close()
 }
 
-func (self *badgerBackend) DeleteBlock(b *storage.Block) {
+func (self *badgerBackend) DeleteBlock(b *storage.Block) error {
 	mlog.Printf2("storage/badger/badger", "bad.DeleteBlock %x", b.Id)
-	self.db.Update(func(txn *badger.Txn) error {
+	return self.db.Update(func(txn *badger.Txn) error {
 		k := append([]byte("1"), []byte(b.Id)...)
 		if err := self.delete(k); err != nil {
-			log.Panic("txn.Delete", err)
+			return err
 		}
 		k = append([]byte("2"), []byte(b.Id)...)
-		if err := self.delete(k); err != nil {
-			log.Panic("txn.Delete 2", err)
-		}
-		return nil
+		return self.delete(k)
 	})
 }
 
@@ -140,49 +142,90 @@ func (self *badgerBackend) GetBlockIdByName(name string) string {
 	return string(bv)
 }
 
-func (self *badgerBackend) setKKValue(prefix, suffix, value []byte) {
-	k := append(prefix, suffix...)
-	if err := self.set(k, value); err != nil {
-		log.Panic("set", err)
+func (self *badgerBackend) iteratePrefix(prefix []byte, cb func(k, v []byte)) {
+	err := self.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+			cb(item.Key()[len(prefix):], v)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic("iterate error:", err)
 	}
 }
 
+func (self *badgerBackend) IterateBlocks(cb func(id string, metadata storage.BlockMetadata)) {
+	self.iteratePrefix([]byte("1"), func(k, v []byte) {
+		var meta storage.BlockMetadata
+		_, err := meta.UnmarshalMsg(v)
+		if err != nil {
+			log.Panic(err)
+		}
+		cb(string(k), meta)
+	})
+}
+
+func (self *badgerBackend) IterateNames(cb func(name, block_id string)) {
+	self.iteratePrefix([]byte("3"), func(k, v []byte) {
+		if len(v) > 0 {
+			cb(string(k), string(v))
+		}
+	})
+}
+
+func (self *badgerBackend) setKKValue(prefix, suffix, value []byte) error {
+	k := append(prefix, suffix...)
+	return self.set(k, value)
+}
+
 func (self *badgerBackend) delete(k []byte) error {
+	self.AssertWritable()
 	return self.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete(k)
 	})
 }
 
 func (self *badgerBackend) set(k, v []byte) error {
+	self.AssertWritable()
 	return self.db.Update(func(txn *badger.Txn) error {
 		return txn.Set(k, v)
 	})
 }
 
-func (self *badgerBackend) SetNameToBlockId(name, block_id string) {
+func (self *badgerBackend) SetNameToBlockId(name, block_id string) error {
 	mlog.Printf2("storage/badger/badger", "bad.SetNameToBlockId %s = %x", name, block_id)
-	self.setKKValue([]byte("3"), []byte(name), []byte(block_id))
+	return self.setKKValue([]byte("3"), []byte(name), []byte(block_id))
 }
 
-func (self *badgerBackend) StoreBlock(b *storage.Block) {
+func (self *badgerBackend) StoreBlock(b *storage.Block) error {
 	data := *b.Data.Get()
 	mlog.Printf2("storage/badger/badger", "bad.StoreBlock %x (%d b)", b.Id, len(data))
-	self.updateBlock(b)
-	self.setKKValue([]byte("2"), []byte(b.Id), data)
+	// Data first, as the block exists only once it has metadata
+	err := self.setKKValue([]byte("2"), []byte(b.Id), data)
+	if err != nil {
+		return err
+	}
+	return self.updateBlock(b)
 }
 
-func (self *badgerBackend) updateBlock(b *storage.Block) {
+func (self *badgerBackend) updateBlock(b *storage.Block) error {
 	buf, err := b.BlockMetadata.MarshalMsg(nil)
 	if err != nil {
 		log.Panic(err)
 	}
-	self.setKKValue([]byte("1"), []byte(b.Id), buf)
+	return self.setKKValue([]byte("1"), []byte(b.Id), buf)
 }
 
-func (self *badgerBackend) UpdateBlock(b *storage.Block) int {
+func (self *badgerBackend) UpdateBlock(b *storage.Block) (int, error) {
 	mlog.Printf2("storage/badger/badger", "bad.UpdateBlock %x", b.Id)
-	self.updateBlock(b)
-	return 1
+	return 1, self.updateBlock(b)
 }
 
 func (self *badgerBackend) Supports(feature storage.BackendFeature) bool {
@@ -111,15 +111,17 @@ func (self *Block) flush() int {
 		log.Panicf("self.Stored not set?!?")
 	}
 	ops := 0
-	hadRefs := self.Backend != nil && self.Stored.RefCount != 0
+	var err error
 	if self.RefCount == 0 {
 		if self.Backend != nil {
 			// just in case grab data if we already do not
 			// have it and we have to re-add this back
 			self.GetData()
 			self.storage.counters[C_DELETE].AddInt(1)
-			self.Backend.DeleteBlock(self)
-			self.Backend = nil
+			err = self.Backend.DeleteBlock(self)
+			if err == nil {
+				self.Backend = nil
+			}
 		}
 		ops++
 	} else if self.Backend == nil {
@@ -127,16 +129,22 @@ func (self *Block) flush() int {
 		self.storage.counters[C_WRITE].AddInt(1)
 		data := self.GetData()
 		self.storage.counters[C_WRITEBYTES].AddInt(len(data))
-		self.storage.Backend.StoreBlock(self)
-		self.Backend = self.storage.Backend
+		err = self.storage.Backend.StoreBlock(self)
+		if err == nil {
+			self.Backend = self.storage.Backend
+		}
 		ops++
 	} else {
-		ops += self.storage.Backend.UpdateBlock(self)
+		var n int
+		n, err = self.storage.Backend.UpdateBlock(self)
+		ops += n
 	}
+	// The dependencies follow what the backend should have, even
+	// if the write failed; otherwise blocks the failed one
+	// refers to could be freed before the write is retried.
 	haveRefs := self.RefCount != 0
-	if hadRefs != haveRefs {
+	if self.shouldHaveDiskDependencies(haveRefs) {
 		mlog.Printf2("storage/block", " dependencies changed")
-		self.shouldHaveDiskDependencies(haveRefs)
 		if haveRefs {
 			// By default if we have dependencies on disk, there
 			// is no need to have them also in storage (= RAM
@@ -144,8 +152,16 @@ func (self *Block) flush() int {
 			self.shouldHaveStorageDependencies(false)
 		}
 	}
-	self.Stored = nil
 	delete(self.storage.dirtyBlocks, self)
+	if err != nil {
+		// Keep it dirty (but out of the current flush) so
+		// that it is retried on the next flush
+		mlog.Printf2("storage/block", " flush failed: %v", err)
+		self.storage.reportWriteError(err)
+		self.storage.failedBlocks[self] = true
+		return ops
+	}
+	self.Stored = nil
 
 	self.addStorageRefCount(-1)
 	return ops
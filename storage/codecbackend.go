@@ -44,13 +44,13 @@ func (self *codecBackend) GetBlockData(bl *Block) []byte {
 	return b
 }
 
-func (self *codecBackend) StoreBlock(bl *Block) {
+func (self *codecBackend) StoreBlock(bl *Block) error {
 	dp := bl.Data.Get()
 	b, err := self.Codec.EncodeBytes(*dp, []byte(bl.Id))
 	if err != nil {
-		log.Panic("Encoding failed", err)
+		return err
 	}
 	bl2 := *bl
 	bl2.Data.Set(&b)
-	self.Backend.StoreBlock(&bl2)
+	return self.Backend.StoreBlock(&bl2)
 }
@@ -92,5 +92,6 @@ func NewCryptoStorage(config CryptoStorageConfiguration) *storage.Storage {
 		c = &codec.CodecChain{}
 		mlog.Printf2("storage/factory/factory", " backend supports codec -> omitting from storage")
 	}
-	return storage.Storage{QueueLength: queuelength, Backend: be, Codec: c}.Init()
+	return storage.Storage{QueueLength: queuelength, Backend: be, Codec: c,
+		ReadOnly: config.ReadOnly}.Init()
 }
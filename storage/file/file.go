@@ -12,6 +12,7 @@
 package file
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -60,8 +61,8 @@ func (self *fileBackend) Init(config storage.BackendConfiguration) {
 	(&self.DirectoryBackendBase).Init(config)
 }
 
-func (self *fileBackend) Flush() {
-
+func (self *fileBackend) Flush() error {
+	return nil
 }
 func (self *fileBackend) delay() {
 	if self.DelayPerOp > 0 {
@@ -69,13 +70,11 @@ func (self *fileBackend) delay() {
 	}
 }
 
-func (self *fileBackend) DeleteBlock(bl *storage.Block) {
+func (self *fileBackend) DeleteBlock(bl *storage.Block) error {
+	self.AssertWritable()
 	self.delay()
 	_, path := self.blockPath(bl, bl.Stored)
-	err := os.Remove(path)
-	if err != nil {
-		log.Panic(err)
-	}
+	return os.Remove(path)
 }
 
 func (self *fileBackend) mkdirAllRec(path string) {
@@ -160,40 +159,102 @@ func (self *fileBackend) GetBlockIdByName(name string) string {
 	return string(b)
 }
 
+func (self *fileBackend) IterateBlocks(cb func(id string, metadata storage.BlockMetadata)) {
+	self.delay()
+	dirs, err := ioutil.ReadDir(fmt.Sprintf("%s/blocks", self.Directory))
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		prefix, err := hex.DecodeString(d.Name())
+		if err != nil {
+			continue
+		}
+		fis, err := ioutil.ReadDir(fmt.Sprintf("%s/blocks/%s", self.Directory, d.Name()))
+		if err != nil {
+			continue
+		}
+		for _, v := range fis {
+			arr := strings.Split(v.Name(), "_")
+			if len(arr) != 3 {
+				continue
+			}
+			suffix, err := hex.DecodeString(arr[0])
+			if err != nil {
+				continue
+			}
+			refcount, err := strconv.Atoi(arr[1])
+			if err != nil {
+				continue
+			}
+			status, err := strconv.Atoi(arr[2])
+			if err != nil {
+				continue
+			}
+			meta := storage.BlockMetadata{RefCount: int32(refcount),
+				Status: storage.BlockStatus(status)}
+			cb(string(prefix)+string(suffix), meta)
+		}
+	}
+}
+
+func (self *fileBackend) IterateNames(cb func(name, block_id string)) {
+	self.delay()
+	dir := fmt.Sprintf("%s/names", self.Directory)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, v := range fis {
+		name, err := hex.DecodeString(v.Name())
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", dir, v.Name()))
+		if err != nil {
+			log.Panic(err)
+		}
+		cb(string(name), string(b))
+	}
+}
+
 func (self *fileBackend) SetInFlush(value bool) {
 }
 
-func (self *fileBackend) SetNameToBlockId(name, block_id string) {
+func (self *fileBackend) SetNameToBlockId(name, block_id string) error {
+	self.AssertWritable()
 	mlog.Printf2("storage/file/file", "fbb.SetNameToBlockId %v %x", name, block_id)
 	dir := fmt.Sprintf("%s/names", self.Directory)
 	path := fmt.Sprintf("%s/%x", dir, name)
 	self.mkdirAll(dir)
 	if block_id == "" {
-		err := os.Remove(path)
-		if err != nil {
-			log.Panic(err)
-		}
-		return
+		return os.Remove(path)
 	}
 	err := ioutil.WriteFile(path, []byte(block_id), 0600)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	mlog.Printf2("storage/file/file", " wrote to %v", path)
+	return nil
 }
 
-func (self *fileBackend) StoreBlock(bl *storage.Block) {
+func (self *fileBackend) StoreBlock(bl *storage.Block) error {
+	self.AssertWritable()
 	self.delay()
 	dir, path := self.blockPath(bl, nil)
 	self.mkdirAll(dir)
 	err := ioutil.WriteFile(path, *bl.Data.Get(), 0600)
 	if err != nil {
-		log.Panic(err)
+		// Partial block is worse than no block at all
+		os.Remove(path)
+		return err
 	}
 	mlog.Printf2("storage/file/file", "fbb.StoreBlock %x to %v", bl.Id, path)
+	return nil
 }
 
-func (self *fileBackend) UpdateBlock(bl *storage.Block) int {
+func (self *fileBackend) UpdateBlock(bl *storage.Block) (int, error) {
+	self.AssertWritable()
 	mlog.Printf2("storage/file/file", "fbb.UpdateBlock %x", bl.Id)
 	self.delay()
 	if bl.Stored == nil {
@@ -205,10 +266,10 @@ func (self *fileBackend) UpdateBlock(bl *storage.Block) int {
 	mlog.Printf2("storage/file/file", " newpath:%v", newpath)
 	err := os.Rename(oldpath, newpath)
 	if err != nil {
-		log.Panic(err)
+		return 0, err
 	}
 	mlog.Printf2("storage/file/file", "fbb.UpdateBlock %x", bl.Id)
-	return 1
+	return 1, nil
 }
 
 func (self *fileBackend) Close() {
@@ -22,6 +22,7 @@ import (
 // inMemoryBackend provides In-memory storage; data is always
 // assumed to be available and is just stored in maps.
 type inMemoryBackend struct {
+	storage.BackendConfiguration
 	id2Block map[string]storage.Block
 	name2Id  map[string]string
 	lock     util.MutexLocked
@@ -38,21 +39,23 @@ func NewInMemoryBackend() storage.Backend {
 }
 
 func (self *inMemoryBackend) Init(config storage.BackendConfiguration) {
-
+	self.BackendConfiguration = config
 }
 
-func (self *inMemoryBackend) Flush() {
-
+func (self *inMemoryBackend) Flush() error {
+	return nil
 }
 
 func (self *inMemoryBackend) Close() {
 
 }
 
-func (self *inMemoryBackend) DeleteBlock(b *storage.Block) {
+func (self *inMemoryBackend) DeleteBlock(b *storage.Block) error {
+	self.AssertWritable()
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/inmemory/inmemory", "im.DeleteBlock %x", b.Id)
 	delete(self.id2Block, b.Id)
+	return nil
 }
 
 func (self *inMemoryBackend) GetBlockData(bl *storage.Block) []byte {
@@ -86,12 +89,31 @@ func (self *inMemoryBackend) GetBytesUsed() uint64 {
 	return 0
 }
 
-func (self *inMemoryBackend) SetNameToBlockId(name, block_id string) {
+func (self *inMemoryBackend) IterateBlocks(cb func(id string, metadata storage.BlockMetadata)) {
+	defer self.lock.Locked()()
+	for id, b := range self.id2Block {
+		cb(id, b.BlockMetadata)
+	}
+}
+
+func (self *inMemoryBackend) IterateNames(cb func(name, block_id string)) {
+	defer self.lock.Locked()()
+	for name, id := range self.name2Id {
+		if id != "" {
+			cb(name, id)
+		}
+	}
+}
+
+func (self *inMemoryBackend) SetNameToBlockId(name, block_id string) error {
+	self.AssertWritable()
 	defer self.lock.Locked()()
 	self.name2Id[name] = block_id
+	return nil
 }
 
-func (self *inMemoryBackend) StoreBlock(b *storage.Block) {
+func (self *inMemoryBackend) StoreBlock(b *storage.Block) error {
+	self.AssertWritable()
 	defer self.lock.Locked()()
 	_, ok := self.id2Block[b.Id]
 	if ok {
@@ -101,16 +123,20 @@ func (self *inMemoryBackend) StoreBlock(b *storage.Block) {
 	nb := *b
 	nb.Backend = self
 	self.id2Block[b.Id] = nb
+	return nil
 }
 
-func (self *inMemoryBackend) UpdateBlock(b *storage.Block) int {
+func (self *inMemoryBackend) UpdateBlock(b *storage.Block) (int, error) {
+	self.AssertWritable()
 	defer self.lock.Locked()()
-	_, ok := self.id2Block[b.Id]
+	ob, ok := self.id2Block[b.Id]
 	if !ok {
 		log.Panic("Non-existent block id in StoreBlock")
 	}
 	mlog.Printf2("storage/inmemory/inmemory", "im.UpdateBlock %x", b.Id)
-	return 1
+	ob.BlockMetadata = b.BlockMetadata
+	self.id2Block[b.Id] = ob
+	return 1, nil
 }
 
 func (self *inMemoryBackend) Supports(feature storage.BackendFeature) bool {
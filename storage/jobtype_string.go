@@ -4,9 +4,9 @@ package storage
 
 import "strconv"
 
-const _jobType_name = "jobFlushjobGetBlockByIdjobGetBlockIdByNamejobSetNameToBlockIdjobSetStorageBlockStatusjobReferOrStoreBlockjobUpdateBlockIdRefCountjobUpdateBlockIdStorageRefCountjobStoreBlockjobQuit"
+const _jobType_name = "jobFlushjobGetBlockByIdjobGetBlockIdByNamejobSetNameToBlockIdjobSetStorageBlockStatusjobReferOrStoreBlockjobUpdateBlockIdRefCountjobUpdateBlockIdStorageRefCountjobStoreBlockjobAuditReferencesjobQuit"
 
-var _jobType_index = [...]uint8{0, 8, 23, 42, 61, 85, 105, 129, 160, 173, 180}
+var _jobType_index = [...]uint8{0, 8, 23, 42, 61, 85, 105, 129, 160, 173, 191, 198}
 
 func (i jobType) String() string {
 	if i < 0 || i >= jobType(len(_jobType_index)-1) {
@@ -53,10 +53,20 @@ func (self *mapRunnerBackend) runWithBlock(b *Block, cb func()) {
 	b.addStorageRefCount(-1)
 }
 
-func (self *mapRunnerBackend) DeleteBlock(b *Block) {
-	b = b.copy()
+// runWithBlockError runs cb like runWithBlock, but waits for it to
+// finish and returns its error.
+func (self *mapRunnerBackend) runWithBlockError(b *Block, cb func() error) error {
+	errc := make(chan error, 1)
 	self.runWithBlock(b, func() {
-		self.Backend.DeleteBlock(b)
+		errc <- cb()
+	})
+	return <-errc
+}
+
+func (self *mapRunnerBackend) DeleteBlock(b *Block) error {
+	b = b.copy()
+	return self.runWithBlockError(b, func() error {
+		return self.Backend.DeleteBlock(b)
 	})
 }
 
@@ -82,17 +92,18 @@ func (self *mapRunnerBackend) GetBlockById(id string) *Block {
 	return fut.Get()
 }
 
-func (self *mapRunnerBackend) StoreBlock(b *Block) {
+func (self *mapRunnerBackend) StoreBlock(b *Block) error {
 	b = b.copy()
-	self.runWithBlock(b, func() {
-		self.Backend.StoreBlock(b)
+	return self.runWithBlockError(b, func() error {
+		return self.Backend.StoreBlock(b)
 	})
 }
 
-func (self *mapRunnerBackend) UpdateBlock(b *Block) int {
+func (self *mapRunnerBackend) UpdateBlock(b *Block) (n int, err error) {
 	b = b.copy()
-	self.runWithBlock(b, func() {
-		self.Backend.UpdateBlock(b)
+	err = self.runWithBlockError(b, func() (err error) {
+		n, err = self.Backend.UpdateBlock(b)
+		return
 	})
-	return 1
+	return
 }
@@ -61,7 +61,14 @@ func (self *NameInBlockBackend) GetBlockIdByName(name string) string {
 	return self.getBlock().NameToBlockId[name]
 }
 
-func (self *NameInBlockBackend) SetNameToBlockId(name, block_id string) {
+func (self *NameInBlockBackend) IterateNames(cb func(name, block_id string)) {
+	defer self.lock.Locked()()
+	for name, block_id := range self.getBlock().NameToBlockId {
+		cb(name, block_id)
+	}
+}
+
+func (self *NameInBlockBackend) SetNameToBlockId(name, block_id string) error {
 	defer self.lock.Locked()()
 	block := self.getBlock()
 	if block_id != "" {
@@ -70,7 +77,11 @@ func (self *NameInBlockBackend) SetNameToBlockId(name, block_id string) {
 		delete(block.NameToBlockId, name)
 	}
 	if self.block != nil {
-		self.bb.DeleteBlock(self.block)
+		err := self.bb.DeleteBlock(self.block)
+		if err != nil {
+			return err
+		}
+		self.block = nil
 	}
 	b, err := self.namedMap.MarshalMsg(nil)
 	if err != nil {
@@ -78,6 +89,10 @@ func (self *NameInBlockBackend) SetNameToBlockId(name, block_id string) {
 	}
 	bl := &Block{Id: self.mapName}
 	bl.Data.Set(&b)
-	self.bb.StoreBlock(bl)
+	err = self.bb.StoreBlock(bl)
+	if err != nil {
+		return err
+	}
 	self.block = bl
+	return nil
 }
@@ -32,8 +32,8 @@ func (self *proxyBackend) Init(config BackendConfiguration) {
 	self.Backend.Init(config)
 }
 
-func (self *proxyBackend) Flush() {
-	self.Backend.Flush()
+func (self *proxyBackend) Flush() error {
+	return self.Backend.Flush()
 }
 
 func (self *proxyBackend) Close() {
@@ -41,8 +41,8 @@ func (self *proxyBackend) Close() {
 	self.Backend.Close()
 }
 
-func (self *proxyBackend) DeleteBlock(b *Block) {
-	self.Backend.DeleteBlock(b)
+func (self *proxyBackend) DeleteBlock(b *Block) error {
+	return self.Backend.DeleteBlock(b)
 }
 
 func (self *proxyBackend) GetBlockData(b *Block) []byte {
@@ -69,18 +69,26 @@ func (self *proxyBackend) GetBytesUsed() uint64 {
 	return self.Backend.GetBytesUsed()
 }
 
-func (self *proxyBackend) SetNameToBlockId(name, block_id string) {
-	self.Backend.SetNameToBlockId(name, block_id)
+func (self *proxyBackend) IterateBlocks(cb func(id string, metadata BlockMetadata)) {
+	self.Backend.IterateBlocks(cb)
 }
 
-func (self *proxyBackend) StoreBlock(b *Block) {
-	self.Backend.StoreBlock(b)
+func (self *proxyBackend) IterateNames(cb func(name, block_id string)) {
+	self.Backend.IterateNames(cb)
+}
+
+func (self *proxyBackend) SetNameToBlockId(name, block_id string) error {
+	return self.Backend.SetNameToBlockId(name, block_id)
+}
+
+func (self *proxyBackend) StoreBlock(b *Block) error {
+	return self.Backend.StoreBlock(b)
 }
 
 func (self *proxyBackend) Supports(feature BackendFeature) bool {
 	return self.Backend.Supports(feature)
 }
 
-func (self *proxyBackend) UpdateBlock(b *Block) int {
+func (self *proxyBackend) UpdateBlock(b *Block) (int, error) {
 	return self.Backend.UpdateBlock(b)
 }
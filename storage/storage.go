@@ -12,6 +12,8 @@
 package storage
 
 import (
+	"log"
+
 	"github.com/fingon/go-tfhfs/codec"
 	"github.com/fingon/go-tfhfs/mlog"
 	"github.com/fingon/go-tfhfs/util"
@@ -60,6 +62,10 @@ type Storage struct {
 	// fetching it from backend
 	Codec codec.Codec
 
+	// ReadOnly storage never writes anything to the backend; the
+	// changes (if any) are kept only in memory.
+	ReadOnly bool
+
 	// blocks is Block object herd; they are reference counted, so
 	// as long as someone keeps a reference to one, it stays
 	// here. Being in dirtyBlocks means it also has extra
@@ -69,6 +75,13 @@ type Storage struct {
 	blocks                             blockMap
 	dirtyBlocks, dirtyStorageRefBlocks blockObjectMap
 
+	// failedBlocks are dirty blocks which failed to be written
+	// during the current flush
+	failedBlocks blockObjectMap
+
+	// backendUnflushed is set if the last Backend.Flush failed
+	backendUnflushed bool
+
 	// Stuff below here is ~DelayedStorage
 	names map[string]*oldNewStruct
 
@@ -77,6 +90,9 @@ type Storage struct {
 	jobChannel chan *jobIn
 
 	jobCounts map[jobType]int
+
+	// writeErrors keeps track of backend write failures
+	writeErrors *WriteErrors
 }
 
 // Init sets up the default values to be usable
@@ -86,7 +102,9 @@ func (self Storage) Init() *Storage {
 	self.blocks = make(blockMap)
 	self.dirtyBlocks = make(blockObjectMap)
 	self.dirtyStorageRefBlocks = make(blockObjectMap)
+	self.failedBlocks = make(blockObjectMap)
 	self.jobCounts = make(map[jobType]int)
+	self.writeErrors = &WriteErrors{}
 
 	if self.Codec != nil {
 		// No need to care about encoding elsewhere with this
@@ -106,6 +124,25 @@ func (self Storage) Init() *Storage {
 	return &self
 }
 
+func (self *Storage) reportWriteError(err error) {
+	if err != nil {
+		log.Printf("Storage: backend write failed: %v", err)
+		self.writeErrors.Report(err)
+	}
+}
+
+// WriteErrorSeq returns the current write error sequence number; see
+// WriteErrors.Seq.
+func (self *Storage) WriteErrorSeq() uint64 {
+	return self.writeErrors.Seq()
+}
+
+// WriteErrorSince returns the latest backend write error if there
+// has been one since the seq; see WriteErrors.Since.
+func (self *Storage) WriteErrorSince(seq uint64) (uint64, error) {
+	return self.writeErrors.Since(seq)
+}
+
 func (self *Storage) Close() {
 	// Implicitly also flush; storage that persists randomly seems bad
 	if self.Backend != nil {
@@ -143,7 +180,8 @@ func (self *Storage) setNameToBlockId(name, bid string) {
 		self.getBlockById(n.newValue).addStorageRefCount(-1)
 	}
 	n.newValue = bid
-	n.gotStorageRef = true
+	// (releasing the name does not hold anything)
+	n.gotStorageRef = bid != ""
 }
 
 func (self *Storage) getName(name string) *oldNewStruct {
@@ -159,7 +197,12 @@ func (self *Storage) getName(name string) *oldNewStruct {
 
 func (self *Storage) flushBlockName(k string, v *oldNewStruct) {
 	mlog.Printf2("storage/storage", "flushBlockName %s=%x", k, v.newValue)
-	self.Backend.SetNameToBlockId(k, v.newValue)
+	err := self.Backend.SetNameToBlockId(k, v.newValue)
+	if err != nil {
+		// Try again on next flush
+		self.reportWriteError(err)
+		return
+	}
 	if v.newValue != "" {
 		b := self.getBlockById(v.newValue)
 		b.addRefCount(1)
@@ -218,8 +261,14 @@ func (self *Storage) flush() int {
 		self.counters[i].Set(0)
 	}
 
+	ops := 0
+	if self.ReadOnly {
+		mlog.Printf2("storage/storage", " read-only, skipping writes")
+		return self.flushStorageRefs(ops)
+	}
+
 	// _flush_names in Python prototype
-	ops := self.flushBlockNames()
+	ops += self.flushBlockNames()
 
 	// flush_dirty_stored_blocks in Python
 	for len(self.dirtyBlocks) > 0 {
@@ -246,7 +295,28 @@ func (self *Storage) flush() int {
 		}
 	}
 
+	// Whatever failed is retried on the next flush
+	for b, _ := range self.failedBlocks {
+		self.dirtyBlocks[b] = true
+		delete(self.failedBlocks, b)
+	}
+
 	// similarly handle the storageRefCounts
+	ops = self.flushStorageRefs(ops)
+
+	if self.Backend != nil && (ops > 0 || c[C_WRITE] > 0 || c[C_DELETE] > 0 || self.backendUnflushed) {
+		err := self.Backend.Flush()
+		// Failed flush is retried on the next flush
+		self.backendUnflushed = err != nil
+		self.reportWriteError(err)
+	}
+
+	mlog.Printf2("storage/storage", " ops:%v", ops)
+	return ops
+}
+
+// flushStorageRefs handles the in-memory storageRefCounts.
+func (self *Storage) flushStorageRefs(ops int) int {
 	for len(self.dirtyStorageRefBlocks) > 0 {
 		oops := ops
 		for b, _ := range self.dirtyStorageRefBlocks {
@@ -264,12 +334,6 @@ func (self *Storage) flush() int {
 			ops += b.flushStorageRef()
 		}
 	}
-
-	if self.Backend != nil && (ops > 0 || c[C_WRITE] > 0 || c[C_DELETE] > 0) {
-		self.Backend.Flush()
-	}
-
-	mlog.Printf2("storage/storage", " ops:%v", ops)
 	return ops
 }
 
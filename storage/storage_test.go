@@ -200,6 +200,64 @@ func ProdStorageDeps(t *testing.T, be storage.Backend) {
 	assert.True(t, !broken)
 }
 
+func ProdStorageAudit(t *testing.T, be storage.Backend) {
+	s := storage.Storage{Backend: be,
+		IterateReferencesCallback: func(id string, data []byte, cb storage.BlockReferenceCallback) {
+			for _, subid := range strings.Split(string(data), " ") {
+				if subid != "" {
+					cb(subid)
+				}
+			}
+		}}.Init()
+	defer s.Close()
+	mlog.Printf2("storage/storage_test", "ProdStorageAudit")
+	s.ReferOrStoreBlock("asub", storage.BS_NORMAL, []byte(" ")).Close()
+	s.ReferOrStoreBlock("atop", storage.BS_NORMAL, []byte("asub")).Close()
+	s.SetNameToBlockId("audit", "atop")
+	s.ReleaseBlockId("asub")
+	s.ReleaseBlockId("atop")
+	s.Flush()
+	// ProdBackend may have left raw blocks behind; they are
+	// unreachable, but nothing else should be wrong
+	a := s.AuditReferences(false, true)
+	assert.Equal(t, len(a.Missing)+len(a.Mismatched), 0, a.Problems())
+	a = s.AuditReferences(false, false)
+	assert.Equal(t, len(a.Problems()), 0, a.Problems())
+	assert.True(t, a.Blocks >= 2)
+	assert.True(t, a.Names >= 1)
+
+	// Break things behind the back of the storage
+	b := be.GetBlockById("asub")
+	stored := b.BlockMetadata
+	b.Stored = &stored
+	b.RefCount = 3
+	be.UpdateBlock(b)
+	leak := &storage.Block{Id: "aleak",
+		BlockMetadata: storage.BlockMetadata{RefCount: 1,
+			Status: storage.BS_NORMAL}}
+	data := []byte(" ")
+	leak.Data.Set(&data)
+	be.StoreBlock(leak)
+	be.SetNameToBlockId("dangling", "amissing")
+
+	for _, fix := range []bool{false, true} {
+		a = s.AuditReferences(fix, fix)
+		assert.Equal(t, a.Missing, []string{"amissing"})
+		assert.Equal(t, len(a.Mismatched), 1)
+		assert.Equal(t, a.Mismatched[0].Id, "asub")
+		assert.Equal(t, a.Mismatched[0].Expected.RefCount, int32(1))
+		assert.Equal(t, len(a.Unreachable), 1)
+		assert.Equal(t, a.Unreachable[0].Id, "aleak")
+	}
+	assert.Equal(t, a.Repaired, 2)
+
+	be.SetNameToBlockId("dangling", "")
+	a = s.AuditReferences(false, false)
+	assert.Equal(t, len(a.Problems()), 0, a.Problems())
+	assert.Nil(t, be.GetBlockById("aleak"))
+	assert.Equal(t, be.GetBlockById("asub").RefCount, int32(1))
+}
+
 func ProdStorage(t *testing.T, factory func() storage.Backend) {
 	be := factory()
 	mlog.Printf2("storage/storage_test", "ProdStorage %v", be)
@@ -216,6 +274,34 @@ func ProdStorage(t *testing.T, factory func() storage.Backend) {
 	s2.Close()
 
 	ProdStorageDeps(t, be)
+
+	ProdStorageAudit(t, factory())
+}
+
+func ProdBackendReadOnly(t *testing.T, factory func() storage.Backend) {
+	be := factory()
+	s := storage.Storage{Backend: be, ReadOnly: true}.Init()
+	s.ReferOrStoreBlock("rokey", storage.BS_NORMAL, []byte("v")).Close()
+	s.SetNameToBlockId("roname", "rokey")
+	s.Flush()
+	// Changes are visible only in memory
+	assert.Equal(t, s.GetBlockIdByName("roname"), "rokey")
+	s.Close()
+
+	be = factory()
+	defer be.Close()
+	assert.Equal(t, be.GetBlockIdByName("roname"), "")
+	assert.Nil(t, be.GetBlockById("rokey"))
+
+	// Direct writes are refused too
+	panicked := false
+	func() {
+		defer func() {
+			panicked = recover() != nil
+		}()
+		be.SetNameToBlockId("roname", "rokey")
+	}()
+	assert.True(t, panicked)
 }
 
 func TestBackend(t *testing.T) {
@@ -230,6 +316,11 @@ func TestBackend(t *testing.T) {
 					DelayPerOp: time.Millisecond}
 				return factory.NewWithConfig(k, config)
 			})
+			ProdBackendReadOnly(t, func() storage.Backend {
+				config := storage.BackendConfiguration{Directory: dir,
+					ReadOnly: true}
+				return factory.NewWithConfig(k, config)
+			})
 		})
 	}
 }
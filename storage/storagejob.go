@@ -30,6 +30,7 @@ const (
 	jobUpdateBlockIdRefCount        // ReferBlockId, ReleaseBlockId
 	jobUpdateBlockIdStorageRefCount // ReleaseStorageBlockId
 	jobStoreBlock                   // StoreBlock, StoreBlock0
+	jobAuditReferences
 	jobQuit
 )
 
@@ -37,6 +38,8 @@ type jobOut struct {
 	sb *StorageBlock
 	id string
 	ok bool
+
+	audit *ReferenceAudit
 }
 
 type jobIn struct {
@@ -62,6 +65,9 @@ type jobIn struct {
 
 	status BlockStatus
 
+	// in jobAuditReferences
+	rebuild, gc bool
+
 	out chan *jobOut
 }
 
@@ -119,6 +125,8 @@ func (self *Storage) run() {
 			b.addStorageRefCount(job.count)
 		case jobSetNameToBlockId:
 			self.setNameToBlockId(job.name, job.id)
+		case jobAuditReferences:
+			job.out <- &jobOut{audit: self.auditReferences(job.rebuild, job.gc)}
 		case jobSetStorageBlockStatus:
 			jo := &jobOut{ok: job.sb.block.Get().setStatus(job.status)}
 			job.out <- jo
@@ -135,6 +143,20 @@ func (self *Storage) Flush() {
 	<-out
 }
 
+// AuditReferences recomputes the reference counts of blocks, starting
+// from the names, and compares them with what the backend has
+// stored. If rebuild is set, the metadata of referenced blocks is
+// fixed, and if gc is set, the unreferenced blocks are removed. The
+// repairs should be done only when nothing else is using the storage.
+func (self *Storage) AuditReferences(rebuild, gc bool) *ReferenceAudit {
+	out := make(chan *jobOut, 1)
+	self.jobChannel <- &jobIn{jobType: jobAuditReferences, out: out,
+		rebuild: rebuild, gc: gc,
+	}
+	jr := <-out
+	return jr.audit
+}
+
 func (self *Storage) GetBlockById(id string) *StorageBlock {
 	sb := newStorageBlock(id)
 	self.jobChannel <- &jobIn{jobType: jobGetBlockById,
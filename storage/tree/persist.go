@@ -25,7 +25,7 @@ type treePersister interface {
 	Close()
 	ReadData(location LocationSlice) []byte
 	Size() uint64
-	WriteData(location LocationSlice, data []byte)
+	WriteData(location LocationSlice, data []byte) error
 }
 
 type inMemoryFile struct {
@@ -58,7 +58,7 @@ func (self *inMemoryFile) Size() uint64 {
 	return uint64(len(self.b))
 }
 
-func (self *inMemoryFile) WriteData(location LocationSlice, data []byte) {
+func (self *inMemoryFile) WriteData(location LocationSlice, data []byte) error {
 	ofs := uint64(0)
 	mlog.Printf2("storage/tree/persist", "p.WriteData")
 	for _, v := range location {
@@ -70,6 +70,7 @@ func (self *inMemoryFile) WriteData(location LocationSlice, data []byte) {
 		copy(self.b[v.Offset:], data[ofs:ofs+v.Size])
 		ofs += v.Size
 	}
+	return nil
 }
 
 var _ treePersister = &inMemoryFile{}
@@ -81,10 +82,14 @@ type systemFile struct {
 
 var _ treePersister = &systemFile{}
 
-func (self systemFile) Init(directory string) *systemFile {
-	os.Mkdir(directory, 0700)
+func (self systemFile) Init(directory string, readOnly bool) *systemFile {
 	self.path = fmt.Sprintf("%s/db", directory)
-	f, err := os.OpenFile(self.path, os.O_RDWR|os.O_CREATE, 0755)
+	flag := os.O_RDONLY
+	if !readOnly {
+		os.Mkdir(directory, 0700)
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(self.path, flag, 0755)
 	if err != nil {
 		mlog.Panicf("Unable to open %s: %s", self.path, err)
 	}
@@ -125,17 +130,14 @@ func (self *systemFile) Size() uint64 {
 	return uint64(fi.Size())
 }
 
-func (self *systemFile) WriteData(location LocationSlice, data []byte) {
+func (self *systemFile) WriteData(location LocationSlice, data []byte) error {
 	ofs := uint64(0)
 	for _, v := range location {
-		_, err := self.f.Seek(int64(v.Offset), 0)
-		if err != nil {
-			log.Panic(err)
-		}
-		_, err = self.f.Write(data[ofs : ofs+v.Size])
+		_, err := self.f.WriteAt(data[ofs:ofs+v.Size], int64(v.Offset))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		ofs += v.Size
 	}
+	return nil
 }
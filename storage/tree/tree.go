@@ -26,6 +26,10 @@ const blockSize = 1 << 9
 const treeNodeMaximumSize = 1 << 12
 const superBlockSize = 1 << 16
 
+// namesBlockId is the id of the block NameInBlockBackend stores the
+// names in.
+const namesBlockId = "names"
+
 // treeBackend provides storage on top of flat 'device'; in practise
 // it may be in truth a number of files, or single raw disk device, or
 // something else.
@@ -52,13 +56,22 @@ type treeBackend struct {
 	currentMap          map[ibtree.BlockId]bool
 	superIndex          int
 	flushing            bool
+
+	// deferredFrees are the locations freed by a flush whose
+	// superblock could not be written; the previous superblock
+	// still refers to them, so they can be reused only after
+	// the next superblock has been written.
+	deferredFrees []LocationEntry
+
+	// saveErr is the first failure to write a node during flush
+	saveErr error
 }
 
 var _ storage.Backend = &treeBackend{}
 
 func (self *treeBackend) Init(config storage.BackendConfiguration) {
 	self.DirectoryBackendBase.Init(config)
-	self.NameInBlockBackend.Init("names", self)
+	self.NameInBlockBackend.Init(namesBlockId, self)
 
 	self.nodeDataCache.Init(util.IOr(config.CacheSize, 1234))
 
@@ -67,7 +80,7 @@ func (self *treeBackend) Init(config storage.BackendConfiguration) {
 	}
 
 	if config.Directory != "" {
-		self.p = systemFile{}.Init(config.Directory)
+		self.p = systemFile{}.Init(config.Directory, config.ReadOnly)
 	} else {
 		self.p = &inMemoryFile{}
 	}
@@ -372,9 +385,13 @@ func (self *treeBackend) flushPending() {
 	// TBD think if this is better than the constant free+alloc thing..
 }
 
-func (self *treeBackend) Flush() {
+func (self *treeBackend) Flush() (err error) {
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/tree/tree", "%v.Flush", self)
+	if self.ReadOnly {
+		// changes (if any) stay in memory
+		return
+	}
 
 	// in flushing mode, we do bonus add-frees, but store those
 	// only in superblock (and at end of flush stick them to the
@@ -387,8 +404,28 @@ func (self *treeBackend) Flush() {
 	}
 
 	self.flushing = true
+	deferredFrees := self.deferredFrees
+	pendingLen := len(self.Pending)
+	bytesUsed, bytesTotal := self.BytesUsed, self.BytesTotal
+	for _, le := range deferredFrees {
+		self.appendOp(le, true)
+	}
+	self.deferredFrees = nil
 	self.newTransaction(root)
 	newRoot, bid := root.Commit()
+	if self.saveErr != nil {
+		// The new tree is not usable; start from scratch
+		// next time
+		err = self.saveErr
+		self.saveErr = nil
+		self.flushing = false
+		self.deferredFrees = deferredFrees
+		self.Pending = self.Pending[:pendingLen]
+		self.BytesUsed, self.BytesTotal = bytesUsed, bytesTotal
+		self.newTransaction(root)
+		self.currentMap = make(map[ibtree.BlockId]bool)
+		return
+	}
 
 	// determine delta in blocks, using currentMap entries as
 	// 'interesting' border
@@ -406,7 +443,8 @@ func (self *treeBackend) Flush() {
 	mlog.Printf2("storage/tree/tree", " writing superblock %d @%d", si, ofs)
 	var pending OpSlice
 	for i := 0; i < 2; i++ {
-		b, err := self.Superblock.MarshalMsg(nil)
+		var b []byte
+		b, err = self.Superblock.MarshalMsg(nil)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -416,7 +454,10 @@ func (self *treeBackend) Flush() {
 		}
 		if len(b) <= superBlockSize {
 			ls := LocationSlice{LocationEntry{Size: uint64(len(b)), Offset: ofs}}
-			self.p.WriteData(ls, b)
+			err = self.p.WriteData(ls, b)
+			if err != nil {
+				mlog.Printf2("storage/tree/tree", " unable to write superblock: %v", err)
+			}
 			break
 		}
 		if i == 0 {
@@ -433,7 +474,10 @@ func (self *treeBackend) Flush() {
 					log.Panic(err)
 				}
 				if uint64(len(b)) <= s {
-					self.p.WriteData(sl, b)
+					err = self.p.WriteData(sl, b)
+					if err != nil {
+						mlog.Printf2("storage/tree/tree", " unable to write pending: %v", err)
+					}
 					break
 				}
 				self.freeSlice(sl)
@@ -442,6 +486,9 @@ func (self *treeBackend) Flush() {
 			pending = self.Pending
 			self.PendingLocation = sl
 			self.Pending = nil
+			if err != nil {
+				break
+			}
 		} else {
 			mlog.Panicf("Too large superblock: %v > %v", len(b), superBlockSize)
 		}
@@ -462,18 +509,46 @@ func (self *treeBackend) Flush() {
 		self.freeSlice(self.PendingLocation)
 		self.PendingLocation = nil
 	}
+	if err != nil {
+		// The superblock we failed to write is rewritten
+		// next time, so that the previous one stays valid
+		self.superIndex--
+
+		// Space allocated by the flush is in use, but what it
+		// freed is not reusable yet
+		freed := make(map[LocationEntry]bool)
+		for _, op := range self.Pending {
+			switch {
+			case op.Free:
+				freed[op.Location] = true
+			case freed[op.Location]:
+				delete(freed, op.Location)
+			default:
+				self.removeFreeTree(op.Location)
+			}
+		}
+		self.Pending = self.Pending[:0]
+		for le := range freed {
+			self.deferredFrees = append(self.deferredFrees, le)
+		}
+	}
 	self.flushPending()
 
 	// Clever bit: Use the post-flush root as base so we do not
 	// cause subsequent flushes just based on flushPending
+	// (unless the superblock has to be written again)
 	self.unchangedRoot = self.t.Root()
+	if err != nil {
+		self.unchangedRoot = nil
+	}
 
 	// Definition of 'current' is invalidated by this
 	self.currentMap = make(map[ibtree.BlockId]bool)
-
+	return
 }
 
-func (self *treeBackend) DeleteBlock(b *storage.Block) {
+func (self *treeBackend) DeleteBlock(b *storage.Block) error {
+	self.AssertWritable()
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/tree/tree", "%v.DeleteBlock %v", self, b)
 	bd := self.getBlockData(b.Id)
@@ -482,6 +557,7 @@ func (self *treeBackend) DeleteBlock(b *storage.Block) {
 	}
 	self.freeSlice(bd.Location)
 	self.blockTree.Delete(ibtree.Key(b.Id))
+	return nil
 }
 
 func (self *treeBackend) GetBlockData(b *storage.Block) []byte {
@@ -507,6 +583,23 @@ func (self *treeBackend) GetBlockById(id string) *storage.Block {
 	return b
 }
 
+func (self *treeBackend) IterateBlocks(cb func(id string, metadata storage.BlockMetadata)) {
+	defer self.lock.Locked()()
+	k := ibtree.Key("")
+	for {
+		nkeyp := self.blockTree.NextKey(k)
+		if nkeyp == nil {
+			return
+		}
+		k = *nkeyp
+		if k == namesBlockId {
+			continue
+		}
+		bd := self.getBlockData(string(k))
+		cb(string(k), bd.BlockMetadata)
+	}
+}
+
 func (self *treeBackend) setBlockData(id string, bdata *BlockData) {
 	b, err := bdata.MarshalMsg(nil)
 	if err != nil {
@@ -516,27 +609,34 @@ func (self *treeBackend) setBlockData(id string, bdata *BlockData) {
 	self.blockTree.Set(ibtree.Key(id), string(b))
 }
 
-func (self *treeBackend) StoreBlock(bl *storage.Block) {
+func (self *treeBackend) StoreBlock(bl *storage.Block) error {
+	self.AssertWritable()
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/tree/tree", "%v.StoreBlock %v", self, bl)
 	b := *bl.Data.Get()
 	b, err := self.Codec.EncodeBytes(b, nil)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	ls := self.allocateSlice(uint64(len(b)))
-	self.p.WriteData(ls, b)
+	err = self.p.WriteData(ls, b)
+	if err != nil {
+		self.freeSlice(ls)
+		return err
+	}
 	bdata := BlockData{Location: ls, BlockMetadata: bl.BlockMetadata}
 	self.setBlockData(bl.Id, &bdata)
+	return nil
 }
 
-func (self *treeBackend) UpdateBlock(bl *storage.Block) int {
+func (self *treeBackend) UpdateBlock(bl *storage.Block) (int, error) {
+	self.AssertWritable()
 	defer self.lock.Locked()()
 	mlog.Printf2("storage/tree/tree", "%v.UpdateBlock %v", self, bl)
 	bd := self.getBlockData(bl.Id)
 	bd.BlockMetadata = bl.BlockMetadata
 	self.setBlockData(bl.Id, bd)
-	return 1
+	return 1, nil
 }
 
 func NewTreeBackend() storage.Backend {
@@ -559,7 +659,14 @@ func (self *treeBackend) SaveNode(nd *ibtree.NodeData) ibtree.BlockId {
 		mlog.Panicf("SaveNode unable to encode data: %v", err)
 	}
 	ls := self.allocateSlice(uint64(len(b)))
-	self.p.WriteData(ls, b)
+	err = self.p.WriteData(ls, b)
+	if err != nil {
+		// Flush fails, but it has to finish the commit first
+		mlog.Printf2("storage/tree/tree", " unable to write node: %v", err)
+		if self.saveErr == nil {
+			self.saveErr = err
+		}
+	}
 	bid := ls.ToBlockId()
 	self.currentMap[bid] = true
 	self.nodeDataCache.Set(bid, nd)
@@ -14,6 +14,7 @@ package tree
 import (
 	"io/ioutil"
 	"os"
+	"syscall"
 	"testing"
 
 	"github.com/fingon/go-tfhfs/codec"
@@ -168,3 +169,77 @@ func TestTree(t *testing.T) {
 		})
 	}
 }
+
+// failingPersister fails writes while fail is set, or writes of
+// the first superblock while failSuper is set.
+type failingPersister struct {
+	treePersister
+	fail, failSuper bool
+}
+
+func (self *failingPersister) WriteData(location LocationSlice, data []byte) error {
+	if self.fail || (self.failSuper && location[0].Offset == 0) {
+		return syscall.EIO
+	}
+	return self.treePersister.WriteData(location, data)
+}
+
+func TestTreeFlushError(t *testing.T) {
+	t.Parallel()
+
+	dir, _ := ioutil.TempDir("", "tree")
+	defer os.RemoveAll(dir)
+
+	config := storage.BackendConfiguration{Directory: dir}
+	be := NewTreeBackend()
+	tbe := be.(*treeBackend)
+	be.Init(config)
+	defer be.Close()
+	p := &failingPersister{treePersister: tbe.p}
+	tbe.p = p
+	reopen := func() *treeBackend {
+		be2 := NewTreeBackend()
+		be2.Init(config)
+		return be2.(*treeBackend)
+	}
+	store := func(id string) {
+		b := storage.Block{Id: id}
+		bd := []byte(id)
+		b.Data.Set(&bd)
+		assert.Nil(t, be.StoreBlock(&b))
+	}
+
+	store("foo")
+	assert.Nil(t, be.Flush())
+	store("bar")
+	p.fail = true
+	assert.True(t, be.Flush() != nil)
+
+	// Previous superblock is still valid
+	tbe2 := reopen()
+	assert.True(t, tbe2.GetBlockById("foo") != nil)
+	assert.True(t, tbe2.GetBlockById("bar") == nil)
+
+	// Flush is retried even without changes
+	p.fail = false
+	assert.Nil(t, be.Flush())
+	tbe2 = reopen()
+	assert.True(t, tbe2.GetBlockById("bar") != nil)
+	assert.Equal(t, tbe2.Superblock, tbe.Superblock)
+
+	// Same with only the superblock failing
+	store("baz")
+	p.failSuper = true
+	assert.True(t, be.Flush() != nil)
+	tbe2 = reopen()
+	assert.True(t, tbe2.GetBlockById("bar") != nil)
+	assert.True(t, tbe2.GetBlockById("baz") == nil)
+	p.failSuper = false
+	assert.Nil(t, be.Flush())
+	tbe2 = reopen()
+	assert.True(t, tbe2.GetBlockById("baz") != nil)
+	assert.Equal(t, tbe2.Superblock, tbe.Superblock)
+	bytesUsed := tbe.BytesUsed
+	assert.Nil(t, be.Flush())
+	assert.Equal(t, tbe.BytesUsed, bytesUsed)
+}
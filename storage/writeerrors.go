@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/fingon/go-tfhfs/util"
+)
+
+// WriteErrors keeps track of failures to write to the backend in the
+// manner of Linux errseq_t: every failure advances the sequence
+// number, and consumers remember the sequence number up to which
+// they have seen the failures. That way each consumer (e.g. open
+// file) gets to see every failure once.
+type WriteErrors struct {
+	lock util.MutexLocked
+	seq  uint64
+	err  error
+}
+
+// Report records a new failure.
+func (self *WriteErrors) Report(err error) {
+	mlog.Printf2("storage/writeerrors", "WriteErrors.Report %v", err)
+	defer self.lock.Locked()()
+	self.seq++
+	self.err = err
+}
+
+// Seq returns the current sequence number.
+func (self *WriteErrors) Seq() uint64 {
+	defer self.lock.Locked()()
+	return self.seq
+}
+
+// Since returns the current sequence number, and the latest failure
+// if there have been any after seq.
+func (self *WriteErrors) Since(seq uint64) (uint64, error) {
+	defer self.lock.Locked()()
+	if self.seq == seq {
+		return seq, nil
+	}
+	return self.seq, self.err
+}
@@ -0,0 +1,80 @@
+package util
+
+// Chunker implements FastCDC content-defined chunking (Xia et al,
+// 'FastCDC: a Fast and Efficient Content-Defined Chunking Approach
+// for Data Deduplication', 2016) with normalized chunking.
+//
+// The gear table is derived from fixed seed, so that same content
+// produces same chunks everywhere (which is the whole point).
+type Chunker struct {
+	MinSize, AvgSize, MaxSize int
+
+	maskS, maskL uint64
+}
+
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x7466686673636463) // 'tfhfscdc'
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// spreadMask returns mask with the given number of bits spread over
+// the upper part of the 64-bit hash (lower bits of gear hash see only
+// few most recent bytes).
+func spreadMask(bits int) (mask uint64) {
+	for i := 0; i < bits; i++ {
+		mask |= 1 << uint(63-i*48/bits)
+	}
+	return
+}
+
+func NewChunker(minSize, avgSize, maxSize int) *Chunker {
+	bits := 0
+	for (1 << uint(bits+1)) <= avgSize {
+		bits++
+	}
+	return &Chunker{MinSize: minSize, AvgSize: avgSize, MaxSize: maxSize,
+		maskS: spreadMask(bits + 2),
+		maskL: spreadMask(bits - 2)}
+}
+
+// Cut returns the length of the first chunk within data. If no cut
+// point is found within data (and it is shorter than MaxSize),
+// len(data) is returned with found set to false; the caller should
+// then either provide more data or consider the data to end there.
+func (self *Chunker) Cut(data []byte) (n int, found bool) {
+	l := len(data)
+	if l <= self.MinSize {
+		return l, false
+	}
+	if l > self.MaxSize {
+		l = self.MaxSize
+	}
+	normal := self.AvgSize
+	if normal > l {
+		normal = l
+	}
+	var h uint64
+	i := self.MinSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&self.maskS == 0 {
+			return i + 1, true
+		}
+	}
+	for ; i < l; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&self.maskL == 0 {
+			return i + 1, true
+		}
+	}
+	return l, l == self.MaxSize
+}
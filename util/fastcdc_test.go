@@ -0,0 +1,58 @@
+package util
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func chunkAll(c *Chunker, data []byte) (chunks []string) {
+	for len(data) > 0 {
+		n, _ := c.Cut(data)
+		chunks = append(chunks, string(data[:n]))
+		data = data[n:]
+	}
+	return
+}
+
+func TestChunker(t *testing.T) {
+	t.Parallel()
+	c := NewChunker(1024, 4096, 16384)
+	data := make([]byte, 1000000)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	chunks := chunkAll(c, data)
+	total := 0
+	for i, ch := range chunks {
+		total += len(ch)
+		assert.True(t, len(ch) <= c.MaxSize)
+		if i < len(chunks)-1 {
+			assert.True(t, len(ch) > c.MinSize)
+		}
+	}
+	assert.Equal(t, total, len(data))
+	avg := len(data) / len(chunks)
+	assert.True(t, avg > c.AvgSize/2 && avg < c.AvgSize*2, "bad average ", avg)
+
+	// Inserting data near the start should not change most of the
+	// chunks
+	data2 := append([]byte("hello"), data...)
+	m := make(map[string]bool)
+	for _, ch := range chunks {
+		m[ch] = true
+	}
+	same := 0
+	chunks2 := chunkAll(c, data2)
+	for _, ch := range chunks2 {
+		if m[ch] {
+			same++
+		}
+	}
+	assert.True(t, same >= len(chunks2)-2, "too few same chunks ", same, len(chunks2))
+
+	// Without cut point, we get whatever data there was
+	n, found := c.Cut(data[:c.MinSize])
+	assert.Equal(t, n, c.MinSize)
+	assert.False(t, found)
+}
@@ -55,3 +55,13 @@ func (self *MutexLockedMap) Locked(name interface{}) func() {
 		ul()
 	}
 }
+
+// Names returns the names that are currently locked (or waited for).
+func (self *MutexLockedMap) Names() []interface{} {
+	defer self.l.Locked()()
+	names := make([]interface{}, 0, len(self.m))
+	for name := range self.m {
+		names = append(names, name)
+	}
+	return names
+}
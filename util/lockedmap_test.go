@@ -16,6 +16,7 @@ import (
 	"testing"
 
 	"github.com/fingon/go-tfhfs/mlog"
+	"github.com/stvp/assert"
 )
 
 func TestLockedMap(t *testing.T) {
@@ -41,3 +42,13 @@ func TestLockedMap(t *testing.T) {
 	mut3.Lock()
 	mlog.Printf2("util/lockedmap_test", "exiting")
 }
+
+func TestLockedMapNames(t *testing.T) {
+	t.Parallel()
+	l := &MutexLockedMap{}
+	assert.Equal(t, len(l.Names()), 0)
+	unlock := l.Locked("foo")
+	assert.Equal(t, l.Names(), []interface{}{"foo"})
+	unlock()
+	assert.Equal(t, len(l.Names()), 0)
+}